@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAADEndpoint = "https://login.microsoftonline.com/"
+	defaultARMEndpoint = "https://management.azure.com/"
+
+	// imdsTokenURL is the managed identity endpoint of the Azure Instance
+	// Metadata Service.
+	imdsTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	// tokenRefreshMargin is how long before their expiry tokens are renewed.
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// aadCredential obtains Azure AD access tokens for the driver, either for a
+// service principal with a client secret or, without a secret, for the
+// managed identity of the VM (the user-assigned identity clientID if set).
+type aadCredential struct {
+	endpoint     string // Azure AD authority, e.g. defaultAADEndpoint
+	tenantID     string
+	clientID     string
+	clientSecret string
+
+	m      sync.Mutex
+	tokens map[string]aadToken // keyed by resource
+}
+
+type aadToken struct {
+	value   string
+	expires time.Time
+}
+
+func newAADCredential(endpoint, tenantID, clientID, clientSecret string) (*aadCredential, error) {
+	if clientSecret != "" && (tenantID == "" || clientID == "") {
+		return nil, fmt.Errorf("azure AD tenant and client IDs must be provided with a client secret")
+	}
+	return &aadCredential{
+		endpoint:     strings.TrimSuffix(endpoint, "/") + "/",
+		tenantID:     tenantID,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		tokens:       make(map[string]aadToken),
+	}, nil
+}
+
+// token returns an access token for the resource (e.g. defaultARMEndpoint),
+// reusing the last one until shortly before it expires.
+func (c *aadCredential) token(resource string) (string, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if t, ok := c.tokens[resource]; ok && time.Now().Add(tokenRefreshMargin).Before(t.expires) {
+		return t.value, nil
+	}
+	var (
+		req *http.Request
+		err error
+	)
+	if c.clientSecret != "" {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {c.clientID},
+			"client_secret": {c.clientSecret},
+			"resource":      {resource},
+		}
+		req, err = http.NewRequest("POST", c.endpoint+c.tenantID+"/oauth2/token", strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		q := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+		if c.clientID != "" {
+			q.Set("client_id", c.clientID)
+		}
+		req, err = http.NewRequest("GET", imdsTokenURL+"?"+q.Encode(), nil)
+		if err == nil {
+			req.Header.Set("Metadata", "true")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := storageHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot get azure AD token: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("cannot read azure AD token: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("azure AD returned %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"` // seconds since the epoch, as a string
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return "", fmt.Errorf("cannot parse azure AD token: %v", err)
+	}
+	t := aadToken{value: out.AccessToken, expires: time.Now().Add(time.Hour)}
+	if s, err := strconv.ParseInt(out.ExpiresOn, 10, 64); err == nil {
+		t.expires = time.Unix(s, 0)
+	}
+	c.tokens[resource] = t
+	return t.value, nil
+}
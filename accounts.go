@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// accountConfig is a named storage account of the --accounts file, which
+// volumes select with the 'account' option.
+type accountConfig struct {
+	AccountName    string `json:"account_name"`
+	AccountKey     string `json:"account_key"`
+	AccountKeyFile string `json:"account_key_file"`
+	StorageBase    string `json:"storage_base"`
+	Region         string `json:"region"` // e.g. westeurope, see --regional-accounts
+}
+
+// defaultAccount selects the account given to the driver with the 'account'
+// option, e.g. to override --regional-accounts.
+const defaultAccount = "default"
+
+// storageAccount is an account volumes are hosted on, with its File service
+// client.
+type storageAccount struct {
+	name        string
+	key         string
+	storageBase string
+	files       *fileClient
+	region      string
+}
+
+// loadAccounts reads the named accounts of the --accounts file, a JSON object
+// of account configurations keyed by name, e.g.
+//
+//	{"prod-euw": {"account_name": "prodeuw", "account_key_file": "/run/secrets/prodeuw"}}
+//
+// Accounts not setting a storage base use storageBase, and all of them the
+// storage endpoint if not nil. Their clients are taken from clients. Every
+// account in allowed, if not empty, must be configured.
+func loadAccounts(clients *clientCache, file, storageBase string, endpoint *url.URL, allowed []string) (map[string]*storageAccount, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read accounts: %v", err)
+	}
+	var configs map[string]accountConfig
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("cannot parse accounts: %v", err)
+	}
+	accounts := make(map[string]*storageAccount, len(configs))
+	for name, c := range configs {
+		if name == "" || name == defaultAccount || strings.ContainsAny(name, ",= ") {
+			return nil, fmt.Errorf("invalid account name %q", name)
+		}
+		if c.AccountName == "" {
+			return nil, fmt.Errorf("account %q: account_name is missing", name)
+		}
+		if (c.AccountKey == "") == (c.AccountKeyFile == "") {
+			return nil, fmt.Errorf("account %q: exactly one of account_key and account_key_file must be set", name)
+		}
+		key := c.AccountKey
+		if c.AccountKeyFile != "" {
+			if key, err = readSecret(c.AccountKeyFile); err != nil {
+				return nil, fmt.Errorf("account %q: %v", name, err)
+			}
+		}
+		registerSecret(key)
+		base := c.StorageBase
+		if base == "" {
+			base = storageBase
+		}
+		files, err := clients.get(c.AccountName, key, base, endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("account %q: error creating azure client: %v", name, err)
+		}
+		accounts[name] = &storageAccount{c.AccountName, key, base, files, normalizeRegion(c.Region)}
+	}
+	for _, name := range allowed {
+		if _, ok := accounts[name]; !ok {
+			return nil, fmt.Errorf("allowed account %q is not configured", name)
+		}
+	}
+	return accounts, nil
+}
+
+// accountNames returns the names of the accounts, sorted.
+func accountNames(accounts map[string]*storageAccount) []string {
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// account returns the account of volumes with the options: the named account
+// selected by their 'account' option, or the account given to the driver if
+// none (or defaultAccount) is selected. Named accounts not allowed by
+// --allowed-accounts are refused. Caller must hold the driver lock.
+func (v *volumeDriver) account(opts VolumeOptions) (*storageAccount, error) {
+	if opts.Account == "" || opts.Account == defaultAccount {
+		return &storageAccount{v.accountName, v.accountKey, v.storageBase, v.files, ""}, nil
+	}
+	a, ok := v.accounts[opts.Account]
+	if !ok {
+		names := v.allowAccounts
+		if len(names) == 0 {
+			names = accountNames(v.accounts)
+		}
+		return nil, newError(codeInvalidOptions, "unknown account %q, must be one of: %s", opts.Account, strings.Join(names, ", "))
+	}
+	if len(v.allowAccounts) != 0 && !contains(v.allowAccounts, opts.Account) {
+		return nil, newError(codePolicyDenied, "account %q is not allowed for this driver instance (--allowed-accounts)", opts.Account)
+	}
+	return a, nil
+}
+
+// driverAccountOption returns the option of the volume options only supported
+// on the account of the driver, where leases, snapshots and backups are
+// taken, or an empty string if there is none.
+func driverAccountOption(opts VolumeOptions) string {
+	switch {
+	case opts.Exclusive:
+		return "exclusive"
+	case opts.RestoreFrom != "":
+		return "restore-from-snapshot"
+	case opts.Reclaim == reclaimSnapshot:
+		return "reclaim=" + reclaimSnapshot
+	}
+	return ""
+}
+
+// volumeAccount is like account for an existing volume, checking that it is
+// hosted on the account its options select. Caller must hold the driver lock.
+func (v *volumeDriver) volumeAccount(name string, meta volumeMetadata) (*storageAccount, error) {
+	a, err := v.account(meta.Options)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Account != a.name {
+		return nil, newError(codeAccountMismatch, "volume %q is hosted on a different account (%q)", name, meta.Account)
+	}
+	return a, nil
+}
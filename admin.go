@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultBatchWorkers is the number of volumes created concurrently by a
+	// batch request unless specified otherwise.
+	defaultBatchWorkers = 8
+
+	// maxBatchWorkers caps the concurrency of a batch request to avoid
+	// overwhelming the storage account.
+	maxBatchWorkers = 64
+)
+
+// volumeDefinition describes a volume to create through the admin API.
+type volumeDefinition struct {
+	Name    string            `json:"name"`
+	Options map[string]string `json:"options"`
+}
+
+// volumeResult is the outcome of an admin operation on a single volume.
+type volumeResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// serveAdmin serves the administrative endpoints of the driver, see
+// adminHandler, on addr. It only returns when the listener fails.
+func serveAdmin(addr, token string, v *volumeDriver) error {
+	log.Debugf("admin endpoint listening on %s", addr)
+	return http.ListenAndServe(addr, adminHandler(token, v))
+}
+
+// adminHandler returns the handler of the administrative HTTP endpoints of the
+// driver. Endpoints other than /metrics and /version require token as a bearer
+// token, and are refused when it is empty.
+func adminHandler(token string, v *volumeDriver) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/version", handleVersion)
+	mux.HandleFunc("/volumes/batch", requireToken(token, v.handleBatchCreate))
+	mux.HandleFunc("/volumes/definitions", requireToken(token, v.handleDefinitions))
+	mux.HandleFunc("/volumes/recover", requireToken(token, v.handleRecover))
+	mux.HandleFunc("/volumes/", requireToken(token, v.handleVolume))
+	mux.HandleFunc("/transfers/", requireToken(token, v.handleTransfers))
+	mux.HandleFunc("/loglevel", requireToken(token, handleLogLevel))
+	mux.HandleFunc("/drain", requireToken(token, v.handleDrain))
+	mux.HandleFunc("/rotate-key", requireToken(token, v.handleRotateKey))
+	mux.HandleFunc("/events", requireToken(token, handleEvents))
+	return mux
+}
+
+// requireToken wraps the handler to reject requests without the bearer
+// token. Without a token configured, all requests are refused.
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "forbidden: --admin-token is required for this endpoint", http.StatusForbidden)
+			return
+		}
+		if !validToken(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// validToken returns true if the request carries the bearer token, compared
+// in constant time.
+func validToken(r *http.Request, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// writeJSON writes v as the JSON response body with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("admin: cannot write response: %v", err)
+	}
+}
+
+// handleBatchCreate creates the volumes listed in the request body (a JSON
+// array of volume definitions) using a bounded pool of workers, set by the
+// 'workers' query parameter. The response lists the outcome for each volume
+// in request order.
+func (v *volumeDriver) handleBatchCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	workers := defaultBatchWorkers
+	if s := r.URL.Query().Get("workers"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxBatchWorkers {
+			http.Error(w, fmt.Sprintf("workers must be between 1 and %d", maxBatchWorkers), http.StatusBadRequest)
+			return
+		}
+		workers = n
+	}
+	var defs []volumeDefinition
+	if err := json.NewDecoder(r.Body).Decode(&defs); err != nil {
+		http.Error(w, fmt.Sprintf("cannot parse volume definitions: %v", err), http.StatusBadRequest)
+		return
+	}
+	for i, d := range defs {
+		if d.Name == "" {
+			http.Error(w, fmt.Sprintf("volume definition #%d has no name", i+1), http.StatusBadRequest)
+			return
+		}
+		if err := validateVolumeName(d.Name); err != nil {
+			http.Error(w, fmt.Sprintf("volume definition #%d: %v", i+1, err), http.StatusBadRequest)
+			return
+		}
+	}
+	log.WithFields(log.Fields{
+		"operation": "batch-create",
+		"volumes":   len(defs),
+		"workers":   workers,
+	}).Debug("request accepted")
+
+	sp := v.tracer.start("batch-create", nil, "volumes", strconv.Itoa(len(defs)))
+	defer sp.end("")
+	results := make([]volumeResult, len(defs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j].Name = defs[j].Name
+				rq := v.newRequest("create", defs[j].Name, sp)
+				if err := v.create(rq, defs[j].Name, defs[j].Options); err != nil {
+					results[j].Error = err.Error()
+				}
+				rq.finish(&results[j].Error)
+			}
+		}()
+	}
+	for i := range defs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	code := http.StatusOK
+	for _, res := range results {
+		if res.Error != "" {
+			code = http.StatusMultiStatus
+			break
+		}
+	}
+	writeJSON(w, code, results)
+}
+
+// restoreResult is the outcome of restoring a snapshot through the admin API.
+type restoreResult struct {
+	Name     string `json:"name"`
+	Snapshot string `json:"snapshot"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleVolume serves the list of volumes and the operations on a single
+// volume:
+//
+//	GET  /volumes/?label=<k>[=<v>]&share=&account=&mounted=
+//	                                           lists the matching volumes
+//	GET  /volumes/<name>/snapshots             lists the snapshots of the share
+//	POST /volumes/<name>/snapshots             takes a snapshot of the share
+//	POST /volumes/<name>/restore?snapshot=<id> promotes a snapshot over the share
+//	PUT  /volumes/<name>/quota?gib=<n>         changes the quota of the share
+//	PUT  /volumes/<name>/tier?tier=<tier>      changes the access tier of the share
+//	PUT  /volumes/<name>/protection            enables deletion protection
+//	DELETE /volumes/<name>/protection          clears deletion protection
+//	POST /volumes/<name>/undelete[?version=]   restores a soft-deleted share
+//	POST /volumes/<name>/export?destination=<url>
+//	POST /volumes/<name>/import?source=<url>   start an azcopy transfer job
+func (v *volumeDriver) handleVolume(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/volumes/" {
+		v.handleListVolumes(w, r)
+		return
+	}
+	p := strings.Split(strings.TrimPrefix(r.URL.Path, "/volumes/"), "/")
+	if len(p) != 2 || p[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	name := p[0]
+	switch p[1] {
+	case "snapshots":
+		if r.Method == "GET" {
+			snapshots, err := v.volumeSnapshots(name)
+			if err != nil {
+				writeJSON(w, errorStatus(err), volumeResult{Name: name, Error: err.Error()})
+				return
+			}
+			if snapshots == nil {
+				snapshots = []shareSnapshot{}
+			}
+			writeJSON(w, http.StatusOK, snapshots)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		snapshot, err := v.snapshotVolume(name)
+		if err != nil {
+			writeJSON(w, errorStatus(err), volumeResult{Name: name, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"name": name, "snapshot": snapshot})
+	case "restore":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		snapshot := r.URL.Query().Get("snapshot")
+		if snapshot == "" {
+			http.Error(w, "missing query parameter: snapshot", http.StatusBadRequest)
+			return
+		}
+		res := restoreResult{Name: name, Snapshot: snapshot}
+		c, err := v.restoreVolume(name, snapshot)
+		if c != nil {
+			res.Files, res.Bytes = c.Files, c.Bytes
+		}
+		if err != nil {
+			res.Error = err.Error()
+			writeJSON(w, errorStatus(err), res)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case "quota":
+		if r.Method != "PUT" && r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		quota, err := strconv.Atoi(r.URL.Query().Get("gib"))
+		if err != nil {
+			http.Error(w, "query parameter gib must be a number of GiB", http.StatusBadRequest)
+			return
+		}
+		if err := v.resizeVolume(name, quota); err != nil {
+			writeJSON(w, errorStatus(err), volumeResult{Name: name, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "quotaGiB": quota})
+	case "tier":
+		if r.Method != "PUT" && r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tier, err := parseAccessTier(r.URL.Query().Get("tier"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := v.setVolumeTier(name, tier); err != nil {
+			writeJSON(w, errorStatus(err), volumeResult{Name: name, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "accessTier": tier})
+	case "protection":
+		if r.Method != "PUT" && r.Method != "DELETE" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		protected := r.Method == "PUT"
+		if err := v.setProtection(name, protected); err != nil {
+			writeJSON(w, errorStatus(err), volumeResult{Name: name, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "protected": protected})
+	case "undelete":
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		res, err := v.undeleteVolume(name, r.URL.Query().Get("version"))
+		if err != nil {
+			res.Error = err.Error()
+			writeJSON(w, errorStatus(err), res)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	case transferExport, transferImport:
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		param := "destination"
+		if p[1] == transferImport {
+			param = "source"
+		}
+		remote := r.URL.Query().Get(param)
+		if remote == "" {
+			http.Error(w, "missing query parameter: "+param, http.StatusBadRequest)
+			return
+		}
+		job, err := v.startTransfer(name, p[1], remote)
+		if err != nil {
+			writeJSON(w, errorStatus(err), volumeResult{Name: name, Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleRecover regenerates the metadata of the volumes of the shares
+// selected by the 'prefix' and 'tag' query parameters, see recoverVolumes.
+func (v *volumeDriver) handleRecover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tags, err := parseShareTags(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := v.recoverVolumes(r.URL.Query().Get("prefix"), tags)
+	if err != nil {
+		writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	code := http.StatusOK
+	for _, res := range results {
+		if res.Error != "" {
+			code = http.StatusMultiStatus
+			break
+		}
+	}
+	writeJSON(w, code, results)
+}
+
+// handleListVolumes lists the volumes selected by the filter given as query
+// parameters, see parseVolumeFilter.
+func (v *volumeDriver) handleListVolumes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := parseVolumeFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	vols, err := v.listVolumes(f)
+	if err != nil {
+		writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, vols)
+}
+
+// handleTransfers serves the transfer jobs:
+//
+//	GET  /transfers/             lists the jobs
+//	GET  /transfers/<id>         returns the progress of a job
+//	POST /transfers/<id>/resume  resumes a failed job
+func (v *volumeDriver) handleTransfers(w http.ResponseWriter, r *http.Request) {
+	if v.transfers == nil {
+		http.NotFound(w, r)
+		return
+	}
+	p := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/transfers/"), "/"), "/")
+	switch {
+	case len(p) == 1 && p[0] == "" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, v.transfers.list())
+	case len(p) == 1 && r.Method == "GET":
+		job, ok := v.transfers.get(p[0])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	case len(p) == 2 && p[1] == "resume" && r.Method == "POST":
+		job, err := v.resumeTransfer(p[0])
+		if err != nil {
+			writeJSON(w, errorStatus(err), map[string]string{"id": p[0], "error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// errorStatus maps the code of a driver error to an HTTP status code.
+func errorStatus(err error) int {
+	switch classify(err, codeInternal) {
+	case codeVolumeNotFound, codeShareNotFound:
+		return http.StatusNotFound
+	case codeInvalidOptions, codeAccountMismatch, codeNamespace, codeProtocolMismatch, codeShareExists, codeShareInUse:
+		return http.StatusBadRequest
+	case codePolicyDenied, codeAuthFailed:
+		return http.StatusForbidden
+	case codeThrottled, codeUnavailable, codeDraining, codeNetwork, codeServerError, codeUnreachable:
+		return http.StatusServiceUnavailable
+	case codeTimeout:
+		return http.StatusGatewayTimeout
+	case codeProtected, codeVolumeMounted, codeLeased:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serveAuthorized serves a request with the Authorization header auth through
+// the handler wrap returns, and reports the status code and whether the
+// wrapped handler was reached.
+func serveAuthorized(wrap func(http.HandlerFunc) http.HandlerFunc, auth string) (int, bool) {
+	called := false
+	h := wrap(func(w http.ResponseWriter, r *http.Request) { called = true })
+	r := httptest.NewRequest("POST", "/volumes/batch", nil)
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w.Code, called
+}
+
+func TestRequireToken(t *testing.T) {
+	for _, tc := range []struct {
+		token, auth string
+		want        int
+	}{
+		{"", "", http.StatusForbidden},
+		{"", "Bearer ", http.StatusForbidden},
+		{"", "Bearer anything", http.StatusForbidden},
+		{"secret", "Bearer secret", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer other", http.StatusUnauthorized},
+		{"secret", "Bearer secret2", http.StatusUnauthorized},
+		{"secret", "Bearer ", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Basic secret", http.StatusUnauthorized},
+	} {
+		wrap := func(h http.HandlerFunc) http.HandlerFunc { return requireToken(tc.token, h) }
+		code, called := serveAuthorized(wrap, tc.auth)
+		if code != tc.want || called != (tc.want == http.StatusOK) {
+			t.Errorf("token %q, Authorization %q: got status %d, handler called %v, want status %d", tc.token, tc.auth, code, called, tc.want)
+		}
+	}
+}
+
+func TestAdminHandlerAuth(t *testing.T) {
+	v := &volumeDriver{transfers: newTransferManager("azcopy")}
+	for _, tc := range []struct {
+		token, method, path, auth string
+		want                      int
+	}{
+		{"", "GET", "/metrics", "", http.StatusOK},
+		{"", "GET", "/version", "", http.StatusOK},
+		{"", "POST", "/volumes/web-data/export", "", http.StatusForbidden},
+		{"", "POST", "/volumes/web-data/import", "", http.StatusForbidden},
+		{"", "GET", "/transfers/", "", http.StatusForbidden},
+		{"", "POST", "/transfers/3f2a9c0d1e4b5a67/resume", "", http.StatusForbidden},
+		{"", "POST", "/rotate-key", "", http.StatusForbidden},
+		{"", "POST", "/volumes/batch", "", http.StatusForbidden},
+		{"", "POST", "/volumes/definitions", "", http.StatusForbidden},
+		{"", "POST", "/volumes/recover", "", http.StatusForbidden},
+		{"", "PUT", "/volumes/web-data/protection", "", http.StatusForbidden},
+		{"", "POST", "/volumes/web-data/restore", "", http.StatusForbidden},
+		{"", "POST", "/volumes/web-data/undelete", "", http.StatusForbidden},
+		{"", "PUT", "/volumes/web-data/quota", "", http.StatusForbidden},
+		{"", "PUT", "/volumes/web-data/tier", "", http.StatusForbidden},
+		{"", "PUT", "/loglevel", "", http.StatusForbidden},
+		{"", "PUT", "/drain", "", http.StatusForbidden},
+		{"", "GET", "/events", "", http.StatusForbidden},
+		{"", "GET", "/volumes/", "Bearer ", http.StatusForbidden},
+		{"secret", "GET", "/metrics", "", http.StatusOK},
+		{"secret", "POST", "/volumes/web-data/export", "", http.StatusUnauthorized},
+		{"secret", "PUT", "/drain", "", http.StatusUnauthorized},
+		{"secret", "PUT", "/volumes/web-data/quota", "Bearer other", http.StatusUnauthorized},
+		{"secret", "GET", "/transfers/", "Bearer other", http.StatusUnauthorized},
+		{"secret", "GET", "/transfers/", "Bearer secret", http.StatusOK},
+		{"secret", "POST", "/volumes/web-data/export", "Bearer secret", http.StatusBadRequest}, // no destination
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		adminHandler(tc.token, v).ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("token %q, %s %s with Authorization %q: got status %d, want %d", tc.token, tc.method, tc.path, tc.auth, w.Code, tc.want)
+		}
+	}
+}
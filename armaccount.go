@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// accountCreateTimeout bounds how long the creation of the storage
+	// account may take.
+	accountCreateTimeout = 5 * time.Minute
+
+	// accountPollInterval is how often the provisioning state of a storage
+	// account being created is checked.
+	accountPollInterval = 5 * time.Second
+)
+
+// accountSpec describes the storage account created by --create-account.
+type accountSpec struct {
+	Location      string
+	SKU           string   // e.g. Standard_LRS or Premium_LRS
+	Kind          string   // e.g. StorageV2 or FileStorage
+	DefaultAction string   // network access not matching the rules: Allow or Deny
+	Subnets       []string // ARM resource IDs of the virtual network subnets allowed
+	IPRules       []string // addresses or CIDR ranges allowed
+}
+
+// armAccount is the storage account resource of Azure Resource Manager.
+type armAccount struct {
+	Location   string               `json:"location,omitempty"`
+	SKU        *armSKU              `json:"sku,omitempty"`
+	Kind       string               `json:"kind,omitempty"`
+	Properties armAccountProperties `json:"properties"`
+}
+
+type armSKU struct {
+	Name string `json:"name"`
+}
+
+type armAccountProperties struct {
+	ProvisioningState        string          `json:"provisioningState,omitempty"`
+	SupportsHTTPSTrafficOnly bool            `json:"supportsHttpsTrafficOnly"`
+	MinimumTLSVersion        string          `json:"minimumTlsVersion,omitempty"`
+	LargeFileSharesState     string          `json:"largeFileSharesState,omitempty"`
+	NetworkACLs              *armNetworkACLs `json:"networkAcls,omitempty"`
+}
+
+type armNetworkACLs struct {
+	DefaultAction       string           `json:"defaultAction"`
+	Bypass              string           `json:"bypass,omitempty"`
+	VirtualNetworkRules []armNetworkRule `json:"virtualNetworkRules,omitempty"`
+	IPRules             []armIPRule      `json:"ipRules,omitempty"`
+}
+
+type armNetworkRule struct {
+	ID string `json:"id"`
+}
+
+type armIPRule struct {
+	Value string `json:"value"`
+}
+
+// accountURL returns the URL of the storage account resource, or of the
+// action of the account if not empty.
+func (a *armShares) accountURL(action string) string {
+	u := a.endpoint + a.accountID
+	if action != "" {
+		u += "/" + action
+	}
+	return u + "?" + url.Values{"api-version": {armSharesAPIVersion}}.Encode()
+}
+
+// ensureAccount creates the storage account as described by spec unless it
+// exists, waiting for its provisioning to complete. Existing accounts are
+// left as they are.
+func (a *armShares) ensureAccount(ctx context.Context, spec accountSpec) error {
+	logctx := log.WithFields(log.Fields{"operation": "create-account", "account": a.accountName})
+	var acct armAccount
+	_, err := a.do(ctx, "GET", a.accountURL(""), nil, nil, &acct)
+	if e, ok := err.(*fileServiceError); ok && e.StatusCode == http.StatusNotFound {
+		acct = armAccount{
+			Location: spec.Location,
+			SKU:      &armSKU{spec.SKU},
+			Kind:     spec.Kind,
+			Properties: armAccountProperties{
+				SupportsHTTPSTrafficOnly: true,
+				MinimumTLSVersion:        "TLS1_2",
+				NetworkACLs:              &armNetworkACLs{DefaultAction: spec.DefaultAction, Bypass: "AzureServices"},
+			},
+		}
+		for _, id := range spec.Subnets {
+			acct.Properties.NetworkACLs.VirtualNetworkRules = append(acct.Properties.NetworkACLs.VirtualNetworkRules, armNetworkRule{id})
+		}
+		for _, ip := range spec.IPRules {
+			acct.Properties.NetworkACLs.IPRules = append(acct.Properties.NetworkACLs.IPRules, armIPRule{ip})
+		}
+		logctx.Infof("creating storage account (%s %s in %s)", spec.Kind, spec.SKU, spec.Location)
+		if _, err := a.do(ctx, "PUT", a.accountURL(""), nil, acct, &acct); err != nil {
+			return wrapError(err, codeStorageAPI, "error creating storage account %q: %v", a.accountName, err)
+		}
+	} else if err != nil {
+		return wrapError(err, codeStorageAPI, "error getting storage account %q: %v", a.accountName, err)
+	} else if acct.Properties.ProvisioningState == "Succeeded" {
+		logctx.Debug("storage account exists")
+		return nil
+	}
+
+	// creation is asynchronous, the account is usable once provisioned
+	for acct.Properties.ProvisioningState != "Succeeded" {
+		if s := acct.Properties.ProvisioningState; s == "Failed" || s == "Canceled" {
+			return newError(codeStorageAPI, "provisioning of storage account %q %s", a.accountName, strings.ToLower(s))
+		}
+		select {
+		case <-time.After(accountPollInterval):
+		case <-ctx.Done():
+			return newError(codeTimeout, "storage account %q is still being provisioned: %v", a.accountName, ctx.Err())
+		}
+		if _, err := a.do(ctx, "GET", a.accountURL(""), nil, nil, &acct); err != nil {
+			return wrapError(err, codeStorageAPI, "error getting storage account %q: %v", a.accountName, err)
+		}
+	}
+	logctx.Info("created storage account")
+	return nil
+}
+
+// accountKey returns the first key of the storage account.
+func (a *armShares) accountKey(ctx context.Context) (string, error) {
+	var out struct {
+		Keys []struct {
+			KeyName string `json:"keyName"`
+			Value   string `json:"value"`
+		} `json:"keys"`
+	}
+	if _, err := a.do(ctx, "POST", a.accountURL("listKeys"), nil, nil, &out); err != nil {
+		return "", wrapError(err, codeStorageAPI, "error listing the keys of storage account %q: %v", a.accountName, err)
+	}
+	if len(out.Keys) == 0 {
+		return "", newError(codeStorageAPI, "storage account %q has no keys", a.accountName)
+	}
+	return out.Keys[0].Value, nil
+}
+
+// enableLargeShares enables large file shares, which allow quotas up to
+// maxLargeShareQuota, on the storage account unless they are. This cannot be
+// undone and rules out geo-redundant replication of the account, so it is
+// only done when the operator allowed it (--enable-large-file-shares);
+// otherwise an error is returned unless they are enabled already.
+func (a *armShares) enableLargeShares(ctx context.Context) error {
+	var acct armAccount
+	if _, err := a.do(ctx, "GET", a.accountURL(""), nil, nil, &acct); err != nil {
+		return err
+	}
+	if acct.Properties.LargeFileSharesState == "Enabled" {
+		return nil
+	}
+	if !a.largeShares {
+		return newError(codeInvalidOptions, "large file shares are not enabled on storage account %q: enable them on the account (this cannot be undone and disables geo-redundant replication) or start the driver with --enable-large-file-shares", a.accountName)
+	}
+	log.WithField("account", a.accountName).Info("enabling large file shares on the storage account")
+	patch := armAccount{Properties: armAccountProperties{
+		SupportsHTTPSTrafficOnly: acct.Properties.SupportsHTTPSTrafficOnly,
+		LargeFileSharesState:     "Enabled",
+	}}
+	_, err := a.do(ctx, "PATCH", a.accountURL(""), nil, patch, nil)
+	return err
+}
+
+// createAccount creates the storage account of the ARM resource ID unless it
+// exists, and returns its first key.
+func createAccount(creds *aadCredential, armEndpoint, accountID string, spec accountSpec) (string, error) {
+	a, err := newARMShares(creds, armEndpoint, accountID)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), accountCreateTimeout)
+	defer cancel()
+	if err := a.ensureAccount(ctx, spec); err != nil {
+		return "", err
+	}
+	return a.accountKey(ctx)
+}
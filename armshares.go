@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// armSharesAPIVersion is the version of the Microsoft.Storage resource
+// provider API used to manage shares.
+const armSharesAPIVersion = "2021-04-01"
+
+// Ways the driver authenticates the management operations on shares.
+const (
+	managementAuthKey = "key"
+	managementAuthAAD = "aad"
+)
+
+// armShares creates, deletes, resizes and snapshots the shares of a storage
+// account through Azure Resource Manager, authorized by the RBAC roles of an
+// Azure AD identity (e.g. Storage Account Contributor).
+type armShares struct {
+	creds       *aadCredential
+	endpoint    string
+	accountID   string // ARM resource ID of the storage account
+	accountName string
+	largeShares bool             // enable large file shares on the account, see enableLargeShares
+	pressure    *pressureTracker // records the throttled and slow requests, nil for none
+}
+
+func newARMShares(creds *aadCredential, endpoint, accountID string) (*armShares, error) {
+	if err := validateStorageAccountID(accountID); err != nil {
+		return nil, err
+	}
+	p := strings.Split(strings.Trim(accountID, "/"), "/")
+	return &armShares{
+		creds:       creds,
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/",
+		accountID:   strings.Join(p, "/"),
+		accountName: p[7],
+	}, nil
+}
+
+// armShare is the share resource of Azure Resource Manager.
+type armShare struct {
+	Name       string             `json:"name,omitempty"`
+	Properties armShareProperties `json:"properties"`
+}
+
+type armShareProperties struct {
+	ShareQuota       int               `json:"shareQuota,omitempty"`
+	EnabledProtocols string            `json:"enabledProtocols,omitempty"`
+	RootSquash       string            `json:"rootSquash,omitempty"`
+	AccessTier       string            `json:"accessTier,omitempty"`
+	SnapshotTime     string            `json:"snapshotTime,omitempty"`
+	LastModifiedTime string            `json:"lastModifiedTime,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+// do sends a request for the resource at path under the storage account,
+// with body encoded as JSON if not nil, and decodes the response into out if
+// not nil. Failed requests are returned as *fileServiceError, so that they
+// are classified like those of the File service.
+func (a *armShares) do(ctx context.Context, method, path string, q url.Values, body, out interface{}) (int, error) {
+	token, err := a.creds.token(a.endpoint)
+	if err != nil {
+		return 0, err
+	}
+	if q == nil {
+		q = url.Values{}
+	}
+	q.Set("api-version", armSharesAPIVersion)
+	var r *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(b)
+	} else {
+		r = bytes.NewReader(nil)
+	}
+	u := path
+	if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		u = a.endpoint + a.accountID + "/fileServices/default/" + path + "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create request: %v", err)
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	start := time.Now()
+	resp, err := storageHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	a.pressure.observe(a.accountName, "", time.Since(start), isThrottled(resp))
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("cannot read response: %v", err)
+	}
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(b, &e)
+		if e.Error.Code == "" {
+			e.Error.Code = http.StatusText(resp.StatusCode)
+		}
+		return resp.StatusCode, &fileServiceError{StatusCode: resp.StatusCode, Code: e.Error.Code, Message: e.Error.Message}
+	}
+	if out != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("cannot parse response: %v", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (a *armShares) shareExists(ctx context.Context, share string) (bool, error) {
+	_, err := a.do(ctx, "GET", "shares/"+share, nil, nil, nil)
+	if e, ok := err.(*fileServiceError); ok && e.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (a *armShares) createShareIfNotExists(ctx context.Context, share string, props shareProperties) (bool, error) {
+	// creating a share overwrites the properties of an existing one
+	if exists, err := a.shareExists(ctx, share); err != nil || exists {
+		return false, err
+	}
+	if props.LargeShare {
+		if err := a.enableLargeShares(ctx); err != nil {
+			return false, err
+		}
+	}
+	p := armShareProperties{ShareQuota: props.QuotaGiB, AccessTier: props.Tier, Metadata: props.Metadata}
+	if props.Protocol == protocolNFS {
+		p.EnabledProtocols = "NFS"
+		p.RootSquash = rootSquashModes[props.Squash]
+	}
+	if _, err := a.do(ctx, "PUT", "shares/"+share, nil, armShare{Properties: p}, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *armShares) updateShare(ctx context.Context, share string, p armShareProperties) error {
+	_, err := a.do(ctx, "PATCH", "shares/"+share, nil, armShare{Properties: p}, nil)
+	return err
+}
+
+func (a *armShares) deleteShareIfExists(ctx context.Context, share string, snapshots bool) (bool, error) {
+	q := url.Values{}
+	if snapshots {
+		q.Set("$include", "snapshots")
+	}
+	status, err := a.do(ctx, "DELETE", "shares/"+share, q, nil, nil)
+	if e, ok := err.(*fileServiceError); ok && e.StatusCode == http.StatusConflict && isSnapshotConflict(e) {
+		// reported as a conflict by the resource provider, classified as
+		// the File service does so that callers handle both alike
+		e.Code = "ShareHasSnapshots"
+	}
+	if err != nil {
+		return false, err
+	}
+	// deleting a share that does not exist succeeds with no content
+	return status != http.StatusNoContent, nil
+}
+
+// isSnapshotConflict returns true if the conflict reported by the resource
+// provider is about the snapshots of the share, rather than e.g. a lease.
+func isSnapshotConflict(e *fileServiceError) bool {
+	return e.Code == "ShareHasSnapshots" || strings.Contains(strings.ToLower(e.Message), "snapshot")
+}
+
+func (a *armShares) createSnapshot(ctx context.Context, share string) (string, error) {
+	var out armShare
+	if _, err := a.do(ctx, "PUT", "shares/"+share, url.Values{"$expand": {"snapshots"}}, armShare{}, &out); err != nil {
+		return "", err
+	}
+	return out.Properties.SnapshotTime, nil
+}
+
+// listSnapshots lists the shares whose name starts with share (there is no
+// way to list the snapshots of a single share) along with their snapshots,
+// rather than every share of the account, which quickly runs into the read
+// throttling of Azure Resource Manager on large accounts.
+func (a *armShares) listSnapshots(ctx context.Context, share string) ([]shareSnapshot, error) {
+	var snapshots []shareSnapshot
+	path, q := "shares", url.Values{"$expand": {"snapshots"}, "$filter": {share}}
+	for path != "" {
+		var out struct {
+			Value    []armShare `json:"value"`
+			NextLink string     `json:"nextLink"`
+		}
+		if _, err := a.do(ctx, "GET", path, q, nil, &out); err != nil {
+			return nil, err
+		}
+		for _, s := range out.Value {
+			if s.Name == share && s.Properties.SnapshotTime != "" {
+				snapshots = append(snapshots, shareSnapshot{s.Properties.SnapshotTime, s.Properties.LastModifiedTime, s.Properties.ShareQuota})
+			}
+		}
+		path = out.NextLink
+	}
+	sort.Sort(bySnapshotTime(snapshots))
+	return snapshots, nil
+}
+
+func (a *armShares) listShares(ctx context.Context, prefix string) ([]shareInfo, error) {
+	var shares []shareInfo
+	path := "shares"
+	for path != "" {
+		var out struct {
+			Value    []armShare `json:"value"`
+			NextLink string     `json:"nextLink"`
+		}
+		if _, err := a.do(ctx, "GET", path, nil, nil, &out); err != nil {
+			return nil, err
+		}
+		for _, s := range out.Value {
+			if !strings.HasPrefix(s.Name, prefix) {
+				continue
+			}
+			p := s.Properties
+			info := shareInfo{Name: s.Name, QuotaGiB: p.ShareQuota, Tier: p.AccessTier, Metadata: p.Metadata}
+			if strings.EqualFold(p.EnabledProtocols, "NFS") {
+				info.Protocol = protocolNFS
+				info.Squash = squashMode(p.RootSquash)
+			}
+			shares = append(shares, info)
+		}
+		path = out.NextLink
+	}
+	return shares, nil
+}
+
+// bySnapshotTime orders snapshots oldest first, as the File service lists
+// them. Snapshot times are UTC timestamps, so they compare as strings.
+type bySnapshotTime []shareSnapshot
+
+func (s bySnapshotTime) Len() int           { return len(s) }
+func (s bySnapshotTime) Less(i, j int) bool { return s[i].Snapshot < s[j].Snapshot }
+func (s bySnapshotTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
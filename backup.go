@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// backupGeneration records a completed copy of a volume's share into the
+// backup storage account.
+type backupGeneration struct {
+	ID          string    `json:"id"`
+	Account     string    `json:"account"`
+	Share       string    `json:"share"`
+	Directory   string    `json:"directory"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	Files       int       `json:"files"`
+	Bytes       int64     `json:"bytes"`
+}
+
+// enableBackups configures the account volumes are backed up to and starts
+// backing them up periodically, keeping the last retain generations of each
+// volume (all of them if zero).
+func (v *volumeDriver) enableBackups(accountName, accountKey string, interval time.Duration, retain int) error {
+	if accountName == v.accountName {
+		return fmt.Errorf("backup account must be different from the volume account")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("backup interval must be positive")
+	}
+	if retain < 0 {
+		return fmt.Errorf("backup retention must not be negative")
+	}
+	cl, err := v.clients.get(accountName, accountKey, v.storageBase, v.endpoint)
+	if err != nil {
+		return fmt.Errorf("error creating backup account client: %v", err)
+	}
+	v.backup = cl
+	v.backupRetain = retain
+	go v.runBackups(interval)
+	return nil
+}
+
+// runBackups backs up all volumes every interval until the process exits.
+func (v *volumeDriver) runBackups(interval time.Duration) {
+	for range time.Tick(interval) {
+		v.m.Lock()
+		vols, err := v.meta.List()
+		v.m.Unlock()
+		if err != nil {
+			log.Errorf("backup: failed to list volumes: %v", err)
+			continue
+		}
+		for _, name := range vols {
+			v.clients.pressure.pause(v.accountName)
+			v.clients.pressure.pause(v.backup.accountName)
+			if err := v.backupVolume(name); err != nil {
+				log.WithField("name", name).Errorf("backup failed: %v", err)
+			}
+		}
+	}
+}
+
+// backupVolume copies the contents of the volume's share into a new
+// directory of the same-named share on the backup account and records the
+// generation in the volume metadata, then prunes the generations beyond the
+// retention. The driver lock is not held while the copy is in progress.
+func (v *volumeDriver) backupVolume(name string) error {
+	logctx := log.WithFields(log.Fields{
+		"operation": "backup",
+		"name":      name,
+	})
+
+	v.m.Lock()
+	meta, err := v.meta.Get(name)
+	src := v.files
+	v.m.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not fetch metadata: %v", err)
+	}
+	if meta.Account != v.accountName {
+		logctx.Debugf("volume hosted on a different account (%q), skipping", meta.Account)
+		return nil
+	}
+	if err := v.checkNamespace(meta); err != nil {
+		logctx.Debugf("%v, skipping", err)
+		return nil
+	}
+	if meta.Options.Protocol == protocolNFS {
+		logctx.Debug("NFS shares cannot be copied through the REST API, skipping")
+		return nil
+	}
+
+	share := meta.Options.Share
+	gen := backupGeneration{
+		ID:        time.Now().UTC().Format("20060102T150405Z"),
+		Account:   v.backup.accountName,
+		Share:     share,
+		StartedAt: time.Now().UTC(),
+	}
+	gen.Directory = gen.ID
+	logctx.Debugf("starting backup generation %s", gen.ID)
+
+	if ok, err := v.backup.createShareIfNotExists(share, shareProperties{}); err != nil {
+		return fmt.Errorf("error creating backup share %q: %v", share, err)
+	} else if ok {
+		logctx.Infof("created backup share %q on account %q", share, gen.Account)
+	}
+	if err := v.backup.createDirectory(share, gen.Directory); err != nil {
+		return fmt.Errorf("error creating backup directory: %v", err)
+	}
+
+	c := newTreeCopy(src, share, "", v.backup, share)
+	if err := c.run("", gen.Directory); err != nil {
+		return err
+	}
+	gen.Files, gen.Bytes = c.Files, c.Bytes
+	gen.CompletedAt = time.Now().UTC()
+
+	v.m.Lock()
+	meta, err = v.meta.Get(name)
+	if err != nil {
+		v.m.Unlock()
+		return fmt.Errorf("volume removed during backup: %v", err)
+	}
+	meta.Backups = append(meta.Backups, gen)
+	if err := v.meta.Set(name, meta); err != nil {
+		v.m.Unlock()
+		return fmt.Errorf("error saving metadata: %v", err)
+	}
+	expired := v.expiredBackups(meta.Backups)
+	v.m.Unlock()
+	logctx.Infof("backup generation %s completed: %d files, %d bytes", gen.ID, gen.Files, gen.Bytes)
+
+	if len(expired) > 0 {
+		if err := v.pruneBackups(name, expired); err != nil {
+			logctx.Warnf("failed to prune backup generations: %v", err)
+		}
+	}
+	return nil
+}
+
+// expiredBackups returns the oldest of the generations on the backup account
+// beyond the retention. Generations on other accounts (made before the backup
+// account was changed) are neither counted nor returned.
+func (v *volumeDriver) expiredBackups(gens []backupGeneration) []backupGeneration {
+	if v.backupRetain == 0 {
+		return nil
+	}
+	var own []backupGeneration
+	for _, g := range gens {
+		if g.Account == v.backup.accountName {
+			own = append(own, g)
+		}
+	}
+	if len(own) <= v.backupRetain {
+		return nil
+	}
+	return own[:len(own)-v.backupRetain]
+}
+
+// pruneBackups deletes the directories of the expired generations of the
+// volume from the backup account and their entries from its metadata. The
+// entries of generations that could not be deleted are kept, so they are
+// pruned by the next backup. The driver lock is not held while deleting.
+func (v *volumeDriver) pruneBackups(name string, expired []backupGeneration) error {
+	deleted := make(map[string]bool)
+	var firstErr error
+	for _, g := range expired {
+		if err := v.backup.deleteTree(g.Share, g.Directory); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error deleting backup generation %s: %v", g.ID, err)
+			}
+			continue
+		}
+		deleted[g.ID] = true
+		log.WithField("name", name).Infof("deleted backup generation %s", g.ID)
+	}
+	if len(deleted) == 0 {
+		return firstErr
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	meta, err := v.meta.Get(name)
+	if err != nil {
+		// removed meanwhile, there are no entries left to prune
+		return firstErr
+	}
+	var kept []backupGeneration
+	for _, g := range meta.Backups {
+		if !(g.Account == v.backup.accountName && deleted[g.ID]) {
+			kept = append(kept, g)
+		}
+	}
+	meta.Backups = kept
+	if err := v.meta.Set(name, meta); err != nil {
+		return fmt.Errorf("error saving metadata: %v", err)
+	}
+	return firstErr
+}
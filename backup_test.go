@@ -0,0 +1,31 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpiredBackups(t *testing.T) {
+	gen := func(id, account string) backupGeneration {
+		return backupGeneration{ID: id, Account: account}
+	}
+	gens := []backupGeneration{gen("1", "old"), gen("2", "bak"), gen("3", "bak"), gen("4", "old"), gen("5", "bak")}
+	for _, tc := range []struct {
+		retain int
+		gens   []backupGeneration
+		want   []backupGeneration
+	}{
+		{retain: 0, gens: gens},
+		{retain: 1, gens: nil},
+		{retain: 3, gens: gens},
+		{retain: 5, gens: gens},
+		{retain: 2, gens: gens, want: []backupGeneration{gen("2", "bak")}},
+		{retain: 1, gens: gens, want: []backupGeneration{gen("2", "bak"), gen("3", "bak")}},
+		{retain: 1, gens: []backupGeneration{gen("1", "old"), gen("2", "old")}},
+	} {
+		v := &volumeDriver{backupRetain: tc.retain, backup: &fileClient{accountName: "bak"}}
+		if got := v.expiredBackups(tc.gens); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expiredBackups(%v) retaining %d = %v, want %v", tc.gens, tc.retain, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	benchBlockSize       = 1 << 20 // of sequential reads and writes
+	benchRandomBlockSize = 4 << 10 // of random reads and writes
+	benchMountID         = "bench"
+)
+
+// benchCommand measures the throughput of a share mounted with the options
+// given, to compare mount option tunings.
+var benchCommand = cli.Command{
+	Name:  "bench",
+	Usage: "Mount a share and measure sequential and random throughput and small file operations",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "opt, o",
+			Usage: "Option (key=value) of the benchmarked volume, e.g. -o rsize=4194304 -o extra-opts=cache=loose",
+			Value: &cli.StringSlice{},
+		},
+		cli.StringFlag{
+			Name:  "share",
+			Usage: "Existing share to benchmark (left in place), instead of a temporary share",
+		},
+		cli.IntFlag{
+			Name:  "size",
+			Usage: "Size in MiB of the file read and written",
+			Value: 256,
+		},
+		cli.DurationFlag{
+			Name:  "random-duration",
+			Usage: "How long random reads and writes are measured each",
+			Value: 10 * time.Second,
+		},
+		cli.IntFlag{
+			Name:  "files",
+			Usage: "Number of small files created, listed, read and deleted",
+			Value: 500,
+		},
+	},
+	Action: func(c *cli.Context) {
+		opts, err := parseOptFlags(c.StringSlice("opt"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if c.Int("size") < 1 || c.Int("files") < 1 {
+			fmt.Fprintln(os.Stderr, "--size and --files must be positive")
+			os.Exit(2)
+		}
+		v, cleanup, err := temporaryDriver(c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		name := "bench-" + randomHex(4)
+		if s := c.String("share"); s != "" {
+			opts["share"], opts["exists"], opts["reclaim"] = s, existsUse, reclaimRetain
+		} else {
+			opts["share"] = name
+		}
+		ok := runBench(os.Stdout, v, name, opts, benchParams{
+			size:           int64(c.Int("size")) << 20,
+			randomDuration: c.Duration("random-duration"),
+			files:          c.Int("files"),
+		})
+		cleanup()
+		if !ok {
+			os.Exit(1)
+		}
+	},
+}
+
+type benchParams struct {
+	size           int64
+	randomDuration time.Duration
+	files          int
+}
+
+// runBench creates and mounts the volume, runs the benchmarks printing their
+// results to w, and removes the volume. The volume is mounted again between
+// writing and reading, so that reads are served by the share rather than the
+// page cache. It returns false if a step failed.
+func runBench(w io.Writer, v *volumeDriver, name string, opts map[string]string, p benchParams) bool {
+	log.SetOutput(ioutil.Discard) // the steps print the errors
+	fmt.Fprintf(w, "Benchmarking share %s%s (%d MiB file, %d small files)\n", v.sharePrefix, opts["share"], p.size>>20, p.files)
+
+	if err := responseError(v.Create(volume.Request{Name: name, Options: opts})); err != nil {
+		fmt.Fprintf(w, "create: FAILED (%v)\n", err)
+		return false
+	}
+	defer func() {
+		if err := responseError(v.Remove(volume.Request{Name: name})); err != nil {
+			fmt.Fprintf(w, "remove: FAILED (%v)\n", err)
+		}
+	}()
+	var path, dir string
+	mounted := false
+	mount := func() bool {
+		resp := v.Mount(volume.MountRequest{Name: name, ID: benchMountID})
+		if err := responseError(resp); err != nil {
+			fmt.Fprintf(w, "mount: FAILED (%v)\n", err)
+			return false
+		}
+		path, mounted = resp.Mountpoint, true
+		return true
+	}
+	unmount := func() bool {
+		mounted = false
+		if err := responseError(v.Unmount(volume.UnmountRequest{Name: name, ID: benchMountID})); err != nil {
+			fmt.Fprintf(w, "unmount: FAILED (%v)\n", err)
+			return false
+		}
+		return true
+	}
+	defer func() {
+		if !mounted && dir != "" {
+			// failed between unmounting and mounting, mount to clean up
+			mount()
+		}
+		if mounted {
+			os.RemoveAll(dir)
+			unmount()
+		}
+	}()
+
+	if !mount() {
+		return false
+	}
+	dir = filepath.Join(path, "bench-"+randomHex(4))
+	file := filepath.Join(dir, "seq.dat")
+	if !benchRun(w, "sequential write", func() (string, error) {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return "", err
+		}
+		return benchThroughput(p.size, func() error { return benchWriteFile(file, p.size) })
+	}) || !unmount() || !mount() {
+		return false
+	}
+	return benchRun(w, "sequential read", func() (string, error) {
+		return benchThroughput(p.size, func() error { return benchReadFile(file) })
+	}) && benchRun(w, "random read 4KiB", func() (string, error) {
+		return benchRandom(file, p.size, p.randomDuration, false)
+	}) && benchRun(w, "random write 4KiB", func() (string, error) {
+		return benchRandom(file, p.size, p.randomDuration, true)
+	}) && benchSmallFiles(w, filepath.Join(dir, "small"), p.files)
+}
+
+// benchRun prints the result of the benchmark, or its error.
+func benchRun(w io.Writer, what string, f func() (string, error)) bool {
+	res, err := f()
+	if err != nil {
+		fmt.Fprintf(w, "%-18s FAILED (%v)\n", what+":", err)
+		return false
+	}
+	fmt.Fprintf(w, "%-18s %s\n", what+":", res)
+	return true
+}
+
+// benchThroughput runs f, which transfers size bytes, and returns its
+// throughput.
+func benchThroughput(size int64, f func() error) (string, error) {
+	start := time.Now()
+	if err := f(); err != nil {
+		return "", err
+	}
+	d := time.Since(start)
+	return fmt.Sprintf("%.1f MiB/s (%v)", float64(size)/(1<<20)/d.Seconds(), elapsed(start)), nil
+}
+
+// benchWriteFile writes size bytes of random data to a new file at path in
+// benchBlockSize blocks, flushing it to the server.
+func benchWriteFile(path string, size int64) error {
+	block := make([]byte, benchBlockSize)
+	if _, err := rand.Read(block); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for n := int64(0); n < size; n += int64(len(block)) {
+		if size-n < int64(len(block)) {
+			block = block[:size-n]
+		}
+		if _, err := f.Write(block); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func benchReadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyBuffer(ioutil.Discard, f, make([]byte, benchBlockSize))
+	return err
+}
+
+// benchRandom reads (or writes) benchRandomBlockSize blocks at random offsets
+// of the file of the size for the duration, and returns the operations per
+// second.
+func benchRandom(path string, size int64, duration time.Duration, write bool) (string, error) {
+	flag := os.O_RDONLY
+	if write {
+		flag = os.O_WRONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	block := make([]byte, benchRandomBlockSize)
+	blocks := size / benchRandomBlockSize
+	if blocks < 1 {
+		blocks = 1
+	}
+	ops := 0
+	start := time.Now()
+	for time.Since(start) < duration {
+		off := mrand.Int63n(blocks) * benchRandomBlockSize
+		if write {
+			_, err = f.WriteAt(block, off)
+		} else {
+			_, err = f.ReadAt(block, off)
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		ops++
+	}
+	if write {
+		if err := f.Sync(); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%.0f IOPS", float64(ops)/time.Since(start).Seconds()), nil
+}
+
+// benchSmallFiles creates, lists, reads and deletes n small files in dir,
+// printing the rate of each operation to w.
+func benchSmallFiles(w io.Writer, dir string, n int) bool {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		fmt.Fprintf(w, "%-18s FAILED (%v)\n", "file create:", err)
+		return false
+	}
+	data := make([]byte, benchRandomBlockSize)
+	each := func(f func(string) error) func() (string, error) {
+		return func() (string, error) {
+			start := time.Now()
+			for i := 0; i < n; i++ {
+				if err := f(filepath.Join(dir, strconv.Itoa(i))); err != nil {
+					return "", err
+				}
+			}
+			return fmt.Sprintf("%.0f files/s", float64(n)/time.Since(start).Seconds()), nil
+		}
+	}
+	return benchRun(w, "file create", each(func(p string) error {
+		return ioutil.WriteFile(p, data, 0644)
+	})) && benchRun(w, "file stat", each(func(p string) error {
+		_, err := os.Stat(p)
+		return err
+	})) && benchRun(w, "directory listing", func() (string, error) {
+		start := time.Now()
+		if _, err := ioutil.ReadDir(dir); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d entries in %v", n, elapsed(start)), nil
+	}) && benchRun(w, "file read", each(func(p string) error {
+		_, err := ioutil.ReadFile(p)
+		return err
+	})) && benchRun(w, "file delete", each(os.Remove))
+}
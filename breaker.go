@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Defaults of --storage-breaker-threshold and --storage-breaker-cooldown.
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// breakerOpenError is returned without calling the storage API while the
+// circuit of the account is open.
+type breakerOpenError struct {
+	account string
+	until   time.Time
+}
+
+func (e *breakerOpenError) Error() string {
+	return fmt.Sprintf("storage API unavailable: requests to account %q are failing, not retrying before %s", e.account, e.until.Format(time.RFC3339))
+}
+
+// breaker stops calls to the storage API of an account after a number of
+// consecutive failures, so that requests fail fast instead of each waiting
+// for timeouts. After the cooldown, a single trial call is let through and
+// closes the circuit if it succeeds.
+type breaker struct {
+	account   string
+	threshold int // zero disables the breaker
+	cooldown  time.Duration
+
+	m        sync.Mutex
+	failures int
+	openedAt time.Time // zero when closed
+	trial    bool      // a trial call is in progress
+}
+
+// breakers holds the circuit breakers of the accounts, with their settings.
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+
+	m sync.Mutex
+	b map[string]*breaker
+}
+
+func newBreakers(threshold int, cooldown time.Duration) *breakers {
+	return &breakers{threshold: threshold, cooldown: cooldown, b: make(map[string]*breaker)}
+}
+
+// get returns the circuit breaker of the account, a disabled one if s is nil.
+func (s *breakers) get(account string) *breaker {
+	if s == nil {
+		return &breaker{account: account}
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	b, ok := s.b[account]
+	if !ok {
+		b = &breaker{account: account, threshold: s.threshold, cooldown: s.cooldown}
+		s.b[account] = b
+	}
+	return b
+}
+
+// allow returns an error if the circuit is open and calls must not be made.
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	until := b.openedAt.Add(b.cooldown)
+	if time.Now().Before(until) || b.trial {
+		return &breakerOpenError{b.account, until}
+	}
+	b.trial = true
+	return nil
+}
+
+// record records the outcome of a call let through by allow.
+func (b *breaker) record(failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.trial = false
+	if !failed {
+		if !b.openedAt.IsZero() {
+			log.Infof("storage API of account %q recovered, closing circuit", b.account)
+		}
+		b.failures, b.openedAt = 0, time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.openedAt.IsZero() {
+			log.Warnf("storage API of account %q failed %d times in a row, opening circuit for %v", b.account, b.failures, b.cooldown)
+		}
+		b.openedAt = time.Now()
+	}
+}
+
+// isUnavailable returns true if the error means the storage API could not
+// serve the request at all, as opposed to rejecting it.
+func isUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*breakerOpenError); ok {
+		return false
+	}
+	// server errors, and transport errors such as refused connections
+	switch classify(err, codeUnreachable) {
+	case codeServerError, codeThrottled, codeUnreachable, codeNetwork:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package main
+
+// Some operations on a volume, such as extracting its seed archive, take too
+// long to hold the driver lock throughout. They release it and mark the
+// volume busy instead, so that the other operations changing the mounts of
+// that volume are refused until they are done while the other volumes are
+// still served.
+
+// setBusy marks the volume busy with op. Caller must hold the driver lock
+// and have checked that the volume is not busy already (see checkBusy).
+func (v *volumeDriver) setBusy(name, op string) {
+	v.busy[name] = op
+}
+
+// clearBusy marks the volume no longer busy. Caller must hold the driver
+// lock.
+func (v *volumeDriver) clearBusy(name string) {
+	delete(v.busy, name)
+}
+
+// checkBusy returns an error if an operation running without the driver lock
+// marked the volume busy. Caller must hold the driver lock.
+func (v *volumeDriver) checkBusy(name string) error {
+	if op, ok := v.busy[name]; ok {
+		return newError(codeVolumeBusy, "volume is busy %s, try again later", op)
+	}
+	return nil
+}
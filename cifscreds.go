@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+const (
+	// cifsAddrKeyPrefix starts the descriptions of the logon keys the CIFS
+	// client requests for the users of multiuser mounts, followed by the
+	// address of the server, as cifscreds(1) adds them.
+	cifsAddrKeyPrefix = "cifs:a:"
+
+	// cifsCredsKeyPrefix starts the descriptions of the keys holding the
+	// credentials of multiuser mounts in the user keyring of the driver,
+	// followed by the description of the key the CIFS client requests.
+	cifsCredsKeyPrefix = "azurefile:"
+
+	// legacyCIFSCredsDir held the credentials of multiuser mounts in
+	// plaintext files before they were moved to the kernel keyring.
+	legacyCIFSCredsDir = "/run/azurefile-dockervolumedriver/cifscreds"
+)
+
+// writeCIFSCreds records the credentials of the users of multiuser mounts
+// of the server at ip, in the "user:password" payload format of the logon
+// keys of the CIFS client, in the kernel keyring of the driver (see
+// addUserKey): they never reach the filesystem. The kernel requests these
+// keys by server address only, so it fails if a multiuser mount of the host
+// already uses the credentials of another user (storage account) for the
+// same address, as storage accounts can share a front-end IP.
+func writeCIFSCreds(ip, user, password string) error {
+	desc := cifsCredsKeyPrefix + cifsAddrKeyPrefix + ip
+	if id, err := searchUserKey(desc); err == nil {
+		if b, err := readKey(id); err == nil && !strings.HasPrefix(string(b), user+":") {
+			used, err := multiuserServers()
+			if err != nil {
+				return err
+			}
+			if used[ip] {
+				return fmt.Errorf("a multiuser mount of another storage account uses the same server address %s, whose users would get the credentials of either account", ip)
+			}
+		}
+	}
+	if err := addUserKey(desc, []byte(user+":"+password)); err != nil {
+		return fmt.Errorf("cannot add multiuser credentials to the kernel keyring: %v", err)
+	}
+	return nil
+}
+
+// rewriteCIFSCreds replaces the password of user in the recorded credentials,
+// after the account key was rotated, so that the sessions of users created
+// later use it.
+func rewriteCIFSCreds(user, password string) error {
+	keys, err := userKeys(cifsCredsKeyPrefix + cifsAddrKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("cannot list multiuser credentials: %v", err)
+	}
+	for desc, id := range keys {
+		b, err := readKey(id)
+		if err == syscall.ENOKEY || err == syscall.EKEYREVOKED {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("cannot read multiuser credentials: %v", err)
+		}
+		if strings.HasPrefix(string(b), user+":") {
+			if err := writeCIFSCreds(strings.TrimPrefix(desc, cifsCredsKeyPrefix+cifsAddrKeyPrefix), user, password); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeUnusedCIFSCreds deletes the credentials recorded for the servers that
+// no multiuser CIFS mount of the host uses anymore.
+func removeUnusedCIFSCreds() {
+	keys, err := userKeys(cifsCredsKeyPrefix + cifsAddrKeyPrefix)
+	if err != nil || len(keys) == 0 {
+		return
+	}
+	used, err := multiuserServers()
+	if err != nil {
+		log.Warnf("cannot clean up multiuser credentials: %v", err)
+		return
+	}
+	for desc, id := range keys {
+		ip := strings.TrimPrefix(desc, cifsCredsKeyPrefix+cifsAddrKeyPrefix)
+		if used[ip] {
+			continue
+		}
+		if err := unlinkUserKey(id); err != nil && err != syscall.ENOKEY {
+			log.Warnf("cannot remove multiuser credentials: %v", err)
+		} else {
+			log.Debugf("removed multiuser credentials of %s", ip)
+		}
+	}
+}
+
+// removeLegacyCIFSCreds deletes the plaintext credentials files written by
+// earlier versions of the driver, whose multiuser mounts now get their
+// credentials from the kernel keyring once remounted.
+func removeLegacyCIFSCreds() {
+	if err := os.RemoveAll(legacyCIFSCredsDir); err != nil {
+		log.Warnf("cannot remove %s: %v", legacyCIFSCredsDir, err)
+	}
+}
+
+// multiuserServers returns the addresses of the servers of the multiuser
+// CIFS mounts of the host, as read from the addr= option of their super
+// block in /proc/self/mountinfo.
+func multiuserServers() (map[string]bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mountinfo: %v", err)
+	}
+	defer f.Close()
+	servers := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// 36 35 0:52 / /mnt rw,relatime - cifs //acct.file.core.windows.net/share rw,vers=3.0,addr=10.0.0.4,multiuser,...
+		fields := strings.Fields(s.Text())
+		for i := 6; i+3 < len(fields); i++ {
+			if fields[i] != "-" {
+				continue
+			}
+			if fields[i+1] != "cifs" {
+				break
+			}
+			var addr string
+			multiuser := false
+			for _, o := range strings.Split(fields[i+3], ",") {
+				if o == "multiuser" {
+					multiuser = true
+				} else if strings.HasPrefix(o, "addr=") {
+					addr = strings.TrimPrefix(o, "addr=")
+				}
+			}
+			if multiuser && addr != "" {
+				servers[addr] = true
+			}
+			break
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read mountinfo: %v", err)
+	}
+	return servers, nil
+}
+
+// requestKeyCommand is the request-key(8) program instantiating the keys
+// the CIFS client requests when a user without credentials in their keyring
+// accesses a multiuser mount: for the UIDs given with --uids only, it prints
+// the credentials the driver recorded in its keyring for the server, which
+// request-key sets as the payload of the key. It must be configured in
+// request-key.conf(5) with:
+//
+//	create logon cifs:a:* * |/usr/bin/azurefile-dockervolumedriver request-key --uids=1000,1001 %d %u
+var requestKeyCommand = cli.Command{
+	Name:  "request-key",
+	Usage: "Print the credentials of a multiuser mount requested by the kernel for a user: request-key --uids=<uid,...> <key description> <uid> (see request-key.conf(5))",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "uids",
+			Usage: "Comma-separated UIDs handed the credentials of multiuser mounts, other users get none",
+		},
+	},
+	Action: func(c *cli.Context) {
+		b, err := requestedCIFSCreds(c.Args().Get(0), c.Args().Get(1), c.String("uids"))
+		if err != nil {
+			// request-key negates the key, failing the access
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(b)
+	},
+}
+
+// requestedCIFSCreds returns the credentials recorded for the server of the
+// key with the given description, requested for the user uid.
+func requestedCIFSCreds(desc, uid, uids string) ([]byte, error) {
+	key, err := cifsCredsKey(desc, uid, uids)
+	if err != nil {
+		return nil, err
+	}
+	id, err := searchUserKey(key)
+	if err == syscall.ENOKEY {
+		return nil, fmt.Errorf("no multiuser mount of %s", strings.TrimPrefix(desc, cifsAddrKeyPrefix))
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot find multiuser credentials: %v", err)
+	}
+	return readKey(id)
+}
+
+// cifsCredsKey returns the description of the key holding the credentials
+// requested with the key description desc for the user uid, who must be one
+// of the comma-separated uids.
+func cifsCredsKey(desc, uid, uids string) (string, error) {
+	if !strings.HasPrefix(desc, cifsAddrKeyPrefix) {
+		return "", fmt.Errorf("not a CIFS server key: %q", desc)
+	}
+	ip := strings.TrimPrefix(desc, cifsAddrKeyPrefix)
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("invalid server address %q", ip)
+	}
+	if _, err := strconv.ParseUint(uid, 10, 32); err != nil {
+		return "", fmt.Errorf("invalid UID %q", uid)
+	}
+	for _, u := range strings.Split(uids, ",") {
+		if strings.TrimSpace(u) == uid {
+			return cifsCredsKeyPrefix + desc, nil
+		}
+	}
+	return "", fmt.Errorf("UID %s is not allowed the credentials of multiuser mounts (--uids)", uid)
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestCIFSCredsKey(t *testing.T) {
+	for _, tc := range []struct {
+		desc, uid, uids string
+		want            string
+		wantErr         bool
+	}{
+		{desc: "cifs:a:10.0.0.4", uid: "1000", uids: "1000", want: "azurefile:cifs:a:10.0.0.4"},
+		{desc: "cifs:a:10.0.0.4", uid: "1001", uids: "1000, 1001", want: "azurefile:cifs:a:10.0.0.4"},
+		{desc: "cifs:a:10.0.0.4", uid: "0", uids: "1000", wantErr: true},
+		{desc: "cifs:a:10.0.0.4", uid: "100", uids: "1000", wantErr: true},
+		{desc: "cifs:a:10.0.0.4", uid: "1000", uids: "", wantErr: true},
+		{desc: "cifs:a:10.0.0.4", uid: "", uids: "1000,", wantErr: true},
+		{desc: "cifs:d:corp", uid: "1000", uids: "1000", wantErr: true},
+		{desc: "cifs:a:../10.0.0.4", uid: "1000", uids: "1000", wantErr: true},
+		{desc: "cifs:a:", uid: "1000", uids: "1000", wantErr: true},
+	} {
+		got, err := cifsCredsKey(tc.desc, tc.uid, tc.uids)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("cifsCredsKey(%q, %q, %q) = %q, want error", tc.desc, tc.uid, tc.uids, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cifsCredsKey(%q, %q, %q) failed: %v", tc.desc, tc.uid, tc.uids, err)
+		} else if got != tc.want {
+			t.Errorf("cifsCredsKey(%q, %q, %q) = %q, want %q", tc.desc, tc.uid, tc.uids, got, tc.want)
+		}
+	}
+}
+
+func TestCIFSCredsKeyring(t *testing.T) {
+	// a documentation address no multiuser mount of the host uses
+	const ip = "192.0.2.1"
+	if err := writeCIFSCreds(ip, "acct", "secret"); err != nil {
+		t.Skipf("kernel keyring not available: %v", err)
+	}
+	defer removeUnusedCIFSCreds()
+
+	got, err := requestedCIFSCreds(cifsAddrKeyPrefix+ip, "1000", "1000")
+	if err != nil || string(got) != "acct:secret" {
+		t.Fatalf("requestedCIFSCreds = %q, %v, want acct:secret", got, err)
+	}
+	if got, err := requestedCIFSCreds(cifsAddrKeyPrefix+ip, "1001", "1000"); err == nil {
+		t.Errorf("requestedCIFSCreds for a UID not allowed = %q, want error", got)
+	}
+
+	if err := rewriteCIFSCreds("acct", "rotated"); err != nil {
+		t.Fatalf("rewriteCIFSCreds failed: %v", err)
+	}
+	if got, err := requestedCIFSCreds(cifsAddrKeyPrefix+ip, "1000", "1000"); err != nil || string(got) != "acct:rotated" {
+		t.Errorf("requestedCIFSCreds after rotation = %q, %v, want acct:rotated", got, err)
+	}
+	// not mounted, so another account may take the address over
+	if err := writeCIFSCreds(ip, "other", "key"); err != nil {
+		t.Errorf("writeCIFSCreds of another account for an unused address failed: %v", err)
+	}
+
+	removeUnusedCIFSCreds()
+	if got, err := requestedCIFSCreds(cifsAddrKeyPrefix+ip, "1000", "1000"); err == nil {
+		t.Errorf("requestedCIFSCreds after the credentials were removed = %q, want error", got)
+	}
+}
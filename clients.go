@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storageHTTPClient is shared by all File service clients so that
+// connections to the storage endpoints are kept alive and reused.
+var storageHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// clientCache caches File service clients by storage account. Its settings
+// are given to the clients it creates, so they must be set before the first
+// get.
+type clientCache struct {
+	apiVersion string           // x-ms-version of the requests, see --storage-api-version
+	pressure   *pressureTracker // shared by the clients, see --slow-request-threshold
+	breakers   *breakers        // shared by the clients, see --storage-breaker-threshold
+	arm        *armShares       // manages the shares of its account if set, see fileClient.arm
+
+	m       sync.Mutex
+	clients map[string]*fileClient // keyed by account name and storage base or endpoint
+}
+
+func newClientCache() *clientCache {
+	return &clientCache{
+		apiVersion: defaultFileAPIVersion,
+		pressure:   newPressureTracker(defaultSlowRequestThreshold),
+		breakers:   newBreakers(defaultBreakerThreshold, defaultBreakerCooldown),
+		clients:    make(map[string]*fileClient),
+	}
+}
+
+// get returns the client for the account, creating it on first use or when
+// the account key changed. See fileClient for the endpoint.
+func (c *clientCache) get(accountName, accountKey, storageBase string, endpoint *url.URL) (*fileClient, error) {
+	k := accountName + "." + storageBase
+	if endpoint != nil {
+		k = endpoint.String() + "/" + accountName
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if cl, ok := c.clients[k]; ok && cl.key == accountKey {
+		return cl, nil
+	}
+	cl, err := c.create(accountName, accountKey, storageBase, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[k] = cl
+	return cl, nil
+}
+
+// create returns a new client for the account with the settings of the
+// cache, without caching it.
+func (c *clientCache) create(accountName, accountKey, storageBase string, endpoint *url.URL) (*fileClient, error) {
+	cl, err := newFileClient(accountName, accountKey, storageBase, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	cl.apiVersion = c.apiVersion
+	cl.pressure = c.pressure
+	cl.breakers = c.breakers
+	if c.arm != nil && strings.EqualFold(c.arm.accountName, accountName) {
+		cl.management = c.arm
+	}
+	return cl, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// defaultConnectivityTimeout bounds each step of check-connectivity.
+const defaultConnectivityTimeout = 10 * time.Second
+
+// negotiateDialects are the SMB dialects offered by negotiateSMB. SMB 3.1.1
+// is left out as offering it requires negotiate contexts; servers supporting
+// it also support 3.0.2.
+var negotiateDialects = []uint16{0x0210, 0x0300, 0x0302}
+
+// checkConnectivityCommand diagnoses why SMB mounts of the account cannot
+// reach the File service, blocked outbound port 445 being the most common
+// cause.
+var checkConnectivityCommand = cli.Command{
+	Name:  "check-connectivity",
+	Usage: "Check DNS resolution, TCP reachability and SMB negotiation against the File service endpoint of the account",
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "How long each check may take",
+			Value: defaultConnectivityTimeout,
+		},
+	},
+	Action: func(c *cli.Context) {
+		host, err := fileServiceHost(c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		port := c.GlobalInt("smb-port")
+		if port <= 0 {
+			port = 445
+		}
+		if !checkConnectivity(os.Stdout, host, port, c.Duration("timeout")) {
+			os.Exit(1)
+		}
+	},
+}
+
+// fileServiceHost returns the File service host of the account given to the
+// driver, which SMB mounts connect to.
+func fileServiceHost(c *cli.Context) (string, error) {
+	a, err := accountFromFlags(c)
+	if err != nil {
+		return "", err
+	}
+	if a.endpoint != nil {
+		return "", fmt.Errorf("SMB mounts are not checked against the custom storage endpoint %s or the storage emulator", a.endpoint)
+	}
+	return fmt.Sprintf("%s.file.%s", a.name, a.storageBase), nil
+}
+
+// checkConnectivity resolves host, connects to its SMB port and negotiates
+// an SMB dialect, printing the outcome of each step and a diagnosis of the
+// first failure to w. It returns true if all the steps succeeded.
+func checkConnectivity(w io.Writer, host string, port int, timeout time.Duration) bool {
+	fmt.Fprintf(w, "Checking %s port %d\n", host, port)
+
+	start := time.Now()
+	addrs, err := lookupHost(host, timeout)
+	if err != nil {
+		fmt.Fprintf(w, "DNS resolution:  FAILED (%v)\n", err)
+		fmt.Fprintf(w, "\nThe endpoint name cannot be resolved. Check the account name and --storage-base,\n"+
+			"and that the host can resolve public names (or the private DNS zone of a private\n"+
+			"endpoint of the account). See --mount-resolve-ip if only the mount helper fails.\n")
+		return false
+	}
+	fmt.Fprintf(w, "DNS resolution:  ok (%s in %v)\n", addrs[0], elapsed(start))
+
+	start = time.Now()
+	addr := net.JoinHostPort(addrs[0], strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		fmt.Fprintf(w, "TCP connection:  FAILED (%v)\n", err)
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			fmt.Fprintf(w, "\nThe connection to port %d timed out, which almost always means that outbound\n"+
+				"SMB is blocked by the ISP, a corporate firewall or a network security group.\n"+
+				"Mount from a network allowing port %d (e.g. an Azure VM in the region of the\n"+
+				"account), through a VPN, an SMB tunnel or gateway on another port (--smb-port),\n"+
+				"or through the REST API (-o transport=rest or --rest-fallback).\n", port, port)
+		} else {
+			fmt.Fprintf(w, "\nThe connection to port %d was rejected. Check the firewall and virtual network\n"+
+				"rules of the storage account, and that nothing intercepts the connection.\n", port)
+		}
+		return false
+	}
+	defer conn.Close()
+	fmt.Fprintf(w, "TCP connection:  ok (%s in %v)\n", addr, elapsed(start))
+
+	start = time.Now()
+	conn.SetDeadline(time.Now().Add(timeout))
+	dialect, err := negotiateSMB(conn)
+	if err != nil {
+		fmt.Fprintf(w, "SMB negotiation: FAILED (%v)\n", err)
+		fmt.Fprintf(w, "\nPort %d accepts connections but does not answer as an SMB server. A proxy or\n"+
+			"firewall may be intercepting the connection, or --smb-port does not point at an\n"+
+			"SMB gateway.\n", port)
+		return false
+	}
+	fmt.Fprintf(w, "SMB negotiation: ok (SMB %s in %v)\n", dialect, elapsed(start))
+	if dialect == "2.1" {
+		fmt.Fprintf(w, "\nThe server only negotiated SMB 2.1, which is not encrypted: mounts from outside\n"+
+			"the region of the account, or of accounts requiring secure transfer, will fail.\n")
+		return true
+	}
+	fmt.Fprintf(w, "\nThe File service endpoint is reachable over SMB. If mounts still fail, check the\n"+
+		"account key and that the kernel supports SMB %s (cifs-utils installed).\n", dialect)
+	return true
+}
+
+// lookupHost resolves host, giving up after timeout.
+func lookupHost(host string, timeout time.Duration) ([]string, error) {
+	type result struct {
+		addrs []string
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		addrs, err := net.LookupHost(host)
+		ch <- result{addrs, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.addrs, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("lookup %s: timed out after %v", host, timeout)
+	}
+}
+
+func elapsed(start time.Time) time.Duration {
+	return time.Since(start) / time.Millisecond * time.Millisecond
+}
+
+// negotiateSMB sends an SMB2 NEGOTIATE request offering negotiateDialects
+// over conn and returns the dialect chosen by the server, e.g. "3.0".
+func negotiateSMB(conn net.Conn) (string, error) {
+	var msg bytes.Buffer
+	// SMB2 header
+	msg.Write([]byte{0xfe, 'S', 'M', 'B'})
+	binary.Write(&msg, binary.LittleEndian, uint16(64)) // structure size
+	msg.Write(make([]byte, 2+4))                        // credit charge, status
+	binary.Write(&msg, binary.LittleEndian, uint16(0))  // command: NEGOTIATE
+	binary.Write(&msg, binary.LittleEndian, uint16(1))  // credits requested
+	msg.Write(make([]byte, 4+4+8+4+4+8+16))             // flags to signature
+	// NEGOTIATE request
+	binary.Write(&msg, binary.LittleEndian, uint16(36)) // structure size
+	binary.Write(&msg, binary.LittleEndian, uint16(len(negotiateDialects)))
+	binary.Write(&msg, binary.LittleEndian, uint16(1)) // security mode: signing enabled
+	msg.Write(make([]byte, 2+4+16+8))                  // reserved, capabilities, client GUID, start time
+	for _, d := range negotiateDialects {
+		binary.Write(&msg, binary.LittleEndian, d)
+	}
+
+	// direct TCP transport header: zero and the 24-bit message length
+	frame := make([]byte, 4, 4+msg.Len())
+	binary.BigEndian.PutUint32(frame, uint32(msg.Len()))
+	if _, err := conn.Write(append(frame, msg.Bytes()...)); err != nil {
+		return "", err
+	}
+
+	if _, err := io.ReadFull(conn, frame[:4]); err != nil {
+		return "", fmt.Errorf("no response: %v", err)
+	}
+	n := binary.BigEndian.Uint32(frame[:4]) & 0xffffff
+	if frame[0] != 0 || n < 64+8 || n > 1<<16 {
+		return "", fmt.Errorf("unexpected response")
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return "", fmt.Errorf("truncated response: %v", err)
+	}
+	if !bytes.Equal(resp[:4], []byte{0xfe, 'S', 'M', 'B'}) {
+		return "", fmt.Errorf("response is not an SMB2 message")
+	}
+	if status := binary.LittleEndian.Uint32(resp[8:]); status != 0 {
+		return "", fmt.Errorf("negotiation failed with status 0x%08x", status)
+	}
+	switch d := binary.LittleEndian.Uint16(resp[64+4:]); d {
+	case 0x0210:
+		return "2.1", nil
+	case 0x0300:
+		return "3.0", nil
+	case 0x0302:
+		return "3.0.2", nil
+	default:
+		return "", fmt.Errorf("server chose unexpected dialect 0x%04x", d)
+	}
+}
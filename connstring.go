@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// connectionString holds the settings of an Azure Storage connection string
+// the driver uses.
+type connectionString struct {
+	AccountName    string
+	AccountKey     string
+	EndpointSuffix string // storage base, e.g. core.windows.net
+	FileEndpoint   string
+	DevStorage     bool // UseDevelopmentStorage=true, i.e. the emulator
+}
+
+// parseConnectionString parses a connection string of the form
+// "DefaultEndpointsProtocol=https;AccountName=<name>;AccountKey=<key>;EndpointSuffix=core.windows.net"
+// as given by the Azure portal and CLI. Setting names are case-insensitive.
+func parseConnectionString(s string) (connectionString, error) {
+	var cs connectionString
+	for _, kv := range strings.Split(s, ";") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			return cs, fmt.Errorf("malformed connection string setting %q, expected <name>=<value>", kv)
+		}
+		k, v := strings.ToLower(strings.TrimSpace(p[0])), strings.TrimSpace(p[1])
+		switch k {
+		case "accountname":
+			cs.AccountName = v
+		case "accountkey":
+			cs.AccountKey = v
+		case "endpointsuffix":
+			cs.EndpointSuffix = v
+		case "fileendpoint":
+			cs.FileEndpoint = v
+		case "usedevelopmentstorage":
+			cs.DevStorage = strings.EqualFold(v, "true")
+		case "defaultendpointsprotocol", "blobendpoint", "queueendpoint", "tableendpoint":
+			// the file endpoint is always reached over https
+		case "sharedaccesssignature":
+			return cs, fmt.Errorf("connection strings with a shared access signature are not supported, the account key is needed for SMB mounts")
+		default:
+			return cs, fmt.Errorf("unknown connection string setting %q", p[0])
+		}
+	}
+	if cs.DevStorage {
+		return cs, nil
+	}
+	if cs.AccountName == "" || cs.AccountKey == "" {
+		return cs, fmt.Errorf("connection string must have AccountName and AccountKey")
+	}
+	return cs, nil
+}
+
+// fileEndpoint returns the storage base derived from FileEndpoint if it is
+// the standard https://<account>.file.<base> endpoint, or the endpoint as a
+// custom storage endpoint (see --storage-endpoint) otherwise.
+func (cs connectionString) fileEndpoint() (storageBase, endpoint string, err error) {
+	u, err := url.Parse(cs.FileEndpoint)
+	if err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("invalid FileEndpoint %q in connection string", cs.FileEndpoint)
+	}
+	prefix := strings.ToLower(cs.AccountName) + ".file."
+	if u.Scheme == "https" && strings.HasPrefix(strings.ToLower(u.Host), prefix) && strings.Trim(u.Path, "/") == "" {
+		return u.Host[len(prefix):], "", nil
+	}
+	// path-style endpoints, e.g. of emulators, include the account name
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/"+cs.AccountName)
+	return "", u.String(), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConnectionString(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    connectionString
+		wantErr bool
+	}{
+		{
+			in:   "DefaultEndpointsProtocol=https;AccountName=acct;AccountKey=a2V5==;EndpointSuffix=core.windows.net",
+			want: connectionString{AccountName: "acct", AccountKey: "a2V5==", EndpointSuffix: "core.windows.net"},
+		},
+		{
+			in:   "accountname=acct; ACCOUNTKEY=a2V5==;",
+			want: connectionString{AccountName: "acct", AccountKey: "a2V5=="},
+		},
+		{
+			in:   "AccountName=acct;AccountKey=a2V5==;FileEndpoint=https://acct.file.core.chinacloudapi.cn/",
+			want: connectionString{AccountName: "acct", AccountKey: "a2V5==", FileEndpoint: "https://acct.file.core.chinacloudapi.cn/"},
+		},
+		{
+			in:   "UseDevelopmentStorage=true",
+			want: connectionString{DevStorage: true},
+		},
+		{in: "AccountName=acct", wantErr: true},
+		{in: "AccountName=acct;AccountKey", wantErr: true},
+		{in: "AccountName=acct;AccountKey=a2V5==;SharedAccessSignature=sv=x&sig=y", wantErr: true},
+		{in: "AccountName=acct;AccountKey=a2V5==;Unknown=x", wantErr: true},
+	} {
+		got, err := parseConnectionString(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseConnectionString(%q) = %+v, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseConnectionString(%q) failed: %v", tc.in, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseConnectionString(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestConnectionStringFileEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		cs                    connectionString
+		storageBase, endpoint string
+	}{
+		{connectionString{AccountName: "acct", FileEndpoint: "https://acct.file.core.windows.net/"}, "core.windows.net", ""},
+		{connectionString{AccountName: "acct", FileEndpoint: "https://ACCT.file.core.windows.net"}, "core.windows.net", ""},
+		{connectionString{AccountName: "devstoreaccount1", FileEndpoint: "http://127.0.0.1:8080/devstoreaccount1"}, "", "http://127.0.0.1:8080"},
+		{connectionString{AccountName: "acct", FileEndpoint: "https://files.example.com/acct/"}, "", "https://files.example.com"},
+	} {
+		base, endpoint, err := tc.cs.fileEndpoint()
+		if err != nil {
+			t.Errorf("fileEndpoint of %q failed: %v", tc.cs.FileEndpoint, err)
+		} else if base != tc.storageBase || endpoint != tc.endpoint {
+			t.Errorf("fileEndpoint of %q = %q, %q, want %q, %q", tc.cs.FileEndpoint, base, endpoint, tc.storageBase, tc.endpoint)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+const (
+	// copyTimeout bounds how long a tree copy takes, from listing the
+	// source to the completion of the pending server-side copies. The source
+	// share is only readable through the SAS of the copy until then.
+	copyTimeout = 6 * time.Hour
+)
+
+// treeCopy is a server-side copy of a directory tree from a share (or one of
+// its snapshots) into a share, possibly on another storage account.
+type treeCopy struct {
+	src         *fileClient
+	srcShare    string
+	srcSnapshot string // empty to copy from the live share
+	dst         *fileClient
+	dstShare    string
+
+	sas      string    // read-only on the source share, until deadline
+	deadline time.Time // of the whole copy
+	pending  []string  // destination paths of copies still in progress
+	Files    int
+	Bytes    int64
+}
+
+func newTreeCopy(src *fileClient, srcShare, srcSnapshot string, dst *fileClient, dstShare string) *treeCopy {
+	deadline := time.Now().Add(copyTimeout)
+	return &treeCopy{
+		src:         src,
+		srcShare:    srcShare,
+		srcSnapshot: srcSnapshot,
+		dst:         dst,
+		dstShare:    dstShare,
+		sas:         src.shareSAS(srcShare, sasRead, deadline),
+		deadline:    deadline,
+	}
+}
+
+// run copies everything under srcDir into dstDir (empty for the root
+// directory) and waits for the copies to complete.
+func (c *treeCopy) run(srcDir, dstDir string) error {
+	if err := c.copyDir(srcDir, dstDir); err != nil {
+		return err
+	}
+	return c.wait()
+}
+
+// copyDir recursively starts copies of everything under srcDir into dstDir.
+func (c *treeCopy) copyDir(srcDir, dstDir string) error {
+	entries, err := c.src.listDirectory(c.srcShare, c.srcSnapshot, srcDir)
+	if err != nil {
+		return fmt.Errorf("cannot list %q: %v", srcDir, err)
+	}
+	for _, e := range entries {
+		srcPath := path.Join(srcDir, e.Name)
+		dstPath := path.Join(dstDir, e.Name)
+		if e.IsDir {
+			if err := c.dst.createDirectory(c.dstShare, dstPath); err != nil {
+				return fmt.Errorf("error creating directory %q: %v", dstPath, err)
+			}
+			if err := c.copyDir(srcPath, dstPath); err != nil {
+				return err
+			}
+			continue
+		}
+		srcURL := c.src.fileURL(c.srcShare+"/"+srcPath, nil)
+		q := srcURL.Query()
+		if c.srcSnapshot != "" {
+			q.Set("sharesnapshot", c.srcSnapshot)
+		}
+		srcURL.RawQuery = q.Encode()
+		if srcURL.RawQuery != "" {
+			srcURL.RawQuery += "&"
+		}
+		srcURL.RawQuery += c.sas
+		status, err := c.dst.copyFile(c.dstShare, dstPath, srcURL.String())
+		if err != nil {
+			return fmt.Errorf("error copying %q: %v", srcPath, err)
+		}
+		if status == "pending" {
+			c.pending = append(c.pending, dstPath)
+		}
+		c.Files++
+		c.Bytes += e.Size
+	}
+	return nil
+}
+
+// wait blocks until all pending copies complete, or one of them fails.
+func (c *treeCopy) wait() error {
+	for _, p := range c.pending {
+		for {
+			status, desc, err := c.dst.copyStatus(c.dstShare, p)
+			if err != nil {
+				return fmt.Errorf("cannot get copy status of %q: %v", p, err)
+			}
+			if status == "success" {
+				break
+			} else if status != "pending" {
+				return fmt.Errorf("copy of %q did not succeed: %s %s", p, status, desc)
+			} else if time.Now().After(c.deadline) {
+				return fmt.Errorf("timed out waiting for copy of %q", p)
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	c.pending = nil
+	return nil
+}
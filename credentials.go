@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+const (
+	// keyFilePollInterval is how often the credential files are checked for
+	// changes.
+	keyFilePollInterval = 30 * time.Second
+
+	// rotateKeyTimeout bounds the storage API request checking a new account
+	// key before it is swapped in.
+	rotateKeyTimeout = 30 * time.Second
+
+	// Names of the Swarm secrets looked up in the secrets directory when the
+	// account name or key is not provided otherwise.
+	accountNameSecret = "azure_storage_account"
+	accountKeySecret  = "azure_storage_account_key"
+)
+
+// readSecret reads a credential stored in the file at path (e.g. a Docker
+// secret), ignoring surrounding whitespace.
+func readSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read credential file: %v", err)
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "" {
+		return "", fmt.Errorf("credential file %s is empty", path)
+	}
+	return v, nil
+}
+
+// commandAccount is the storage account given to the driver, for the
+// commands talking to the account without starting the driver.
+type commandAccount struct {
+	name, key, storageBase string
+	endpoint               *url.URL // see parseStorageEndpoint
+	emulator               bool
+}
+
+// accountFromFlags returns the account given to the driver by flag,
+// credential file, Swarm secret or connection string. The key is empty if
+// none is given. The storage endpoint is the one of the emulator or of
+// --storage-endpoint, as for the driver.
+func accountFromFlags(c *cli.Context) (commandAccount, error) {
+	name, key, storageBase := c.GlobalString("account-name"), c.GlobalString("account-key"), c.GlobalString("storage-base")
+	emulator, endpoint := c.GlobalBool("emulator"), c.GlobalString("storage-endpoint")
+	var u *url.URL
+	var err error
+	if s := c.GlobalString("connection-string"); s != "" {
+		cs, err := parseConnectionString(s)
+		if err != nil {
+			return commandAccount{}, err
+		}
+		name, key, emulator = cs.AccountName, cs.AccountKey, emulator || cs.DevStorage
+		if cs.EndpointSuffix != "" {
+			storageBase = cs.EndpointSuffix
+		}
+		if cs.FileEndpoint != "" {
+			suffix, e, err := cs.fileEndpoint()
+			if err != nil {
+				return commandAccount{}, err
+			}
+			storageBase = suffix
+			if e != "" && endpoint == "" {
+				endpoint = e
+			}
+		}
+	}
+	if emulator && endpoint == "" {
+		return commandAccount{}, errNoEmulatorEndpoint
+	}
+	if endpoint != "" {
+		if u, err = parseStorageEndpoint(endpoint); err != nil {
+			return commandAccount{}, err
+		}
+	}
+	secretsDir := c.GlobalString("secrets-dir")
+	for _, cred := range []struct {
+		value        *string
+		file, secret string
+		emulator     string
+	}{
+		{&name, c.GlobalString("account-name-file"), accountNameSecret, emulatorAccountName},
+		{&key, c.GlobalString("account-key-file"), accountKeySecret, emulatorAccountKey},
+	} {
+		if *cred.value != "" {
+			continue
+		}
+		file := cred.file
+		if file == "" && emulator {
+			*cred.value = cred.emulator
+			continue
+		} else if file == "" {
+			file = swarmSecret(secretsDir, cred.secret)
+		}
+		if file != "" {
+			if *cred.value, err = readSecret(file); err != nil {
+				return commandAccount{}, err
+			}
+		}
+	}
+	if name == "" {
+		return commandAccount{}, fmt.Errorf("azure storage account name must be provided")
+	}
+	registerSecret(key)
+	return commandAccount{name, key, storageBase, u, emulator}, nil
+}
+
+// swarmSecret returns the path of the named secret in secretsDir if it
+// exists, or an empty string otherwise.
+func swarmSecret(secretsDir, name string) string {
+	if secretsDir == "" {
+		return ""
+	}
+	p := filepath.Join(secretsDir, name)
+	if _, err := os.Stat(p); err != nil {
+		return ""
+	}
+	return p
+}
+
+// setCredentials replaces the storage account name and key used for
+// subsequent API calls and mounts. Caller must hold the driver lock.
+func (v *volumeDriver) setCredentials(accountName, accountKey string) error {
+	files, err := v.clients.get(accountName, accountKey, v.storageBase, v.endpoint)
+	if err != nil {
+		return fmt.Errorf("error creating azure client: %v", err)
+	}
+	v.files = files
+	v.accountName = accountName
+	v.accountKey = accountKey
+	return nil
+}
+
+// watchCredentials periodically re-reads the account key file (an empty path
+// means the key is not read from a file) and starts using the new key when it
+// changes, e.g. after a Swarm secret rotation. Volumes already mounted keep
+// using the key they were mounted with. A key swapped in with rotate-key is
+// kept until the key file changes.
+//
+// The account name is only read at startup: the name and key files are not
+// updated together, so swapping the name in would pair it with the key of
+// the other account for a while. A change of the name file is only reported.
+func (v *volumeDriver) watchCredentials(nameFile, keyFile string) {
+	v.m.Lock()
+	lastName, lastKey := v.accountName, v.accountKey
+	v.m.Unlock()
+	for range time.Tick(keyFilePollInterval) {
+		if nameFile != "" {
+			if name, err := readSecret(nameFile); err != nil {
+				log.Errorf("cannot reload account name: %v", err)
+			} else if name != lastName {
+				log.Warnf("account name changed from %q to %q, restart the driver to use the new account", lastName, name)
+				lastName = name
+			}
+		}
+		if keyFile == "" {
+			continue
+		}
+		key, err := readSecret(keyFile)
+		if err != nil {
+			log.Errorf("cannot reload account key: %v", err)
+			continue
+		}
+		registerSecret(key)
+		if key == lastKey {
+			continue
+		}
+		lastKey = key
+
+		v.m.Lock()
+		if key != v.accountKey {
+			if err := v.setCredentials(v.accountName, key); err != nil {
+				log.Errorf("cannot reload credentials: %v", err)
+			} else {
+				log.Info("account key changed, using the new key")
+			}
+		}
+		v.m.Unlock()
+	}
+}
+
+// rotateKeyRequest is the body of a rotate-key admin request.
+type rotateKeyRequest struct {
+	Key     string `json:"key"`
+	Remount bool   `json:"remount"`
+}
+
+// rotateKeyResult is the response to a rotate-key admin request, listing the
+// outcome of remounting each volume mounted on the host.
+type rotateKeyResult struct {
+	Remounted []volumeResult `json:"remounted,omitempty"`
+}
+
+// handleRotateKey swaps in the account key given in the request body (a
+// rotateKeyRequest), so that the key can be regenerated without restarting
+// the driver. The key is in the body rather than the URL to keep it out of
+// access logs.
+func (v *volumeDriver) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req rotateKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("cannot parse request: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.Key = strings.TrimSpace(req.Key)
+	if req.Key == "" {
+		http.Error(w, "missing account key", http.StatusBadRequest)
+		return
+	}
+	registerSecret(req.Key)
+	results, err := v.rotateKey(req.Key, req.Remount)
+	if err != nil {
+		writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	code := http.StatusOK
+	for _, res := range results {
+		if res.Error != "" {
+			code = http.StatusMultiStatus
+			break
+		}
+	}
+	writeJSON(w, code, rotateKeyResult{Remounted: results})
+}
+
+// rotateKey checks that the account accepts key and uses it for subsequent
+// API calls and mounts. With remount, the volumes mounted on the host are
+// unmounted and mounted again with the new key, as the kernel keeps using the
+// key a share was mounted with when it reconnects; volumes in use by
+// containers are left alone (see remount).
+func (v *volumeDriver) rotateKey(key string, remount bool) ([]volumeResult, error) {
+	logctx := log.WithField("operation", "rotate-key")
+
+	v.m.Lock()
+	accountName := v.accountName
+	v.m.Unlock()
+	files, err := v.clients.create(accountName, key, v.storageBase, v.endpoint)
+	if err != nil {
+		return nil, newError(codeInvalidOptions, "invalid account key: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rotateKeyTimeout)
+	defer cancel()
+	if _, err := files.withContext(ctx).listShares(v.sharePrefix); err != nil {
+		return nil, wrapError(err, codeStorageAPI, "the account did not accept the new key: %v", err)
+	}
+
+	v.m.Lock()
+	if err := v.setCredentials(accountName, key); err != nil {
+		v.m.Unlock()
+		return nil, newError(codeInternal, "%v", err)
+	}
+	logctx.Info("account key rotated, using the new key")
+	if err := rewriteCIFSCreds(accountName, key); err != nil {
+		logctx.Errorf("cannot update multiuser credentials with the new key: %v", err)
+	}
+	if !remount {
+		v.m.Unlock()
+		return nil, nil
+	}
+	mounted := true
+	vols, err := v.listVolumesLocked(volumeFilter{mounted: &mounted})
+	v.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	results := []volumeResult{}
+	for _, vol := range vols {
+		res := volumeResult{Name: vol.Name}
+		if status, err := v.remount(vol.Name); err != nil {
+			logctx.WithField("name", vol.Name).Errorf("cannot remount volume with the new key: %v", err)
+			res.Error = err.Error()
+		} else {
+			res.Status = status
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Outcomes of remounting a volume after rotating the key.
+const (
+	remountDone  = "remounted"
+	remountInUse = "in use, still using the old key until its containers restart"
+	remountNFS   = "not mounted with the key"
+)
+
+// remount unmounts the volume and mounts it again with the current
+// credentials, and returns the outcome. Volumes with mount records on the
+// host are left alone: the bind mounts of their containers keep the session
+// of the old mount, so remounting would not switch them to the new key. NFS
+// volumes, which are not mounted with the key, are left alone too. The
+// driver lock is taken as Mount and Unmount do, and released while unmounting
+// with the volume marked busy.
+func (v *volumeDriver) remount(name string) (string, error) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	if err := v.checkBusy(name); err != nil {
+		return "", err
+	}
+	meta, err := v.meta.Get(name)
+	if err != nil {
+		return "", err
+	}
+	if meta.Options.Protocol == protocolNFS {
+		return remountNFS, nil
+	}
+	for _, m := range meta.Mounts {
+		if m.Host == v.hostname {
+			return remountInUse, nil
+		}
+	}
+	ctx, cancel := v.operationContext("mount")
+	defer cancel()
+	path := v.pathForVolume(name)
+	v.setBusy(name, "being remounted")
+	v.m.Unlock()
+	start := time.Now()
+	err = unmount(ctx, path)
+	observeMount("unmount", start, err)
+	v.m.Lock()
+	v.clearBusy(name)
+	if err != nil {
+		return "", wrapError(err, codeMountBusy, "cannot unmount, the volume keeps the old key until it is no longer used: %v", err)
+	}
+	start = time.Now()
+	_, err = v.mount(ctx, path, v.mountOptions(meta.Options), meta.SMBVersion)
+	observeMount("mount", start, err)
+	if err != nil {
+		return "", wrapError(err, codeMountFailed, "unmounted but cannot mount again: %v", err)
+	}
+	return remountDone, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// volumeDefinitions returns the definitions of the volumes of the driver in
+// the format of /volumes/batch, so that applying them on another host
+// recreates the same volumes on the same shares.
+func (v *volumeDriver) volumeDefinitions() ([]volumeDefinition, error) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	names, err := v.meta.List()
+	if err != nil {
+		return nil, newError(codeInternal, "failed to list managed volumes: %v", err)
+	}
+	defs := []volumeDefinition{}
+	for _, name := range names {
+		meta, err := v.meta.Get(name)
+		if err != nil {
+			log.WithField("name", name).Warnf("volume left out of the definitions: %v", err)
+			continue
+		}
+		if v.checkNamespace(meta) != nil {
+			continue
+		}
+		defs = append(defs, volumeDefinition{
+			Name:    name,
+			Options: volumeOptionsMap(meta.Options, v.sharePrefix),
+		})
+	}
+	return defs, nil
+}
+
+// volumeOptionsMap returns the volume options that Validate parses into
+// opts, with the share prefix of the driver removed from the share name as
+// create adds it back. Options only acting at creation (exists,
+// restore-from-snapshot, and seed, whose URL may carry a SAS token, with
+// seed-sha256) are left out: the share already exists and has its contents.
+func volumeOptionsMap(opts VolumeOptions, sharePrefix string) map[string]string {
+	m := map[string]string{"share": strings.TrimPrefix(opts.Share, sharePrefix)}
+	set := func(k, val string) {
+		if val != "" {
+			m[k] = val
+		}
+	}
+	setBool := func(k string, b bool) {
+		if b {
+			m[k] = "true"
+		}
+	}
+	setInt := func(k string, n int) {
+		if n != 0 {
+			m[k] = strconv.Itoa(n)
+		}
+	}
+	set("filemode", opts.FileMode)
+	set("dirmode", opts.DirMode)
+	set("uid", opts.UID)
+	set("gid", opts.GID)
+	set("remotepath", opts.RemotePath)
+	set("domain", opts.Domain)
+	set("protocol", opts.Protocol)
+	set("squash", opts.Squash)
+	set("transport", opts.Transport)
+	set("reclaim", opts.Reclaim)
+	set("tier", opts.AccessTier)
+	set("account", opts.Account)
+	set("extra-opts", strings.Join(opts.ExtraOpts, ","))
+	set("mkdirs", strings.Join(opts.Mkdirs, ","))
+	set("root-sddl", opts.RootSDDL)
+	set("mapchars", opts.MapChars)
+	setBool("nolock", opts.NoLock)
+	setBool("noperm", opts.NoPerm)
+	setBool("ro", opts.ReadOnly)
+	setBool("multichannel", opts.Multichannel)
+	setBool("multiuser", opts.Multiuser)
+	setBool("exclusive", opts.Exclusive)
+	setBool("protected", opts.Protected)
+	setBool("largeshare", opts.LargeShare)
+	setInt("rsize", opts.RSize)
+	setInt("wsize", opts.WSize)
+	setInt("maxchannels", opts.MaxChannels)
+	setInt("port", opts.Port)
+	setInt("quota", opts.Quota)
+	if len(opts.Labels) != 0 {
+		m["labels"] = joinLabels(opts.Labels)
+	}
+	if len(opts.Tags) != 0 {
+		m["tags"] = joinLabels(opts.Tags)
+	}
+	return m
+}
+
+// handleDefinitions serves the volume catalog of the driver:
+//
+//	GET  /volumes/definitions  dumps the definitions of all volumes
+//	POST /volumes/definitions  creates the volumes of such a dump, see
+//	                           handleBatchCreate
+func (v *volumeDriver) handleDefinitions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		defs, err := v.volumeDefinitions()
+		if err != nil {
+			writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, defs)
+	case "POST":
+		v.handleBatchCreate(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVolumeOptionsMapRoundTrip(t *testing.T) {
+	m := &metadataDriver{}
+	for _, opts := range []map[string]string{
+		{"share": "data"},
+		{"share": "data", "filemode": "0640", "dirmode": "0750", "uid": "1000", "gid": "1000", "nolock": "true", "ro": "true"},
+		{"share": "data", "remotepath": "sub/dir", "domain": "corp", "noperm": "true", "mapchars": "sfu"},
+		{"share": "data", "protocol": "nfs", "squash": "root"},
+		{"share": "data", "multichannel": "true", "maxchannels": "4", "rsize": "65536", "wsize": "65536", "port": "443"},
+		{"share": "data", "extra-opts": "cache=none,actimeo=30", "mkdirs": "a,b/c", "quota": "100"},
+		{"share": "data", "reclaim": "retain", "protected": "true", "exclusive": "true", "multiuser": "true"},
+		{"share": "data", "labels": "app=web,tier=front", "tags": "owner=ops,env=prod"},
+		{"share": "data", "labels": `note=a\,b,path=C:\dir,eq=x\=y,k\=1=v,end=\\`},
+	} {
+		first, err := m.Validate(opts)
+		if err != nil {
+			t.Errorf("Validate(%v) failed: %v", opts, err)
+			continue
+		}
+		dumped := volumeOptionsMap(first.Options, "")
+		second, err := m.Validate(dumped)
+		if err != nil {
+			t.Errorf("Validate of the dump %v of %v failed: %v", dumped, opts, err)
+			continue
+		}
+		if !reflect.DeepEqual(first.Options, second.Options) {
+			t.Errorf("options %v dumped as %v: got %+v, want %+v", opts, dumped, second.Options, first.Options)
+		}
+	}
+}
+
+func TestVolumeOptionsMapSharePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		share, prefix, want string
+	}{
+		{"data", "", "data"},
+		{"team-data", "team-", "data"},
+		{"data", "team-", "data"},
+	} {
+		if got := volumeOptionsMap(VolumeOptions{Share: tc.share}, tc.prefix)["share"]; got != tc.want {
+			t.Errorf("share %q with prefix %q dumped as %q, want %q", tc.share, tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{in: "app=web,tier=front", want: map[string]string{"app": "web", "tier": "front"}},
+		{in: "expr=a=b", want: map[string]string{"expr": "a=b"}},
+		{in: "empty=", want: map[string]string{"empty": ""}},
+		{in: `note=a\,b`, want: map[string]string{"note": "a,b"}},
+		{in: `k\=1=v`, want: map[string]string{"k=1": "v"}},
+		{in: `path=C:\dir`, want: map[string]string{"path": `C:\dir`}},
+		{in: `end=x\\,next=y`, want: map[string]string{"end": `x\`, "next": "y"}},
+		{in: "note=a,b", wantErr: true},
+		{in: "=v", wantErr: true},
+		{in: "app=web,", wantErr: true},
+	} {
+		got, err := parseLabels(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseLabels(%q) = %v, want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLabels(%q) failed: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseLabels(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+		if again, err := parseLabels(joinLabels(got)); err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("labels %v joined as %q parsed back as %v, %v", got, joinLabels(got), again, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// doctorCredentialTimeout bounds the storage API request checking the
+// credentials.
+const doctorCredentialTimeout = 30 * time.Second
+
+var cifsUtilsVersionRe = regexp.MustCompile(`version:?\s*(\S+)`)
+
+// doctorCheck is a check of the host run by the doctor command. It returns
+// what it found, and on failure how to fix it.
+type doctorCheck struct {
+	name string
+	run  func() (ok bool, detail, hint string)
+}
+
+// doctorCommand checks that the host has what the driver needs to mount
+// volumes, for setting up new hosts and support requests.
+var doctorCommand = cli.Command{
+	Name:  "doctor",
+	Usage: "Check the host for the kernel support, tools, directories and credentials the driver needs",
+	Action: func(c *cli.Context) {
+		if !runDoctor(os.Stdout, doctorChecks(c)) {
+			os.Exit(1)
+		}
+	},
+}
+
+// runDoctor runs the checks, printing their outcome and the remediation hints
+// of those failing to w. It returns true if all the checks passed.
+func runDoctor(w io.Writer, checks []doctorCheck) bool {
+	passed := true
+	for _, ch := range checks {
+		ok, detail, hint := ch.run()
+		status := "PASS"
+		if !ok {
+			status, passed = "FAIL", false
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, ch.name, detail)
+		if !ok && hint != "" {
+			fmt.Fprintf(w, "       %s\n", hint)
+		}
+	}
+	return passed
+}
+
+func doctorChecks(c *cli.Context) []doctorCheck {
+	return []doctorCheck{
+		{"kernel cifs module", checkCIFSModule},
+		{"cifs-utils", checkCIFSUtils},
+		{"keyutils", checkKeyutils},
+		{"mountpoint", func() (bool, string, string) { return checkMountpointDir(c.GlobalString("mountpoint")) }},
+		{"metadata root", func() (bool, string, string) { return checkMetadataDir(c.GlobalString("metadata")) }},
+		{"credentials", func() (bool, string, string) { return checkCredentials(c) }},
+	}
+}
+
+func checkCIFSModule() (bool, string, string) {
+	if b, err := ioutil.ReadFile("/proc/filesystems"); err == nil {
+		for _, l := range strings.Split(string(b), "\n") {
+			if strings.TrimSpace(strings.TrimPrefix(l, "nodev")) == "cifs" {
+				return true, "loaded", ""
+			}
+		}
+	}
+	if err := exec.Command("modprobe", "-n", "-q", "cifs").Run(); err == nil {
+		return true, "available, loaded on the first mount", ""
+	}
+	return false, "not available in the running kernel",
+		"install the kernel modules of the running kernel (e.g. linux-modules-extra-$(uname -r) on Ubuntu) and run 'modprobe cifs'"
+}
+
+func checkCIFSUtils() (bool, string, string) {
+	path, err := exec.LookPath("mount.cifs")
+	if err != nil {
+		return false, "mount.cifs not found", "install cifs-utils, e.g. 'apt-get install -y cifs-utils' or 'yum install -y cifs-utils'"
+	}
+	out, err := exec.Command(path, "-V").CombinedOutput()
+	if m := cifsUtilsVersionRe.FindSubmatch(out); err == nil && m != nil {
+		return true, fmt.Sprintf("%s version %s", path, m[1]), ""
+	}
+	return true, path, ""
+}
+
+func checkKeyutils() (bool, string, string) {
+	hint := "install keyutils (e.g. 'apt-get install -y keyutils'), which cifs.upcall needs to resolve names and for Kerberos"
+	path, err := exec.LookPath("request-key")
+	if err != nil {
+		for _, p := range []string{"/sbin/request-key", "/usr/sbin/request-key"} {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+			}
+		}
+	}
+	if path == "" {
+		return false, "request-key not found", hint
+	}
+	if _, err := os.Stat("/etc/request-key.conf"); err != nil {
+		return false, "/etc/request-key.conf is missing", hint
+	}
+	return true, path, ""
+}
+
+// checkMountpointDir checks that the driver can mount volumes under dir: it
+// must run as root, and the directory must not be writable by other users,
+// who could otherwise replace mountpoints.
+func checkMountpointDir(dir string) (bool, string, string) {
+	if os.Geteuid() != 0 {
+		return false, "not running as root", "run the driver (and doctor) as root, mounting requires it"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err.Error(), "check that the parent directories of --mountpoint exist and are writable by root"
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return false, err.Error(), ""
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		return false, fmt.Sprintf("%s is writable by other users (%v)", dir, fi.Mode().Perm()),
+			fmt.Sprintf("run 'chmod go-w %s'", dir)
+	}
+	return true, fmt.Sprintf("%s (%v)", dir, fi.Mode().Perm()), ""
+}
+
+func checkMetadataDir(dir string) (bool, string, string) {
+	hint := "check the permissions of --metadata and that its file system is not mounted read-only"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err.Error(), hint
+	}
+	f, err := ioutil.TempFile(dir, ".doctor-")
+	if err != nil {
+		return false, fmt.Sprintf("%s is not writable: %v", dir, err), hint
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true, dir + " is writable", ""
+}
+
+// checkCredentials checks the account name and key by listing the shares of
+// the account.
+func checkCredentials(c *cli.Context) (bool, string, string) {
+	a, err := accountFromFlags(c)
+	if err != nil {
+		return false, err.Error(), "give the account with --account-name and --account-key or --connection-string"
+	} else if a.key == "" {
+		return false, "no account key", "give the account key with --account-key, --account-key-file or --connection-string"
+	}
+	name := a.name
+	files, err := newFileClient(a.name, a.key, a.storageBase, a.endpoint)
+	if err != nil {
+		return false, err.Error(), ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorCredentialTimeout)
+	defer cancel()
+	shares, err := files.withContext(ctx).listShares(c.GlobalString("share-prefix"))
+	if err != nil {
+		switch classify(err, codeStorageAPI) {
+		case codeAuthFailed:
+			return false, fmt.Sprintf("account %q rejected the key", name), "check the account key, it may have been rotated"
+		case codeNameResolution, codeNetwork, codeTimeout, codeUnreachable:
+			return false, err.Error(), "the storage API cannot be reached, run 'check-connectivity' and check the proxy and firewall settings"
+		}
+		return false, err.Error(), ""
+	}
+	return true, fmt.Sprintf("account %q, %d share(s) found", name, len(shares)), ""
+}
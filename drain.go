@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// drainStatus reports the progress of draining the host.
+type drainStatus struct {
+	Draining bool     `json:"draining"`
+	Drained  bool     `json:"drained"` // draining and no volume is mounted anymore
+	Mounted  []string `json:"mounted"`
+}
+
+// setDraining enables or disables drain mode, in which new mounts are
+// refused while unmounts are still served. Volumes kept mounted after their
+// last unmount (see keepMount) are unmounted when it is enabled.
+func (v *volumeDriver) setDraining(draining bool) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	if v.draining == draining {
+		return
+	}
+	v.draining = draining
+	if draining {
+		log.Warn("drain mode enabled, refusing new mounts")
+		for name, t := range v.kept {
+			t.Stop()
+			delete(v.kept, name)
+			if err := v.unmountAll(name); err != nil {
+				log.WithField("name", name).Errorf("cannot unmount volume kept mounted: %v", err)
+			}
+		}
+	} else {
+		log.Warn("drain mode disabled")
+	}
+}
+
+// drainStatus returns whether the driver is draining and the volumes still
+// mounted on the host.
+func (v *volumeDriver) drainStatus() (drainStatus, error) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	mounted := true
+	vols, err := v.listVolumesLocked(volumeFilter{mounted: &mounted})
+	if err != nil {
+		return drainStatus{}, err
+	}
+	st := drainStatus{Draining: v.draining, Mounted: []string{}}
+	for _, vol := range vols {
+		st.Mounted = append(st.Mounted, vol.Name)
+	}
+	st.Drained = st.Draining && len(st.Mounted) == 0
+	return st, nil
+}
+
+// handleDrain reports the drain status on GET, enables drain mode on PUT or
+// POST and disables it on DELETE.
+func (v *volumeDriver) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		v.setDraining(true)
+	case "DELETE":
+		v.setDraining(false)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := v.drainStatus()
+	if err != nil {
+		writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
@@ -1,48 +1,138 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/cipher"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
-	azure "github.com/Azure/azure-sdk-for-go/storage"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
+// Policies for mountpoints that contain files before the share is mounted.
+const (
+	nonEmptyWarn   = "warn"
+	nonEmptyRefuse = "refuse"
+	nonEmptyMove   = "move"
+)
+
+// Policies for volumes created on a share that backs another volume.
+const (
+	sharedAllow    = "allow"
+	sharedReject   = "reject"
+	sharedReadOnly = "allow-readonly" // only if the new volume is read-only
+)
+
+const (
+	// Backoff between mount attempts failing due to name resolution errors.
+	mountRetryInitialBackoff = time.Second
+	mountRetryMaxBackoff     = 30 * time.Second
+)
+
+var (
+	// shareNameRe matches valid Azure File share names (length is checked
+	// separately).
+	shareNameRe = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+	// sharePrefixRe matches prefixes that still produce valid share names
+	// when prepended to one.
+	sharePrefixRe = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*-?$`)
+)
+
 type volumeDriver struct {
-	m            sync.Mutex
-	cl           azure.FileServiceClient
-	meta         *metadataDriver
-	accountName  string
-	accountKey   string
-	storageBase  string
-	mountpoint   string
-	removeShares bool
+	m             sync.Mutex
+	clients       *clientCache             // of all the accounts, see loadAccounts
+	timeouts      map[string]time.Duration // bound the requests by operation, see operationContext
+	tracer        *otlpTracer              // nil if tracing is disabled, see --otlp-endpoint
+	metricLabels  []string                 // volume labels added to the volume metrics, see setMetricLabels
+	files         *fileClient
+	backup        *fileClient
+	meta          *metadataDriver
+	accountName   string
+	accountKey    string
+	storageBase   string
+	endpoint      *url.URL // File service endpoint, see parseStorageEndpoint
+	mountpoint    string
+	sharePrefix   string
+	removeShares  bool
+	removeMounted bool
+	hostname      string                   // recorded with the mounts of volumes
+	leases        map[string]chan struct{} // leases held on the shares of exclusive volumes, see acquireLease
+	draining      bool                     // refuse new mounts, see setDraining
+	keepMounted   time.Duration            // how long volumes stay mounted after the last unmount
+	kept          map[string]*time.Timer   // volumes kept mounted, see keepMount
+	busy          map[string]string        // operations running without the lock, see setBusy
+	seeds         seedPolicy               // where seed archives are read from, and their limits
+	snapshots     *snapshotCache           // snapshots reported in the status of volumes
+	selinuxLabel  string                   // SELinux context of the mounts, if set
+	smbPort       int                      // SMB port of volumes not setting one, zero for 445
+	restFallback  bool                     // mount through the REST API when SMB is unreachable
+	restHelper    string                   // FUSE file system of the 'rest' transport, see mountREST
+	domain        string
+	smbMinVers    string
+	dnsRetries    int
+	resolveIP     bool
+	nonEmpty      string
+	sharedShares  string
+	localShares   string // if set, shares are bind-mounted from here, see mountLocal
+	policy        *policy
+	stats         *statsCollector
+	monitor       *monitorCollector
+	transfers     *transferManager
+	accounts      map[string]*storageAccount // named accounts of the --accounts file
+	allowAccounts []string                   // named accounts volumes may use, empty for all
+	localAccount  string                     // named account new volumes default to, see --regional-accounts
+	delSnapshots  bool                       // delete the snapshots of the shares it deletes
+	backupRetain  int                        // backup generations kept per volume, zero for all
 }
 
-func newVolumeDriver(accountName, accountKey, storageBase, mountpoint, metadataRoot string, removeShares bool) (*volumeDriver, error) {
-	storageClient, err := azure.NewClient(accountName, accountKey, storageBase, azure.DefaultAPIVersion, true)
+func newVolumeDriver(clients *clientCache, accountName, accountKey, storageBase string, endpoint *url.URL, mountpoint, metadataRoot string, metadataKey cipher.AEAD, sharePrefix string, removeShares bool) (*volumeDriver, error) {
+	if sharePrefix != "" && !sharePrefixRe.MatchString(sharePrefix) {
+		return nil, fmt.Errorf("invalid share prefix %q: only lowercase letters, numbers and non-consecutive hyphens are allowed", sharePrefix)
+	}
+	files, err := clients.get(accountName, accountKey, storageBase, endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("error creating azure client: %v", err)
 	}
-	metaDriver, err := newMetadataDriver(metadataRoot)
+	metaDriver, err := newMetadataDriver(metadataRoot, metadataKey)
 	if err != nil {
 		return nil, fmt.Errorf("cannot initialize metadata driver: %v", err)
 	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine host name: %v", err)
+	}
 	return &volumeDriver{
-		cl:           storageClient.GetFileService(),
+		clients:      clients,
+		files:        files,
 		meta:         metaDriver,
 		accountName:  accountName,
 		accountKey:   accountKey,
 		storageBase:  storageBase,
+		endpoint:     endpoint,
 		mountpoint:   mountpoint,
+		sharePrefix:  sharePrefix,
 		removeShares: removeShares,
+		restHelper:   defaultRESTMountHelper,
+		hostname:     hostname,
+		leases:       make(map[string]chan struct{}),
+		kept:         make(map[string]*time.Timer),
+		busy:         make(map[string]string),
+		snapshots:    newSnapshotCache(),
+		timeouts: map[string]time.Duration{
+			"create":  defaultCreateTimeout,
+			"mount":   defaultMountTimeout,
+			"unmount": defaultMountTimeout,
+			"remove":  defaultRemoveTimeout,
+		},
 	}, nil
 }
 
@@ -52,126 +142,409 @@ func (v *volumeDriver) Capabilities(req volume.Request) (resp volume.Response) {
 }
 
 func (v *volumeDriver) Create(req volume.Request) (resp volume.Response) {
-	v.m.Lock()
-	defer v.m.Unlock()
+	rq := v.newRequest("create", req.Name, nil)
+	defer rq.finish(&resp.Err)
+	if err := v.create(rq, req.Name, req.Options); err != nil {
+		resp.Err = err.Error()
+	}
+	return
+}
 
-	logctx := log.WithFields(log.Fields{
-		"operation": "create",
-		"name":      req.Name,
-		"options":   req.Options})
+// create validates the options of a new volume, provisions its share and
+// saves its metadata. The driver lock is only held while saving the metadata,
+// so that several volumes can be provisioned concurrently.
+func (v *volumeDriver) create(rq *request, name string, options map[string]string) error {
+	logctx := rq.log.WithField("options", options)
+	sp := rq.span
+	fail := func(err error) error {
+		logctx.Error(err)
+		return err
+	}
 
-	volMeta, err := v.meta.Validate(req.Options)
+	if err := validateVolumeName(name); err != nil {
+		return fail(newError(codeInvalidOptions, "%v", err))
+	}
+	volMeta, err := v.meta.Validate(options)
 	if err != nil {
-		resp.Err = fmt.Sprintf("error validating metadata: %v", err)
-		logctx.Error(resp.Err)
-		return
+		return fail(newError(codeInvalidOptions, "error validating metadata: %v", err))
+	}
+	logctx = rq.withLabels(volMeta.Options.Labels).WithField("options", options)
+	if sd := volMeta.Options.Seed; filepath.IsAbs(sd) {
+		if err := checkSeedPath(sd, v.seeds.dir); err != nil {
+			return fail(newError(codeInvalidOptions, "%v", err))
+		}
+	} else if sd != "" {
+		if err := checkSeedHost(sd, v.seeds.hosts); err != nil {
+			return fail(newError(codeInvalidOptions, "%v", err))
+		}
+	}
+
+	v.m.Lock()
+	if volMeta.Options.Account == "" && v.localAccount != "" && driverAccountOption(volMeta.Options) == "" {
+		volMeta.Options.Account = v.localAccount
 	}
+	account, err := v.account(volMeta.Options)
+	v.m.Unlock()
+	if err != nil {
+		return fail(err)
+	}
+	accountName, files := account.name, account.files.withContext(rq.ctx)
 
 	// Additional volume metadata
-	volMeta.Account = v.accountName
+	volMeta.Account = accountName
 	volMeta.CreatedAt = time.Now().UTC()
 
-	share := req.Options["share"]
+	share := volMeta.Options.Share
 	if share == "" {
-		resp.Err = "missing volume option: 'share'"
-		logctx.Error(resp.Err)
-		return
+		return fail(newError(codeInvalidOptions, "missing volume option: 'share'"))
+	}
+	share = v.sharePrefix + share
+	if len(share) < 3 || len(share) > 63 || !shareNameRe.MatchString(share) {
+		return fail(newError(codeInvalidOptions, "invalid share name %q", share))
+	}
+	volMeta.Options.Share = share
+
+	if err := v.policy.check(opCreate, name, volMeta.Options.Labels); err != nil {
+		return fail(err)
+	}
+
+	v.m.Lock()
+	existing, err := v.meta.Get(name)
+	v.m.Unlock()
+	if err == nil && existing.Options.Share == share {
+		// re-creating an existing volume only changes the quota and access
+		// tier of its share
+		if q := volMeta.Options.Quota; q != 0 && q != existing.Options.Quota {
+			if err := v.resizeVolume(name, q); err != nil {
+				return fail(err)
+			}
+		}
+		if t := volMeta.Options.AccessTier; t != "" && t != existing.Options.AccessTier {
+			if err := v.setVolumeTier(name, t); err != nil {
+				return fail(err)
+			}
+		}
+		logctx.Debug("volume already exists")
+		return nil
 	}
 
 	logctx.Debug("request accepted")
 
-	// Create azure file share
-	if ok, err := v.cl.CreateShareIfNotExists(share); err != nil {
-		resp.Err = fmt.Sprintf("error creating azure file share: %v", err)
-		logctx.Error(resp.Err)
-		return
-	} else if ok {
-		logctx.Infof("created azure file share %q", share)
+	if err := v.checkSharedShare(name, volMeta, logctx); err != nil {
+		return fail(err)
+	}
+
+	var created bool
+	if volMeta.Options.Exists == existsUse {
+		// attach to the existing share only
+		csp := startSpan("azure.ShareExists", sp, "share", share)
+		exists, err := files.shareExists(share)
+		csp.endErr(err)
+		if err != nil {
+			return fail(wrapError(err, codeStorageAPI, "error checking azure file share: %v", err))
+		} else if !exists {
+			return fail(newError(codeShareNotFound, "azure file share %q does not exist and 'exists=use' is set", share))
+		}
+	} else {
+		// Create azure file share
+		csp := startSpan("azure.CreateShare", sp, "share", share)
+		ok, err := files.createShareIfNotExists(share, shareProperties{
+			QuotaGiB:   volMeta.Options.Quota,
+			Protocol:   volMeta.Options.Protocol,
+			Squash:     volMeta.Options.Squash,
+			Tier:       volMeta.Options.AccessTier,
+			Metadata:   volMeta.Options.Tags,
+			LargeShare: volMeta.Options.LargeShare,
+		})
+		csp.endErr(err)
+		if err != nil {
+			if e, isSvcErr := err.(*fileServiceError); isSvcErr && e.Code == "InvalidHeaderValue" && volMeta.Options.Quota > maxShareQuota {
+				return fail(newError(codeInvalidOptions, "error creating azure file share: quota of %d GiB requires large file shares to be enabled on storage account %q", volMeta.Options.Quota, accountName))
+			}
+			return fail(wrapError(err, codeStorageAPI, "error creating azure file share: %v", err))
+		} else if ok {
+			created = true
+			logctx.Infof("created azure file share %q", share)
+		} else if volMeta.Options.Exists == existsFail {
+			return fail(newError(codeShareExists, "azure file share %q already exists and 'exists=fail' is set", share))
+		}
+	}
+
+	if created && volMeta.Options.RootSDDL != "" {
+		psp := startSpan("azure.SetDirectoryPermission", sp, "share", share)
+		err := files.setDirectoryPermission(share, "", volMeta.Options.RootSDDL)
+		psp.endErr(err)
+		if err != nil {
+			return fail(wrapError(err, codeStorageAPI, "error setting the permissions of the root directory: %v", err))
+		}
+		logctx.Debug("set the permissions of the root directory")
+	}
+	if volMeta.Options.RestoreFrom != "" {
+		rsp := startSpan("azure.RestoreSnapshot", sp, "share", share, "snapshot", volMeta.Options.RestoreFrom)
+		err := v.restoreInto(files, share, volMeta.Options.RestoreFrom, logctx)
+		rsp.endErr(err)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	for _, d := range volMeta.Options.Mkdirs {
+		dsp := startSpan("azure.CreateDirectory", sp, "share", share, "directory", d)
+		err := files.createDirectories(share, d)
+		dsp.endErr(err)
+		if err != nil {
+			return fail(wrapError(err, codeStorageAPI, "error creating directory %q: %v", d, err))
+		}
 	}
 
 	// Save volume metadata
-	if err := v.meta.Set(req.Name, volMeta); err != nil {
-		resp.Err = fmt.Sprintf("error saving metadata: %v", err)
-		logctx.Error(resp.Err)
-		return
+	v.m.Lock()
+	defer v.m.Unlock()
+	if err := v.meta.Set(name, volMeta); err != nil {
+		return fail(newError(codeInternal, "error saving metadata: %v", err))
 	}
-	return
+	if err := v.meta.DeleteArchived(name); err != nil {
+		logctx.Errorf("%v", err)
+	}
+	return nil
 }
 
 func (v *volumeDriver) Path(req volume.Request) (resp volume.Response) {
+	rq := v.newRequest("path", req.Name, nil)
+	defer rq.finish(&resp.Err)
 	v.m.Lock()
 	defer v.m.Unlock()
 
-	log.WithFields(log.Fields{
-		"operation": "path", "name": req.Name,
-	}).Debug("request accepted")
+	rq.log.Debug("request accepted")
 
 	resp.Mountpoint = v.pathForVolume(req.Name)
 	return
 }
 
 func (v *volumeDriver) Mount(req volume.MountRequest) (resp volume.Response) {
+	rq := v.newRequest("mount", req.Name, nil)
+	rq.span.set("docker.mount_id", req.ID)
+	defer rq.finish(&resp.Err)
+	sp := rq.span
 	v.m.Lock()
 	defer v.m.Unlock()
 
-	logctx := log.WithFields(log.Fields{
-		"operation": "mount",
-		"name":      req.Name,
-	})
+	logctx := rq.log
 	logctx.Debug("request accepted")
 
+	if v.draining {
+		resp.Err = newError(codeDraining, "the driver is draining the host, new mounts are refused").Error()
+		logctx.Error(resp.Err)
+		return
+	}
+	if err := v.checkBusy(req.Name); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
+
 	path := v.pathForVolume(req.Name)
 	if err := os.MkdirAll(path, 0700); err != nil {
-		resp.Err = fmt.Sprintf("could not create mount point: %v", err)
+		resp.Err = newError(codeInternal, "could not create mount point: %v", err).Error()
+		logctx.Error(resp.Err)
+		return
+	}
+
+	if err := v.checkMountpoint(path, logctx); err != nil {
+		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
 
 	meta, err := v.meta.Get(req.Name)
 	if err != nil {
-		resp.Err = fmt.Sprintf("could not fetch metadata: %v", err)
+		resp.Err = wrapError(err, codeInternal, "could not fetch metadata: %v", err).Error()
+		logctx.Error(resp.Err)
+		return
+	}
+	logctx = rq.withLabels(meta.Options.Labels)
+
+	if _, err := v.volumeAccount(req.Name, meta); err != nil {
+		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
 
-	if meta.Account != v.accountName {
-		resp.Err = fmt.Sprintf("volume hosted on a different account ('%s') cannot mount", meta.Account)
+	if err := v.checkNamespace(meta); err != nil {
+		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
 
-	if err := mount(v.accountName, v.accountKey, v.storageBase, path, meta.Options); err != nil {
+	if err := v.policy.check(opMount, req.Name, meta.Options.Labels); err != nil {
 		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
+
+	// volumes created before 'extra-opts' was restricted further
+	if _, err := parseExtraOpts(strings.Join(meta.Options.ExtraOpts, ",")); err != nil {
+		resp.Err = newError(codeInvalidOptions, "%v", err).Error()
+		logctx.Error(resp.Err)
+		return
+	}
+
+	if meta.ShareMissingSince != nil {
+		// fail fast unless the share was re-created since
+		var exists bool
+		if meta, exists, err = v.checkShare(req.Name, meta); err == nil && !exists {
+			resp.Err = shareDeletedError(meta).Error()
+			logctx.Error(resp.Err)
+			return
+		}
+	}
+
+	v.cancelKeptMount(req.Name)
+	if live, err := mountedShare(path, meta.Options.Share); err != nil {
+		logctx.Warnf("cannot check for an existing mount: %v", err)
+	} else if live {
+		// another container of the host uses the volume, or it was kept
+		// mounted after the last unmount
+		meta.Mounts = addMount(meta.Mounts, v.hostname, req.ID)
+		if err := v.meta.Set(req.Name, meta); err != nil {
+			logctx.Errorf("error saving metadata: %v", err)
+		}
+		logctx.Debug("volume is already mounted, reusing the mount")
+		resp.Mountpoint = path
+		return
+	}
+
+	opts := v.mountOptions(meta.Options)
+	_, leased := v.leases[req.Name]
+	if opts.Exclusive {
+		lsp := startSpan("azure.AcquireLease", sp, "share", opts.Share)
+		err := v.acquireLease(rq.ctx, req.Name, opts.Share)
+		lsp.endErr(err)
+		if err != nil {
+			resp.Err = err.Error()
+			logctx.Error(resp.Err)
+			return
+		}
+	}
+	start := time.Now()
+	msp := startSpan("exec.mount", sp, "share", opts.Share, "protocol", opts.Protocol)
+	vers, err := v.mount(rq.ctx, path, opts, meta.SMBVersion)
+	msp.set("smb.version", vers)
+	msp.endErr(err)
+	observeMount("mount", start, err)
+	if err != nil {
+		if opts.Exclusive && !leased {
+			if lerr := v.releaseLease(context.Background(), req.Name, opts.Share); lerr != nil {
+				logctx.Errorf("error releasing lease after failed mount: %v", lerr)
+			}
+		}
+		if code := classify(err, codeMountFailed); code == codeShareNotFound || code == codeMountFailed {
+			// tell a deleted share apart from other failures
+			if m, exists, cerr := v.checkShare(req.Name, meta); cerr == nil && !exists {
+				err = shareDeletedError(m)
+			}
+		}
+		if e, ok := err.(*mountError); ok {
+			logctx.Debugf("%s output: %q", e.cmd, e.output)
+		}
+		resp.Err = wrapError(err, codeMountFailed, "%v", err).Error()
+		logctx.Error(resp.Err)
+		return
+	}
+	// the lock may have been released while retrying the mount
+	if m, err := v.meta.Get(req.Name); err == nil {
+		meta = m
+	}
+	if meta.Options.Seed != "" && meta.SeededAt == nil {
+		if err := v.seed(req.Name, path, meta.Options, logctx); err != nil {
+			// unmount so that seeding is attempted again on the next mount
+			if uerr := unmount(context.Background(), path); uerr != nil {
+				logctx.Errorf("error unmounting after failed seeding: %v", uerr)
+			}
+			if opts.Exclusive && !leased {
+				if lerr := v.releaseLease(context.Background(), req.Name, opts.Share); lerr != nil {
+					logctx.Errorf("error releasing lease after failed seeding: %v", lerr)
+				}
+			}
+			resp.Err = newError(codeInternal, "error seeding volume: %v", err).Error()
+			logctx.Error(resp.Err)
+			return
+		}
+		// the lock was released while seeding
+		if m, err := v.meta.Get(req.Name); err == nil {
+			meta = m
+		}
+		now := time.Now().UTC()
+		meta.SeededAt = &now
+	}
+	meta.Mounts = addMount(meta.Mounts, v.hostname, req.ID)
+	if vers != "" && vers != meta.SMBVersion {
+		logctx.Infof("mounted with SMB %s", vers)
+		meta.SMBVersion = vers
+	}
+	if err := v.meta.Set(req.Name, meta); err != nil {
+		logctx.Errorf("error saving metadata: %v", err)
+	}
 	resp.Mountpoint = path
 	return
 }
 
 func (v *volumeDriver) Unmount(req volume.UnmountRequest) (resp volume.Response) {
+	rq := v.newRequest("unmount", req.Name, nil)
+	rq.span.set("docker.mount_id", req.ID)
+	defer rq.finish(&resp.Err)
+	sp := rq.span
 	v.m.Lock()
 	defer v.m.Unlock()
 
-	logctx := log.WithFields(log.Fields{
-		"operation": "unmount",
-		"name":      req.Name,
-	})
+	logctx := rq.log
 
 	logctx.Debug("request accepted")
-	path := v.pathForVolume(req.Name)
-	if err := unmount(path); err != nil {
+	if err := v.checkBusy(req.Name); err != nil {
 		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
+	path := v.pathForVolume(req.Name)
+	if meta, err := v.meta.Get(req.Name); err == nil {
+		logctx = rq.withLabels(meta.Options.Labels)
+		if active, err := isMounted(path); err == nil {
+			switch {
+			case usedByOthers(meta, v.hostname, req.ID) && active:
+				// mounts are shared by the containers of the host
+				meta.Mounts = removeMount(meta.Mounts, v.hostname, req.ID)
+				if err := v.meta.Set(req.Name, meta); err != nil {
+					logctx.Errorf("error saving metadata: %v", err)
+				}
+				logctx.Debug("volume still used by other containers, not unmounting")
+				return
+			case !active && !hasMount(meta.Mounts, v.hostname, req.ID):
+				// retried by Docker after the volume was unmounted
+				logctx.Debug("volume is not mounted for this mount ID, nothing to unmount")
+				return
+			}
+		}
+	}
+	if v.keepMount(req.Name, req.ID, path, logctx) {
+		return
+	}
+	start := time.Now()
+	usp := startSpan("exec.umount", sp)
+	err := unmount(rq.ctx, path)
+	usp.endErr(err)
+	observeMount("unmount", start, err)
+	if err != nil {
+		resp.Err = wrapError(err, codeMountFailed, "%v", err).Error()
+		logctx.Error(resp.Err)
+		return
+	}
 	logctx.Debug("unmount successful")
 
 	// Docker does not keep track of what is mounted and what is not, it will
 	// issue /Volume.Mount and /Volume.Unmount requests regardless when multiple
-	// containers use the same volume simulatenosly. This leads to duplicate
-	// mount entries and requirement for a careful cleanup of the mountpath in
-	// the following code.
+	// containers use the same volume simulatenosly. Containers share a single
+	// mount (see Mount), but mounts made over a dead mount or by older versions
+	// of the driver leave duplicate mount entries and require a careful
+	// cleanup of the mountpath in the following code.
 	//
 	// If same path is mounted multiple times, duplicate entries will occur
 	// in mount table for the same mountpoint. umount will remove the mount
@@ -181,16 +554,30 @@ func (v *volumeDriver) Unmount(req volume.UnmountRequest) (resp volume.Response)
 	// mounted, and only when there is nothing mounted, we remove the mountpoint
 	isActive, err := isMounted(path)
 	if err != nil {
-		resp.Err = err.Error()
+		resp.Err = newError(codeInternal, "%v", err).Error()
 		logctx.Error(resp.Err)
 		return
 	}
+	if meta, err := v.meta.Get(req.Name); err == nil {
+		if isActive {
+			meta.Mounts = removeMount(meta.Mounts, v.hostname, req.ID)
+		} else {
+			// forget stale mounts of this host too
+			meta.Mounts = removeMounts(meta.Mounts, v.hostname)
+			if err := v.releaseLease(rq.ctx, req.Name, meta.Options.Share); err != nil {
+				logctx.Errorf("error releasing lease: %v", err)
+			}
+		}
+		if err := v.meta.Set(req.Name, meta); err != nil {
+			logctx.Errorf("error saving metadata: %v", err)
+		}
+	}
 	if isActive {
 		logctx.Debug("mountpoint still has active mounts, not removing")
 	} else {
 		logctx.Debug("mountpoint has no further mounts, removing")
 		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-			resp.Err = fmt.Sprintf("error removing mountpoint: %v", err)
+			resp.Err = newError(codeInternal, "error removing mountpoint: %v", err).Error()
 			logctx.Error(resp.Err)
 			return
 		}
@@ -199,191 +586,538 @@ func (v *volumeDriver) Unmount(req volume.UnmountRequest) (resp volume.Response)
 }
 
 func (v *volumeDriver) Remove(req volume.Request) (resp volume.Response) {
+	rq := v.newRequest("remove", req.Name, nil)
+	defer rq.finish(&resp.Err)
+	sp := rq.span
 	v.m.Lock()
 	defer v.m.Unlock()
 
-	logctx := log.WithFields(log.Fields{
-		"operation": "remove",
-		"name":      req.Name,
-	})
+	logctx := rq.log
 	logctx.Debug("request accepted")
+	if err := v.checkBusy(req.Name); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
 
 	meta, err := v.meta.Get(req.Name)
 	if err != nil {
-		resp.Err = fmt.Sprintf("could not fetch metadata: %v", err)
+		resp.Err = wrapError(err, codeInternal, "could not fetch metadata: %v", err).Error()
+		logctx.Error(resp.Err)
+		return
+	}
+	logctx = rq.withLabels(meta.Options.Labels)
+
+	if err := v.checkNamespace(meta); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
+
+	if err := v.policy.check(opRemove, req.Name, meta.Options.Labels); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
+
+	if t, ok := v.kept[req.Name]; ok {
+		// no container uses a volume kept mounted after its last unmount
+		t.Stop()
+		delete(v.kept, req.Name)
+		if err := v.unmountAll(req.Name); err != nil {
+			resp.Err = err.Error()
+			logctx.Error(resp.Err)
+			return
+		}
+	}
+
+	if mounted, err := isMounted(v.pathForVolume(req.Name)); err != nil {
+		resp.Err = newError(codeInternal, "%v", err).Error()
+		logctx.Error(resp.Err)
+		return
+	} else if mounted && !v.removeMounted {
+		resp.Err = newError(codeVolumeMounted, "volume is mounted on this host, unmount it first").Error()
+		logctx.Error(resp.Err)
+		return
+	} else if mounted {
+		logctx.Warn("removing volume mounted on this host")
+	}
+
+	if meta.Options.Protected {
+		resp.Err = newError(codeProtected, "volume is protected from deletion, clear the protection through the admin API first").Error()
 		logctx.Error(resp.Err)
 		return
 	}
 
 	share := meta.Options.Share
-	if v.removeShares {
-		if ok, err := v.cl.DeleteShareIfExists(share); err != nil {
-			resp.Err = fmt.Sprintf("error removing azure file share %q: %v", share, err)
+	reclaim := v.reclaimPolicy(meta)
+	others := v.otherVolumesOfShare(req.Name, meta)
+	if reclaim == reclaimSnapshot && len(others) == 0 {
+		if err := v.finalBackup(req.Name, sp); err != nil {
+			resp.Err = err.Error()
 			logctx.Error(resp.Err)
 			return
-		} else if ok {
+		}
+		// the lock was released during the backup: the volume may have been
+		// mounted or protected, or other volumes created on its share since
+		if meta, err = v.recheckRemoval(req.Name, meta); err != nil {
+			resp.Err = err.Error()
+			logctx.Error(resp.Err)
+			return
+		}
+		others = v.otherVolumesOfShare(req.Name, meta)
+	}
+	if reclaim != reclaimRetain && len(others) > 0 {
+		// the share is deleted with the last volume referencing it
+		logctx.Infof("not removing share %q still used by volume(s) %s", share, strings.Join(others, ", "))
+	} else if reclaim != reclaimRetain {
+		account, err := v.account(meta.Options)
+		if err != nil {
+			resp.Err = err.Error()
+			logctx.Error(resp.Err)
+			return
+		}
+		dsp := startSpan("azure.DeleteShare", sp, "share", share)
+		deleted, err := account.files.withContext(rq.ctx).deleteShareIfExists(share, v.delSnapshots)
+		dsp.endErr(err)
+		if e, ok := err.(*fileServiceError); ok && e.Code == "ShareHasSnapshots" {
+			resp.Err = newError(codeStorageAPI, "share %q has snapshots, delete them or set --remove-share-snapshots to remove it: %v", share, err).Error()
+			logctx.Error(resp.Err)
+			return
+		} else if err != nil {
+			resp.Err = wrapError(err, codeStorageAPI, "error removing azure file share %q: %v", share, err).Error()
+			logctx.Error(resp.Err)
+			return
+		} else if deleted {
 			logctx.Infof("removed azure file share %q", share)
+			// for undeleting the share if the account has soft delete on
+			meta.Mounts = nil
+			if err := v.meta.Archive(req.Name, meta); err != nil {
+				logctx.Errorf("error archiving volume metadata: %v", err)
+			}
 		}
 	} else {
 		logctx.Debugf("not removing share %q upon volume removal", share)
 	}
 
 	logctx.Debug("removing volume metadata")
-	if err != v.meta.Delete(req.Name) {
-		resp.Err = err.Error()
+	if err := v.meta.Delete(req.Name); err != nil {
+		resp.Err = newError(codeInternal, "%v", err).Error()
 		logctx.Error(resp.Err)
 		return
 	}
+	v.forgetVolumeMetrics(req.Name, meta)
+	if meta.Options.Multiuser {
+		removeUnusedCIFSCreds()
+	}
 	return
 }
 
 func (v *volumeDriver) Get(req volume.Request) (resp volume.Response) {
+	rq := v.newRequest("get", req.Name, nil)
+	defer rq.finish(&resp.Err)
 	v.m.Lock()
 	defer v.m.Unlock()
-	logctx := log.WithFields(log.Fields{
-		"operation": "get",
-		"name":      req.Name,
-	})
+	logctx := rq.log
 	logctx.Debug("request accepted")
 
-	_, err := v.meta.Get(req.Name)
+	meta, err := v.meta.Get(req.Name)
 	if err != nil {
-		resp.Err = fmt.Sprintf("could not fetch metadata: %v", err)
+		resp.Err = wrapError(err, codeInternal, "could not fetch metadata: %v", err).Error()
+		logctx.Error(resp.Err)
+		return
+	}
+	if err := v.checkNamespace(meta); err != nil {
+		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
 	resp.Volume = v.volumeEntry(req.Name)
+	resp.Volume.Status = v.volumeStatus(req.Name, meta)
 	return
 }
 
 func (v *volumeDriver) List(req volume.Request) (resp volume.Response) {
+	rq := v.newRequest("list", "", nil)
+	defer rq.finish(&resp.Err)
 	v.m.Lock()
 	defer v.m.Unlock()
 
-	logctx := log.WithFields(log.Fields{
-		"operation": "list",
-	})
+	logctx := rq.log
 	logctx.Debug("request accepted")
 
-	vols, err := v.meta.List()
+	vols, err := v.listVolumesLocked(volumeFilter{})
 	if err != nil {
-		resp.Err = fmt.Sprintf("failed to list managed volumes: %v", err)
+		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
 
-	for _, vn := range vols {
-		resp.Volumes = append(resp.Volumes, v.volumeEntry(vn))
+	for _, vol := range vols {
+		resp.Volumes = append(resp.Volumes, v.volumeEntry(vol.Name))
 	}
 	logctx.Debugf("response has %d items", len(resp.Volumes))
 	return
 }
 
-func (v *volumeDriver) volumeEntry(name string) *volume.Volume {
-	return &volume.Volume{Name: name,
-		Mountpoint: v.pathForVolume(name)}
+// checkMountpoint applies the configured policy if the mountpoint contains
+// files although nothing is mounted on it, e.g. data written by a container
+// while the share was not mounted. Mounting over such files would silently
+// hide them.
+func (v *volumeDriver) checkMountpoint(path string, logctx *log.Entry) error {
+	if active, err := isMounted(path); err != nil {
+		return newError(codeInternal, "%v", err)
+	} else if active {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return newError(codeInternal, "cannot open mountpoint: %v", err)
+	}
+	names, err := f.Readdirnames(1)
+	f.Close()
+	if err != nil && err != io.EOF {
+		return newError(codeInternal, "cannot read mountpoint: %v", err)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	switch v.nonEmpty {
+	case nonEmptyRefuse:
+		return newError(codeNotEmpty, "mountpoint %s is not empty, refusing to mount over its contents", path)
+	case nonEmptyMove:
+		aside := fmt.Sprintf("%s.shadowed-%s", path, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(path, aside); err != nil {
+			return newError(codeInternal, "cannot move mountpoint contents aside: %v", err)
+		}
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return newError(codeInternal, "could not create mount point: %v", err)
+		}
+		logctx.Warnf("mountpoint was not empty, moved its contents to %s", aside)
+	default:
+		logctx.Warnf("mountpoint %s is not empty, its contents will be hidden by the mount", path)
+	}
+	return nil
 }
 
-func (v *volumeDriver) pathForVolume(name string) string {
-	return filepath.Join(v.mountpoint, name)
+// mountOptions returns the options to mount a volume with: its own, with the
+// defaults of the driver for those it does not set.
+func (v *volumeDriver) mountOptions(opts VolumeOptions) VolumeOptions {
+	if opts.Domain == "" && opts.Protocol != protocolNFS {
+		opts.Domain = v.domain
+	}
+	return opts
 }
 
-func mount(accountName, accountKey, storageBase, mountPath string, options VolumeOptions) error {
-	// Set defaults
-	if len(options.FileMode) == 0 {
-		options.FileMode = "0777"
+// mount mounts the volume at path, retrying with exponential backoff while
+// the storage endpoint cannot be resolved, and through the REST API if the
+// volume asks for it or SMB is unreachable with --rest-fallback. It returns
+// the SMB dialect used, if any. Caller must hold the driver lock.
+func (v *volumeDriver) mount(ctx context.Context, path string, opts VolumeOptions, lastVers string) (string, error) {
+	if v.selinuxLabel != "" {
+		opts = withSELinuxContext(opts, v.selinuxLabel)
 	}
-	if len(options.DirMode) == 0 {
-		options.DirMode = "0777"
+	if opts.Port == 0 && opts.Protocol != protocolNFS {
+		opts.Port = v.smbPort
 	}
-	if len(options.UID) == 0 {
-		options.UID = "0"
+	if v.localShares != "" {
+		return "", mountLocal(ctx, v.localShares, path, opts)
+	}
+	a, err := v.account(opts)
+	if err != nil {
+		return "", err
 	}
-	if len(options.GID) == 0 {
-		options.GID = "0"
+	if opts.Transport == transportREST {
+		return "", mountREST(ctx, v.restHelper, a.name, a.key, a.storageBase, path, opts)
 	}
-	mountURI := fmt.Sprintf("//%s.file.%s/%s", accountName, storageBase, options.Share)
-	if len(options.RemotePath) != 0 {
-		mountURI += fmt.Sprintf("/%s", strings.TrimPrefix(options.RemotePath, "/"))
+	vers, err := v.mountKernel(ctx, a, path, opts, lastVers)
+	if err != nil && v.restFallback && opts.Protocol != protocolNFS && classify(err, codeMountFailed) == codeUnreachable {
+		log.WithField("name", filepath.Base(path)).Warnf("storage endpoint unreachable over SMB, mounting through the REST API: %v", err)
+		return "", mountREST(ctx, v.restHelper, a.name, a.key, a.storageBase, path, opts)
 	}
+	return vers, err
+}
 
-	opts := []string{
-		"vers=3.0",
-		fmt.Sprintf("username=%s", accountName),
-		fmt.Sprintf("password=%s", accountKey),
-		fmt.Sprintf("file_mode=%s", options.FileMode),
-		fmt.Sprintf("dir_mode=%s", options.DirMode),
-		fmt.Sprintf("uid=%s", options.UID),
-		fmt.Sprintf("gid=%s", options.GID),
+// mountKernel mounts the volume with the kernel client of its protocol,
+// retrying while the storage endpoint of the account cannot be resolved. The
+// driver lock is released while waiting to retry, the volume being marked
+// busy meanwhile. Caller must hold the driver lock.
+func (v *volumeDriver) mountKernel(ctx context.Context, a *storageAccount, path string, opts VolumeOptions, lastVers string) (string, error) {
+	name := filepath.Base(path)
+	backoff := mountRetryInitialBackoff
+	for attempt := 0; ; attempt++ {
+		var (
+			vers string
+			err  error
+		)
+		if attempt > 0 {
+			// the key may have been rotated while waiting
+			if a, err = v.account(opts); err != nil {
+				return "", err
+			}
+		}
+		if v.resolveIP && opts.Protocol != protocolNFS {
+			opts.ServerIP, err = resolveEndpoint(a.name, a.storageBase)
+		}
+		if err == nil {
+			vers, err = mount(ctx, a.name, a.key, a.storageBase, path, opts, v.smbVersions(lastVers))
+		}
+		if err == nil || !isNameResolutionFailure(err) || attempt >= v.dnsRetries {
+			return vers, err
+		}
+		log.WithField("name", name).Warnf("storage endpoint could not be resolved, retrying mount in %v (%d/%d)", backoff, attempt+1, v.dnsRetries)
+		v.setBusy(name, "waiting to retry its mount")
+		v.m.Unlock()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		v.m.Lock()
+		v.clearBusy(name)
+		if ctx.Err() != nil {
+			return "", err
+		}
+		if backoff *= 2; backoff > mountRetryMaxBackoff {
+			backoff = mountRetryMaxBackoff
+		}
 	}
-	if options.NoLock {
-		opts = append(opts, "nolock")
+}
+
+// smbVersions returns the SMB dialects to attempt a mount with: all known
+// dialects down to the configured floor, starting with the dialect the volume
+// was last mounted with (if still allowed).
+func (v *volumeDriver) smbVersions(last string) []string {
+	var allowed []string
+	for _, vers := range smbVersions {
+		allowed = append(allowed, vers)
+		if vers == v.smbMinVers {
+			break
+		}
+	}
+	if !contains(allowed, last) {
+		return allowed
+	}
+	versions := []string{last}
+	for _, vers := range allowed {
+		if vers != last {
+			versions = append(versions, vers)
+		}
 	}
+	return versions
+}
 
-	// TODO: replace with mount() syscall using docker/docker/pkg/mount
-	// (currently gives hard-to-debug 'invalid argument' error with the
-	// following arguments, my guess is, mount program does IP resolution
-	// and essentially passes a different set of options to system call).
-	cmd := exec.Command("mount", "-t", "cifs", mountURI, mountPath, "-o", strings.Join(opts, ","), "--verbose")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("mount failed: %v\noutput=%q", err, out)
+// checkSharedShare applies the configured policy if the share of the new
+// volume already backs other volumes on the account.
+func (v *volumeDriver) checkSharedShare(name string, meta volumeMetadata, logctx *log.Entry) error {
+	v.m.Lock()
+	others := v.otherVolumesOfShare(name, meta)
+	v.m.Unlock()
+	if len(others) == 0 {
+		return nil
+	}
+	switch v.sharedShares {
+	case sharedReject:
+		return newError(codeShareInUse, "share %q is already used by volume(s) %s", meta.Options.Share, strings.Join(others, ", "))
+	case sharedReadOnly:
+		if !meta.Options.ReadOnly {
+			return newError(codeShareInUse, "share %q is already used by volume(s) %s, additional volumes must set 'ro=true'", meta.Options.Share, strings.Join(others, ", "))
+		}
+	default:
+		logctx.Warnf("share %q is also used by volume(s) %s", meta.Options.Share, strings.Join(others, ", "))
 	}
 	return nil
 }
 
-func unmount(mountpoint string) error {
-	cmd := exec.Command("umount", mountpoint)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("unmount failed: %v\noutput=%q", err, out)
+// addMount returns the mount records with the mount of the host with the
+// mount ID. Mounts are counted per mount ID, so that a mount Docker retries
+// is only recorded once; mounts without an ID, sent by Docker versions before
+// 1.13, are recorded once per request.
+func addMount(mounts []mountRecord, host, id string) []mountRecord {
+	if id != "" && hasMount(mounts, host, id) {
+		return mounts
 	}
-	return nil
+	return append(mounts, mountRecord{
+		Host:      host,
+		ID:        id,
+		MountedAt: time.Now().UTC(),
+	})
 }
 
-// isMounted reads /proc/self/mountinfo to see if the specified mountpoint is
-// mounted.
-func isMounted(mountpoint string) (bool, error) {
-	f, err := os.Open("/proc/self/mountinfo")
-	if err != nil {
-		return false, fmt.Errorf("cannot read mountinfo: %v", err)
+// hasMount returns true if the host has a mount record with the mount ID.
+func hasMount(mounts []mountRecord, host, id string) bool {
+	for _, m := range mounts {
+		if m.Host == host && m.ID == id {
+			return true
+		}
 	}
-	defer f.Close()
+	return false
+}
 
-	// format of mountinfo:
-	//    38 23 0:30 / /sys/fs/cgroup/devices rw,relatime - cgroup cgroup rw,devices
-	//    39 23 0:31 / /sys/fs/cgroup/freezer rw,relatime - cgroup cgroup rw,freezer
-	//    33 22 8:17 / /mnt rw,relatime - ext4 /dev/sdb1 rw,data=ordered
-	// so we split the lines into the specified format and match the mountpoint
-	// at 5th field.
-	//
-	// This code is adopted from https://github.com/docker/docker/blob/master/pkg/mount/mountinfo_linux.go
+// removeMount returns the mount records without the mount of the host with
+// the mount ID (a single one if id is empty, see addMount).
+func removeMount(mounts []mountRecord, host, id string) []mountRecord {
+	for i, m := range mounts {
+		if m.Host == host && m.ID == id {
+			return append(mounts[:i:i], mounts[i+1:]...)
+		}
+	}
+	return mounts
+}
 
-	oldFi, err := os.Stat(mountpoint)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
+// usedByOthers returns true if the volume has mounts on the host other than
+// the one with the mount ID.
+func usedByOthers(meta volumeMetadata, host, id string) bool {
+	for _, m := range removeMount(meta.Mounts, host, id) {
+		if m.Host == host {
+			return true
 		}
-		return false, fmt.Errorf("cannot stat mountpoint: %v", err)
 	}
+	return false
+}
 
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		t := s.Text()
-		f := strings.Fields(t)
-		if len(f) < 5 {
-			return false, fmt.Errorf("mountinfo line %q has less than 5 fields, cannot parse mountpoint", t)
+// removeMounts returns the mount records without those of the host.
+func removeMounts(mounts []mountRecord, host string) []mountRecord {
+	var out []mountRecord
+	for _, m := range mounts {
+		if m.Host != host {
+			out = append(out, m)
 		}
-		mp := f[4] // ID, Parent, Major, Minor, Root, *Mountpoint*, Opts, OptionalFields
-		fi, err := os.Stat(mp)
-		if err != nil {
-			return false, fmt.Errorf("cannot stat %s: %v", mp, err)
+	}
+	return out
+}
+
+// seed extracts the seed archive of the volume into its mountpoint path. The
+// driver lock is released during the download and extraction, and the volume
+// marked busy meanwhile. Caller must hold the driver lock.
+func (v *volumeDriver) seed(name, path string, opts VolumeOptions, logctx *log.Entry) error {
+	v.setBusy(name, "seeding")
+	v.m.Unlock()
+	err := seedVolume(path, opts.Seed, opts.SeedSHA256, v.seeds, logctx)
+	v.m.Lock()
+	v.clearBusy(name)
+	return err
+}
+
+// reclaimPolicy returns what to do with the share of the volume when it is
+// removed: the reclaim option of the volume, or the --remove-shares default.
+func (v *volumeDriver) reclaimPolicy(meta volumeMetadata) string {
+	if meta.Options.Reclaim != "" {
+		return meta.Options.Reclaim
+	}
+	if v.removeShares {
+		return reclaimDelete
+	}
+	return reclaimRetain
+}
+
+// finalBackup copies the share of the volume to the backup account before it
+// is deleted, as share snapshots cannot outlive their share. Caller
+// must hold the driver lock, which is released during the copy.
+func (v *volumeDriver) finalBackup(name string, parent *span) error {
+	if v.backup == nil {
+		return newError(codeInvalidOptions, "reclaim 'snapshot-then-delete' requires a backup account (--backup-account-name)")
+	}
+	bsp := startSpan("azure.FinalBackup", parent)
+	v.m.Unlock()
+	err := v.backupVolume(name)
+	v.m.Lock()
+	bsp.endErr(err)
+	if err != nil {
+		return wrapError(err, codeStorageAPI, "error backing up the share before removal: %v", err)
+	}
+	return nil
+}
+
+// recheckRemoval fetches the metadata of the volume again after the driver
+// lock was released during its removal, and returns an error if the volume
+// has since been mounted or protected. before is the metadata the removal
+// started with. Caller must hold the driver lock.
+func (v *volumeDriver) recheckRemoval(name string, before volumeMetadata) (volumeMetadata, error) {
+	meta, err := v.meta.Get(name)
+	if err != nil {
+		return meta, wrapError(err, codeInternal, "could not fetch metadata: %v", err)
+	}
+	if mounted, err := isMounted(v.pathForVolume(name)); err != nil {
+		return meta, newError(codeInternal, "%v", err)
+	} else if (mounted && !v.removeMounted) || len(meta.Mounts) > len(before.Mounts) {
+		return meta, newError(codeVolumeMounted, "volume was mounted during the final backup, unmount it first")
+	}
+	if meta.Options.Protected {
+		return meta, newError(codeProtected, "volume was protected from deletion during the final backup")
+	}
+	return meta, nil
+}
+
+// otherVolumesOfShare returns the names of the volumes other than name backed
+// by the same share of the same account as meta. Caller must hold the driver
+// lock.
+func (v *volumeDriver) otherVolumesOfShare(name string, meta volumeMetadata) []string {
+	var others []string
+	for _, vn := range v.meta.VolumesOfShare(meta.Options.Share) {
+		if m, err := v.meta.Get(vn); vn != name && err == nil && m.Account == meta.Account {
+			others = append(others, vn)
 		}
-		same := os.SameFile(oldFi, fi)
-		if same {
-			return true, nil
+	}
+	return others
+}
+
+// checkNamespace returns an error if the volume's share is outside of the
+// share prefix this driver instance is restricted to.
+func (v *volumeDriver) checkNamespace(meta volumeMetadata) error {
+	if !strings.HasPrefix(meta.Options.Share, v.sharePrefix) {
+		return newError(codeNamespace, "share %q is outside of the namespace of this driver (%q)", meta.Options.Share, v.sharePrefix)
+	}
+	return nil
+}
+
+// volumeStatus returns the driver-specific details reported for the volume
+// by docker volume inspect, or nil if there are none.
+func (v *volumeDriver) volumeStatus(name string, meta volumeMetadata) map[string]interface{} {
+	status := make(map[string]interface{})
+	if meta.ShareMissingSince != nil {
+		err := shareDeletedError(meta)
+		status["state"] = "error"
+		status["error"] = err.Error()
+		status["retryable"] = retryable(err)
+	}
+	if n := len(meta.Backups); n > 0 {
+		status["lastBackup"] = meta.Backups[n-1]
+	}
+	if meta.Options.Quota > 0 {
+		status["quotaGiB"] = meta.Options.Quota
+	}
+	if meta.Options.AccessTier != "" {
+		status["accessTier"] = meta.Options.AccessTier
+	}
+	if meta.Options.Protected {
+		status["protected"] = true
+	}
+	if len(meta.Mounts) > 0 {
+		status["mounts"] = meta.Mounts
+	}
+	if st, ok := v.volumeStats(name); ok {
+		status["usage"] = st
+	}
+	if mm, ok := v.shareMonitorMetrics(meta.Options.Share); ok && meta.Account == v.accountName {
+		status["monitor"] = mm
+	}
+	if meta.Account == v.accountName && meta.Options.Protocol != protocolNFS && meta.ShareMissingSince == nil {
+		if snapshots := v.snapshots.get(meta.Options.Share, v.files); len(snapshots) > 0 {
+			status["snapshots"] = snapshots
 		}
 	}
-	log.Debug("mountpoint not found")
-	return false, nil
+	if len(status) == 0 {
+		return nil
+	}
+	return status
+}
+
+func (v *volumeDriver) volumeEntry(name string) *volume.Volume {
+	return &volume.Volume{Name: name,
+		Mountpoint: v.pathForVolume(name)}
+}
+
+func (v *volumeDriver) pathForVolume(name string) string {
+	return filepath.Join(v.mountpoint, name)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// fakeLeases is a File service recording the lease actions it is sent.
+type fakeLeases struct {
+	m       sync.Mutex
+	actions []string
+}
+
+func (f *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("comp") == "lease" {
+		f.m.Lock()
+		f.actions = append(f.actions, r.Header.Get("x-ms-lease-action"))
+		f.m.Unlock()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeLeases) taken() string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	a := strings.Join(f.actions, ",")
+	f.actions = nil
+	return a
+}
+
+func TestMountSeedRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the share is "mounted" by a REST mount helper doing nothing, so that
+	// the seed is extracted into the mountpoint directory itself
+	helper := filepath.Join(dir, "rclone")
+	if err := ioutil.WriteFile(helper, []byte("#!/bin/sh\nexit 0\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	leases := &fakeLeases{}
+	srv := httptest.NewServer(leases)
+	defer srv.Close()
+	endpoint, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := newVolumeDriver(newClientCache(), "acct", "a2V5", "core.windows.net", endpoint, filepath.Join(dir, "mnt"), filepath.Join(dir, "meta"), nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedDir := filepath.Join(dir, "seeds")
+	if err := os.Mkdir(seedDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	v.restHelper = helper
+	v.seeds = seedPolicy{dir: seedDir, maxBytes: 1 << 20, maxFiles: 2}
+	archive := filepath.Join(seedDir, "app.tar")
+	meta := volumeMetadata{Account: "acct", Options: VolumeOptions{
+		Share:     "data",
+		Transport: transportREST,
+		Exclusive: true,
+		Seed:      archive,
+	}}
+	if err := v.meta.Set("vol", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	// too many entries: the lease is released and nothing is left behind
+	writeSeedArchive(t, archive, map[string]string{"a": "1", "b": "2", "c": "3"})
+	resp := v.Mount(volume.MountRequest{Name: "vol", ID: "c1"})
+	if !strings.Contains(resp.Err, "error seeding volume") {
+		t.Fatalf("Mount with an archive over the limits = %+v, want a seeding error", resp)
+	}
+	if got := leases.taken(); got != "acquire,release" {
+		t.Errorf("lease actions of the failed mount = %q, want acquire,release", got)
+	}
+	if _, held := v.leases["vol"]; held {
+		t.Errorf("lease still renewed after the failed mount")
+	}
+	if entries, _ := ioutil.ReadDir(v.pathForVolume("vol")); len(entries) != 0 {
+		t.Errorf("failed seeding left %d entries in the share", len(entries))
+	}
+	if m, err := v.meta.Get("vol"); err != nil || m.SeededAt != nil || len(m.Mounts) != 0 {
+		t.Errorf("metadata after the failed mount = %+v, %v, want it not seeded nor mounted", m, err)
+	}
+
+	// seeded on the next mount
+	writeSeedArchive(t, archive, map[string]string{"a": "1", "b": "2"})
+	resp = v.Mount(volume.MountRequest{Name: "vol", ID: "c1"})
+	if resp.Err != "" || resp.Mountpoint != v.pathForVolume("vol") {
+		t.Fatalf("Mount = %+v, want mounted at %s", resp, v.pathForVolume("vol"))
+	}
+	if got := leases.taken(); got != "acquire" {
+		t.Errorf("lease actions of the mount = %q, want acquire", got)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(v.pathForVolume("vol"), "b")); err != nil || string(b) != "2" {
+		t.Errorf("seeded file b = %q, %v, want 2", b, err)
+	}
+	if m, err := v.meta.Get("vol"); err != nil || m.SeededAt == nil || len(m.Mounts) != 1 {
+		t.Errorf("metadata after the mount = %+v, %v, want it seeded and mounted once", m, err)
+	}
+	v.m.Lock()
+	err = v.releaseLease(context.Background(), "vol", "data")
+	v.m.Unlock()
+	if err != nil {
+		t.Errorf("releaseLease failed: %v", err)
+	}
+}
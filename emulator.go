@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// emulatorAccountName and emulatorAccountKey are the well-known
+	// development credentials of the storage emulators.
+	emulatorAccountName = "devstoreaccount1"
+	emulatorAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+	// defaultEmulatorShares is the directory backing the shares of volumes
+	// when running against an emulator.
+	defaultEmulatorShares = "/var/lib/azurefile-emulator"
+)
+
+// errNoEmulatorEndpoint is returned in emulator mode without an endpoint:
+// neither Azurite nor the legacy storage emulator serve the File service, so
+// there is no well-known endpoint to default to.
+var errNoEmulatorEndpoint = errors.New("emulator mode needs the File service endpoint of the emulator in --storage-endpoint or the FileEndpoint of the connection string")
+
+// parseStorageEndpoint parses the --storage-endpoint flag, the File service
+// endpoint used instead of https://<account>.file.<storage base>. Requests
+// are addressed path-style (the account name is the first path segment) as
+// storage emulators expect.
+func parseStorageEndpoint(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid storage endpoint %q, must be an http(s) URL", s)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid storage endpoint %q, must not have a query", s)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// mountLocal stands in for CIFS and NFS mounts when the shares are provided
+// by an emulator, which does not serve SMB: the directory under sharesDir
+// backing the share is bind-mounted at mountPath instead, so unmounts and
+// mount table lookups behave as with real mounts.
+func mountLocal(ctx context.Context, sharesDir, mountPath string, options VolumeOptions) error {
+	src := filepath.Join(sharesDir, options.Share, filepath.Clean("/"+options.RemotePath))
+	if err := os.MkdirAll(src, 0755); err != nil {
+		return fmt.Errorf("cannot create local share directory: %v", err)
+	}
+	opts := "bind"
+	if options.ReadOnly {
+		opts += ",ro"
+	}
+	return runMount(ctx, exec.CommandContext(ctx, "mount", "-o", opts, src, mountPath))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errorCode is a stable, machine-readable class of failure included in the
+// errors returned to Docker, so that tooling can branch on it instead of
+// matching messages. Retryable codes describe transient failures, such as
+// network errors and timeouts, which retrying the operation later may get
+// past; retrying the others fails again until something is changed.
+type errorCode struct {
+	id        string
+	name      string
+	retryable bool
+}
+
+var (
+	codeInternal         = errorCode{"AZF000", "Internal", false}
+	codeShareNotFound    = errorCode{"AZF001", "ShareNotFound", false}
+	codeAuthFailed       = errorCode{"AZF002", "AuthFailed", false}
+	codeMountBusy        = errorCode{"AZF003", "MountBusy", true}
+	codeInvalidOptions   = errorCode{"AZF004", "InvalidOptions", false}
+	codeVolumeNotFound   = errorCode{"AZF005", "VolumeNotFound", false}
+	codePolicyDenied     = errorCode{"AZF006", "PolicyDenied", false}
+	codeNamespace        = errorCode{"AZF007", "NamespaceViolation", false}
+	codeAccountMismatch  = errorCode{"AZF008", "AccountMismatch", false}
+	codeStorageAPI       = errorCode{"AZF009", "StorageAPIError", false}
+	codeMountFailed      = errorCode{"AZF010", "MountFailed", false}
+	codeNameResolution   = errorCode{"AZF011", "NameResolution", true}
+	codeProtocolMismatch = errorCode{"AZF012", "ProtocolMismatch", false}
+	codeUnreachable      = errorCode{"AZF013", "EndpointUnreachable", true}
+	codeThrottled        = errorCode{"AZF014", "Throttled", true}
+	codeNotEmpty         = errorCode{"AZF015", "MountpointNotEmpty", false}
+	codeShareExists      = errorCode{"AZF016", "ShareExists", false}
+	codeUnavailable      = errorCode{"AZF017", "StorageUnavailable", true}
+	codeTimeout          = errorCode{"AZF018", "Timeout", true}
+	codeShareInUse       = errorCode{"AZF019", "ShareInUse", false}
+	codeProtected        = errorCode{"AZF020", "Protected", false}
+	codeVolumeMounted    = errorCode{"AZF021", "VolumeMounted", false}
+	codeLeased           = errorCode{"AZF022", "Leased", true}
+	codeDraining         = errorCode{"AZF023", "Draining", false}
+	codeNetwork          = errorCode{"AZF024", "NetworkError", true}
+	codeServerError      = errorCode{"AZF025", "StorageServerError", true}
+	codeVolumeBusy       = errorCode{"AZF026", "VolumeBusy", true}
+)
+
+// codedError is an error annotated with an error code. Its message is
+// prefixed with the code, e.g. "AZF002 AuthFailed: mount failed: ...", and
+// suffixed with "(retryable)" if the code is retryable.
+type codedError struct {
+	code errorCode
+	err  error
+}
+
+func (e *codedError) Error() string {
+	if e.code.retryable {
+		return fmt.Sprintf("%s %s: %v (retryable)", e.code.id, e.code.name, e.err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.code.id, e.code.name, e.err)
+}
+
+// retryable returns true if err is a transient failure (see errorCode).
+func retryable(err error) bool {
+	return classify(err, codeInternal).retryable
+}
+
+// newError returns an error with the code and the formatted message.
+func newError(code errorCode, format string, args ...interface{}) error {
+	return &codedError{code, fmt.Errorf(format, unwrapCoded(args)...)}
+}
+
+// wrapError returns an error with the formatted message describing the
+// failure err, annotated with the code of err (see classify) or fallback if
+// err does not indicate a specific class of failure.
+func wrapError(err error, fallback errorCode, format string, args ...interface{}) error {
+	return newError(classify(err, fallback), format, args...)
+}
+
+// unwrapCoded replaces coded errors in args with the errors they annotate so
+// that codes are not repeated in wrapped messages.
+func unwrapCoded(args []interface{}) []interface{} {
+	out := make([]interface{}, len(args))
+	for i, a := range args {
+		if e, ok := a.(*codedError); ok {
+			a = e.err
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// classify returns the error code describing err, or fallback if err does not
+// indicate a specific class of failure.
+func classify(err error, fallback errorCode) errorCode {
+	if err == context.DeadlineExceeded {
+		return codeTimeout
+	}
+	switch e := err.(type) {
+	case *codedError:
+		return e.code
+	case *fileServiceError:
+		return classifyStatus(e.StatusCode)
+	case *breakerOpenError:
+		return codeUnavailable
+	case *url.Error:
+		if e.Err == context.DeadlineExceeded {
+			return codeTimeout
+		}
+		if _, ok := e.Err.(net.Error); ok {
+			return codeNetwork // e.g. refused or reset connections
+		}
+	case *net.DNSError:
+		return codeNameResolution
+	case *mountError:
+		out := string(e.output)
+		switch {
+		case e.err == context.DeadlineExceeded:
+			return codeTimeout
+		case isNameResolutionFailure(e):
+			return codeNameResolution
+		case isProtocolMismatch(e):
+			return codeProtocolMismatch
+		case strings.Contains(out, "error(13)"):
+			return codeAuthFailed
+		case strings.Contains(out, "error(2)"):
+			return codeShareNotFound
+		case strings.Contains(out, "error(16)"), strings.Contains(out, "busy"):
+			return codeMountBusy
+		case strings.Contains(out, "error(112)"), strings.Contains(out, "error(113)"), strings.Contains(out, "error(115)"):
+			return codeUnreachable
+		}
+		return codeMountFailed
+	}
+	return fallback
+}
+
+func classifyStatus(code int) errorCode {
+	switch code {
+	case http.StatusNotFound:
+		return codeShareNotFound
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return codeAuthFailed
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return codeThrottled
+	}
+	if code >= 500 {
+		return codeServerError
+	}
+	return codeStorageAPI
+}
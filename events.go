@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultEventCount is the number of operations kept by the event ring unless
+// set with --events.
+const defaultEventCount = 200
+
+// unrecordedOperations are not recorded as events: Docker calls them
+// constantly and they change nothing.
+var unrecordedOperations = []string{"get", "list", "path"}
+
+// event is a finished operation of the driver, as listed by GET /events.
+type event struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Volume    string    `json:"volume,omitempty"`
+	Request   string    `json:"request"`
+	Duration  float64   `json:"duration_seconds"`
+	Error     string    `json:"error,omitempty"` // empty if the operation succeeded
+}
+
+// eventRing keeps the last events in memory.
+type eventRing struct {
+	m      sync.Mutex
+	events []event // used as a ring buffer once full
+	next   int     // index of the oldest event once full
+	size   int
+}
+
+// events records the operations of the driver, see request.finish.
+var events = newEventRing(defaultEventCount)
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{size: size}
+}
+
+// add records the event, replacing the oldest one if the ring is full.
+func (e *eventRing) add(ev event) {
+	if contains(unrecordedOperations, ev.Operation) {
+		return
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.size <= 0 {
+		return
+	}
+	if len(e.events) < e.size {
+		e.events = append(e.events, ev)
+		return
+	}
+	e.events[e.next] = ev
+	e.next = (e.next + 1) % e.size
+}
+
+// list returns the events, most recent first.
+func (e *eventRing) list() []event {
+	e.m.Lock()
+	defer e.m.Unlock()
+	out := make([]event, 0, len(e.events))
+	for i := len(e.events) - 1; i >= 0; i-- {
+		out = append(out, e.events[(e.next+i)%len(e.events)])
+	}
+	return out
+}
+
+// handleEvents lists the recent operations, most recent first, optionally
+// filtered by the 'volume' and 'operation' query parameters, only the failed
+// ones with 'failed=true', and at most 'limit' of them.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	var failed bool
+	if s := q.Get("failed"); s != "" {
+		var err error
+		if failed, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "'failed' must be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := -1
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "'limit' must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	out := []event{}
+	for _, ev := range events.list() {
+		if len(out) == limit {
+			break
+		}
+		if failed && ev.Error == "" ||
+			q.Get("volume") != "" && ev.Volume != q.Get("volume") ||
+			q.Get("operation") != "" && ev.Operation != q.Get("operation") {
+			continue
+		}
+		out = append(out, ev)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,949 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// defaultFileAPIVersion supports all the features of the driver, see
+	// requireAPIVersion.
+	defaultFileAPIVersion = "2020-02-10"
+
+	// snapshotAPIVersion is the first x-ms-version supporting share
+	// snapshots.
+	snapshotAPIVersion = "2017-04-17"
+
+	// nfsAPIVersion is the first x-ms-version supporting NFS shares.
+	nfsAPIVersion = "2020-02-10"
+
+	// leaseAPIVersion is the first x-ms-version supporting share leases.
+	leaseAPIVersion = "2020-02-10"
+
+	// softDeleteAPIVersion is the first x-ms-version listing and restoring
+	// soft-deleted shares.
+	softDeleteAPIVersion = "2019-12-12"
+
+	// tierAPIVersion is the first x-ms-version supporting share access
+	// tiers.
+	tierAPIVersion = "2019-12-12"
+
+	// permissionAPIVersion is the first x-ms-version setting the security
+	// descriptors of files and directories.
+	permissionAPIVersion = "2019-02-02"
+
+	// Throttled requests are retried up to throttleRetries times, waiting for
+	// the Retry-After duration of the response (capped at maxThrottleWait) or
+	// an exponential backoff if the service does not specify one.
+	throttleRetries        = 5
+	throttleInitialBackoff = time.Second
+	maxThrottleWait        = 30 * time.Second
+)
+
+// fileClient is a minimal client for the Azure File Service REST API,
+// implementing the operations the driver needs.
+type fileClient struct {
+	accountName string
+	accountKey  []byte
+	key         string // accountKey as given, base64-encoded
+	storageBase string
+	endpoint    *url.URL         // used instead of https://<account>.file.<storage base> if set, see parseStorageEndpoint
+	pressure    *pressureTracker // records the throttled and slow requests, nil for none
+	breakers    *breakers        // fail fast while the account is failing, nil for never
+	apiVersion  string           // x-ms-version of the requests, see --storage-api-version
+	management  *armShares       // see arm
+	hc          *http.Client
+	ctx         context.Context // bounds the requests, nil for no bound
+}
+
+// fileServiceError is the error returned when the File service responds with
+// a non-successful status code.
+type fileServiceError struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *fileServiceError) Error() string {
+	return fmt.Sprintf("file service returned %d (%s): %s", e.StatusCode, e.Code, strings.TrimSpace(e.Message))
+}
+
+// dirEntry is an item returned from listing a directory.
+type dirEntry struct {
+	Name  string
+	IsDir bool
+	Size  int64
+}
+
+func newFileClient(accountName, accountKey, storageBase string, endpoint *url.URL) (*fileClient, error) {
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("account key is not valid base64: %v", err)
+	}
+	return &fileClient{
+		accountName: accountName,
+		accountKey:  key,
+		key:         accountKey,
+		storageBase: storageBase,
+		endpoint:    endpoint,
+		apiVersion:  defaultFileAPIVersion,
+		hc:          storageHTTPClient,
+	}, nil
+}
+
+// arm returns the Azure Resource Manager client managing the shares of the
+// account with an Azure AD identity, or nil if the account key is used.
+func (c *fileClient) arm() *armShares {
+	return c.management
+}
+
+// withContext returns a copy of the client whose requests are cancelled when
+// ctx is done.
+func (c *fileClient) withContext(ctx context.Context) *fileClient {
+	cc := *c
+	cc.ctx = ctx
+	return &cc
+}
+
+// fileURL returns the URL for the resource at path (share name followed by
+// optional directory/file segments) with the given query parameters.
+func (c *fileClient) fileURL(path string, q url.Values) *url.URL {
+	path = "/" + strings.TrimPrefix(path, "/")
+	if c.endpoint != nil {
+		return &url.URL{
+			Scheme:   c.endpoint.Scheme,
+			Host:     c.endpoint.Host,
+			Path:     c.endpoint.Path + "/" + c.accountName + path,
+			RawQuery: q.Encode(),
+		}
+	}
+	return &url.URL{
+		Scheme:   "https",
+		Host:     fmt.Sprintf("%s.file.%s", c.accountName, c.storageBase),
+		Path:     path,
+		RawQuery: q.Encode(),
+	}
+}
+
+// do executes a signed request against the File service. The x-ms-version
+// header can be overridden through headers. Responses with a
+// status code of 400 or higher are returned as *fileServiceError and their
+// body is consumed. Throttled requests are retried.
+func (c *fileClient) do(method, path string, q url.Values, headers map[string]string) (*http.Response, error) {
+	b := c.breakers.get(c.accountName)
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	backoff := throttleInitialBackoff
+	for i := 0; ; i++ {
+		start := time.Now()
+		resp, err := c.doOnce(method, path, q, headers)
+		c.pressure.observe(c.accountName, requestShare(path), time.Since(start), isThrottled(resp))
+		if !isThrottled(resp) || i == throttleRetries {
+			b.record(isUnavailable(err))
+			return resp, err
+		}
+		wait := retryAfter(resp, backoff)
+		storageThrottled.inc(c.accountName)
+		log.Debugf("%s %s throttled by the storage account, retrying in %v", method, path, wait)
+		if err := c.sleep(wait); err != nil {
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// sleep waits for d, or returns the error of the context of the client if it
+// is done first.
+func (c *fileClient) sleep(d time.Duration) error {
+	if c.ctx == nil {
+		time.Sleep(d)
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+// isThrottled returns true if the File service rejected the request because
+// the account is over its limits.
+func isThrottled(resp *http.Response) bool {
+	return resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable)
+}
+
+// retryAfter returns how long to wait as specified by the Retry-After header
+// of the response, in seconds or as an HTTP date, or def if it is missing.
+func retryAfter(resp *http.Response, def time.Duration) time.Duration {
+	wait := def
+	if h := resp.Header.Get("Retry-After"); h != "" {
+		if s, err := strconv.Atoi(h); err == nil && s >= 0 {
+			wait = time.Duration(s) * time.Second
+		} else if t, err := http.ParseTime(h); err == nil {
+			wait = t.Sub(time.Now())
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	} else if wait > maxThrottleWait {
+		wait = maxThrottleWait
+	}
+	return wait
+}
+
+func (c *fileClient) doOnce(method, path string, q url.Values, headers map[string]string) (*http.Response, error) {
+	u := c.fileURL(path, q)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %v", err)
+	}
+	if c.ctx != nil {
+		req = req.WithContext(c.ctx)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if req.Header.Get("x-ms-version") == "" {
+		req.Header.Set("x-ms-version", c.apiVersion)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", c.accountName, c.sign(req)))
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		e := &fileServiceError{StatusCode: resp.StatusCode}
+		if b, err := ioutil.ReadAll(resp.Body); err == nil && len(b) > 0 {
+			xml.Unmarshal(b, e)
+		}
+		if e.Code == "" {
+			e.Code = http.StatusText(resp.StatusCode)
+		}
+		return resp, e
+	}
+	return resp, nil
+}
+
+// sign computes the Shared Key signature of the request.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (c *fileClient) sign(req *http.Request) string {
+	var msHeaders []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			msHeaders = append(msHeaders, lk)
+		}
+	}
+	sort.Strings(msHeaders)
+	var canonHeaders string
+	for _, k := range msHeaders {
+		canonHeaders += fmt.Sprintf("%s:%s\n", k, strings.TrimSpace(req.Header.Get(k)))
+	}
+
+	canonResource := "/" + c.accountName + req.URL.EscapedPath()
+	q := req.URL.Query()
+	var params []string
+	for k := range q {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		vals := q[k]
+		sort.Strings(vals)
+		canonResource += fmt.Sprintf("\n%s:%s", strings.ToLower(k), strings.Join(vals, ","))
+	}
+
+	contentLength := req.Header.Get("Content-Length")
+	if contentLength == "0" {
+		contentLength = ""
+	}
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		canonHeaders + canonResource,
+	}, "\n")
+	return c.hmac(toSign)
+}
+
+func (c *fileClient) hmac(s string) string {
+	h := hmac.New(sha256.New, c.accountKey)
+	h.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Permissions granted by shared access signatures.
+const (
+	sasRead  = "rl"
+	sasWrite = "rcwl" // create and write files, without deleting any
+)
+
+// shareSAS returns a service shared access signature query string granting
+// the permissions to the share only until the specified time.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/create-service-sas
+func (c *fileClient) shareSAS(share, permissions string, expiry time.Time) string {
+	q := url.Values{
+		"sv":  {c.apiVersion},
+		"sr":  {"s"},
+		"sp":  {permissions},
+		"se":  {expiry.UTC().Format("2006-01-02T15:04:05Z")},
+		"spr": {"https"},
+	}
+	toSign := strings.Join([]string{
+		q.Get("sp"),
+		"", // start time
+		q.Get("se"),
+		"/file/" + c.accountName + "/" + share,
+		"", // stored access policy
+		"", // ip range
+		q.Get("spr"),
+		q.Get("sv"),
+		"", "", "", "", "", // response headers
+	}, "\n")
+	q.Set("sig", c.hmac(toSign))
+	return q.Encode()
+}
+
+// shareProperties are the settings applied to a share when it is created.
+type shareProperties struct {
+	QuotaGiB int    // maximum size of the share, zero for the service default
+	Protocol string // "nfs" for NFS shares, empty for SMB
+	Squash   string // root squash mode of NFS shares, see rootSquashModes
+	Tier     string // access tier, empty for the account default
+
+	// Metadata is set on the share, names must match shareMetadataNameRe.
+	Metadata map[string]string
+
+	// LargeShare enables large file shares on the account through Azure
+	// Resource Manager if needed (the File service cannot).
+	LargeShare bool
+}
+
+// createShareIfNotExists creates the share and returns true, or returns false
+// if the share already exists (in which case props are not applied).
+func (c *fileClient) createShareIfNotExists(share string, props shareProperties) (bool, error) {
+	if a := c.arm(); a != nil {
+		return a.createShareIfNotExists(c.ctx, share, props)
+	}
+	headers := make(map[string]string)
+	if props.QuotaGiB > 0 {
+		headers["x-ms-share-quota"] = strconv.Itoa(props.QuotaGiB)
+	}
+	if props.Protocol == protocolNFS {
+		if err := c.requireAPIVersion(nfsAPIVersion, "NFS shares"); err != nil {
+			return false, err
+		}
+		headers["x-ms-enabled-protocols"] = "NFS"
+		if props.Squash != "" {
+			headers["x-ms-root-squash"] = rootSquashModes[props.Squash]
+		}
+	}
+	if props.Tier != "" {
+		if err := c.requireAPIVersion(tierAPIVersion, "access tiers"); err != nil {
+			return false, err
+		}
+		headers["x-ms-access-tier"] = props.Tier
+	}
+	for k, v := range props.Metadata {
+		headers["x-ms-meta-"+k] = v
+	}
+	resp, err := c.do("PUT", share, url.Values{"restype": {"share"}}, headers)
+	if err != nil {
+		if e, ok := err.(*fileServiceError); ok && e.Code == "ShareAlreadyExists" {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// setShareQuota sets the maximum size of the share in GiB.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/set-share-properties
+func (c *fileClient) setShareQuota(share string, quotaGiB int) error {
+	if a := c.arm(); a != nil {
+		return a.updateShare(c.ctx, share, armShareProperties{ShareQuota: quotaGiB})
+	}
+	resp, err := c.do("PUT", share, url.Values{"restype": {"share"}, "comp": {"properties"}},
+		map[string]string{"x-ms-share-quota": strconv.Itoa(quotaGiB)})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// setShareTier sets the access tier of the share.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/set-share-properties
+func (c *fileClient) setShareTier(share, tier string) error {
+	if a := c.arm(); a != nil {
+		return a.updateShare(c.ctx, share, armShareProperties{AccessTier: tier})
+	}
+	if err := c.requireAPIVersion(tierAPIVersion, "access tiers"); err != nil {
+		return err
+	}
+	resp, err := c.do("PUT", share, url.Values{"restype": {"share"}, "comp": {"properties"}}, map[string]string{
+		"x-ms-access-tier": tier,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// deleteShareIfExists deletes the share, along with its snapshots if
+// snapshots is set (shares with snapshots cannot be deleted otherwise), and
+// returns true, or returns false if the share does not exist.
+func (c *fileClient) deleteShareIfExists(share string, snapshots bool) (bool, error) {
+	if a := c.arm(); a != nil {
+		return a.deleteShareIfExists(c.ctx, share, snapshots)
+	}
+	var headers map[string]string
+	if snapshots {
+		headers = map[string]string{"x-ms-delete-snapshots": "include"}
+	}
+	resp, err := c.do("DELETE", share, url.Values{"restype": {"share"}}, headers)
+	if err != nil {
+		if e, ok := err.(*fileServiceError); ok && e.Code == "ShareNotFound" {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// createDirectory creates the directory at path under the share. It does not
+// fail if the directory already exists.
+func (c *fileClient) createDirectory(share, path string) error {
+	resp, err := c.do("PUT", share+"/"+path, url.Values{"restype": {"directory"}}, nil)
+	if err != nil {
+		if e, ok := err.(*fileServiceError); ok && e.Code == "ResourceAlreadyExists" {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// deleteTree deletes the directory at path under the share along with
+// everything under it. It does not fail if the directory does not exist.
+func (c *fileClient) deleteTree(share, path string) error {
+	entries, err := c.listDirectory(share, "", path)
+	if err != nil {
+		if e, ok := err.(*fileServiceError); ok && e.Code == "ResourceNotFound" {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		p := path + "/" + e.Name
+		if e.IsDir {
+			err = c.deleteTree(share, p)
+		} else {
+			err = c.deleteResource(share, p, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.deleteResource(share, path, url.Values{"restype": {"directory"}})
+}
+
+// deleteResource deletes the file, or the empty directory if q sets its
+// restype, at path under the share. It does not fail if it does not exist.
+func (c *fileClient) deleteResource(share, path string, q url.Values) error {
+	resp, err := c.do("DELETE", share+"/"+path, q, nil)
+	if err != nil {
+		if e, ok := err.(*fileServiceError); ok && e.Code == "ResourceNotFound" {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// setDirectoryPermission sets the security descriptor of the directory at path
+// under the share (the root directory if path is empty), given in SDDL,
+// keeping its other properties.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/set-directory-properties
+func (c *fileClient) setDirectoryPermission(share, path, sddl string) error {
+	if err := c.requireAPIVersion(permissionAPIVersion, "security descriptors"); err != nil {
+		return err
+	}
+	resp, err := c.do("PUT", share+"/"+path, url.Values{"restype": {"directory"}, "comp": {"properties"}}, map[string]string{
+		"x-ms-file-permission":      sddl,
+		"x-ms-file-attributes":      "preserve",
+		"x-ms-file-creation-time":   "preserve",
+		"x-ms-file-last-write-time": "preserve",
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// createDirectories creates the directory at path under the share along with
+// any missing parents.
+func (c *fileClient) createDirectories(share, path string) error {
+	var p string
+	for _, d := range strings.Split(path, "/") {
+		if p != "" {
+			p += "/"
+		}
+		p += d
+		if err := c.createDirectory(share, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listDirectory returns the files and directories immediately under path in
+// the share, or in the share snapshot if snapshot is not empty. An empty path
+// lists the root directory.
+func (c *fileClient) listDirectory(share, snapshot, path string) ([]dirEntry, error) {
+	var (
+		entries []dirEntry
+		marker  string
+	)
+	p := share
+	if path != "" {
+		p += "/" + path
+	}
+	for {
+		q := url.Values{"restype": {"directory"}, "comp": {"list"}}
+		if snapshot != "" {
+			q.Set("sharesnapshot", snapshot)
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := c.do("GET", p, q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Files []struct {
+				Name string `xml:"Name"`
+				Size int64  `xml:"Properties>Content-Length"`
+			} `xml:"Entries>File"`
+			Directories []struct {
+				Name string `xml:"Name"`
+			} `xml:"Entries>Directory"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse directory listing: %v", err)
+		}
+		for _, d := range out.Directories {
+			entries = append(entries, dirEntry{Name: d.Name, IsDir: true})
+		}
+		for _, f := range out.Files {
+			entries = append(entries, dirEntry{Name: f.Name, Size: f.Size})
+		}
+		if out.NextMarker == "" {
+			return entries, nil
+		}
+		marker = out.NextMarker
+	}
+}
+
+// copyFile starts a server-side copy of sourceURL into path in the share and
+// returns the copy status reported by the service ("success" or "pending").
+func (c *fileClient) copyFile(share, path, sourceURL string) (string, error) {
+	resp, err := c.do("PUT", share+"/"+path, nil, map[string]string{"x-ms-copy-source": sourceURL})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("x-ms-copy-status"), nil
+}
+
+// copyStatus returns the status of the last copy operation whose destination
+// was the file at path, along with the status description.
+func (c *fileClient) copyStatus(share, path string) (string, string, error) {
+	resp, err := c.do("HEAD", share+"/"+path, nil, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("x-ms-copy-status"), resp.Header.Get("x-ms-copy-status-description"), nil
+}
+
+// shareUsage returns the approximate number of bytes stored in the share.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/get-share-stats
+func (c *fileClient) shareUsage(share string) (int64, error) {
+	resp, err := c.do("GET", share, url.Values{"restype": {"share"}, "comp": {"stats"}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		UsageGiB   int64 `xml:"ShareUsage"`
+		UsageBytes int64 `xml:"ShareUsageBytes"` // only in newer API versions
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, fmt.Errorf("cannot parse share stats: %v", err)
+	}
+	if out.UsageBytes > 0 {
+		return out.UsageBytes, nil
+	}
+	return out.UsageGiB << 30, nil
+}
+
+// shareExists returns whether the share exists.
+func (c *fileClient) shareExists(share string) (bool, error) {
+	if a := c.arm(); a != nil {
+		return a.shareExists(c.ctx, share)
+	}
+	resp, err := c.do("HEAD", share, url.Values{"restype": {"share"}}, nil)
+	if err != nil {
+		if e, ok := err.(*fileServiceError); ok && e.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// shareSnapshot describes a snapshot returned from listing the snapshots of a
+// share. The File service does not report the size of snapshots; QuotaGiB is
+// the quota of the share when the snapshot was taken.
+type shareSnapshot struct {
+	Snapshot     string `json:"snapshot"`
+	LastModified string `json:"lastModified,omitempty"`
+	QuotaGiB     int    `json:"quotaGiB,omitempty"`
+}
+
+// listSnapshots returns the snapshots of the share, oldest first.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/list-shares
+func (c *fileClient) listSnapshots(share string) ([]shareSnapshot, error) {
+	if a := c.arm(); a != nil {
+		return a.listSnapshots(c.ctx, share)
+	}
+	if err := c.requireAPIVersion(snapshotAPIVersion, "share snapshots"); err != nil {
+		return nil, err
+	}
+	var (
+		snapshots []shareSnapshot
+		marker    string
+	)
+	for {
+		q := url.Values{"comp": {"list"}, "include": {"snapshots"}, "prefix": {share}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := c.do("GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Shares []struct {
+				Name         string `xml:"Name"`
+				Snapshot     string `xml:"Snapshot"`
+				LastModified string `xml:"Properties>Last-Modified"`
+				Quota        int    `xml:"Properties>Quota"`
+			} `xml:"Shares>Share"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse share listing: %v", err)
+		}
+		for _, s := range out.Shares {
+			// the prefix also matches other shares starting with the name
+			if s.Name == share && s.Snapshot != "" {
+				snapshots = append(snapshots, shareSnapshot{s.Snapshot, s.LastModified, s.Quota})
+			}
+		}
+		if out.NextMarker == "" {
+			return snapshots, nil
+		}
+		marker = out.NextMarker
+	}
+}
+
+// createSnapshot creates a read-only snapshot of the share and returns its
+// identifier (the snapshot timestamp).
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/snapshot-share
+func (c *fileClient) createSnapshot(share string) (string, error) {
+	if a := c.arm(); a != nil {
+		return a.createSnapshot(c.ctx, share)
+	}
+	if err := c.requireAPIVersion(snapshotAPIVersion, "share snapshots"); err != nil {
+		return "", err
+	}
+	resp, err := c.do("PUT", share, url.Values{"restype": {"share"}, "comp": {"snapshot"}}, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("x-ms-snapshot"), nil
+}
+
+// shareInfo is a share of the account with the properties the driver
+// provisions.
+type shareInfo struct {
+	Name     string
+	QuotaGiB int
+	Protocol string // "nfs" for NFS shares, empty for SMB
+	Squash   string // root squash mode of NFS shares, see rootSquashModes
+	Tier     string
+	Metadata map[string]string
+}
+
+// listShares returns the shares of the account whose name starts with
+// prefix, without their snapshots.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/list-shares
+func (c *fileClient) listShares(prefix string) ([]shareInfo, error) {
+	if a := c.arm(); a != nil {
+		return a.listShares(c.ctx, prefix)
+	}
+	var (
+		shares []shareInfo
+		marker string
+	)
+	for {
+		q := url.Values{"comp": {"list"}, "include": {"metadata"}}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := c.do("GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Shares []struct {
+				Name       string `xml:"Name"`
+				Quota      int    `xml:"Properties>Quota"`
+				Protocols  string `xml:"Properties>EnabledProtocols"`
+				RootSquash string `xml:"Properties>RootSquash"`
+				AccessTier string `xml:"Properties>AccessTier"`
+				Metadata   struct {
+					Items []struct {
+						XMLName xml.Name
+						Value   string `xml:",chardata"`
+					} `xml:",any"`
+				} `xml:"Metadata"`
+			} `xml:"Shares>Share"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse share listing: %v", err)
+		}
+		for _, s := range out.Shares {
+			info := shareInfo{Name: s.Name, QuotaGiB: s.Quota, Tier: s.AccessTier}
+			if strings.EqualFold(s.Protocols, "NFS") {
+				info.Protocol = protocolNFS
+				info.Squash = squashMode(s.RootSquash)
+			}
+			for _, m := range s.Metadata.Items {
+				if info.Metadata == nil {
+					info.Metadata = make(map[string]string)
+				}
+				info.Metadata[m.XMLName.Local] = m.Value
+			}
+			shares = append(shares, info)
+		}
+		if out.NextMarker == "" {
+			return shares, nil
+		}
+		marker = out.NextMarker
+	}
+}
+
+// squashMode returns the 'squash' option value of the root squash setting of
+// a share, empty if unknown.
+func squashMode(rootSquash string) string {
+	for k, v := range rootSquashModes {
+		if strings.EqualFold(v, rootSquash) {
+			return k
+		}
+	}
+	return ""
+}
+
+// deletedShare is a soft-deleted share, which can be restored until its
+// retention period is over.
+type deletedShare struct {
+	Version       string `json:"version"`
+	DeletedTime   string `json:"deletedTime"`
+	RemainingDays int    `json:"remainingRetentionDays"`
+}
+
+// listDeletedShares returns the soft-deleted versions of the share, in the
+// order they were deleted. It returns none if the storage account does not
+// have share soft delete enabled.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/list-shares
+func (c *fileClient) listDeletedShares(share string) ([]deletedShare, error) {
+	var (
+		deleted []deletedShare
+		marker  string
+	)
+	if err := c.requireAPIVersion(softDeleteAPIVersion, "soft-deleted shares"); err != nil {
+		return nil, err
+	}
+	for {
+		q := url.Values{"comp": {"list"}, "include": {"deleted"}, "prefix": {share}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := c.do("GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Shares []struct {
+				Name          string `xml:"Name"`
+				Deleted       bool   `xml:"Deleted"`
+				Version       string `xml:"Version"`
+				DeletedTime   string `xml:"Properties>DeletedTime"`
+				RemainingDays int    `xml:"Properties>RemainingRetentionDays"`
+			} `xml:"Shares>Share"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse share listing: %v", err)
+		}
+		for _, s := range out.Shares {
+			if s.Name == share && s.Deleted {
+				deleted = append(deleted, deletedShare{s.Version, s.DeletedTime, s.RemainingDays})
+			}
+		}
+		if out.NextMarker == "" {
+			sort.Stable(byDeletedTime(deleted))
+			return deleted, nil
+		}
+		marker = out.NextMarker
+	}
+}
+
+type byDeletedTime []deletedShare
+
+func (s byDeletedTime) Len() int           { return len(s) }
+func (s byDeletedTime) Less(i, j int) bool { return s[i].deletedAt().Before(s[j].deletedAt()) }
+func (s byDeletedTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// deletedAt parses the deletion time of the share, zero if malformed.
+func (s deletedShare) deletedAt() time.Time {
+	t, _ := time.Parse(http.TimeFormat, s.DeletedTime)
+	return t
+}
+
+// undeleteShare restores the soft-deleted version of the share, which must
+// not exist.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/restore-share
+func (c *fileClient) undeleteShare(share, version string) error {
+	if err := c.requireAPIVersion(softDeleteAPIVersion, "soft-deleted shares"); err != nil {
+		return err
+	}
+	resp, err := c.do("PUT", share, url.Values{"restype": {"share"}, "comp": {"undelete"}}, map[string]string{
+		"x-ms-deleted-share-name":    share,
+		"x-ms-deleted-share-version": version,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// leaseShare performs the lease action (acquire, renew or release) on the
+// share with the lease ID. Acquired leases expire after duration unless
+// renewed. Acquiring a lease already held with the same ID renews it.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/lease-share
+func (c *fileClient) leaseShare(share, action, id string, duration time.Duration) error {
+	if err := c.requireAPIVersion(leaseAPIVersion, "share leases"); err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"x-ms-lease-action": action,
+	}
+	if action == "acquire" {
+		headers["x-ms-proposed-lease-id"] = id
+		headers["x-ms-lease-duration"] = strconv.Itoa(int(duration / time.Second))
+	} else {
+		headers["x-ms-lease-id"] = id
+	}
+	resp, err := c.do("PUT", share, url.Values{"restype": {"share"}, "comp": {"lease"}}, headers)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// validateAPIVersion checks that v looks like a storage service version
+// (a YYYY-MM-DD date).
+func validateAPIVersion(v string) error {
+	if _, err := time.Parse("2006-01-02", v); err != nil {
+		return fmt.Errorf("invalid storage API version %q, must be a date like %s", v, defaultFileAPIVersion)
+	}
+	return nil
+}
+
+// requireAPIVersion returns an error if the storage API version of the client
+// is older than min, which is needed for feature. Versions are dates, so they
+// compare as strings.
+func (c *fileClient) requireAPIVersion(min, feature string) error {
+	if c.apiVersion < min {
+		return fmt.Errorf("%s require storage API version %s or later, the driver is pinned to %s", feature, min, c.apiVersion)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// volumeFilter selects volumes by their metadata and mount state. Zero
+// fields match all volumes.
+type volumeFilter struct {
+	labels  map[string]string // an empty value matches any value of the label
+	share   string
+	account string
+	mounted *bool
+}
+
+// volumeSummary is an entry of the volume list of the admin API.
+type volumeSummary struct {
+	Name       string            `json:"name"`
+	Share      string            `json:"share"`
+	Account    string            `json:"account"`
+	Mountpoint string            `json:"mountpoint"`
+	Mounted    bool              `json:"mounted"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// parseVolumeFilter parses the filter from the query parameters 'label'
+// (repeatable, "key" or "key=value" as with docker volume ls), 'share',
+// 'account' and 'mounted'.
+func parseVolumeFilter(q url.Values) (volumeFilter, error) {
+	f := volumeFilter{
+		share:   q.Get("share"),
+		account: q.Get("account"),
+	}
+	for _, l := range q["label"] {
+		kv := strings.SplitN(l, "=", 2)
+		if kv[0] == "" {
+			return f, fmt.Errorf("invalid label filter %q", l)
+		}
+		if f.labels == nil {
+			f.labels = make(map[string]string)
+		}
+		if len(kv) == 2 {
+			f.labels[kv[0]] = kv[1]
+		} else {
+			f.labels[kv[0]] = ""
+		}
+	}
+	if s := q.Get("mounted"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return f, fmt.Errorf("invalid mounted filter %q, must be true or false", s)
+		}
+		f.mounted = &b
+	}
+	return f, nil
+}
+
+// empty returns true if the filter matches all volumes.
+func (f volumeFilter) empty() bool {
+	return len(f.labels) == 0 && f.share == "" && f.account == "" && f.mounted == nil
+}
+
+// match returns true if the volume with the metadata and mount state is
+// selected by the filter.
+func (f volumeFilter) match(meta volumeMetadata, mounted bool) bool {
+	if f.share != "" && meta.Options.Share != f.share {
+		return false
+	}
+	if f.account != "" && meta.Account != f.account {
+		return false
+	}
+	if f.mounted != nil && *f.mounted != mounted {
+		return false
+	}
+	for k, want := range f.labels {
+		got, ok := meta.Options.Labels[k]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// listVolumes returns the volumes in the namespace of the driver selected by
+// the filter, reading the mount table only once.
+func (v *volumeDriver) listVolumes(f volumeFilter) ([]volumeSummary, error) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	return v.listVolumesLocked(f)
+}
+
+// listVolumesLocked is listVolumes for callers holding the driver lock.
+func (v *volumeDriver) listVolumesLocked(f volumeFilter) ([]volumeSummary, error) {
+	var names []string
+	if f.share != "" {
+		names = v.meta.VolumesOfShare(f.share)
+	} else {
+		var err error
+		if names, err = v.meta.List(); err != nil {
+			return nil, newError(codeInternal, "failed to list managed volumes: %v", err)
+		}
+	}
+	mounted, err := mountPoints()
+	if err != nil {
+		return nil, newError(codeInternal, "%v", err)
+	}
+	vols := []volumeSummary{}
+	for _, name := range names {
+		path := v.pathForVolume(name)
+		meta, err := v.meta.Get(name)
+		if err != nil {
+			// unreadable metadata are still listed unless they need to be
+			// inspected
+			if v.sharePrefix == "" && f.empty() {
+				vols = append(vols, volumeSummary{Name: name, Mountpoint: path, Mounted: mounted[path]})
+			}
+			continue
+		}
+		if v.checkNamespace(meta) != nil {
+			continue
+		}
+		if !f.match(meta, mounted[path]) {
+			continue
+		}
+		vols = append(vols, volumeSummary{
+			Name:       name,
+			Share:      meta.Options.Share,
+			Account:    meta.Account,
+			Mountpoint: path,
+			Mounted:    mounted[path],
+			Labels:     meta.Options.Labels,
+		})
+	}
+	return vols, nil
+}
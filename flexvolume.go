@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// Options Kubernetes passes to FlexVolume drivers, besides those of the
+// volume definition.
+const (
+	flexOptionPrefix     = "kubernetes.io/"
+	flexReadWrite        = "kubernetes.io/readwrite"
+	flexFSGroup          = "kubernetes.io/mounterArgs.FsGroup"
+	flexSecretAccount    = "kubernetes.io/secret/accountname"
+	flexSecretAccountKey = "kubernetes.io/secret/accountkey"
+)
+
+// flexResult is the JSON reply of a FlexVolume driver call.
+type flexResult struct {
+	Status       string          `json:"status"` // Success, Failure or Not supported
+	Message      string          `json:"message,omitempty"`
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+}
+
+// flexVolumeCommand implements the Kubernetes FlexVolume driver protocol
+// (init, mount and unmount) on top of the share provisioning and mount code
+// of the Docker driver. Kubelet invokes it through a wrapper executable, see
+// contrib/flexvolume.
+var flexVolumeCommand = cli.Command{
+	Name:            "flexvolume",
+	Usage:           "Run as a Kubernetes FlexVolume driver: flexvolume init|mount <dir> <json>|unmount <dir>",
+	SkipFlagParsing: true,
+	Action: func(c *cli.Context) {
+		res := flexVolume(c, c.Args())
+		json.NewEncoder(os.Stdout).Encode(res)
+		if res.Status == "Failure" {
+			os.Exit(1)
+		}
+	},
+}
+
+func flexVolume(c *cli.Context, args []string) flexResult {
+	if len(args) == 0 {
+		return flexResult{Status: "Failure", Message: "missing FlexVolume operation"}
+	}
+	var err error
+	switch args[0] {
+	case "init":
+		// shares are provisioned on mount, no attach/detach step is needed
+		return flexResult{Status: "Success", Capabilities: map[string]bool{"attach": false}}
+	case "mount":
+		if len(args) != 3 {
+			return flexResult{Status: "Failure", Message: "usage: mount <mount dir> <json options>"}
+		}
+		err = flexMount(c, args[1], args[2])
+	case "unmount":
+		if len(args) != 2 {
+			return flexResult{Status: "Failure", Message: "usage: unmount <mount dir>"}
+		}
+		ctx, cancel := timeoutContext(c.GlobalDuration("mount-timeout"))
+		defer cancel()
+		err = unmount(ctx, args[1])
+	default:
+		return flexResult{Status: "Not supported"}
+	}
+	if err != nil {
+		return flexResult{Status: "Failure", Message: redact(err.Error())}
+	}
+	return flexResult{Status: "Success"}
+}
+
+// flexMount creates the share described by the JSON options unless it
+// exists and mounts it at dir. The account credentials are taken from the
+// secret of the volume if it has one, or from the driver flags otherwise.
+func flexMount(c *cli.Context, dir, options string) error {
+	var in map[string]string
+	if err := json.Unmarshal([]byte(options), &in); err != nil {
+		return newError(codeInvalidOptions, "cannot parse options: %v", err)
+	}
+	accountName, accountKey := c.GlobalString("account-name"), c.GlobalString("account-key")
+	storageBase := c.GlobalString("storage-base")
+	if s := c.GlobalString("connection-string"); s != "" && accountName == "" && accountKey == "" {
+		cs, err := parseConnectionString(s)
+		if err != nil {
+			return newError(codeInvalidOptions, "%v", err)
+		}
+		accountName, accountKey = cs.AccountName, cs.AccountKey
+		if cs.EndpointSuffix != "" {
+			storageBase = cs.EndpointSuffix
+		}
+	}
+	if s := in[flexSecretAccount]; s != "" {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return newError(codeInvalidOptions, "cannot decode account name of the secret: %v", err)
+		}
+		accountName = strings.TrimSpace(string(b))
+	}
+	if s := in[flexSecretAccountKey]; s != "" {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return newError(codeInvalidOptions, "cannot decode account key of the secret: %v", err)
+		}
+		accountKey = strings.TrimSpace(string(b))
+	}
+	if accountName == "" || accountKey == "" {
+		return newError(codeInvalidOptions, "azure storage account name and key must be provided through the secret of the volume or the driver flags")
+	}
+	registerSecret(accountKey)
+
+	opts := make(map[string]string)
+	for k, v := range in {
+		if !strings.HasPrefix(k, flexOptionPrefix) {
+			opts[k] = v
+		}
+	}
+	if in[flexReadWrite] == "ro" {
+		opts["ro"] = "true"
+	}
+	if g := in[flexFSGroup]; g != "" && opts["gid"] == "" {
+		opts["gid"] = g
+	}
+	meta, err := (&metadataDriver{}).Validate(opts)
+	if err != nil {
+		return newError(codeInvalidOptions, "error validating options: %v", err)
+	}
+	if meta.Options.Share == "" {
+		return newError(codeInvalidOptions, "missing volume option: 'share'")
+	}
+	if meta.Options.Domain == "" && meta.Options.Protocol != protocolNFS {
+		meta.Options.Domain = c.GlobalString("domain")
+	}
+
+	files, err := newFileClient(accountName, accountKey, storageBase, nil)
+	if err != nil {
+		return newError(codeInvalidOptions, "error creating azure client: %v", err)
+	}
+	ctx, cancel := timeoutContext(c.GlobalDuration("mount-timeout"))
+	defer cancel()
+	if meta.Options.Exists == existsUse {
+		if exists, err := files.withContext(ctx).shareExists(meta.Options.Share); err != nil {
+			return wrapError(err, codeStorageAPI, "error checking azure file share: %v", err)
+		} else if !exists {
+			return newError(codeShareNotFound, "azure file share %q does not exist and 'exists=use' is set", meta.Options.Share)
+		}
+	} else if _, err := files.withContext(ctx).createShareIfNotExists(meta.Options.Share, shareProperties{
+		QuotaGiB:   meta.Options.Quota,
+		Protocol:   meta.Options.Protocol,
+		Squash:     meta.Options.Squash,
+		Tier:       meta.Options.AccessTier,
+		Metadata:   meta.Options.Tags,
+		LargeShare: meta.Options.LargeShare,
+	}); err != nil {
+		return wrapError(err, codeStorageAPI, "error creating azure file share: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return newError(codeInternal, "could not create mount point: %v", err)
+	}
+	if _, err := mount(ctx, accountName, accountKey, storageBase, dir, meta.Options, smbVersions); err != nil {
+		return wrapError(err, codeMountFailed, "%v", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxIdleCheckInterval is the longest interval between two checks of the
+// mounted volumes for open files with --idle-unmount.
+const maxIdleCheckInterval = time.Minute
+
+// volumeBusy returns true if a process of the host, including those of
+// containers, has a file of the filesystem mounted at path open, or uses a
+// directory of it as working or root directory, or runs an executable of
+// it. Files are matched by device, as containers see them under other paths.
+func volumeBusy(path string) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	dev := fi.Sys().(*syscall.Stat_t).Dev
+	onVolume := func(link string) bool {
+		fi, err := os.Stat(link)
+		return err == nil && fi.Sys().(*syscall.Stat_t).Dev == dev
+	}
+	procs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return false, err
+	}
+	self := filepath.Join("/proc", strconv.Itoa(os.Getpid()))
+	for _, p := range procs {
+		if p == self {
+			continue
+		}
+		if onVolume(filepath.Join(p, "cwd")) || onVolume(filepath.Join(p, "root")) || onVolume(filepath.Join(p, "exe")) {
+			return true, nil
+		}
+		fds, err := ioutil.ReadDir(filepath.Join(p, "fd"))
+		if err != nil {
+			continue // exited or not accessible
+		}
+		for _, fd := range fds {
+			if onVolume(filepath.Join(p, "fd", fd.Name())) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// unmountIdleVolumes unmounts the volumes that had no open files for the idle
+// period, checking them periodically. Only volumes without mount records on
+// the host are unmounted (e.g. kept mounted with --keep-mounted, or left
+// mounted by a driver that was restarted): Docker, Nomad and the containers
+// holding a volume expect its mount to stay until they unmount it.
+// The metadata of the volumes is kept.
+func (v *volumeDriver) unmountIdleVolumes(idle time.Duration) {
+	interval := idle / 4
+	if interval > maxIdleCheckInterval {
+		interval = maxIdleCheckInterval
+	} else if interval < time.Second {
+		interval = time.Second
+	}
+	lastBusy := make(map[string]time.Time)
+	for range time.Tick(interval) {
+		mounted := true
+		vols, err := v.listVolumes(volumeFilter{mounted: &mounted})
+		if err != nil {
+			log.Errorf("idle unmount: %v", err)
+			continue
+		}
+		now := time.Now()
+		seen := make(map[string]time.Time, len(vols))
+		for _, vol := range vols {
+			busy, err := volumeBusy(vol.Mountpoint)
+			if err != nil {
+				log.WithField("name", vol.Name).Errorf("idle unmount: cannot check open files: %v", err)
+				busy = true
+			}
+			last, ok := lastBusy[vol.Name]
+			if busy || !ok {
+				last = now
+			}
+			seen[vol.Name] = last
+			if now.Sub(last) >= idle {
+				if v.unmountIdle(vol.Name) {
+					delete(seen, vol.Name)
+				}
+			}
+		}
+		lastBusy = seen
+	}
+}
+
+// unmountIdle unmounts the volume unless it became busy or has mount records
+// on the host, and returns true if it did.
+func (v *volumeDriver) unmountIdle(name string) bool {
+	logctx := log.WithFields(log.Fields{"operation": "idle-unmount", "name": name})
+	v.m.Lock()
+	defer v.m.Unlock()
+	if v.checkBusy(name) != nil {
+		return false
+	}
+	meta, err := v.meta.Get(name)
+	if err != nil {
+		return false
+	}
+	for _, m := range meta.Mounts {
+		if m.Host == v.hostname {
+			return false
+		}
+	}
+	path := v.pathForVolume(name)
+	if busy, err := volumeBusy(path); err != nil || busy {
+		return false
+	}
+	ctx, cancel := v.operationContext("unmount")
+	defer cancel()
+	for {
+		active, err := isMounted(path)
+		if err != nil {
+			logctx.Error(err)
+			return false
+		}
+		if !active {
+			break
+		}
+		start := time.Now()
+		err = unmount(ctx, path)
+		observeMount("unmount", start, err)
+		if err != nil {
+			logctx.Errorf("cannot unmount idle volume: %v", err)
+			return false
+		}
+	}
+	v.cancelKeptMount(name)
+	if err := v.releaseLease(context.Background(), name, meta.Options.Share); err != nil {
+		logctx.Errorf("error releasing lease: %v", err)
+	}
+	logctx.Info("unmounted idle volume")
+	return true
+}
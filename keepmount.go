@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// keepMount handles the unmount of the volume by the container with the
+// mount ID when --keep-mounted is set: if it is the last container of the
+// host using the volume, its mount record is removed but the volume stays
+// mounted for the keep-mounted period, so that a container restarting in the
+// meantime does not wait for a new mount. It returns false if the volume
+// must be unmounted as usual. Caller must hold the driver lock.
+func (v *volumeDriver) keepMount(name, id, path string, logctx *log.Entry) bool {
+	if v.keepMounted <= 0 || v.draining {
+		return false
+	}
+	meta, err := v.meta.Get(name)
+	if err != nil {
+		return false
+	}
+	if usedByOthers(meta, v.hostname, id) {
+		return false
+	}
+	if active, err := isMounted(path); err != nil || !active {
+		return false
+	}
+	meta.Mounts = removeMount(meta.Mounts, v.hostname, id)
+	if err := v.meta.Set(name, meta); err != nil {
+		logctx.Errorf("error saving metadata: %v", err)
+	}
+	if t, ok := v.kept[name]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(v.keepMounted, func() { v.expireKeptMount(name, t) })
+	v.kept[name] = t
+	logctx.Debugf("keeping the volume mounted for %v", v.keepMounted)
+	return true
+}
+
+// cancelKeptMount cancels the unmount of the volume kept mounted after its
+// last unmount, if any, as it is mounted again. Caller must hold the driver
+// lock.
+func (v *volumeDriver) cancelKeptMount(name string) {
+	if t, ok := v.kept[name]; ok {
+		t.Stop()
+		delete(v.kept, name)
+	}
+}
+
+// expireKeptMount unmounts the volume kept mounted with the timer, unless it
+// was mounted again since.
+func (v *volumeDriver) expireKeptMount(name string, t *time.Timer) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	if v.kept[name] != t {
+		return
+	}
+	delete(v.kept, name)
+	if meta, err := v.meta.Get(name); err == nil {
+		for _, m := range meta.Mounts {
+			if m.Host == v.hostname {
+				return
+			}
+		}
+	}
+	if err := v.unmountAll(name); err != nil {
+		log.WithFields(log.Fields{"operation": "unmount", "name": name}).Errorf("cannot unmount volume kept mounted: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// kernelLogLines is the maximum number of kernel log lines added to the
+// errors of failed mounts.
+const kernelLogLines = 10
+
+// cifsErrorPrefixes start the errors the CIFS client logs ("CIFS VFS:" on
+// older kernels). Its informational and debug messages only start with
+// "CIFS:".
+var cifsErrorPrefixes = []string{"CIFS: VFS:", "CIFS VFS:"}
+
+// kernelLog reads the messages logged by the kernel since it was opened from
+// /dev/kmsg. The CIFS client logs why mounts fail (e.g. STATUS_LOGON_FAILURE)
+// there, while mount.cifs only reports the errno.
+type kernelLog struct {
+	fd int
+}
+
+// openKernelLog starts reading the kernel log at its current end. It returns
+// nil if the kernel log cannot be read, e.g. without CAP_SYSLOG.
+func openKernelLog() *kernelLog {
+	// the file descriptor is read directly rather than through an os.File,
+	// whose reads of non-blocking character devices would wait for new
+	// messages
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		log.Debugf("cannot read the kernel log: %v", err)
+		return nil
+	}
+	if _, err := syscall.Seek(fd, 0, io.SeekEnd); err != nil {
+		log.Debugf("cannot read the kernel log: %v", err)
+		syscall.Close(fd)
+		return nil
+	}
+	return &kernelLog{fd}
+}
+
+// lines returns the last kernelLogLines messages starting with one of the
+// prefixes logged since the kernel log was opened. Callers open the kernel
+// log right before an attempt and read it as soon as the attempt completes,
+// so that only the messages logged during the attempt are returned.
+func (k *kernelLog) lines(prefixes ...string) []string {
+	var lines []string
+	buf := make([]byte, 8192) // each read returns one record
+	for {
+		n, err := syscall.Read(k.fd, buf)
+		if err == syscall.EPIPE {
+			continue // records were overwritten before being read
+		} else if err != nil || n <= 0 {
+			break // EAGAIN once all the records were read
+		}
+		// records are "priority,sequence,timestamp,flags;message\n" followed
+		// by indented key=value lines
+		rec := string(buf[:n])
+		i := strings.IndexByte(rec, ';')
+		if i < 0 {
+			continue
+		}
+		msg := strings.SplitN(rec[i+1:], "\n", 2)[0]
+		for _, p := range prefixes {
+			if strings.HasPrefix(msg, p) {
+				lines = append(lines, msg)
+				break
+			}
+		}
+	}
+	if len(lines) > kernelLogLines {
+		lines = lines[len(lines)-kernelLogLines:]
+	}
+	return lines
+}
+
+func (k *kernelLog) Close() error {
+	return syscall.Close(k.fd)
+}
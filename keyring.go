@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Kernel keyring constants, see keyctl(2).
+const (
+	// keySpecUserKeyring is KEY_SPEC_USER_KEYRING, -4 as a 32-bit key serial.
+	keySpecUserKeyring uintptr = 0xfffffffc
+
+	keyctlSetPerm  = 5  // KEYCTL_SETPERM
+	keyctlDescribe = 6  // KEYCTL_DESCRIBE
+	keyctlUnlink   = 9  // KEYCTL_UNLINK
+	keyctlSearch   = 10 // KEYCTL_SEARCH
+	keyctlRead     = 11 // KEYCTL_READ
+
+	// keyPossessorAll grants all permissions to the processes possessing the
+	// key, which the user keyring is deemed to be by processes of its user,
+	// and only lets the user view its attributes otherwise.
+	keyPossessorAll = 0x3f010000
+)
+
+// addUserKey adds a "user" key with the description and payload to the user
+// keyring of the driver (root), or updates the payload of the key with the
+// same description. Its payload can only be read by the processes of the
+// user, and is only kept in kernel memory.
+func addUserKey(desc string, payload []byte) error {
+	typ, err := syscall.BytePtrFromString("user")
+	if err != nil {
+		return err
+	}
+	d, err := syscall.BytePtrFromString(desc)
+	if err != nil {
+		return err
+	}
+	var p unsafe.Pointer
+	if len(payload) > 0 {
+		p = unsafe.Pointer(&payload[0])
+	}
+	id, _, errno := syscall.Syscall6(syscall.SYS_ADD_KEY, uintptr(unsafe.Pointer(typ)), uintptr(unsafe.Pointer(d)),
+		uintptr(p), uintptr(len(payload)), keySpecUserKeyring, 0)
+	if errno != 0 {
+		return errno
+	}
+	return keyctl(keyctlSetPerm, id, keyPossessorAll)
+}
+
+// searchUserKey returns the ID of the "user" key with the description in
+// the user keyring, failing with ENOKEY if there is none.
+func searchUserKey(desc string) (uintptr, error) {
+	typ, err := syscall.BytePtrFromString("user")
+	if err != nil {
+		return 0, err
+	}
+	d, err := syscall.BytePtrFromString(desc)
+	if err != nil {
+		return 0, err
+	}
+	id, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlSearch, keySpecUserKeyring,
+		uintptr(unsafe.Pointer(typ)), uintptr(unsafe.Pointer(d)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return id, nil
+}
+
+// readKey returns the payload of the key, or the IDs of the keys linked to it
+// for a keyring, as native 32-bit integers.
+func readKey(id uintptr) ([]byte, error) {
+	b := make([]byte, 512)
+	for {
+		n, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlRead, id, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), 0, 0)
+		if errno != 0 {
+			return nil, errno
+		}
+		if int(n) <= len(b) {
+			return b[:n], nil
+		}
+		b = make([]byte, n)
+	}
+}
+
+// userKeys returns the IDs of the "user" keys in the user keyring whose
+// description starts with prefix, by description.
+func userKeys(prefix string) (map[string]uintptr, error) {
+	b, err := readKey(keySpecUserKeyring)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]uintptr)
+	for i := 0; i+4 <= len(b); i += 4 {
+		id := uintptr(*(*int32)(unsafe.Pointer(&b[i])))
+		// type;uid;gid;perm;description
+		desc := make([]byte, 256)
+		n, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlDescribe, id, uintptr(unsafe.Pointer(&desc[0])), uintptr(len(desc)), 0, 0)
+		if errno != 0 || int(n) > len(desc) {
+			// unlinked meanwhile, or not ours
+			continue
+		}
+		f := strings.SplitN(string(bytes.TrimRight(desc[:n], "\x00")), ";", 5)
+		if len(f) == 5 && f[0] == "user" && strings.HasPrefix(f[4], prefix) {
+			keys[f[4]] = id
+		}
+	}
+	return keys, nil
+}
+
+// unlinkUserKey removes the key from the user keyring, which destroys it
+// unless it is linked elsewhere.
+func unlinkUserKey(id uintptr) error {
+	return keyctl(keyctlUnlink, id, keySpecUserKeyring)
+}
+
+func keyctl(cmd int, arg2, arg3 uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_KEYCTL, uintptr(cmd), arg2, arg3); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// leaseDuration is the longest finite share lease, so that the lease of
+	// a crashed host expires as soon as possible while tolerating a couple
+	// of failed renewals.
+	leaseDuration      = 60 * time.Second
+	leaseRenewInterval = 20 * time.Second
+)
+
+// leaseID returns the ID of the lease the host holds on the share of the
+// volume. It is stable across restarts so that a restarted driver takes its
+// own leases back instead of waiting for them to expire.
+func leaseID(host, name string) string {
+	h := sha256.Sum256([]byte(host + "/" + name))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// acquireLease acquires the lease on the share of the exclusive volume and
+// renews it in the background until releaseLease is called. It does nothing
+// if the lease is held already. Caller must hold the driver lock.
+func (v *volumeDriver) acquireLease(ctx context.Context, name, share string) error {
+	if _, ok := v.leases[name]; ok {
+		return nil
+	}
+	id := leaseID(v.hostname, name)
+	if err := v.files.withContext(ctx).leaseShare(share, "acquire", id, leaseDuration); err != nil {
+		if e, ok := err.(*fileServiceError); ok && e.Code == "LeaseAlreadyPresent" {
+			return newError(codeLeased, "exclusive volume is mounted on another host (share %q is leased)", share)
+		}
+		return wrapError(err, codeStorageAPI, "error acquiring lease on azure file share %q: %v", share, err)
+	}
+	stop := make(chan struct{})
+	v.leases[name] = stop
+	go v.renewLease(name, share, id, stop)
+	return nil
+}
+
+// renewLease renews the lease every leaseRenewInterval until stop is closed.
+// Leases are renewed by acquiring them again with the same ID, which also
+// takes the lease back if it expired meanwhile and no other host took it.
+func (v *volumeDriver) renewLease(name, share, id string, stop chan struct{}) {
+	logctx := log.WithFields(log.Fields{
+		"operation": "lease",
+		"name":      name,
+	})
+	t := time.NewTicker(leaseRenewInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		v.m.Lock()
+		files := v.files
+		v.m.Unlock()
+		if err := files.leaseShare(share, "acquire", id, leaseDuration); err != nil {
+			logctx.Errorf("cannot renew lease on azure file share %q: %v", share, err)
+		}
+	}
+}
+
+// releaseLease stops renewing the lease on the share of the volume and
+// releases it, if held. Caller must hold the driver lock.
+func (v *volumeDriver) releaseLease(ctx context.Context, name, share string) error {
+	stop, ok := v.leases[name]
+	if !ok {
+		return nil
+	}
+	close(stop)
+	delete(v.leases, name)
+	return v.files.withContext(ctx).leaseShare(share, "release", leaseID(v.hostname, name), 0)
+}
+
+// resumeLeases takes back the leases of the exclusive volumes that are still
+// mounted on this host, e.g. after the driver was restarted.
+func (v *volumeDriver) resumeLeases() {
+	v.m.Lock()
+	defer v.m.Unlock()
+	names, err := v.meta.List()
+	if err != nil {
+		log.Errorf("cannot resume leases: %v", err)
+		return
+	}
+	for _, name := range names {
+		meta, err := v.meta.Get(name)
+		if err != nil || !meta.Options.Exclusive || meta.Account != v.accountName {
+			continue
+		}
+		if mounted, err := isMounted(v.pathForVolume(name)); err != nil || !mounted {
+			continue
+		}
+		if err := v.acquireLease(context.Background(), name, meta.Options.Share); err != nil {
+			log.WithField("name", name).Errorf("cannot resume lease: %v", err)
+		}
+	}
+}
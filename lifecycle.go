@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// defaultStopTimeout is how long the stop command waits for the driver to
+// exit.
+const defaultStopTimeout = 2 * time.Minute
+
+// readPidfile returns the process ID written in the pidfile.
+func readPidfile(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid < 1 {
+		return 0, fmt.Errorf("pidfile %s does not contain a process ID", path)
+	}
+	return pid, nil
+}
+
+// processAlive returns true if a process with the ID exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// writePidfile writes the ID of the driver process to path, failing if it
+// names another driver process that is still running. Stale pidfiles, e.g.
+// left by a crash, are overwritten.
+func writePidfile(path string) error {
+	if pid, err := readPidfile(path); err == nil && pid != os.Getpid() && processAlive(pid) {
+		return fmt.Errorf("driver is already running with pid %d (pidfile %s)", pid, path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("cannot create pidfile directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("cannot write pidfile: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("cannot write pidfile: %v", err)
+	}
+	return nil
+}
+
+// stopOnSignal stops the driver on SIGTERM or SIGINT, leaving the volumes
+// mounted unless unmountOnStop is set, and on SIGUSR2 after unmounting them.
+// The pidfile, if any, is removed before exiting.
+func (v *volumeDriver) stopOnSignal(unmountOnStop bool, pidfile string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	sig := <-ch
+	unmount := unmountOnStop || sig == syscall.SIGUSR2
+	log.Infof("received %s, stopping (unmount volumes: %v)", sig, unmount)
+	v.stop(unmount)
+	if pidfile != "" {
+		if err := os.Remove(pidfile); err != nil && !os.IsNotExist(err) {
+			log.Errorf("cannot remove pidfile: %v", err)
+		}
+	}
+	log.Info("stopped")
+	os.Exit(0)
+}
+
+// stop refuses new mounts and waits for the operations in progress that hold
+// the driver lock. With unmount, the volumes mounted on the host are
+// unmounted and their leases released; otherwise they stay mounted for the
+// running containers and are picked up by the next driver process (whose
+// leases on exclusive volumes are taken back, see resumeLeases).
+func (v *volumeDriver) stop(unmount bool) {
+	v.setDraining(true)
+	v.m.Lock()
+	defer v.m.Unlock()
+	if !unmount {
+		return
+	}
+	mounted := true
+	vols, err := v.listVolumesLocked(volumeFilter{mounted: &mounted})
+	if err != nil {
+		log.Errorf("cannot list mounted volumes: %v", err)
+		return
+	}
+	for _, vol := range vols {
+		if err := v.unmountAll(vol.Name); err != nil {
+			log.WithField("name", vol.Name).Errorf("cannot unmount volume: %v", err)
+		}
+	}
+}
+
+// unmountAll removes all the mounts of the volume on the host, however many
+// containers use it. Caller must hold the driver lock.
+func (v *volumeDriver) unmountAll(name string) error {
+	if err := v.checkBusy(name); err != nil {
+		return err
+	}
+	logctx := log.WithFields(log.Fields{"operation": "unmount", "name": name})
+	ctx, cancel := v.operationContext("unmount")
+	defer cancel()
+	path := v.pathForVolume(name)
+	for {
+		active, err := isMounted(path)
+		if err != nil {
+			return newError(codeInternal, "%v", err)
+		}
+		if !active {
+			break
+		}
+		start := time.Now()
+		err = unmount(ctx, path)
+		observeMount("unmount", start, err)
+		if err != nil {
+			return wrapError(err, codeMountFailed, "%v", err)
+		}
+	}
+	if meta, err := v.meta.Get(name); err == nil {
+		if err := v.releaseLease(ctx, name, meta.Options.Share); err != nil {
+			logctx.Errorf("error releasing lease: %v", err)
+		}
+		meta.Mounts = removeMounts(meta.Mounts, v.hostname)
+		if err := v.meta.Set(name, meta); err != nil {
+			logctx.Errorf("error saving metadata: %v", err)
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return newError(codeInternal, "error removing mountpoint: %v", err)
+	}
+	logctx.Info("unmounted volume")
+	return nil
+}
+
+// stopCommand stops the driver process named by --pidfile and waits for it
+// to exit, for init scripts and configuration management tools.
+var stopCommand = cli.Command{
+	Name:  "stop",
+	Usage: "Stop the running driver (see --pidfile), leaving volumes mounted unless --unmount is given",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "unmount",
+			Usage: "Unmount the volumes mounted on the host before stopping",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "How long to wait for the driver to exit",
+			Value: defaultStopTimeout,
+		},
+	},
+	Action: func(c *cli.Context) {
+		if err := stopDriver(c.GlobalString("pidfile"), c.Bool("unmount"), c.Duration("timeout")); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// stopDriver signals the driver process of the pidfile to stop and waits up
+// to timeout for it to exit. It succeeds if the driver is not running.
+func stopDriver(pidfile string, unmount bool, timeout time.Duration) error {
+	if pidfile == "" {
+		return fmt.Errorf("--pidfile is required to stop the driver")
+	}
+	pid, err := readPidfile(pidfile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sig := syscall.SIGTERM
+	if unmount {
+		sig = syscall.SIGUSR2
+	}
+	if err := syscall.Kill(pid, sig); err == syscall.ESRCH {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot signal driver process %d: %v", pid, err)
+	}
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if !processAlive(pid) {
+			return nil
+		}
+	}
+	return fmt.Errorf("driver process %d did not exit within %v", pid, timeout)
+}
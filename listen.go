@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	// pluginSockDir is where Docker discovers plugins listening on unix
+	// sockets.
+	pluginSockDir = "/run/docker/plugins"
+
+	// pluginSpecDir is where Docker discovers plugins listening on TCP.
+	pluginSpecDir = "/etc/docker/plugins"
+)
+
+// tlsOptions are the certificates used to secure the TCP plugin listener with
+// mutual TLS. The CA signs both the certificate of the driver and the client
+// certificate Docker presents.
+type tlsOptions struct {
+	CertFile       string
+	KeyFile        string
+	CAFile         string
+	ClientCertFile string
+	ClientKeyFile  string
+}
+
+// pluginSpec is the JSON spec file telling Docker how to reach a plugin.
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig struct {
+		InsecureSkipVerify bool
+		CAFile             string
+		CertFile           string
+		KeyFile            string
+	}
+}
+
+// serverConfig returns the TLS configuration of the listener, which only
+// accepts clients presenting a certificate signed by the CA.
+func (o tlsOptions) serverConfig() (*tls.Config, error) {
+	for _, f := range []struct{ flag, val string }{
+		{"tls-cert", o.CertFile}, {"tls-key", o.KeyFile}, {"tls-ca", o.CAFile},
+		{"tls-client-cert", o.ClientCertFile}, {"tls-client-key", o.ClientKeyFile},
+	} {
+		if f.val == "" {
+			return nil, fmt.Errorf("--%s is required for TLS", f.flag)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %v", err)
+	}
+	ca, err := ioutil.ReadFile(o.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// serveTLS serves the plugin API on addr over mutual TLS and writes the spec
+// file with the client certificate Docker should present. It only returns
+// when the listener fails.
+func serveTLS(h *volume.Handler, name, addr string, o tlsOptions) error {
+	cfg, err := o.serverConfig()
+	if err != nil {
+		return err
+	}
+	l, err := sockets.NewTCPSocket(addr, cfg)
+	if err != nil {
+		return err
+	}
+
+	var spec pluginSpec
+	spec.Name = name
+	spec.Addr = "https://" + l.Addr().String()
+	spec.TLSConfig.CAFile = o.CAFile
+	spec.TLSConfig.CertFile = o.ClientCertFile
+	spec.TLSConfig.KeyFile = o.ClientKeyFile
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("cannot serialize plugin spec: %v", err)
+	}
+	if err := os.MkdirAll(pluginSpecDir, 0755); err != nil {
+		return err
+	}
+	specFile := filepath.Join(pluginSpecDir, name+".json")
+	if err := ioutil.WriteFile(specFile, b, 0644); err != nil {
+		return fmt.Errorf("cannot write plugin spec: %v", err)
+	}
+	defer os.Remove(specFile)
+
+	log.Debugf("serving plugin %q on %s", name, spec.Addr)
+	return h.Serve(l)
+}
+
+// serveAlias serves the plugin API on the socket Docker looks up for the
+// alias name, so that the driver can also be used under that name. It only
+// returns when the listener fails.
+func serveAlias(h *volume.Handler, alias string) error {
+	if err := os.MkdirAll(pluginSockDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(pluginSockDir, alias+".sock")
+	l, err := sockets.NewUnixSocket(path, "docker")
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %v", path, err)
+	}
+	defer os.Remove(path)
+	log.Debugf("serving plugin alias %q on %s", alias, path)
+	return h.Serve(l)
+}
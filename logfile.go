@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// logFileTimeFormat is the suffix of rotated log files, which sorts them
+// oldest first.
+const logFileTimeFormat = "20060102T150405"
+
+// rotatingFile is the --log-file the driver logs to. It is rotated (renamed
+// with the rotation time as suffix) once it exceeds maxSize bytes or was
+// opened for longer than interval, keeping at most maxFiles rotated files,
+// none older than maxAge. Zero values disable each of the limits.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	maxFiles int
+	maxAge   time.Duration
+
+	m      sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// openLogFile opens (appending to) the log file at path.
+func openLogFile(path string, maxSize int64, interval time.Duration, maxFiles int, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxFiles: maxFiles, maxAge: maxAge}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("cannot create log directory: %v", err)
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.prune()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot open log file: %v", err)
+	}
+	r.f, r.size, r.opened = f, fi.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.size > 0 && (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize || r.interval > 0 && time.Since(r.opened) >= r.interval) {
+		if err := r.rotate(); err != nil {
+			// keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "cannot rotate log file: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log file and opens a new one. Caller must hold r.m.
+func (r *rotatingFile) rotate() error {
+	rotated := r.path + "." + time.Now().UTC().Format(logFileTimeFormat)
+	if _, err := os.Stat(rotated); err == nil {
+		// rotated twice within a second
+		rotated += fmt.Sprintf(".%d", time.Now().UnixNano()%1e9)
+	}
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	// the rotated file takes the lines if a new one cannot be opened
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	old.Close()
+	go r.prune()
+	return nil
+}
+
+// prune deletes the rotated log files beyond maxFiles or older than maxAge.
+func (r *rotatingFile) prune() {
+	rotated, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	var files []string
+	for _, f := range rotated {
+		if _, err := time.Parse(logFileTimeFormat, strings.SplitN(strings.TrimPrefix(f, r.path+"."), ".", 2)[0]); err == nil {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	for i, f := range files {
+		old := false
+		if r.maxAge > 0 {
+			if fi, err := os.Stat(f); err == nil && time.Since(fi.ModTime()) > r.maxAge {
+				old = true
+			}
+		}
+		if old || r.maxFiles > 0 && i < len(files)-r.maxFiles {
+			if err := os.Remove(f); err != nil {
+				log.Warnf("cannot delete rotated log file: %v", err)
+			}
+		}
+	}
+}
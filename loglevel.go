@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// toggleDebugOnSignal switches the log level between debug and the level
+// configured at startup every time SIGUSR1 is received.
+func toggleDebugOnSignal() {
+	configured := log.GetLevel()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		level := log.DebugLevel
+		if log.GetLevel() == log.DebugLevel {
+			level = configured
+			if level == log.DebugLevel {
+				level = log.InfoLevel
+			}
+		}
+		log.SetLevel(level)
+		log.Warnf("log level changed to %s on SIGUSR1", level)
+	}
+}
+
+// handleLogLevel returns the current log level on GET, and changes it to the
+// 'level' query parameter (e.g. "debug") on PUT or POST.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		level, err := log.ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.SetLevel(level)
+		log.Warnf("log level changed to %s through the admin endpoint", level)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": log.GetLevel().String()})
+}
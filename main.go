@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/cipher"
+	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
-	azure "github.com/Azure/azure-sdk-for-go/storage"
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -13,6 +18,10 @@ const (
 	volumeDriverName = "azurefile"
 	mountpoint       = "/var/run/docker/volumedriver/azurefile"
 	metadataRoot     = "/etc/docker/plugins/azurefile/volumes"
+
+	// defaultStorageBase is the storage endpoint suffix of the public Azure
+	// cloud.
+	defaultStorageBase = "core.windows.net"
 )
 
 var (
@@ -20,41 +29,467 @@ var (
 	// If the source tree corresponds to a tag, the tag name is used.
 	// Otherwise, provides a string summarizing the state of git tree.
 	GitSummary string
+
+	// GitCommit and BuildDate are the commit the binary was built from and
+	// the build time (RFC 3339), also provided by govvv.
+	GitCommit string
+	BuildDate string
 )
 
 func main() {
 	cmd := cli.NewApp()
 	cmd.Name = "azurefile-dockervolumedriver"
-	cmd.Version = GitSummary
+	cmd.Version = driverVersion()
+	cli.VersionPrinter = func(c *cli.Context) {
+		fmt.Fprintf(c.App.Writer, "%s %s\n", c.App.Name, currentBuild())
+	}
 	cmd.Usage = "Docker Volume Driver for Azure File Service"
 	cli.AppHelpTemplate = usageTemplate
+	log.SetFormatter(redactingFormatter{log.StandardLogger().Formatter})
 
 	cmd.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "connection-string",
+			Usage:  "Azure storage connection string, providing the account name, key and endpoint suffix (instead of their flags)",
+			EnvVar: "AZURE_STORAGE_CONNECTION_STRING",
+		},
 		cli.StringFlag{
 			Name:   "account-name",
 			Usage:  "Azure storage account name",
 			EnvVar: "AZURE_STORAGE_ACCOUNT",
 		},
+		cli.StringFlag{
+			Name:   "account-name-file",
+			Usage:  "Path of a file (e.g. a Docker secret) to read the Azure storage account name from, re-read on change",
+			EnvVar: "AZURE_STORAGE_ACCOUNT_FILE",
+		},
 		cli.StringFlag{
 			Name:   "account-key",
 			Usage:  "Azure storage account key",
 			EnvVar: "AZURE_STORAGE_ACCOUNT_KEY",
 		},
+		cli.StringFlag{
+			Name:   "account-key-file",
+			Usage:  "Path of a file (e.g. a Docker secret) to read the Azure storage account key from, re-read on change",
+			EnvVar: "AZURE_STORAGE_ACCOUNT_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "secrets-dir",
+			Usage:  "Directory to look up the '" + accountNameSecret + "' and '" + accountKeySecret + "' Swarm secrets in when credentials are not provided otherwise",
+			EnvVar: "AZURE_SECRETS_DIR",
+			Value:  "/run/secrets",
+		},
 		cli.StringFlag{
 			Name:   "storage-base",
 			Usage:  "Base domain for Azure Storage endpoint",
 			EnvVar: "AZURE_STORAGE_BASE",
-			Value:  azure.DefaultBaseURL,
+			Value:  defaultStorageBase,
+		},
+		cli.StringFlag{
+			Name:   "storage-endpoint",
+			Usage:  "File service endpoint addressed path-style instead of the storage base domain, e.g. an emulator",
+			EnvVar: "AZURE_STORAGE_ENDPOINT",
+		},
+		cli.BoolFlag{
+			Name:  "emulator",
+			Usage: "Use a File service emulator at --storage-endpoint with the development credentials and bind-mount local directories instead of the shares",
+		},
+		cli.StringFlag{
+			Name:  "emulator-shares",
+			Usage: "Directory holding the contents of the shares in emulator mode",
+			Value: defaultEmulatorShares,
+		},
+		cli.StringFlag{
+			Name:   "storage-api-version",
+			Usage:  "x-ms-version of the File service REST API to use (e.g. an older version for Azure Stack)",
+			EnvVar: "AZURE_STORAGE_API_VERSION",
+			Value:  defaultFileAPIVersion,
+		},
+		cli.StringFlag{
+			Name:   "domain",
+			Usage:  "SMB domain used for mounts of volumes that do not specify one",
+			EnvVar: "AZURE_STORAGE_DOMAIN",
+		},
+		cli.IntFlag{
+			Name:  "smb-port",
+			Usage: "TCP port SMB mounts connect to unless volumes set 'port', e.g. an SMB tunnel or gateway listening on 443 when outbound 445 is blocked (445 if zero)",
+		},
+		cli.BoolFlag{
+			Name:  "rest-fallback",
+			Usage: "Mount SMB volumes through the File service REST API (FUSE, much slower) when the SMB endpoint is unreachable",
+		},
+		cli.StringFlag{
+			Name:  "rest-mount-helper",
+			Value: defaultRESTMountHelper,
+			Usage: "rclone executable mounting shares for the 'rest' transport",
+		},
+		cli.StringFlag{
+			Name:  "smb-min-version",
+			Usage: "Lowest SMB version to fall back to when mounts fail due to a protocol mismatch (" + strings.Join(smbVersions, ", ") + ")",
+			Value: "2.1",
+		},
+		cli.IntFlag{
+			Name:  "mount-dns-retries",
+			Usage: "Number of times to retry mounts failing because the storage endpoint cannot be resolved",
+			Value: 5,
+		},
+		cli.BoolFlag{
+			Name:  "mount-resolve-ip",
+			Usage: "Resolve the storage endpoint in the driver and mount SMB shares by IP address (for hosts where the mount helper cannot resolve names)",
+		},
+		cli.StringFlag{
+			Name:  "nonempty-mountpoint",
+			Usage: "What to do when a mountpoint contains files before mounting: warn, refuse or move (contents are moved aside)",
+			Value: nonEmptyWarn,
+		},
+		cli.StringFlag{
+			Name:  "shared-shares",
+			Usage: "What to do when a volume is created on a share used by another volume: allow, reject or allow-readonly (the new volume must be read-only)",
+			Value: sharedAllow,
+		},
+		cli.DurationFlag{
+			Name:  "share-check-interval",
+			Usage: "Interval to verify that the shares of all volumes still exist at (disabled if zero)",
+		},
+		cli.StringFlag{
+			Name:   "share-prefix",
+			Usage:  "Prefix applied to the share names of new volumes and required on existing volumes (e.g. team name)",
+			EnvVar: "AZURE_SHARE_PREFIX",
 		},
 		cli.BoolFlag{
 			Name:  "remove-shares",
-			Usage: "remove associated Azure File Share when volume is removed",
+			Usage: "remove associated Azure File Share when the last volume using it is removed",
+		},
+		cli.BoolFlag{
+			Name:  "remove-share-snapshots",
+			Usage: "Also delete the snapshots of the shares removed with their volume (shares with snapshots are not removed otherwise)",
+		},
+		cli.BoolFlag{
+			Name:  "remove-mounted",
+			Usage: "allow removing volumes that are still mounted on this host",
+		},
+		cli.StringFlag{
+			Name:   "backup-account-name",
+			Usage:  "Azure storage account to back up volumes to (disabled if empty)",
+			EnvVar: "AZURE_BACKUP_STORAGE_ACCOUNT",
+		},
+		cli.StringFlag{
+			Name:   "backup-account-key",
+			Usage:  "Azure storage account key of the backup account",
+			EnvVar: "AZURE_BACKUP_STORAGE_ACCOUNT_KEY",
+		},
+		cli.DurationFlag{
+			Name:  "backup-interval",
+			Usage: "Interval between volume backups to the backup account",
+			Value: 24 * time.Hour,
+		},
+		cli.IntFlag{
+			Name:  "backup-retention",
+			Usage: "Number of backup generations kept per volume, older ones are deleted from the backup account (0 keeps all)",
+			Value: 7,
+		},
+		cli.DurationFlag{
+			Name:  "create-timeout",
+			Usage: "Maximum duration of volume creation, including restoring snapshots (unbounded if zero)",
+			Value: defaultCreateTimeout,
+		},
+		cli.DurationFlag{
+			Name:  "mount-timeout",
+			Usage: "Maximum duration of mounts and unmounts, hung mount commands are killed (unbounded if zero)",
+			Value: defaultMountTimeout,
+		},
+		cli.DurationFlag{
+			Name:  "remove-timeout",
+			Usage: "Maximum duration of volume removal (unbounded if zero)",
+			Value: defaultRemoveTimeout,
+		},
+		cli.IntFlag{
+			Name:  "storage-breaker-threshold",
+			Usage: "Consecutive storage API failures after which requests to the account fail fast (disabled if zero)",
+			Value: defaultBreakerThreshold,
+		},
+		cli.DurationFlag{
+			Name:  "storage-breaker-cooldown",
+			Usage: "How long requests fail fast before the storage API is tried again",
+			Value: defaultBreakerCooldown,
+		},
+		cli.StringFlag{
+			Name:  "volumes",
+			Usage: "Path of a JSON file listing volumes (in the format of /volumes/batch) to create at startup unless they exist",
+		},
+		cli.StringFlag{
+			Name:  "volumes-dir",
+			Usage: "Directory of JSON files (*.json) listing volumes like --volumes, watched for changes: the volumes of added files are created and those of removed files are removed",
+		},
+		cli.BoolFlag{
+			Name:  "volumes-dir-allow-empty",
+			Usage: "Remove all volumes declared in --volumes-dir when it no longer holds any definitions (by default an empty directory is assumed to be a mistake)",
+		},
+		cli.StringFlag{
+			Name:  "nomad-volumes",
+			Usage: "Path of a JSON file with volume definitions to create and mount at startup as Nomad host volumes",
+		},
+		cli.StringFlag{
+			Name:  "nomad-config",
+			Usage: "Path of the Nomad client configuration file declaring the host volumes of --nomad-volumes",
+			Value: "/etc/nomad.d/azurefile-host-volumes.hcl",
+		},
+		cli.StringFlag{
+			Name:  "policy",
+			Usage: "Path of a JSON file with rules restricting which volumes may be created, removed or mounted",
+		},
+		cli.StringFlag{
+			Name:  "accounts",
+			Usage: "Path of a JSON file with named storage accounts, which volumes select with -o account=<name>",
+		},
+		cli.StringFlag{
+			Name:  "allowed-accounts",
+			Usage: "Comma-separated names of the accounts of --accounts that volumes may use (all if empty)",
+		},
+		cli.BoolFlag{
+			Name:  "regional-accounts",
+			Usage: "Create volumes not selecting an account on the account of --accounts in the region of the host",
+		},
+		cli.StringFlag{
+			Name:  "region",
+			Usage: "Region of the host (e.g. westeurope) for --regional-accounts, queried from the instance metadata service if empty",
+		},
+		cli.StringFlag{
+			Name:  "admin-addr",
+			Usage: "TCP address (host:port) to serve the admin endpoints such as /metrics on (disabled if empty)",
+		},
+		cli.StringFlag{
+			Name:   "admin-token",
+			Usage:  "Bearer token required by the admin endpoints other than /metrics and /version, which are refused without it",
+			EnvVar: "AZUREFILE_ADMIN_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "azcopy",
+			Usage: "Path of the azcopy (v10) binary used by the import and export admin endpoints",
+			Value: "azcopy",
+		},
+		cli.StringFlag{
+			Name:  "azcopy-auth",
+			Usage: "How azcopy authenticates to the volume shares: 'sas' (a short-lived SAS of the share, visible on the azcopy command line) or 'aad' (the --aad-* credentials, passed in its environment)",
+			Value: azcopyAuthSAS,
+		},
+		cli.DurationFlag{
+			Name:  "keep-mounted",
+			Usage: "Keep volumes mounted for this long after the last container unmounts them, for fast remounts (disabled if zero)",
+		},
+		cli.StringFlag{
+			Name:  "seed-dir",
+			Usage: "Directory of the host archives volumes may be seeded from with the 'seed' option (host paths are refused if unset)",
+		},
+		cli.StringSliceFlag{
+			Name:  "seed-hosts",
+			Usage: "Host of the URLs volumes may be seeded from with the 'seed' option, a leading dot allowing its subdomains (can be repeated, URLs are refused if unset)",
+		},
+		cli.IntFlag{
+			Name:  "seed-max-size",
+			Usage: "Total size in MiB of the files a seed archive may extract",
+			Value: defaultSeedMaxSize,
+		},
+		cli.IntFlag{
+			Name:  "seed-max-files",
+			Usage: "Number of entries a seed archive may extract",
+			Value: defaultSeedMaxFiles,
+		},
+		cli.DurationFlag{
+			Name:  "idle-unmount",
+			Usage: "Unmount volumes that had no open files for this long, until mounted again (disabled if zero)",
+		},
+		cli.DurationFlag{
+			Name:  "stats-interval",
+			Usage: "Interval to collect usage statistics of mounted volumes at (disabled if zero)",
+		},
+		cli.BoolFlag{
+			Name:  "stats-count-files",
+			Usage: "Count files on mounted volumes when collecting statistics (walks the whole volume)",
+		},
+		cli.BoolFlag{
+			Name:  "stats-share-usage",
+			Usage: "Query share usage from the File service when collecting statistics",
+		},
+		cli.StringFlag{
+			Name:  "metric-labels",
+			Usage: "Comma-separated volume labels (of the 'labels' option) to add to the volume metrics as label_<name>",
+		},
+		cli.DurationFlag{
+			Name:  "slow-request-threshold",
+			Value: defaultSlowRequestThreshold,
+			Usage: "Duration above which File service requests count as slow, raising the pressure level of the account like throttled requests",
+		},
+		cli.DurationFlag{
+			Name:  "monitor-interval",
+			Usage: "Interval to pull share metrics from Azure Monitor at (disabled if zero), requires --storage-account-id",
+		},
+		cli.StringFlag{
+			Name:   "storage-account-id",
+			Usage:  "ARM resource ID of the storage account (/subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Storage/storageAccounts/<name>)",
+			EnvVar: "AZURE_STORAGE_ACCOUNT_ID",
+		},
+		cli.BoolFlag{
+			Name:  "create-account",
+			Usage: "Create the storage account of --storage-account-id through Azure Resource Manager if it does not exist, and use its key unless one is given",
+		},
+		cli.StringFlag{
+			Name:  "account-location",
+			Usage: "Region to create the storage account in (e.g. westeurope), the region of the host if empty",
+		},
+		cli.StringFlag{
+			Name:  "account-sku",
+			Value: "Standard_LRS",
+			Usage: "SKU of the storage account created by --create-account (e.g. Standard_LRS, Standard_ZRS, Premium_LRS)",
+		},
+		cli.StringFlag{
+			Name:  "account-kind",
+			Value: "StorageV2",
+			Usage: "Kind of the storage account created by --create-account (StorageV2, or FileStorage for premium shares)",
+		},
+		cli.StringFlag{
+			Name:  "account-default-action",
+			Value: "Allow",
+			Usage: "Network access to the storage account created by --create-account not matching its rules: 'Allow' or 'Deny'",
+		},
+		cli.StringFlag{
+			Name:  "account-subnets",
+			Usage: "Comma-separated ARM resource IDs of the virtual network subnets allowed to access the storage account created by --create-account",
+		},
+		cli.StringFlag{
+			Name:  "account-ip-rules",
+			Usage: "Comma-separated addresses or CIDR ranges allowed to access the storage account created by --create-account",
+		},
+		cli.StringFlag{
+			Name:  "management-auth",
+			Value: managementAuthKey,
+			Usage: "How share create, delete, resize and snapshot operations are authorized: 'key' (File service with the account key) or 'aad' (Azure Resource Manager with an Azure AD identity, requires --storage-account-id)",
+		},
+		cli.BoolFlag{
+			Name:  "enable-large-file-shares",
+			Usage: "Enable large file shares on the storage account for volumes created with 'largeshare=true' (--management-auth=aad). This cannot be undone and disables geo-redundant replication of the account",
+		},
+		cli.StringFlag{
+			Name:   "aad-tenant-id",
+			Usage:  "Azure AD tenant of the service principal used for Azure Resource Manager requests",
+			EnvVar: "AZURE_TENANT_ID",
+		},
+		cli.StringFlag{
+			Name:   "aad-client-id",
+			Usage:  "Client ID of the service principal, or of the user-assigned managed identity if no secret is given",
+			EnvVar: "AZURE_CLIENT_ID",
+		},
+		cli.StringFlag{
+			Name:   "aad-client-secret",
+			Usage:  "Client secret of the service principal (the managed identity of the VM is used if empty)",
+			EnvVar: "AZURE_CLIENT_SECRET",
+		},
+		cli.StringFlag{
+			Name:  "aad-endpoint",
+			Value: defaultAADEndpoint,
+			Usage: "Azure AD authority, to change for sovereign clouds",
+		},
+		cli.StringFlag{
+			Name:  "arm-endpoint",
+			Value: defaultARMEndpoint,
+			Usage: "Azure Resource Manager endpoint, to change for sovereign clouds",
+		},
+		cli.StringFlag{
+			Name:   "otlp-endpoint",
+			Usage:  "OTLP/HTTP endpoint of an OpenTelemetry collector (e.g. http://localhost:4318) to export traces of plugin requests to (disabled if empty)",
+			EnvVar: "OTEL_EXPORTER_OTLP_ENDPOINT",
+		},
+		cli.IntFlag{
+			Name:  "events",
+			Value: defaultEventCount,
+			Usage: "Number of recent operations listed by the /events admin endpoint (disabled if zero)",
+		},
+		cli.StringFlag{
+			Name:  "log-file",
+			Usage: "File to write the logs to instead of stderr, rotated as set by the --log-max-* flags",
+		},
+		cli.IntFlag{
+			Name:  "log-max-size",
+			Value: 100,
+			Usage: "Size in MiB above which the log file is rotated (never if zero)",
+		},
+		cli.DurationFlag{
+			Name:  "log-rotate-interval",
+			Usage: "Age above which the log file is rotated, e.g. 24h (never if zero)",
+		},
+		cli.IntFlag{
+			Name:  "log-max-files",
+			Value: 5,
+			Usage: "Number of rotated log files to keep (all if zero)",
+		},
+		cli.DurationFlag{
+			Name:  "log-max-age",
+			Usage: "Age above which rotated log files are deleted, e.g. 168h (never if zero)",
 		},
 		cli.BoolFlag{
 			Name:   "debug",
 			Usage:  "Enable verbose logging",
 			EnvVar: "DEBUG",
 		},
+		cli.StringFlag{
+			Name:  "pidfile",
+			Usage: "Path of a file to write the process ID of the driver to, used by the stop command",
+		},
+		cli.BoolFlag{
+			Name:  "unmount-on-stop",
+			Usage: "Unmount the volumes mounted on the host when stopped by SIGTERM or SIGINT (SIGUSR2 always does)",
+		},
+		cli.StringFlag{
+			Name:  "plugin-name",
+			Usage: "Name of the volume driver in Docker, which names the plugin socket (or spec file with --tcp-addr)",
+			Value: volumeDriverName,
+		},
+		cli.StringSliceFlag{
+			Name:  "plugin-alias",
+			Usage: "Additional name to register the volume driver under (can be repeated), e.g. for compose files using another driver name",
+		},
+		cli.StringFlag{
+			Name:  "socket",
+			Usage: "Path of the plugin unix socket (default: /run/docker/plugins/<plugin-name>.sock)",
+		},
+		cli.StringFlag{
+			Name:  "runtime",
+			Usage: "Container runtime the plugin serves: docker or podman (registers the plugin in containers.conf and labels mounts for SELinux)",
+			Value: runtimeDocker,
+		},
+		cli.StringFlag{
+			Name:  "podman-config",
+			Usage: "Path of the containers.conf drop-in registering the plugin with Podman",
+			Value: defaultPodmanConfig,
+		},
+		cli.StringFlag{
+			Name:  "tcp-addr",
+			Usage: "TCP address (host:port) to serve the plugin API on instead of a unix socket, a spec file pointing to it is written for Docker",
+		},
+		cli.BoolFlag{
+			Name:  "tls",
+			Usage: "Serve the TCP plugin listener over mutual TLS",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "Certificate of the TCP plugin listener",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "Private key of the TCP plugin listener",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "CA certificate that signs the listener and client certificates",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-cert",
+			Usage: "Client certificate Docker presents to the TCP plugin listener, written to the plugin spec",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-key",
+			Usage: "Private key of the client certificate, written to the plugin spec",
+		},
 		cli.StringFlag{
 			Name:  "mountpoint",
 			Usage: "Host path where volumes are mounted at",
@@ -65,35 +500,462 @@ func main() {
 			Usage: "Path where volume metadata are stored",
 			Value: metadataRoot,
 		},
+		cli.StringFlag{
+			Name:  "metadata-key-file",
+			Usage: "Path of a file with a base64 encoded 256-bit key to encrypt the volume metadata with",
+		},
+		cli.StringFlag{
+			Name:  "metadata-key-vault-key",
+			Usage: "URL of the Key Vault key the key of --metadata-key-file is wrapped with (RSA-OAEP-256), unwrapped with the Azure AD credential",
+		},
 	}
+	cmd.Commands = []cli.Command{flexVolumeCommand, stopCommand, checkConnectivityCommand, doctorCommand, selftestCommand, benchCommand, supportBundleCommand, requestKeyCommand}
 	cmd.Action = func(c *cli.Context) {
 		if c.Bool("debug") {
 			log.SetLevel(log.DebugLevel)
 		}
+		if path := c.String("log-file"); path != "" {
+			f, err := openLogFile(path, int64(c.Int("log-max-size"))<<20, c.Duration("log-rotate-interval"), c.Int("log-max-files"), c.Duration("log-max-age"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.SetOutput(f)
+		}
+		events = newEventRing(c.Int("events"))
+		build := currentBuild()
+		log.Infof("starting %s %s", c.App.Name, build)
+		buildInfo.set(1, build.Version, build.Commit, build.GoVersion)
+		go toggleDebugOnSignal()
 
 		accountName := c.String("account-name")
 		accountKey := c.String("account-key")
+		accountNameFile := c.String("account-name-file")
+		accountKeyFile := c.String("account-key-file")
+		secretsDir := c.String("secrets-dir")
 		storageBase := c.String("storage-base")
 		mountpoint := c.String("mountpoint")
 		metaDir := c.String("metadata")
+		sharePrefix := c.String("share-prefix")
+		domain := c.String("domain")
+		smbMinVers := c.String("smb-min-version")
 		removeShares := c.Bool("remove-shares")
+		backupAccountName := c.String("backup-account-name")
+		backupAccountKey := c.String("backup-account-key")
+		backupInterval := c.Duration("backup-interval")
+		policyFile := c.String("policy")
+		adminAddr := c.String("admin-addr")
+		statsInterval := c.Duration("stats-interval")
+		emulator := c.Bool("emulator")
+		endpoint := c.String("storage-endpoint")
+		if s := c.String("connection-string"); s != "" {
+			if accountName != "" || accountKey != "" || accountNameFile != "" || accountKeyFile != "" {
+				log.Fatal("only one of connection string and account name and key can be provided.")
+			}
+			cs, err := parseConnectionString(s)
+			if err != nil {
+				log.Fatal(err)
+			}
+			accountName, accountKey = cs.AccountName, cs.AccountKey
+			emulator = emulator || cs.DevStorage
+			suffix := cs.EndpointSuffix
+			if cs.FileEndpoint != "" {
+				var e string
+				if suffix, e, err = cs.fileEndpoint(); err != nil {
+					log.Fatal(err)
+				} else if e != "" && endpoint == "" {
+					endpoint = e
+				}
+			}
+			if suffix != "" && suffix != storageBase {
+				if storageBase != defaultStorageBase {
+					log.Fatalf("storage base %q conflicts with the endpoint suffix %q of the connection string", storageBase, suffix)
+				}
+				storageBase = suffix
+			}
+		}
+		if emulator {
+			if accountName == "" && accountNameFile == "" {
+				accountName = emulatorAccountName
+			}
+			if accountKey == "" && accountKeyFile == "" {
+				accountKey = emulatorAccountKey
+			}
+			if endpoint == "" {
+				log.Fatal(errNoEmulatorEndpoint)
+			}
+		}
+		var storageEndpoint *url.URL
+		if endpoint != "" {
+			u, err := parseStorageEndpoint(endpoint)
+			if err != nil {
+				log.Fatal(err)
+			}
+			storageEndpoint = u
+		}
+		if accountName == "" && accountNameFile == "" {
+			accountNameFile = swarmSecret(secretsDir, accountNameSecret)
+		}
+		if accountKey == "" && accountKeyFile == "" {
+			accountKeyFile = swarmSecret(secretsDir, accountKeySecret)
+		}
+		if accountNameFile != "" {
+			if accountName != "" {
+				log.Fatal("only one of account name and account name file can be provided.")
+			}
+			name, err := readSecret(accountNameFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			accountName = name
+		}
+		if accountKeyFile != "" {
+			if accountKey != "" {
+				log.Fatal("only one of account key and account key file can be provided.")
+			}
+			key, err := readSecret(accountKeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			accountKey = key
+		}
+		registerSecret(c.String("aad-client-secret"))
+		aad, err := newAADCredential(c.String("aad-endpoint"), c.String("aad-tenant-id"), c.String("aad-client-id"), c.String("aad-client-secret"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if c.Bool("create-account") {
+			if storageEndpoint != nil {
+				log.Fatal("--create-account cannot be used with a custom storage endpoint")
+			}
+			id := c.String("storage-account-id")
+			if err := validateStorageAccountID(id); err != nil {
+				log.Fatalf("--create-account requires --storage-account-id: %v", err)
+			}
+			name := strings.Split(strings.Trim(id, "/"), "/")[7]
+			if accountName != "" && !strings.EqualFold(name, accountName) {
+				log.Fatalf("storage account ID %q is not the ID of account %q", id, accountName)
+			}
+			spec := accountSpec{
+				Location:      normalizeRegion(c.String("account-location")),
+				SKU:           c.String("account-sku"),
+				Kind:          c.String("account-kind"),
+				DefaultAction: c.String("account-default-action"),
+			}
+			if s := c.String("account-subnets"); s != "" {
+				spec.Subnets = strings.Split(s, ",")
+			}
+			if s := c.String("account-ip-rules"); s != "" {
+				spec.IPRules = strings.Split(s, ",")
+			}
+			if spec.DefaultAction != "Allow" && spec.DefaultAction != "Deny" {
+				log.Fatalf("unsupported network default action %q, must be one of: Allow, Deny", spec.DefaultAction)
+			}
+			if spec.Location == "" {
+				if spec.Location, err = hostRegion(); err != nil {
+					log.Fatalf("cannot determine the location of the storage account, set --account-location: %v", err)
+				}
+			}
+			key, err := createAccount(aad, c.String("arm-endpoint"), id, spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			accountName = name
+			if accountKey == "" {
+				accountKey = key
+			}
+		}
 		if accountName == "" || accountKey == "" {
 			log.Fatal("azure storage account name and key must be provided.")
 		}
+		registerSecret(accountKey)
+		registerSecret(backupAccountKey)
+		clients := newClientCache()
+		clients.pressure = newPressureTracker(c.Duration("slow-request-threshold"))
+		clients.breakers = newBreakers(c.Int("storage-breaker-threshold"), c.Duration("storage-breaker-cooldown"))
+		switch auth := c.String("management-auth"); auth {
+		case managementAuthKey:
+		case managementAuthAAD:
+			if storageEndpoint != nil {
+				log.Fatal("--management-auth=aad cannot be used with a custom storage endpoint")
+			}
+			a, err := newARMShares(aad, c.String("arm-endpoint"), c.String("storage-account-id"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !strings.EqualFold(a.accountName, accountName) {
+				log.Fatalf("storage account ID %q is not the ID of account %q", c.String("storage-account-id"), accountName)
+			}
+			a.largeShares = c.Bool("enable-large-file-shares")
+			a.pressure = clients.pressure
+			clients.arm = a
+		default:
+			log.Fatalf("unsupported management auth %q, must be one of: %s, %s", auth, managementAuthKey, managementAuthAAD)
+		}
 
 		log.WithFields(log.Fields{
-			"accountName":  accountName,
-			"metadata":     metaDir,
-			"mountpoint":   mountpoint,
-			"removeShares": removeShares,
+			"accountName":     accountName,
+			"accountNameFile": accountNameFile,
+			"accountKeyFile":  accountKeyFile,
+			"metadata":        metaDir,
+			"mountpoint":      mountpoint,
+			"removeShares":    removeShares,
+			"backupAccount":   backupAccountName,
+			"emulator":        emulator,
 		}).Debug("Starting server.")
 
-		driver, err := newVolumeDriver(accountName, accountKey, storageBase, mountpoint, metaDir, removeShares)
+		var metadataKey cipher.AEAD
+		if f := c.String("metadata-key-file"); f != "" {
+			if metadataKey, err = loadMetadataKey(f, c.String("metadata-key-vault-key"), aad); err != nil {
+				log.Fatal(err)
+			}
+		} else if c.String("metadata-key-vault-key") != "" {
+			log.Fatal("--metadata-key-vault-key requires --metadata-key-file")
+		}
+		// check the remaining flags before creating the driver and starting
+		// anything in the background
+		if !contains(smbVersions, smbMinVers) {
+			log.Fatalf("unsupported SMB version %q, must be one of: %s", smbMinVers, strings.Join(smbVersions, ", "))
+		}
+		if err := validateAPIVersion(c.String("storage-api-version")); err != nil {
+			log.Fatal(err)
+		}
+		clients.apiVersion = c.String("storage-api-version")
+		var metricLabels []string
+		if s := c.String("metric-labels"); s != "" {
+			metricLabels = strings.Split(s, ",")
+			if err := setMetricLabels(metricLabels); err != nil {
+				log.Fatal(err)
+			}
+		}
+		smbPort := c.Int("smb-port")
+		if smbPort < 0 || smbPort > 65535 {
+			log.Fatalf("invalid SMB port %d", smbPort)
+		}
+		runtime := c.String("runtime")
+		if runtime != runtimeDocker && runtime != runtimePodman {
+			log.Fatalf("unsupported runtime %q, must be one of: docker, podman", runtime)
+		}
+		nonEmpty := c.String("nonempty-mountpoint")
+		switch nonEmpty {
+		case nonEmptyWarn, nonEmptyRefuse, nonEmptyMove:
+		default:
+			log.Fatalf("unsupported non-empty mountpoint policy %q, must be one of: warn, refuse, move", nonEmpty)
+		}
+		sharedShares := c.String("shared-shares")
+		switch sharedShares {
+		case sharedAllow, sharedReject, sharedReadOnly:
+		default:
+			log.Fatalf("unsupported shared share policy %q, must be one of: allow, reject, allow-readonly", sharedShares)
+		}
+		if domain != "" {
+			if err := validateDomain(domain); err != nil {
+				log.Fatal(err)
+			}
+		}
+		var volumePolicy *policy
+		if policyFile != "" {
+			if volumePolicy, err = loadPolicy(policyFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		var allowed []string
+		if s := c.String("allowed-accounts"); s != "" {
+			allowed = strings.Split(s, ",")
+		}
+		var accounts map[string]*storageAccount
+		if f := c.String("accounts"); f != "" {
+			if accounts, err = loadAccounts(clients, f, storageBase, storageEndpoint, allowed); err != nil {
+				log.Fatal(err)
+			}
+		} else if len(allowed) != 0 {
+			log.Fatal("--allowed-accounts requires --accounts")
+		}
+		if c.Bool("regional-accounts") && accounts == nil {
+			log.Fatal("--regional-accounts requires --accounts")
+		}
+		if backupAccountName != "" && backupAccountKey == "" {
+			log.Fatal("azure storage account key for the backup account must be provided.")
+		}
+		azcopyAuth := c.String("azcopy-auth")
+		if azcopyAuth != azcopyAuthSAS && azcopyAuth != azcopyAuthAAD {
+			log.Fatalf("unsupported azcopy auth %q, must be one of: %s, %s", azcopyAuth, azcopyAuthSAS, azcopyAuthAAD)
+		}
+		pluginName := c.String("plugin-name")
+		addr := c.String("tcp-addr")
+		if addr != "" && runtime == runtimePodman {
+			log.Fatal("--runtime=podman requires a unix socket, not --tcp-addr.")
+		}
+		aliases := c.StringSlice("plugin-alias")
+		if len(aliases) > 0 && addr != "" {
+			log.Fatal("--plugin-alias is not supported with --tcp-addr.")
+		}
+		for _, a := range aliases {
+			if a == pluginName || filepath.Base(a) != a {
+				log.Fatalf("invalid plugin alias %q", a)
+			}
+		}
+		if c.Bool("tls") && addr == "" {
+			log.Fatal("--tls requires --tcp-addr.")
+		}
+		socket := pluginName
+		if s := c.String("socket"); s != "" {
+			if !filepath.IsAbs(s) {
+				log.Fatalf("socket path %q must be absolute", s)
+			}
+			socket = s
+		}
+
+		driver, err := newVolumeDriver(clients, accountName, accountKey, storageBase, storageEndpoint, mountpoint, metaDir, metadataKey, sharePrefix, removeShares)
 		if err != nil {
 			log.Fatal(err)
 		}
+		driver.smbMinVers = smbMinVers
+		driver.metricLabels = metricLabels
+		if e := c.String("otlp-endpoint"); e != "" {
+			driver.tracer = newTracer(e)
+		}
+		driver.timeouts = map[string]time.Duration{
+			"create":  c.Duration("create-timeout"),
+			"mount":   c.Duration("mount-timeout"),
+			"unmount": c.Duration("mount-timeout"),
+			"remove":  c.Duration("remove-timeout"),
+		}
+		driver.delSnapshots = c.Bool("remove-share-snapshots")
+		driver.removeMounted = c.Bool("remove-mounted")
+		driver.restFallback = c.Bool("rest-fallback")
+		driver.restHelper = c.String("rest-mount-helper")
+		driver.smbPort = smbPort
+		if runtime == runtimePodman && selinuxEnabled() {
+			driver.selinuxLabel = podmanSELinuxContext
+		}
+		if emulator {
+			driver.localShares = c.String("emulator-shares")
+		}
+		driver.dnsRetries = c.Int("mount-dns-retries")
+		driver.resolveIP = c.Bool("mount-resolve-ip")
+		driver.nonEmpty = nonEmpty
+		driver.sharedShares = sharedShares
+		driver.domain = domain
+		driver.policy = volumePolicy
+		driver.accounts, driver.allowAccounts = accounts, allowed
+		if c.Bool("regional-accounts") {
+			region := normalizeRegion(c.String("region"))
+			if region == "" {
+				if region, err = hostRegion(); err != nil {
+					log.Warnf("cannot determine the region of the host, volumes default to account %q: %v", accountName, err)
+				}
+			}
+			if region != "" {
+				driver.localAccount = regionalAccount(driver.accounts, allowed, region)
+				if driver.localAccount != "" {
+					log.Infof("host is in region %s, volumes default to account %q", region, driver.localAccount)
+				} else {
+					log.Warnf("no account of --accounts is in region %s, volumes default to account %q", region, accountName)
+				}
+			}
+		}
+		driver.keepMounted = c.Duration("keep-mounted")
+		driver.seeds = seedPolicy{
+			dir:      c.String("seed-dir"),
+			hosts:    c.StringSlice("seed-hosts"),
+			maxBytes: int64(c.Int("seed-max-size")) << 20,
+			maxFiles: c.Int("seed-max-files"),
+		}
+		if adminAddr != "" {
+			driver.transfers = newTransferManager(c.String("azcopy"))
+			if azcopyAuth == azcopyAuthAAD {
+				driver.transfers.useAAD(c.String("aad-tenant-id"), c.String("aad-client-id"), c.String("aad-client-secret"))
+			}
+		}
+		if backupAccountName != "" {
+			if err := driver.enableBackups(backupAccountName, backupAccountKey, backupInterval, c.Int("backup-retention")); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if d := c.Duration("monitor-interval"); d > 0 {
+			if err := driver.enableMonitor(aad, c.String("arm-endpoint"), c.String("storage-account-id"), d); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		// the driver is configured, start its background jobs and serve it
+		removeLegacyCIFSCreds()
+		pidfile := c.String("pidfile")
+		if pidfile != "" {
+			if err := writePidfile(pidfile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		go driver.stopOnSignal(c.Bool("unmount-on-stop"), pidfile)
+		go driver.resumeLeases()
+		if accountNameFile != "" || accountKeyFile != "" {
+			go driver.watchCredentials(accountNameFile, accountKeyFile)
+		}
+		if d := c.Duration("share-check-interval"); d > 0 {
+			go driver.runShareChecks(d)
+		}
+		if d := c.Duration("idle-unmount"); d > 0 {
+			go driver.unmountIdleVolumes(d)
+		}
+		if statsInterval > 0 {
+			driver.enableStats(statsInterval, c.Bool("stats-count-files"), c.Bool("stats-share-usage"))
+		}
+		if adminAddr != "" {
+			if c.String("admin-token") == "" {
+				log.Warn("no --admin-token set: the admin endpoints other than /metrics and /version are refused")
+			}
+			go func() {
+				log.Fatal(serveAdmin(adminAddr, c.String("admin-token"), driver))
+			}()
+		}
+		if spec := c.String("volumes"); spec != "" {
+			defs, err := loadVolumeDefinitions(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go driver.provisionVolumes(defs)
+		}
+		if dir := c.String("volumes-dir"); dir != "" {
+			go driver.watchVolumesDir(dir, c.Bool("volumes-dir-allow-empty"))
+		}
+		if spec := c.String("nomad-volumes"); spec != "" {
+			defs, err := loadVolumeDefinitions(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := driver.provisionHostVolumes(defs, c.String("nomad-config")); err != nil {
+				log.Fatal(err)
+			}
+		}
 		h := volume.NewHandler(driver)
-		log.Fatal(h.ServeUnix("docker", volumeDriverName))
+		for _, a := range aliases {
+			go func(alias string) {
+				log.Fatal(serveAlias(h, alias))
+			}(a)
+		}
+		if c.Bool("tls") {
+			log.Fatal(serveTLS(h, pluginName, addr, tlsOptions{
+				CertFile:       c.String("tls-cert"),
+				KeyFile:        c.String("tls-key"),
+				CAFile:         c.String("tls-ca"),
+				ClientCertFile: c.String("tls-client-cert"),
+				ClientKeyFile:  c.String("tls-client-key"),
+			}))
+		}
+		if addr != "" {
+			log.Debugf("serving plugin %q on tcp://%s", pluginName, addr)
+			log.Fatal(h.ServeTCP(pluginName, addr))
+		}
+		if runtime == runtimePodman {
+			path := socket
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(pluginSockDir, socket+".sock")
+			}
+			if err := registerPodmanPlugin(c.String("podman-config"), pluginName, path); err != nil {
+				log.Fatal(err)
+			}
+		}
+		log.Fatal(h.ServeUnix("docker", socket))
 	}
 	cmd.Run(os.Args)
 }
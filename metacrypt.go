@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// encryptedMetadataPrefix starts the metadata files encrypted with the
+	// metadata key, followed by the nonce and the AES-GCM sealed JSON.
+	// Plaintext files start with '{'.
+	encryptedMetadataPrefix = "azfenc1\n"
+
+	// keyVaultAPIVersion is the Key Vault REST API version used to unwrap
+	// the metadata key.
+	keyVaultAPIVersion = "7.4"
+
+	// keyVaultWrapAlgorithm is the algorithm the metadata key must be
+	// wrapped with.
+	keyVaultWrapAlgorithm = "RSA-OAEP-256"
+)
+
+// loadMetadataKey reads the 256-bit metadata key, base64 encoded, from
+// keyFile. If vaultKey (the URL of a Key Vault key) is set the file holds the
+// metadata key wrapped by that key instead, unwrapped with the Azure AD
+// credential.
+func loadMetadataKey(keyFile, vaultKey string, creds *aadCredential) (cipher.AEAD, error) {
+	s, err := readSecret(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeBase64(s)
+	if err != nil {
+		return nil, fmt.Errorf("metadata key file must contain a base64 encoded key: %v", err)
+	}
+	if vaultKey != "" {
+		if key, err = unwrapKey(creds, vaultKey, key); err != nil {
+			return nil, fmt.Errorf("cannot unwrap metadata key: %v", err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("metadata key must be 32 bytes long, got %d", len(key))
+	}
+	registerSecret(base64.StdEncoding.EncodeToString(key))
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decodeBase64 decodes s in standard or URL-safe base64, padded or not, as
+// output by the Azure CLI and the Key Vault API respectively.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// unwrapKey unwraps the key with the Key Vault key at keyURL
+// (https://<vault>.vault.azure.net/keys/<name>[/<version>]).
+func unwrapKey(creds *aadCredential, keyURL string, wrapped []byte) ([]byte, error) {
+	u, err := url.Parse(strings.TrimSuffix(keyURL, "/"))
+	if err != nil || u.Scheme != "https" || !strings.HasPrefix(u.Path, "/keys/") || strings.Index(u.Host, ".") < 0 {
+		return nil, fmt.Errorf("invalid Key Vault key URL %q, expected https://<vault>.vault.azure.net/keys/<name>[/<version>]", keyURL)
+	}
+	// the token is for the Key Vault service of the cloud the vault is in,
+	// e.g. https://vault.azure.net
+	token, err := creds.token("https://" + u.Host[strings.Index(u.Host, ".")+1:])
+	if err != nil {
+		return nil, err
+	}
+	body, _ := json.Marshal(map[string]string{
+		"alg":   keyVaultWrapAlgorithm,
+		"value": base64.RawURLEncoding.EncodeToString(wrapped),
+	})
+	req, err := http.NewRequest("POST", u.String()+"/unwrapkey?api-version="+keyVaultAPIVersion, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := storageHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key vault returned %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var out struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, fmt.Errorf("cannot decode key vault response: %v", err)
+	}
+	return decodeBase64(out.Value)
+}
+
+// sealMetadata encrypts the serialized metadata of the volume with the
+// metadata key, if not nil. The volume name is authenticated so that the file
+// cannot be passed off as the metadata of another volume.
+func sealMetadata(key cipher.AEAD, name string, b []byte) ([]byte, error) {
+	if key == nil {
+		return b, nil
+	}
+	nonce := make([]byte, key.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("cannot encrypt metadata: %v", err)
+	}
+	out := append([]byte(encryptedMetadataPrefix), nonce...)
+	return key.Seal(out, nonce, b, []byte(name)), nil
+}
+
+// openMetadata returns the serialized metadata of the volume from the
+// content of its file, decrypting it with the metadata key if encrypted.
+func openMetadata(key cipher.AEAD, name string, b []byte) ([]byte, error) {
+	if !isEncryptedMetadata(b) {
+		return b, nil
+	}
+	if key == nil {
+		return nil, fmt.Errorf("metadata of volume %q is encrypted, --metadata-key-file is required", name)
+	}
+	b = b[len(encryptedMetadataPrefix):]
+	n := key.NonceSize()
+	if len(b) < n {
+		return nil, fmt.Errorf("cannot decrypt metadata of volume %q: file is truncated", name)
+	}
+	plain, err := key.Open(nil, b[:n], b[n:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt metadata of volume %q, wrong metadata key?", name)
+	}
+	return plain, nil
+}
+
+func isEncryptedMetadata(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(encryptedMetadataPrefix))
+}
+
+// encryptPlaintext rewrites the plaintext metadata file at path, of the
+// volume name, encrypted with the metadata key. Encrypted files are left
+// alone.
+func encryptPlaintext(key cipher.AEAD, path, name string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read metadata: %v", err)
+	}
+	if isEncryptedMetadata(b) {
+		return nil
+	}
+	if b, err = sealMetadata(key, name, b); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("cannot write metadata: %v", err)
+	}
+	return nil
+}
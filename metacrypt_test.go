@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+func testMetadataCipher(t *testing.T, key byte) cipher.AEAD {
+	block, err := aes.NewCipher(bytes.Repeat([]byte{key}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestSealOpenMetadata(t *testing.T) {
+	plain := []byte(`{"account":"acct","options":{"share":"data"}}`)
+	key, otherKey := testMetadataCipher(t, 1), testMetadataCipher(t, 2)
+
+	for _, tc := range []struct {
+		name         string
+		sealKey      cipher.AEAD // nil to store the plaintext
+		openKey      cipher.AEAD
+		sealedAs     string
+		openedAs     string
+		corrupt      func([]byte) []byte
+		wantEnc, err bool
+	}{
+		{name: "plaintext without key", sealedAs: "vol", openedAs: "vol"},
+		{name: "plaintext with key", openKey: key, sealedAs: "vol", openedAs: "vol"},
+		{name: "encrypted", sealKey: key, openKey: key, sealedAs: "vol", openedAs: "vol", wantEnc: true},
+		{name: "encrypted without key", sealKey: key, sealedAs: "vol", openedAs: "vol", wantEnc: true, err: true},
+		{name: "wrong key", sealKey: key, openKey: otherKey, sealedAs: "vol", openedAs: "vol", wantEnc: true, err: true},
+		{name: "other volume", sealKey: key, openKey: key, sealedAs: "vol", openedAs: "other", wantEnc: true, err: true},
+		{name: "truncated", sealKey: key, openKey: key, sealedAs: "vol", openedAs: "vol", wantEnc: true, err: true,
+			corrupt: func(b []byte) []byte { return b[:len(encryptedMetadataPrefix)+4] }},
+		{name: "tampered", sealKey: key, openKey: key, sealedAs: "vol", openedAs: "vol", wantEnc: true, err: true,
+			corrupt: func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+	} {
+		b, err := sealMetadata(tc.sealKey, tc.sealedAs, plain)
+		if err != nil {
+			t.Errorf("%s: sealMetadata failed: %v", tc.name, err)
+			continue
+		}
+		if isEncryptedMetadata(b) != tc.wantEnc {
+			t.Errorf("%s: sealed metadata encrypted = %v, want %v", tc.name, !tc.wantEnc, tc.wantEnc)
+		}
+		if tc.wantEnc && bytes.Contains(b, plain) {
+			t.Errorf("%s: sealed metadata contains the plaintext", tc.name)
+		}
+		if tc.corrupt != nil {
+			b = tc.corrupt(b)
+		}
+		got, err := openMetadata(tc.openKey, tc.openedAs, b)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: openMetadata = %q, want error", tc.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: openMetadata failed: %v", tc.name, err)
+		} else if !bytes.Equal(got, plain) {
+			t.Errorf("%s: openMetadata = %q, want %q", tc.name, got, plain)
+		}
+	}
+}
@@ -1,22 +1,161 @@
 package main
 
 import (
+	"crypto/cipher"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Behaviors of Create when the share of the volume already exists, or not.
+const (
+	existsFail   = "fail"   // fail if the share exists
+	existsUse    = "use"    // fail if the share does not exist
+	existsCreate = "create" // create the share unless it exists
+)
+
+// What happens to the share of a volume when the volume is removed.
+const (
+	reclaimRetain   = "retain"
+	reclaimDelete   = "delete"
+	reclaimSnapshot = "snapshot-then-delete" // back up to the backup account first
+)
+
+// Protocols a volume can be mounted with.
+const (
+	protocolSMB = "smb"
+	protocolNFS = "nfs"
+)
+
+var (
+	// extraOptRe matches a single mount option accepted in 'extra-opts'. The
+	// character set excludes separators and anything a shell or mount.cifs
+	// would interpret specially.
+	extraOptRe = regexp.MustCompile(`^[a-z0-9_]+(=[A-Za-z0-9_./:-]+)?$`)
+
+	// domainRe matches NetBIOS and DNS domain names.
+	domainRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+
+	// shareMetadataNameRe matches the names of share metadata, which must be
+	// valid C# identifiers.
+	shareMetadataNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// sddlRe matches security descriptors in the Security Descriptor
+	// Definition Language: owner, group, DACL and SACL components.
+	sddlRe = regexp.MustCompile(`^(?:[OGDS]:[A-Za-z0-9_()\-;:]+)+$`)
+
+	// allowedMountOpts are the mount.cifs options that can be passed in
+	// 'extra-opts': caching, timeouts, locking, attribute and SELinux
+	// settings of the mount. Anything else is refused, in particular the
+	// options carrying credentials, those selecting the server, share or
+	// path mounted (unc, prefixpath, ip, ...), which would get around the
+	// share prefix and the mount policy, the security and POSIX settings,
+	// and the options managed through dedicated volume options.
+	allowedMountOpts = []string{"cache", "actimeo", "acregmax", "acdirmax", "closetimeo", "echo_interval",
+		"handletimeout", "max_cached_dirs", "nohandlecache", "strictsync", "nostrictsync", "nobrl", "brl",
+		"forcemandatorylock", "serverino", "noserverino", "nocase", "ignorecase", "hard", "soft", "retrans",
+		"resilienthandles", "noresilienthandles", "persistenthandles", "nopersistenthandles",
+		"nosharesock", "noblocksend", "fsc", "bsize", "iocharset", "user_xattr", "nouser_xattr", "cifsacl",
+		"nocifsacl", "noacl", "dynperm", "nodfs", "nosetuids", "noatime", "relatime", "nodiratime",
+		"nodev", "nosuid", "noexec", "context", "fscontext", "defcontext", "rootcontext"}
+)
+
+// optionAliases maps alternative option names used by other CIFS and Azure File
+// volume drivers to the names recognized by this driver. Option names are also
+// matched case-insensitively.
+var optionAliases = map[string]string{
+	"sharename":    "share",
+	"file_mode":    "filemode",
+	"dir_mode":     "dirmode",
+	"remote_path":  "remotepath",
+	"readonly":     "ro",
+	"read_only":    "ro",
+	"max_channels": "maxchannels",
+	"metadata":     "tags",
+}
+
+// rootSquashModes maps the values of the 'squash' option of NFS volumes to the
+// root squash setting of the share.
+var rootSquashModes = map[string]string{
+	"none": "NoRootSquash",
+	"root": "RootSquash",
+	"all":  "AllSquash",
+}
+
+// charMappings maps the values of the 'mapchars' option to the mount options
+// storing the characters Windows reserves in file names (e.g. ':', '*' or
+// '?'): remapped to the Unicode private range as Services for Mac or
+// Services for Unix do, or sent as is (and rejected by the server).
+var charMappings = map[string]string{
+	"sfm":  "mapposix",
+	"sfu":  "mapchars",
+	"none": "nomapposix,nomapchars",
+}
+
+const (
+	// Bounds of the rsize and wsize options in bytes.
+	minIOSize = 4096
+	maxIOSize = 16 << 20
+
+	// maxChannels is the most SMB channels the kernel opens per session.
+	maxChannels = 16
+)
+
+const (
+	// Maximum share quotas in GiB for accounts without and with large file
+	// shares enabled.
+	maxShareQuota      = 5120
+	maxLargeShareQuota = 102400
+
+	// maxSDDLLength is the longest security descriptor the File service
+	// accepts in the x-ms-file-permission header.
+	maxSDDLLength = 8 << 10
+)
+
 var (
-	recognizedOptions = []string{"share", "filemode", "dirmode", "uid", "gid", "nolock", "remotepath"}
+	recognizedOptions = []string{"share", "filemode", "dirmode", "uid", "gid", "nolock", "remotepath", "labels", "quota", "largeshare", "protocol", "squash", "extra-opts", "noperm", "domain", "ro", "restore-from-snapshot", "seed", "seed-sha256", "mkdirs", "exists", "rsize", "wsize", "reclaim", "protected", "exclusive", "multichannel", "maxchannels", "port", "transport", "tier", "account", "tags", "root-sddl", "mapchars", "multiuser"}
 )
 
 type volumeMetadata struct {
 	CreatedAt time.Time     `json:"created_at"`
 	Account   string        `json:"account"`
 	Options   VolumeOptions `json:"options"`
+
+	// ShareMissingSince is set when the share of the volume was found to be
+	// deleted outside of the driver.
+	ShareMissingSince *time.Time `json:"share_missing_since,omitempty"`
+
+	// Mounts lists the mounts of the volume that were not unmounted yet.
+	Mounts []mountRecord `json:"mounts,omitempty"`
+
+	// SeededAt is set once the seed archive of the volume was extracted.
+	SeededAt *time.Time `json:"seeded_at,omitempty"`
+
+	// Declared is the file of the --volumes-dir directory the volume was
+	// created for, which removes the volume when it no longer defines it.
+	Declared string `json:"declared,omitempty"`
+
+	// SMBVersion is the SMB dialect the volume was last mounted with.
+	SMBVersion string `json:"smb_version,omitempty"`
+
+	// Backups lists the generations copied to the backup account, oldest
+	// first.
+	Backups []backupGeneration `json:"backups,omitempty"`
+}
+
+// mountRecord is a mount of a volume by a container.
+type mountRecord struct {
+	Host      string    `json:"host"`
+	ID        string    `json:"id"` // mount ID given by Docker
+	MountedAt time.Time `json:"mounted_at"`
 }
 
 // VolumeOptions stores the opts passed to the driver by the docker engine.
@@ -27,36 +166,238 @@ type VolumeOptions struct {
 	UID        string `json:"uid"`
 	GID        string `json:"gid"`
 	NoLock     bool   `json:"nolock"`
+	NoPerm     bool   `json:"noperm,omitempty"`
+	ReadOnly   bool   `json:"ro,omitempty"`
+	Domain     string `json:"domain,omitempty"`
 	RemotePath string `json:"remotepath"`
+
+	// Protocol is the protocol the share is provisioned for and mounted with,
+	// empty means SMB.
+	Protocol string `json:"protocol,omitempty"`
+
+	// Squash sets how the server maps root (or all) users of NFS shares,
+	// one of the keys of rootSquashModes.
+	Squash string `json:"squash,omitempty"`
+
+	// ServerIP is the address of the storage endpoint to connect to instead
+	// of letting the mount helper resolve it. It is set at mount time only.
+	ServerIP string `json:"-"`
+
+	// RSize and WSize are the maximum sizes in bytes of read and write
+	// requests, zero means the driver default.
+	RSize int `json:"rsize,omitempty"`
+	WSize int `json:"wsize,omitempty"`
+
+	// Multichannel enables SMB Multichannel with up to MaxChannels
+	// connections (zero means the kernel default).
+	Multichannel bool `json:"multichannel,omitempty"`
+	MaxChannels  int  `json:"maxchannels,omitempty"`
+
+	// MapChars is how characters reserved on Windows are stored in file
+	// names, one of the keys of charMappings, empty for the kernel default.
+	MapChars string `json:"mapchars,omitempty"`
+
+	// Multiuser mounts the share with a session per user accessing it,
+	// authenticated with the credentials of their kernel keyring or else
+	// with those the driver hands to the kernel, see requestKeyCommand.
+	Multiuser bool `json:"multiuser,omitempty"`
+
+	// Port is the TCP port of the SMB server, zero means the driver default
+	// (445 unless --smb-port is set).
+	Port int `json:"port,omitempty"`
+
+	// Transport is transportREST to mount the share through the REST API
+	// instead of SMB, or empty for SMB (see --rest-fallback).
+	Transport string `json:"transport,omitempty"`
+
+	// ExtraOpts are additional mount.cifs options appended to the options
+	// generated by the driver.
+	ExtraOpts []string `json:"extra_opts,omitempty"`
+
+	// Exists is how Create handles existing shares, empty means
+	// existsCreate.
+	Exists string `json:"exists,omitempty"`
+
+	// Exclusive volumes can only be mounted on one host at a time, enforced
+	// by a lease on the share.
+	Exclusive bool `json:"exclusive,omitempty"`
+
+	// Protected makes Remove fail until the protection is cleared through
+	// the admin API.
+	Protected bool `json:"protected,omitempty"`
+
+	// Reclaim overrides --remove-shares for the volume, one of reclaimRetain,
+	// reclaimDelete or reclaimSnapshot.
+	Reclaim string `json:"reclaim,omitempty"`
+
+	// Quota is the maximum size of the share in GiB set at creation, zero
+	// means the service default.
+	Quota      int  `json:"quota,omitempty"`
+	LargeShare bool `json:"largeshare,omitempty"`
+
+	// AccessTier is the access tier of the share, set at creation or through
+	// the admin API, empty for the account default.
+	AccessTier string `json:"access_tier,omitempty"`
+
+	// Labels are arbitrary key/value pairs given as "k1=v1,k2=v2" (Docker
+	// does not pass volume labels to plugins).
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Tags are key/value pairs given as "k1=v1,k2=v2" set as the metadata
+	// of the share when it is created, e.g. for cost allocation.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Mkdirs are directories (relative to the share root) created through
+	// the REST API when the volume is created.
+	Mkdirs []string `json:"mkdirs,omitempty"`
+
+	// RootSDDL is the security descriptor (in SDDL, e.g.
+	// "O:<sid>G:<sid>D:(A;OICI;FA;;;<sid>)") set on the root directory of
+	// the share when the driver creates it, for identity-based access.
+	RootSDDL string `json:"root_sddl,omitempty"`
+
+	// Seed is the URL or host path of a tar archive extracted into the share
+	// on the first mount.
+	Seed string `json:"seed,omitempty"`
+
+	// SeedSHA256 is the checksum the seed archive is verified against.
+	SeedSHA256 string `json:"seed_sha256,omitempty"`
+
+	// RestoreFrom is the snapshot ("<volume>@<snapshot>") the share was
+	// populated from at creation.
+	RestoreFrom string `json:"restore_from,omitempty"`
+
+	// Account is the named account of the --accounts file hosting the share,
+	// empty for the account given to the driver.
+	Account string `json:"account,omitempty"`
 }
 
 type metadataDriver struct {
 	metaDir string
+	key     cipher.AEAD // encrypts the metadata files if set, see --metadata-key-file
+
+	// m guards the cache of the metadata files, which are read again when
+	// their modification time or size changes (e.g. written by another
+	// process or host sharing the directory), and the share index: shares
+	// indexes the names of the volumes by the share backing them,
+	// volumeShares is the reverse index
+	m            sync.RWMutex
+	cache        map[string]cachedMetadata // by volume name
+	shares       map[string]map[string]bool
+	volumeShares map[string]string
+}
+
+// cachedMetadata is the serialized metadata of a volume, with the
+// modification time and size of its file when it was read or written.
+type cachedMetadata struct {
+	b       []byte
+	modTime time.Time
+	size    int64
+}
+
+// current returns true if the file described by fi has not changed since
+// the metadata was cached.
+func (c cachedMetadata) current(fi os.FileInfo) bool {
+	return fi.ModTime().Equal(c.modTime) && fi.Size() == c.size
 }
 
-func newMetadataDriver(metaDir string) (*metadataDriver, error) {
+func newMetadataDriver(metaDir string, key cipher.AEAD) (*metadataDriver, error) {
 	if err := os.MkdirAll(metaDir, 0700); err != nil {
 		return nil, fmt.Errorf("error creating %s: %v", metaDir, err)
 	}
-	return &metadataDriver{metaDir}, nil
+	m := &metadataDriver{
+		metaDir:      metaDir,
+		key:          key,
+		cache:        make(map[string]cachedMetadata),
+		shares:       make(map[string]map[string]bool),
+		volumeShares: make(map[string]string),
+	}
+	names, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if err := m.encryptAll(names); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		meta, err := m.Get(name)
+		if err != nil {
+			// volumes that cannot be decrypted would be lost to Docker
+			if b, rerr := ioutil.ReadFile(m.path(name)); rerr == nil && isEncryptedMetadata(b) {
+				return nil, err
+			}
+			continue
+		}
+		m.m.Lock()
+		m.index(name, meta.Options.Share)
+		m.m.Unlock()
+	}
+	return m, nil
+}
+
+// encryptAll encrypts the plaintext metadata files of the volumes and of the
+// archived volumes, written before the metadata key was set.
+func (m *metadataDriver) encryptAll(names []string) error {
+	paths := make(map[string]string, len(names))
+	for _, name := range names {
+		paths[m.path(name)] = name
+	}
+	archived, _ := filepath.Glob(filepath.Join(m.metaDir, removedDir, "*"))
+	for _, p := range archived {
+		paths[p] = filepath.Base(p)
+	}
+	for p, name := range paths {
+		if err := encryptPlaintext(m.key, p, name); err != nil {
+			return fmt.Errorf("cannot encrypt metadata of volume %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// index records that the volume is backed by the share, removing it from the
+// share it was previously indexed under. An empty share only removes it.
+// Caller must hold m.m.
+func (m *metadataDriver) index(name, share string) {
+	if old, ok := m.volumeShares[name]; ok {
+		delete(m.shares[old], name)
+		if len(m.shares[old]) == 0 {
+			delete(m.shares, old)
+		}
+		delete(m.volumeShares, name)
+	}
+	if share == "" {
+		return
+	}
+	if m.shares[share] == nil {
+		m.shares[share] = make(map[string]bool)
+	}
+	m.shares[share][name] = true
+	m.volumeShares[name] = share
+}
+
+// VolumesOfShare returns the names of the volumes backed by the share, on
+// any account, in lexical order.
+func (m *metadataDriver) VolumesOfShare(share string) []string {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	var names []string
+	for name := range m.shares[share] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func (m *metadataDriver) Validate(meta map[string]string) (volumeMetadata, error) {
 	var v volumeMetadata
 	var opts VolumeOptions
 
-	// Validate keys
-	for k := range meta {
-		found := false
-		for _, opts := range recognizedOptions {
-			if k == opts {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return v, fmt.Errorf("not a recognized volume driver option: %q", k)
-		}
+	// Normalize and validate keys
+	meta, err := normalizeOptions(meta)
+	if err != nil {
+		return v, err
 	}
 	opts.Share = meta["share"]
 	opts.DirMode = meta["dirmode"]
@@ -65,8 +406,240 @@ func (m *metadataDriver) Validate(meta map[string]string) (volumeMetadata, error
 	opts.UID = meta["uid"]
 	opts.RemotePath = meta["remotepath"]
 
-	if meta["nolock"] == "true" {
-		opts.NoLock = true
+	switch p := strings.ToLower(meta["protocol"]); p {
+	case "", protocolSMB:
+	case protocolNFS:
+		opts.Protocol = p
+		for _, k := range []string{"filemode", "dirmode", "uid", "gid", "noperm", "domain"} {
+			if meta[k] != "" {
+				return v, fmt.Errorf("option %q is not supported with protocol %q", k, p)
+			}
+		}
+	default:
+		return v, fmt.Errorf("protocol must be %q or %q, got %q", protocolSMB, protocolNFS, meta["protocol"])
+	}
+
+	if sq := meta["squash"]; sq != "" {
+		if opts.Protocol != protocolNFS {
+			return v, fmt.Errorf("option 'squash' is only supported with protocol %q", protocolNFS)
+		}
+		if _, ok := rootSquashModes[sq]; !ok {
+			return v, fmt.Errorf("squash must be one of 'none', 'root' or 'all', got %q", sq)
+		}
+		opts.Squash = sq
+	}
+
+	if eo := meta["extra-opts"]; eo != "" {
+		if opts.Protocol == protocolNFS {
+			return v, fmt.Errorf("option 'extra-opts' is only supported with protocol %q", protocolSMB)
+		}
+		extra, err := parseExtraOpts(eo)
+		if err != nil {
+			return v, err
+		}
+		opts.ExtraOpts = extra
+	}
+
+	switch e := strings.ToLower(meta["exists"]); e {
+	case "", existsCreate:
+	case existsFail, existsUse:
+		opts.Exists = e
+	default:
+		return v, fmt.Errorf("exists must be one of 'fail', 'use' or 'create', got %q", meta["exists"])
+	}
+
+	switch r := strings.ToLower(meta["reclaim"]); r {
+	case "":
+	case reclaimRetain, reclaimDelete, reclaimSnapshot:
+		opts.Reclaim = r
+	default:
+		return v, fmt.Errorf("reclaim must be one of 'retain', 'delete' or 'snapshot-then-delete', got %q", meta["reclaim"])
+	}
+
+	if opts.RSize, err = parseIOSize(meta, "rsize"); err != nil {
+		return v, err
+	}
+	if opts.WSize, err = parseIOSize(meta, "wsize"); err != nil {
+		return v, err
+	}
+
+	if opts.Multichannel, err = parseBoolOption(meta, "multichannel"); err != nil {
+		return v, err
+	}
+	if mc := meta["maxchannels"]; mc != "" {
+		n, err := strconv.Atoi(mc)
+		if err != nil || n < 1 || n > maxChannels {
+			return v, fmt.Errorf("maxchannels must be a number between 1 and %d, got %q", maxChannels, mc)
+		}
+		if !opts.Multichannel {
+			return v, fmt.Errorf("option 'maxchannels' requires 'multichannel=true'")
+		}
+		opts.MaxChannels = n
+	}
+	if p := meta["port"]; p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return v, fmt.Errorf("port must be a TCP port number, got %q", p)
+		}
+		if opts.Protocol == protocolNFS {
+			return v, fmt.Errorf("option 'port' is only supported with protocol %q", protocolSMB)
+		}
+		opts.Port = n
+	}
+	switch t := strings.ToLower(meta["transport"]); t {
+	case "", transportSMB:
+	case transportREST:
+		if opts.Protocol == protocolNFS {
+			return v, fmt.Errorf("transport %q is only supported with protocol %q", t, protocolSMB)
+		}
+		if len(opts.ExtraOpts) != 0 {
+			return v, fmt.Errorf("option 'extra-opts' is not supported with transport %q", t)
+		}
+		opts.Transport = t
+	default:
+		return v, fmt.Errorf("transport must be %q or %q, got %q", transportSMB, transportREST, meta["transport"])
+	}
+	if opts.Multichannel && opts.Protocol == protocolNFS {
+		return v, fmt.Errorf("option 'multichannel' is only supported with protocol %q", protocolSMB)
+	}
+	if mc := strings.ToLower(meta["mapchars"]); mc != "" {
+		if _, ok := charMappings[mc]; !ok {
+			return v, fmt.Errorf("mapchars must be one of 'sfm', 'sfu' or 'none', got %q", meta["mapchars"])
+		}
+		opts.MapChars = mc
+	}
+	if opts.Multiuser, err = parseBoolOption(meta, "multiuser"); err != nil {
+		return v, err
+	}
+	// the options set to false are allowed whatever the protocol
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{{"mapchars", opts.MapChars != ""}, {"multiuser", opts.Multiuser}} {
+		if !o.set {
+			continue
+		}
+		if opts.Protocol == protocolNFS {
+			return v, fmt.Errorf("option '%s' is only supported with protocol %q", o.name, protocolSMB)
+		}
+		if opts.Transport == transportREST {
+			return v, fmt.Errorf("option '%s' is not supported with transport %q", o.name, opts.Transport)
+		}
+	}
+
+	if opts.LargeShare, err = parseBoolOption(meta, "largeshare"); err != nil {
+		return v, err
+	}
+	if q := meta["quota"]; q != "" {
+		quota, err := strconv.Atoi(q)
+		if err != nil || quota < 1 {
+			return v, fmt.Errorf("quota must be a positive number of GiB, got %q", q)
+		}
+		if err := validateQuota(quota, opts.LargeShare); err != nil {
+			return v, err
+		}
+		opts.Quota = quota
+	}
+	if t := meta["tier"]; t != "" {
+		if opts.AccessTier, err = parseAccessTier(t); err != nil {
+			return v, err
+		}
+	}
+
+	if l := meta["labels"]; l != "" {
+		labels, err := parseLabels(l)
+		if err != nil {
+			return v, err
+		}
+		opts.Labels = labels
+	}
+	if t := meta["tags"]; t != "" {
+		tags, err := parseLabels(t)
+		if err != nil {
+			return v, err
+		}
+		for k := range tags {
+			if !shareMetadataNameRe.MatchString(k) {
+				return v, fmt.Errorf("invalid tag %q, must start with a letter or underscore followed by letters, digits or underscores", k)
+			}
+		}
+		opts.Tags = tags
+	}
+
+	if r := meta["restore-from-snapshot"]; r != "" {
+		if opts.Protocol == protocolNFS {
+			return v, fmt.Errorf("option 'restore-from-snapshot' is only supported with protocol %q", protocolSMB)
+		}
+		if _, _, err := parseSnapshotRef(r); err != nil {
+			return v, err
+		}
+		opts.RestoreFrom = r
+	}
+
+	if opts.NoLock, err = parseBoolOption(meta, "nolock"); err != nil {
+		return v, err
+	}
+	if opts.NoPerm, err = parseBoolOption(meta, "noperm"); err != nil {
+		return v, err
+	}
+	if opts.ReadOnly, err = parseBoolOption(meta, "ro"); err != nil {
+		return v, err
+	}
+	if opts.Protected, err = parseBoolOption(meta, "protected"); err != nil {
+		return v, err
+	}
+	if opts.Exclusive, err = parseBoolOption(meta, "exclusive"); err != nil {
+		return v, err
+	}
+	if opts.Account = meta["account"]; opts.Account != "" && opts.Account != defaultAccount {
+		if o := driverAccountOption(opts); o != "" {
+			return v, fmt.Errorf("option '%s' is not supported with 'account'", o)
+		}
+	}
+	if d := meta["domain"]; d != "" {
+		if err := validateDomain(d); err != nil {
+			return v, err
+		}
+		opts.Domain = d
+	}
+
+	if opts.Reclaim == reclaimSnapshot && opts.Protocol == protocolNFS {
+		return v, fmt.Errorf("reclaim 'snapshot-then-delete' is only supported with protocol %q", protocolSMB)
+	}
+
+	if md := meta["mkdirs"]; md != "" {
+		if opts.Protocol == protocolNFS {
+			return v, fmt.Errorf("option 'mkdirs' is only supported with protocol %q", protocolSMB)
+		}
+		dirs, err := parseMkdirs(md)
+		if err != nil {
+			return v, err
+		}
+		opts.Mkdirs = dirs
+	}
+	if sd := meta["root-sddl"]; sd != "" {
+		if opts.Protocol == protocolNFS {
+			return v, fmt.Errorf("option 'root-sddl' is only supported with protocol %q", protocolSMB)
+		}
+		if !sddlRe.MatchString(sd) {
+			return v, fmt.Errorf("option 'root-sddl' must be a security descriptor in SDDL, e.g. 'O:BAG:SYD:(A;OICI;FA;;;BA)', got %q", sd)
+		}
+		if len(sd) > maxSDDLLength {
+			return v, fmt.Errorf("option 'root-sddl' cannot exceed %d bytes", maxSDDLLength)
+		}
+		opts.RootSDDL = sd
+	}
+
+	if sd := meta["seed"]; sd != "" {
+		if opts.ReadOnly {
+			return v, fmt.Errorf("option 'seed' cannot be used with read-only volumes")
+		}
+		if err := validateSeed(sd, meta["seed-sha256"]); err != nil {
+			return v, err
+		}
+		opts.Seed, opts.SeedSHA256 = sd, meta["seed-sha256"]
+	} else if meta["seed-sha256"] != "" {
+		return v, fmt.Errorf("option 'seed-sha256' requires option 'seed'")
 	}
 
 	return volumeMetadata{
@@ -74,36 +647,276 @@ func (m *metadataDriver) Validate(meta map[string]string) (volumeMetadata, error
 	}, nil
 }
 
+// normalizeOptions returns the options with lowercased keys and aliases
+// replaced by the recognized option names. It fails on unrecognized options
+// and on options given more than once under different names.
+func normalizeOptions(meta map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(meta))
+	for k, val := range meta {
+		name := strings.ToLower(k)
+		if a, ok := optionAliases[name]; ok {
+			name = a
+		}
+		if !contains(recognizedOptions, name) {
+			return nil, fmt.Errorf("not a recognized volume driver option: %q", k)
+		}
+		if _, dup := out[name]; dup {
+			return nil, fmt.Errorf("volume driver option %q is specified more than once", name)
+		}
+		out[name] = val
+	}
+	return out, nil
+}
+
+// parseBoolOption parses the boolean option with the given name. Missing
+// options are false; options given without a value (e.g. "-o ro=") are true.
+func parseBoolOption(meta map[string]string, name string) (bool, error) {
+	val, ok := meta[name]
+	if !ok {
+		return false, nil
+	}
+	switch strings.ToLower(val) {
+	case "", "true", "1", "yes", "on":
+		return true, nil
+	case "false", "0", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("option %q must be a boolean, got %q", name, val)
+}
+
+// parseIOSize parses the request size option with the given name, which must
+// be a multiple of 1024 bytes between minIOSize and maxIOSize. Missing options
+// are zero.
+func parseIOSize(meta map[string]string, name string) (int, error) {
+	val, ok := meta[name]
+	if !ok || val == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < minIOSize || n > maxIOSize || n%1024 != 0 {
+		return 0, fmt.Errorf("%s must be a multiple of 1024 between %d and %d bytes, got %q", name, minIOSize, maxIOSize, val)
+	}
+	return n, nil
+}
+
+// validateQuota returns an error if the quota in GiB is out of the range
+// allowed for shares with or without large file shares enabled.
+func validateQuota(quota int, largeShare bool) error {
+	if quota < 1 {
+		return fmt.Errorf("quota must be a positive number of GiB, got %d", quota)
+	}
+	if quota > maxLargeShareQuota {
+		return fmt.Errorf("quota cannot exceed %d GiB", maxLargeShareQuota)
+	}
+	if quota > maxShareQuota && !largeShare {
+		return fmt.Errorf("quota above %d GiB requires 'largeshare=true'", maxShareQuota)
+	}
+	return nil
+}
+
+// validateDomain returns an error if d is not usable as the SMB domain.
+func validateDomain(d string) error {
+	if !domainRe.MatchString(d) {
+		return fmt.Errorf("invalid domain %q", d)
+	}
+	return nil
+}
+
+// parseExtraOpts parses and sanitizes comma-separated mount options.
+func parseExtraOpts(s string) ([]string, error) {
+	var opts []string
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if !extraOptRe.MatchString(o) {
+			return nil, fmt.Errorf("mount option %q contains unsupported characters", o)
+		}
+		if name := strings.SplitN(o, "=", 2)[0]; !contains(allowedMountOpts, name) {
+			return nil, fmt.Errorf("mount option %q cannot be set through 'extra-opts', use the dedicated volume option if there is one", name)
+		}
+		opts = append(opts, o)
+	}
+	return opts, nil
+}
+
+// parseMkdirs parses comma-separated directory paths relative to the share
+// root.
+func parseMkdirs(s string) ([]string, error) {
+	var dirs []string
+	for _, d := range strings.Split(s, ",") {
+		d = strings.Trim(strings.TrimSpace(d), "/")
+		if d == "" {
+			continue
+		}
+		for _, p := range strings.Split(d, "/") {
+			if p == "" || p == "." || p == ".." || strings.ContainsAny(p, `\:*?"<>|`) {
+				return nil, fmt.Errorf("invalid directory path %q", d)
+			}
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+// parseLabels parses labels given in the "k1=v1,k2=v2" format, where a
+// backslash escapes a ',', '=' or backslash in keys and values, see
+// joinLabels.
+func parseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range splitEscaped(s, ',', -1) {
+		p := splitEscaped(kv, '=', 2)
+		if len(p) != 2 || p[0] == "" {
+			return nil, fmt.Errorf("malformed label %q, expected key=value", kv)
+		}
+		labels[labelUnescaper.Replace(p[0])] = labelUnescaper.Replace(p[1])
+	}
+	return labels, nil
+}
+
+// joinLabels formats labels in the format parsed by parseLabels, sorted by
+// key.
+func joinLabels(labels map[string]string) string {
+	kvs := make([]string, 0, len(labels))
+	for k, val := range labels {
+		kvs = append(kvs, labelEscaper.Replace(k)+"="+labelEscaper.Replace(val))
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// labelEscaper escapes the separators of labels and backslashes with a
+// backslash. When parsing, a backslash followed by anything else is kept as
+// is, so that values such as Windows paths need no escaping.
+var (
+	labelEscaper   = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`)
+	labelUnescaper = strings.NewReplacer(`\\`, `\`, `\,`, ",", `\=`, "=")
+)
+
+// splitEscaped splits s around the separators not escaped with a backslash
+// into at most n parts (all of them if n < 0), leaving escapes in place.
+func splitEscaped(s string, sep byte, n int) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`\,=`, s[i+1]) >= 0:
+			i++
+		case s[i] == sep && (n < 0 || len(parts) < n-1):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
 func (m *metadataDriver) Delete(name string) error {
+	m.m.Lock()
+	defer m.m.Unlock()
 	if err := os.RemoveAll(m.path(name)); err != nil {
 		return fmt.Errorf("cannot delete volume metadata: %v", err)
 	}
+	delete(m.cache, name)
+	m.index(name, "")
 	return nil
 }
 
+// Set writes the metadata of the volume, the file and the cache being
+// updated together so that they never disagree. The file is encrypted if a
+// metadata key is set, the cache holds the plaintext.
 func (m *metadataDriver) Set(name string, meta volumeMetadata) error {
 	b, err := json.Marshal(meta)
 	if err != nil {
 		return fmt.Errorf("cannot serialize metadata: %v", err)
 	}
-	if err := ioutil.WriteFile(m.path(name), b, 0600); err != nil {
+	sealed, err := sealMetadata(m.key, name, b)
+	if err != nil {
+		return err
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	if err := ioutil.WriteFile(m.path(name), sealed, 0600); err != nil {
 		return fmt.Errorf("cannot write metadata: %v", err)
 	}
+	if fi, err := os.Stat(m.path(name)); err == nil {
+		m.cache[name] = cachedMetadata{b, fi.ModTime(), fi.Size()}
+	} else {
+		delete(m.cache, name)
+	}
+	m.index(name, meta.Options.Share)
 	return nil
 }
 
+// Get returns the metadata of the volume from the cache, only reading the
+// file of volumes not cached yet or whose file changed since (e.g. written by
+// another process). Readers do not block each other, and get their own copy
+// of the metadata.
 func (m *metadataDriver) Get(name string) (volumeMetadata, error) {
 	var v volumeMetadata
-	b, err := ioutil.ReadFile(m.path(name))
-	if err != nil {
+	fi, err := os.Stat(m.path(name))
+	if os.IsNotExist(err) {
+		m.m.Lock()
+		// removed by another process
+		if _, ok := m.cache[name]; ok {
+			delete(m.cache, name)
+			m.index(name, "")
+		}
+		m.m.Unlock()
+		return v, newError(codeVolumeNotFound, "volume %q does not exist", name)
+	} else if err != nil {
 		return v, fmt.Errorf("cannot read metadata: %v", err)
 	}
+	m.m.RLock()
+	c, ok := m.cache[name]
+	m.m.RUnlock()
+	b := c.b
+	if !ok || !c.current(fi) {
+		if b, err = m.load(name); err != nil {
+			return v, err
+		}
+	}
 	if err := json.Unmarshal(b, &v); err != nil {
 		return v, fmt.Errorf("cannot deserialize metadata: %v", err)
 	}
 	return v, nil
 }
 
+// load reads the metadata file of the volume into the cache, unless the
+// cache is current. The write lock is held while reading so that a
+// concurrent Delete cannot be undone.
+func (m *metadataDriver) load(name string) ([]byte, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	f, err := os.Open(m.path(name))
+	if os.IsNotExist(err) {
+		return nil, newError(codeVolumeNotFound, "volume %q does not exist", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read metadata: %v", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read metadata: %v", err)
+	}
+	if c, ok := m.cache[name]; ok && c.current(fi) {
+		return c.b, nil
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read metadata: %v", err)
+	}
+	if b, err = openMetadata(m.key, name, b); err != nil {
+		return nil, err
+	}
+	m.cache[name] = cachedMetadata{b, fi.ModTime(), fi.Size()}
+	var meta volumeMetadata
+	if err := json.Unmarshal(b, &meta); err == nil {
+		m.index(name, meta.Options.Share)
+	}
+	return b, nil
+}
+
 func (m *metadataDriver) List() ([]string, error) {
 	var volumes []string
 
@@ -130,6 +943,65 @@ func (m *metadataDriver) List() ([]string, error) {
 	return volumes, nil
 }
 
+// validateVolumeName returns an error if name cannot be used as the name of
+// a metadata file and a mount directory: it must be a single path element.
+func validateVolumeName(name string) error {
+	if name == "" || name == "." || name == ".." || name == removedDir || filepath.Base(name) != name {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+	return nil
+}
+
 func (m *metadataDriver) path(name string) string {
 	return filepath.Join(m.metaDir, name)
 }
+
+// removedDir holds the metadata of removed volumes whose share was deleted,
+// so that they can be restored along with a soft-deleted share. Its name is
+// not a valid volume name and List skips directories.
+const removedDir = ".removed"
+
+// Archive keeps the metadata of the volume being removed, replacing any
+// previously archived metadata under the name.
+func (m *metadataDriver) Archive(name string, meta volumeMetadata) error {
+	if err := os.MkdirAll(filepath.Join(m.metaDir, removedDir), 0700); err != nil {
+		return fmt.Errorf("error creating %s: %v", removedDir, err)
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("cannot serialize metadata: %v", err)
+	}
+	if b, err = sealMetadata(m.key, name, b); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(m.metaDir, removedDir, name), b, 0600); err != nil {
+		return fmt.Errorf("cannot write metadata: %v", err)
+	}
+	return nil
+}
+
+// GetArchived returns the archived metadata of a removed volume.
+func (m *metadataDriver) GetArchived(name string) (volumeMetadata, error) {
+	var v volumeMetadata
+	b, err := ioutil.ReadFile(filepath.Join(m.metaDir, removedDir, name))
+	if os.IsNotExist(err) {
+		return v, newError(codeVolumeNotFound, "volume %q does not exist and was not removed with its share", name)
+	} else if err != nil {
+		return v, fmt.Errorf("cannot read metadata: %v", err)
+	}
+	if b, err = openMetadata(m.key, name, b); err != nil {
+		return v, err
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return v, fmt.Errorf("cannot deserialize metadata: %v", err)
+	}
+	return v, nil
+}
+
+// DeleteArchived deletes the archived metadata of a removed volume, if any.
+func (m *metadataDriver) DeleteArchived(name string) error {
+	if err := os.Remove(filepath.Join(m.metaDir, removedDir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot delete archived volume metadata: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadataCacheInvalidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// two drivers sharing the directory, as processes or hosts do
+	m, err := newMetadataDriver(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newMetadataDriver(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := volumeMetadata{Account: "acct", Options: VolumeOptions{Share: "data"}}
+	if err := m.Set("vol", meta); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := other.Get("vol"); err != nil || got.Options.Share != "data" {
+		t.Fatalf("Get of a volume written by another driver = %+v, %v", got, err)
+	}
+
+	// same size, so that only the modification time tells the change
+	meta.Options.Share = "logs"
+	if err := other.Set("vol", meta); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(other.path("vol"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := m.Get("vol"); err != nil || got.Options.Share != "logs" {
+		t.Errorf("Get after another driver changed the volume = %+v, %v, want share %q", got, err, "logs")
+	}
+	if got := m.VolumesOfShare("logs"); !reflect.DeepEqual(got, []string{"vol"}) {
+		t.Errorf("VolumesOfShare of the new share = %v, want [vol]", got)
+	}
+	if got := m.VolumesOfShare("data"); len(got) != 0 {
+		t.Errorf("VolumesOfShare of the old share = %v, want none", got)
+	}
+
+	if err := other.Delete("vol"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := m.Get("vol"); classify(err, codeInternal) != codeVolumeNotFound {
+		t.Errorf("Get after another driver removed the volume = %+v, %v, want a not found error", got, err)
+	}
+	if got := m.VolumesOfShare("logs"); len(got) != 0 {
+		t.Errorf("VolumesOfShare after another driver removed the volume = %v, want none", got)
+	}
+}
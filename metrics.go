@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// registry holds all metrics exported by the driver, in registration
+	// order.
+	registry []collector
+
+	volumeUsedBytes = newGauge("azurefile_volume_used_bytes",
+		"Bytes used on the mounted volume as reported by statfs.", "volume", "share")
+	volumeCapacityBytes = newGauge("azurefile_volume_capacity_bytes",
+		"Capacity of the mounted volume as reported by statfs.", "volume", "share")
+	volumeFiles = newGauge("azurefile_volume_files",
+		"Number of files on the mounted volume.", "volume", "share")
+	shareUsageBytes = newGauge("azurefile_share_usage_bytes",
+		"Share usage reported by the File service.", "volume", "share")
+	shareTransactions = newGauge("azurefile_share_transactions",
+		"Requests to the share in the last full hour as reported by Azure Monitor.", "volume", "share")
+	shareE2ELatency = newGauge("azurefile_share_success_e2e_latency_seconds",
+		"Average end-to-end latency of successful requests to the share in the last full hour as reported by Azure Monitor.", "volume", "share")
+	shareServerLatency = newGauge("azurefile_share_success_server_latency_seconds",
+		"Average server latency of successful requests to the share in the last full hour as reported by Azure Monitor.", "volume", "share")
+	shareCapacityBytes = newGauge("azurefile_share_capacity_bytes",
+		"Storage used by the share as reported by Azure Monitor.", "volume", "share")
+
+	mountDuration = newHistogram("azurefile_mount_duration_seconds",
+		"Duration of mount and unmount operations, including retries.", mountDurationBuckets, "operation")
+	storageThrottled = newCounter("azurefile_storage_throttled_total",
+		"Requests to the File service throttled by the storage account and retried.", "account")
+	shareThrottled = newCounter("azurefile_share_throttled_total",
+		"Requests to the share throttled by the storage account.", "account", "share")
+	shareSlowRequests = newCounter("azurefile_share_slow_requests_total",
+		"Requests to the share slower than --slow-request-threshold.", "account", "share")
+	shareRequestLatency = newGauge("azurefile_share_request_latency_seconds",
+		"Moving average of the duration of requests to the share.", "account", "share")
+	accountPressureLevel = newGauge("azurefile_account_pressure_level",
+		"Pressure level of the storage account (0 to 6) raised by throttled and slow requests, slowing down background jobs.", "account")
+	mountErrors = newCounter("azurefile_mount_errors_total",
+		"Failed mount and unmount operations by error class.", "operation", "class")
+	buildInfo = newGauge("azurefile_build_info",
+		"Always 1, labeled with the build of the driver.", "version", "commit", "goversion")
+)
+
+// volumeMetrics are the metric families of volumes, labeled by volume, share
+// and the volume labels of the driver, see setMetricLabels.
+var volumeMetrics = []*metricVec{volumeUsedBytes, volumeCapacityBytes, volumeFiles, shareUsageBytes,
+	shareTransactions, shareE2ELatency, shareServerLatency, shareCapacityBytes}
+
+// metricLabelRe matches the characters not allowed in Prometheus label names.
+var metricLabelRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// setMetricLabels adds the volume labels to the labels of the volume metrics,
+// as label_<name> with the characters not allowed in label names replaced by
+// underscores. It must be called before volume metrics are set, with the
+// metric labels of the driver.
+func setMetricLabels(names []string) error {
+	seen := make(map[string]string)
+	var labelNames []string
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("invalid metric label %q", name)
+		}
+		l := "label_" + metricLabelRe.ReplaceAllString(name, "_")
+		if other, dup := seen[l]; dup {
+			return fmt.Errorf("metric labels %q and %q are both exported as %s", other, name, l)
+		}
+		seen[l] = name
+		labelNames = append(labelNames, l)
+	}
+	for _, v := range volumeMetrics {
+		v.labels = append(v.labels, labelNames...)
+	}
+	return nil
+}
+
+// volumeLabelValues returns the label values of the volume metrics of the
+// volume.
+func (v *volumeDriver) volumeLabelValues(name string, meta volumeMetadata) []string {
+	lv := []string{name, meta.Options.Share}
+	for _, l := range v.metricLabels {
+		lv = append(lv, meta.Options.Labels[l])
+	}
+	return lv
+}
+
+// mountDurationBuckets are the upper bounds of the mount duration histogram
+// buckets in seconds.
+var mountDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// collector is a metric family that can be exported.
+type collector interface {
+	write(w io.Writer)
+}
+
+// metricVec is a metric family with a fixed set of label names, exported in
+// the Prometheus text format.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // "gauge" or "counter"
+	labels []string
+
+	m      sync.Mutex
+	values map[string]float64 // keyed by rendered label pairs
+}
+
+func newMetric(kind, name, help string, labels ...string) *metricVec {
+	v := &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	registry = append(registry, v)
+	return v
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return newMetric("gauge", name, help, labels...)
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return newMetric("counter", name, help, labels...)
+}
+
+// key renders the label pairs for the label values, which must be given in
+// the order the label names were registered.
+func (v *metricVec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, expected %d", v.name, len(labelValues), len(v.labels)))
+	}
+	var p []string
+	for i, l := range v.labels {
+		val := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labelValues[i])
+		p = append(p, fmt.Sprintf("%s=%q", l, val))
+	}
+	return strings.Join(p, ",")
+}
+
+func (v *metricVec) set(val float64, labelValues ...string) {
+	k := v.key(labelValues)
+	v.m.Lock()
+	v.values[k] = val
+	v.m.Unlock()
+}
+
+func (v *metricVec) add(val float64, labelValues ...string) {
+	k := v.key(labelValues)
+	v.m.Lock()
+	v.values[k] += val
+	v.m.Unlock()
+}
+
+func (v *metricVec) inc(labelValues ...string) {
+	v.add(1, labelValues...)
+}
+
+// delete removes the series with the label values, e.g. when a volume goes
+// away.
+func (v *metricVec) delete(labelValues ...string) {
+	k := v.key(labelValues)
+	v.m.Lock()
+	delete(v.values, k)
+	v.m.Unlock()
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	for _, k := range sortedKeys(v.values) {
+		if k == "" {
+			fmt.Fprintf(w, "%s %g\n", v.name, v.values[k])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %g\n", v.name, k, v.values[k])
+		}
+	}
+}
+
+// histogramVec is a histogram family with a fixed set of label names.
+type histogramVec struct {
+	*metricVec // for the label handling, values holds the sums
+	buckets    []float64
+	counts     map[string][]uint64 // per bucket, plus the total count last
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		metricVec: &metricVec{
+			name:   name,
+			help:   help,
+			kind:   "histogram",
+			labels: labels,
+			values: make(map[string]float64),
+		},
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+	}
+	registry = append(registry, h)
+	return h
+}
+
+func (h *histogramVec) observe(val float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.m.Lock()
+	defer h.m.Unlock()
+	c, ok := h.counts[k]
+	if !ok {
+		c = make([]uint64, len(h.buckets)+1)
+		h.counts[k] = c
+	}
+	for i, b := range h.buckets {
+		if val <= b {
+			c[i]++
+		}
+	}
+	c[len(h.buckets)]++
+	h.values[k] += val
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", h.name, h.help, h.name, h.kind)
+	for _, k := range sortedKeys(h.values) {
+		sep := ","
+		if k == "" {
+			sep = ""
+		}
+		c := h.counts[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", h.name, k, sep, b, c[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", h.name, k, sep, c[len(h.buckets)])
+		if k == "" {
+			fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.values[k], h.name, c[len(h.buckets)])
+		} else {
+			fmt.Fprintf(w, "%s_sum{%s} %g\n%s_count{%s} %d\n", h.name, k, h.values[k], h.name, k, c[len(h.buckets)])
+		}
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeMetrics writes all registered metrics in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	for _, c := range registry {
+		c.write(w)
+	}
+}
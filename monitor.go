@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// monitorAPIVersion is the version of the Azure Monitor metrics API.
+const monitorAPIVersion = "2018-01-01"
+
+// monitorMetricNames are the File service metrics queried per share.
+var monitorMetricNames = []string{"Transactions", "SuccessE2ELatency", "SuccessServerLatency", "FileCapacity"}
+
+// shareMonitorMetrics are the metrics of a share reported by Azure Monitor
+// for the last full hour.
+type shareMonitorMetrics struct {
+	CollectedAt            time.Time `json:"collected_at"`
+	Transactions           float64   `json:"transactions"`
+	SuccessE2ELatencyMs    float64   `json:"success_e2e_latency_ms,omitempty"`
+	SuccessServerLatencyMs float64   `json:"success_server_latency_ms,omitempty"`
+	CapacityBytes          float64   `json:"capacity_bytes,omitempty"`
+}
+
+// monitorCollector periodically pulls the metrics of the shares of the
+// volumes from Azure Monitor.
+type monitorCollector struct {
+	creds       *aadCredential
+	armEndpoint string
+	accountID   string // ARM resource ID of the storage account
+
+	m       sync.Mutex
+	metrics map[string]shareMonitorMetrics // keyed by share
+}
+
+// validateStorageAccountID checks that id is the ARM resource ID of a storage
+// account.
+func validateStorageAccountID(id string) error {
+	p := strings.Split(strings.Trim(id, "/"), "/")
+	if len(p) != 8 || !strings.EqualFold(p[0], "subscriptions") || !strings.EqualFold(p[2], "resourceGroups") ||
+		!strings.EqualFold(p[4], "providers") || !strings.EqualFold(p[5], "Microsoft.Storage") || !strings.EqualFold(p[6], "storageAccounts") {
+		return fmt.Errorf("invalid storage account resource ID %q, expected /subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Storage/storageAccounts/<name>", id)
+	}
+	return nil
+}
+
+// enableMonitor starts pulling the metrics of the shares from Azure Monitor
+// every interval.
+func (v *volumeDriver) enableMonitor(creds *aadCredential, armEndpoint, accountID string, interval time.Duration) error {
+	if err := validateStorageAccountID(accountID); err != nil {
+		return err
+	}
+	v.monitor = &monitorCollector{
+		creds:       creds,
+		armEndpoint: strings.TrimSuffix(armEndpoint, "/") + "/",
+		accountID:   "/" + strings.Trim(accountID, "/"),
+		metrics:     make(map[string]shareMonitorMetrics),
+	}
+	go func() {
+		v.collectMonitorMetrics()
+		for range time.Tick(interval) {
+			v.collectMonitorMetrics()
+		}
+	}()
+	return nil
+}
+
+// shareMonitorMetrics returns the last metrics pulled for the share, if any.
+func (v *volumeDriver) shareMonitorMetrics(share string) (shareMonitorMetrics, bool) {
+	if v.monitor == nil {
+		return shareMonitorMetrics{}, false
+	}
+	v.monitor.m.Lock()
+	defer v.monitor.m.Unlock()
+	mm, ok := v.monitor.metrics[share]
+	return mm, ok
+}
+
+// collectMonitorMetrics pulls the metrics of the shares of all volumes on the
+// account. The driver lock is only held while listing volumes.
+func (v *volumeDriver) collectMonitorMetrics() {
+	v.m.Lock()
+	names, err := v.meta.List()
+	metas := make(map[string]volumeMetadata)
+	for _, n := range names {
+		if meta, err := v.meta.Get(n); err == nil && meta.Account == v.accountName {
+			metas[n] = meta
+		}
+	}
+	v.m.Unlock()
+	if err != nil {
+		log.Errorf("monitor: failed to list volumes: %v", err)
+		return
+	}
+
+	collected := make(map[string]shareMonitorMetrics)
+	for _, meta := range metas {
+		share := meta.Options.Share
+		if _, ok := collected[share]; ok {
+			continue
+		}
+		mm, err := v.monitor.query(share)
+		if err != nil {
+			log.WithFields(log.Fields{"operation": "monitor", "share": share}).Errorf("cannot get share metrics: %v", err)
+			continue
+		}
+		collected[share] = mm
+	}
+
+	v.monitor.m.Lock()
+	defer v.monitor.m.Unlock()
+	for name, meta := range metas {
+		mm, ok := collected[meta.Options.Share]
+		lv := v.volumeLabelValues(name, meta)
+		if _, err := v.meta.Get(name); err != nil {
+			ok = false // removed while querying
+		}
+		if !ok {
+			shareTransactions.delete(lv...)
+			shareE2ELatency.delete(lv...)
+			shareServerLatency.delete(lv...)
+			shareCapacityBytes.delete(lv...)
+			continue
+		}
+		shareTransactions.set(mm.Transactions, lv...)
+		shareE2ELatency.set(mm.SuccessE2ELatencyMs/1000, lv...)
+		shareServerLatency.set(mm.SuccessServerLatencyMs/1000, lv...)
+		shareCapacityBytes.set(mm.CapacityBytes, lv...)
+	}
+	v.monitor.metrics = collected
+}
+
+// query returns the metrics of the share for the last full hour.
+//
+// See https://docs.microsoft.com/en-us/rest/api/monitor/metrics/list
+func (c *monitorCollector) query(share string) (shareMonitorMetrics, error) {
+	mm := shareMonitorMetrics{CollectedAt: time.Now().UTC()}
+	token, err := c.creds.token(c.armEndpoint)
+	if err != nil {
+		return mm, err
+	}
+	end := mm.CollectedAt.Truncate(time.Hour)
+	q := url.Values{
+		"api-version": {monitorAPIVersion},
+		"metricnames": {strings.Join(monitorMetricNames, ",")},
+		"aggregation": {"Total,Average"},
+		"interval":    {"PT1H"},
+		"timespan":    {end.Add(-time.Hour).Format(time.RFC3339) + "/" + end.Format(time.RFC3339)},
+		"$filter":     {fmt.Sprintf("FileShare eq '%s'", share)},
+	}
+	req, err := http.NewRequest("GET", c.armEndpoint+strings.TrimPrefix(c.accountID, "/")+
+		"/fileServices/default/providers/Microsoft.Insights/metrics?"+q.Encode(), nil)
+	if err != nil {
+		return mm, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := storageHTTPClient.Do(req)
+	if err != nil {
+		return mm, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return mm, fmt.Errorf("cannot read metrics: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return mm, fmt.Errorf("azure monitor returned %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var out struct {
+		Value []struct {
+			Name struct {
+				Value string `json:"value"`
+			} `json:"name"`
+			Timeseries []struct {
+				Data []struct {
+					Total   *float64 `json:"total"`
+					Average *float64 `json:"average"`
+				} `json:"data"`
+			} `json:"timeseries"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return mm, fmt.Errorf("cannot parse metrics: %v", err)
+	}
+	for _, m := range out.Value {
+		var total, average float64
+		for _, ts := range m.Timeseries {
+			for _, d := range ts.Data {
+				if d.Total != nil {
+					total = *d.Total
+				}
+				if d.Average != nil {
+					average = *d.Average
+				}
+			}
+		}
+		switch m.Name.Value {
+		case "Transactions":
+			mm.Transactions = total
+		case "SuccessE2ELatency":
+			mm.SuccessE2ELatencyMs = average
+		case "SuccessServerLatency":
+			mm.SuccessServerLatencyMs = average
+		case "FileCapacity":
+			mm.CapacityBytes = average
+		}
+	}
+	return mm, nil
+}
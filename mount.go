@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// smb3IOSize is the default rsize and wsize of SMB 3 mounts. The kernel
+// defaults are much smaller and limit the throughput of large files.
+const smb3IOSize = 1 << 20
+
+// smbVersions lists the SMB dialects mounts are attempted with, from the most
+// preferred to the least.
+var smbVersions = []string{"3.0", "2.1"}
+
+// cifsErrorRe matches the error reported by mount.cifs, e.g. "mount
+// error(13): Permission denied".
+var cifsErrorRe = regexp.MustCompile(`mount error\((\d+)\): [^\n]*`)
+
+// cifsErrorHints maps the error numbers of failed CIFS mounts to their usual
+// causes, as the error messages do not tell what to fix.
+var cifsErrorHints = map[string]string{
+	"2":   "the share or remote path does not exist",
+	"13":  "the account key is likely wrong or was rotated",
+	"95":  "the SMB dialect is not supported by the kernel or the server, check --smb-min-version and that the account does not require a newer dialect",
+	"112": "the File service endpoint is down or unreachable, outbound port 445 may be blocked",
+	"113": "no route to the File service endpoint, check the network and firewall rules",
+	"115": "the connection to the File service timed out, outbound port 445 is likely blocked (see check-connectivity)",
+}
+
+// mountError is returned when the mount or umount program fails.
+type mountError struct {
+	cmd    string
+	err    error
+	output []byte
+	// kernelLog holds the kernel messages logged by the failed CIFS mount.
+	kernelLog []string
+}
+
+func (e *mountError) Error() string {
+	msg := fmt.Sprintf("%s failed: %v\noutput=%q", e.cmd, e.err, e.output)
+	if m := cifsErrorRe.FindStringSubmatch(string(e.output)); m != nil {
+		if hint, ok := cifsErrorHints[m[1]]; ok {
+			// the raw output is logged by the driver at debug level
+			msg = fmt.Sprintf("%s failed: %s (%s)", e.cmd, hint, m[0])
+		}
+	}
+	if len(e.kernelLog) != 0 {
+		msg += "\nkernel log:\n" + strings.Join(e.kernelLog, "\n")
+	}
+	return msg
+}
+
+// isProtocolMismatch returns true if the mount failed because the kernel or
+// the server does not support the requested SMB dialect: EOPNOTSUPP, or
+// EINVAL from kernels that do not know the vers= value at all. EINVAL may
+// also be caused by another option, see mount.
+func isProtocolMismatch(err error) bool {
+	e, ok := err.(*mountError)
+	if !ok {
+		return false
+	}
+	out := string(e.output)
+	return strings.Contains(out, "error(95)") || strings.Contains(out, "error(22)")
+}
+
+// isNameResolutionFailure returns true if the mount failed because the
+// storage endpoint could not be resolved, which is often transient (e.g. while
+// the network is coming up on boot).
+func isNameResolutionFailure(err error) bool {
+	if _, ok := err.(*net.DNSError); ok {
+		return true
+	}
+	e, ok := err.(*mountError)
+	if !ok {
+		return false
+	}
+	out := string(e.output)
+	for _, s := range []string{
+		"could not resolve address", // mount.cifs
+		"Failed to resolve server",  // mount.nfs
+		"Temporary failure in name resolution",
+		"Name or service not known",
+	} {
+		if strings.Contains(out, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveEndpoint resolves the File service endpoint of the account and
+// returns one of its addresses.
+func resolveEndpoint(accountName, storageBase string) (string, error) {
+	addrs, err := net.LookupHost(fmt.Sprintf("%s.file.%s", accountName, storageBase))
+	if err != nil {
+		return "", err
+	}
+	return addrs[0], nil
+}
+
+// mount mounts the share described by options at mountPath using the
+// protocol of the volume. SMB mounts are attempted with each of the dialects
+// in versions in order until one succeeds or fails for a reason other than a
+// protocol mismatch. The dialect that succeeded is returned.
+func mount(ctx context.Context, accountName, accountKey, storageBase, mountPath string, options VolumeOptions, versions []string) (string, error) {
+	if options.Protocol == protocolNFS {
+		return "", mountNFS(ctx, accountName, storageBase, mountPath, options)
+	}
+	var first error
+	for i, vers := range versions {
+		err := mountCIFS(ctx, accountName, accountKey, storageBase, mountPath, vers, options)
+		if err == nil {
+			return vers, nil
+		} else if !isProtocolMismatch(err) {
+			return "", err
+		}
+		if first == nil {
+			first = err
+		}
+		if i < len(versions)-1 {
+			log.Debugf("mount with SMB %s failed with a possible protocol mismatch, retrying with SMB %s: %v", vers, versions[i+1], err)
+		}
+	}
+	// an invalid option fails every dialect alike, report it as seen with
+	// the preferred one
+	return "", first
+}
+
+func mountCIFS(ctx context.Context, accountName, accountKey, storageBase, mountPath, vers string, options VolumeOptions) error {
+	// Set defaults
+	if len(options.FileMode) == 0 {
+		options.FileMode = "0777"
+	}
+	if len(options.DirMode) == 0 {
+		options.DirMode = "0777"
+	}
+	if len(options.UID) == 0 {
+		options.UID = "0"
+	}
+	if len(options.GID) == 0 {
+		options.GID = "0"
+	}
+	mountURI := fmt.Sprintf("//%s.file.%s/%s", accountName, storageBase, options.Share)
+	if len(options.RemotePath) != 0 {
+		mountURI += fmt.Sprintf("/%s", strings.TrimPrefix(options.RemotePath, "/"))
+	}
+
+	opts := []string{
+		fmt.Sprintf("vers=%s", vers),
+		fmt.Sprintf("username=%s", accountName),
+		fmt.Sprintf("file_mode=%s", options.FileMode),
+		fmt.Sprintf("dir_mode=%s", options.DirMode),
+		fmt.Sprintf("uid=%s", options.UID),
+		fmt.Sprintf("gid=%s", options.GID),
+	}
+	if options.NoLock {
+		opts = append(opts, "nolock")
+	}
+	if options.NoPerm {
+		opts = append(opts, "noperm")
+	}
+	if options.ReadOnly {
+		opts = append(opts, "ro")
+	}
+	if len(options.Domain) != 0 {
+		opts = append(opts, fmt.Sprintf("domain=%s", options.Domain))
+	}
+	if options.Multiuser {
+		// the kernel requests the credentials of the other users by server
+		// address, known in advance with ip=
+		if options.ServerIP == "" {
+			ip, err := resolveEndpoint(accountName, storageBase)
+			if err != nil {
+				return err
+			}
+			options.ServerIP = ip
+		}
+		if err := writeCIFSCreds(options.ServerIP, accountName, accountKey); err != nil {
+			return err
+		}
+		opts = append(opts, "multiuser", "sec=ntlmssp")
+	}
+	if m, ok := charMappings[options.MapChars]; ok {
+		opts = append(opts, m)
+	}
+	rsize, wsize := options.RSize, options.WSize
+	if strings.HasPrefix(vers, "3") {
+		if rsize == 0 {
+			rsize = smb3IOSize
+		}
+		if wsize == 0 {
+			wsize = smb3IOSize
+		}
+	}
+	if options.Multichannel {
+		if strings.HasPrefix(vers, "3") {
+			opts = append(opts, "multichannel")
+			if options.MaxChannels != 0 {
+				opts = append(opts, fmt.Sprintf("max_channels=%d", options.MaxChannels))
+			}
+		} else {
+			log.Debugf("SMB %s does not support multichannel, mounting with a single channel", vers)
+		}
+	}
+	if rsize != 0 {
+		opts = append(opts, fmt.Sprintf("rsize=%d", rsize))
+	}
+	if wsize != 0 {
+		opts = append(opts, fmt.Sprintf("wsize=%d", wsize))
+	}
+	if options.Port != 0 {
+		opts = append(opts, fmt.Sprintf("port=%d", options.Port))
+	}
+	if len(options.ServerIP) != 0 {
+		// the UNC keeps the host name, which the server expects
+		opts = append(opts, fmt.Sprintf("ip=%s", options.ServerIP))
+	}
+	opts = append(opts, options.ExtraOpts...)
+
+	// TODO: replace with mount() syscall using docker/docker/pkg/mount
+	// (currently gives hard-to-debug 'invalid argument' error with the
+	// following arguments, my guess is, mount program does IP resolution
+	// and essentially passes a different set of options to system call).
+	cmd := exec.CommandContext(ctx, "mount", "-t", "cifs", mountURI, mountPath, "-o", strings.Join(opts, ","), "--verbose")
+	// mount.cifs reads the password from the environment, which keeps the
+	// account key out of the process arguments visible to other users.
+	cmd.Env = append(os.Environ(), "PASSWD="+accountKey)
+	klog := openKernelLog()
+	err := runMount(ctx, cmd)
+	if klog != nil {
+		if e, ok := err.(*mountError); ok {
+			e.kernelLog = klog.lines(cifsErrorPrefixes...)
+		}
+		klog.Close()
+	}
+	if err != nil && options.Multiuser {
+		removeUnusedCIFSCreds()
+	}
+	return err
+}
+
+// mountNFS mounts an NFS v4.1 share, which is only available on premium
+// (FileStorage) accounts. Access is authorized by the network rules of the
+// account, so no credentials are passed.
+func mountNFS(ctx context.Context, accountName, storageBase, mountPath string, options VolumeOptions) error {
+	host := fmt.Sprintf("%s.file.%s", accountName, storageBase)
+	export := fmt.Sprintf("%s:/%s/%s", host, accountName, options.Share)
+	if len(options.RemotePath) != 0 {
+		export += fmt.Sprintf("/%s", strings.TrimPrefix(options.RemotePath, "/"))
+	}
+
+	opts := []string{"vers=4", "minorversion=1", "sec=sys"}
+	if options.NoLock {
+		opts = append(opts, "nolock")
+	}
+	if options.RSize != 0 {
+		opts = append(opts, fmt.Sprintf("rsize=%d", options.RSize))
+	}
+	if options.WSize != 0 {
+		opts = append(opts, fmt.Sprintf("wsize=%d", options.WSize))
+	}
+	if options.ReadOnly {
+		opts = append(opts, "ro")
+	}
+	opts = append(opts, options.ExtraOpts...)
+
+	cmd := exec.CommandContext(ctx, "mount", "-t", "nfs", export, mountPath, "-o", strings.Join(opts, ","), "--verbose")
+	return runMount(ctx, cmd)
+}
+
+// runMount runs the mount or umount command, which is killed when ctx is
+// done.
+func runMount(ctx context.Context, cmd *exec.Cmd) error {
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return &mountError{cmd: cmd.Args[0], err: err, output: out}
+	}
+	return nil
+}
+
+// observeMount records the duration and outcome of a mount or unmount
+// operation started at start in the metrics.
+func observeMount(operation string, start time.Time, err error) {
+	mountDuration.observe(time.Since(start).Seconds(), operation)
+	if err != nil {
+		mountErrors.inc(operation, classify(err, codeMountFailed).name)
+	}
+}
+
+// unmount unmounts the mountpoint regardless of the protocol it was mounted
+// with. The multiuser credentials of a server are deleted with its last
+// multiuser mount.
+func unmount(ctx context.Context, mountpoint string) error {
+	if err := runMount(ctx, exec.CommandContext(ctx, "umount", mountpoint)); err != nil {
+		return err
+	}
+	removeUnusedCIFSCreds()
+	return nil
+}
+
+// mountinfoUnescaper decodes the octal escapes of mountinfo paths.
+var mountinfoUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// mountPoints reads /proc/self/mountinfo and returns the set of mountpoints.
+// Unlike isMounted, paths are compared as strings, so symlinks are not
+// resolved; it is meant to look up many volumes at once.
+func mountPoints() (map[string]bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mountinfo: %v", err)
+	}
+	defer f.Close()
+	mps := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("mountinfo line %q has less than 5 fields, cannot parse mountpoint", s.Text())
+		}
+		mps[mountinfoUnescaper.Replace(fields[4])] = true
+	}
+	return mps, s.Err()
+}
+
+// isMounted reads /proc/self/mountinfo to see if the specified mountpoint is
+// mounted.
+func isMounted(mountpoint string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, fmt.Errorf("cannot read mountinfo: %v", err)
+	}
+	defer f.Close()
+
+	// format of mountinfo:
+	//    38 23 0:30 / /sys/fs/cgroup/devices rw,relatime - cgroup cgroup rw,devices
+	//    39 23 0:31 / /sys/fs/cgroup/freezer rw,relatime - cgroup cgroup rw,freezer
+	//    33 22 8:17 / /mnt rw,relatime - ext4 /dev/sdb1 rw,data=ordered
+	// so we split the lines into the specified format and match the mountpoint
+	// at 5th field.
+	//
+	// This code is adopted from https://github.com/docker/docker/blob/master/pkg/mount/mountinfo_linux.go
+
+	oldFi, err := os.Stat(mountpoint)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot stat mountpoint: %v", err)
+	}
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		t := s.Text()
+		f := strings.Fields(t)
+		if len(f) < 5 {
+			return false, fmt.Errorf("mountinfo line %q has less than 5 fields, cannot parse mountpoint", t)
+		}
+		mp := f[4] // ID, Parent, Major, Minor, Root, *Mountpoint*, Opts, OptionalFields
+		fi, err := os.Stat(mp)
+		if err != nil {
+			return false, fmt.Errorf("cannot stat %s: %v", mp, err)
+		}
+		same := os.SameFile(oldFi, fi)
+		if same {
+			return true, nil
+		}
+	}
+	log.Debug("mountpoint not found")
+	return false, nil
+}
+
+// mountAliveTimeout bounds how long checking that a mount still responds may
+// take: requests to an unreachable CIFS server block for much longer.
+const mountAliveTimeout = 5 * time.Second
+
+// mountedShare returns true if the topmost mount at mountpoint is a mount of
+// the share that still responds, as read from /proc/self/mountinfo. The
+// share is matched in the mount source of CIFS, NFS and REST mounts, and in
+// the root directory of the bind mounts of emulator shares.
+func mountedShare(mountpoint, share string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, fmt.Errorf("cannot read mountinfo: %v", err)
+	}
+	defer f.Close()
+	var fsType, source, root string
+	found := false
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || mountinfoUnescaper.Replace(fields[4]) != mountpoint {
+			continue
+		}
+		for i := 6; i+2 < len(fields); i++ {
+			if fields[i] == "-" {
+				// later entries are mounted on top of earlier ones
+				found, fsType, source, root = true, fields[i+1], mountinfoUnescaper.Replace(fields[i+2]), mountinfoUnescaper.Replace(fields[3])
+				break
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return false, fmt.Errorf("cannot read mountinfo: %v", err)
+	}
+	if !found || !sourceOfShare(fsType, source, root, share) {
+		return false, nil
+	}
+	return mountAlive(mountpoint), nil
+}
+
+// sourceOfShare returns true if the mount with the file system type, source
+// and root directory is a mount of the share.
+func sourceOfShare(fsType, source, root, share string) bool {
+	var p []string
+	switch {
+	case fsType == "cifs" || fsType == "smb3":
+		// //<account>.file.<storage base>/<share>[/<remote path>]
+		p = strings.SplitN(strings.TrimPrefix(source, "//"), "/", 3)
+		return len(p) >= 2 && strings.EqualFold(p[1], share)
+	case strings.HasPrefix(fsType, "nfs"):
+		// <account>.file.<storage base>:/<account>/<share>[/<remote path>]
+		if i := strings.Index(source, ":/"); i >= 0 {
+			p = strings.SplitN(source[i+2:], "/", 3)
+		}
+		return len(p) >= 2 && p[1] == share
+	case strings.HasPrefix(fsType, "fuse"):
+		// :azurefiles:<share>[/<remote path>]
+		p = strings.SplitN(strings.TrimPrefix(source, ":azurefiles:"), "/", 2)
+		return p[0] == share
+	}
+	return strings.Contains(root+"/", "/"+share+"/")
+}
+
+// mountAlive returns true if the file system mounted at mountpoint answers a
+// statfs within mountAliveTimeout.
+func mountAlive(mountpoint string) bool {
+	done := make(chan error, 1)
+	go func() {
+		var st syscall.Statfs_t
+		done <- syscall.Statfs(mountpoint, &st)
+	}()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(mountAliveTimeout):
+		return false
+	}
+}
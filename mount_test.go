@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestSourceOfShare(t *testing.T) {
+	for _, tc := range []struct {
+		fsType, source, root, share string
+		want                        bool
+	}{
+		{"cifs", "//acct.file.core.windows.net/data", "/", "data", true},
+		{"cifs", "//acct.file.core.windows.net/DATA/sub", "/", "data", true},
+		{"smb3", "//acct.file.core.windows.net/data", "/", "data", true},
+		{"cifs", "//acct.file.core.windows.net/other", "/", "data", false},
+		{"cifs", "//acct.file.core.windows.net", "/", "data", false},
+		{"nfs4", "acct.file.core.windows.net:/acct/data", "/", "data", true},
+		{"nfs4", "acct.file.core.windows.net:/acct/data/sub", "/", "data", true},
+		{"nfs4", "acct.file.core.windows.net:/acct/DATA", "/", "data", false},
+		{"nfs", "acct.file.core.windows.net:/acct", "/", "data", false},
+		{"fuse.rclone", ":azurefiles:data", "/", "data", true},
+		{"fuse.rclone", ":azurefiles:data/sub", "/", "data", true},
+		{"fuse.rclone", ":azurefiles:other", "/", "data", false},
+		{"ext4", "/dev/sda1", "/var/lib/azurefile-emulator/data", "data", true},
+		{"ext4", "/dev/sda1", "/var/lib/azurefile-emulator/database", "data", false},
+	} {
+		if got := sourceOfShare(tc.fsType, tc.source, tc.root, tc.share); got != tc.want {
+			t.Errorf("sourceOfShare(%q, %q, %q, %q) = %v, want %v", tc.fsType, tc.source, tc.root, tc.share, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// nomadMountID is the mount ID recorded for volumes mounted as Nomad host
+// volumes.
+const nomadMountID = "nomad"
+
+// provisionHostVolumes creates and mounts the defined volumes unless they are
+// mounted already, and writes a Nomad client configuration declaring them as
+// host volumes to configPath.
+func (v *volumeDriver) provisionHostVolumes(defs []volumeDefinition, configPath string) error {
+	var hcl bytes.Buffer
+	hcl.WriteString("# Generated by azurefile-dockervolumedriver, do not edit.\nclient {\n")
+	for _, d := range defs {
+		logctx := log.WithFields(log.Fields{
+			"operation": "nomad",
+			"name":      d.Name,
+		})
+		if resp := v.Create(volume.Request{Name: d.Name, Options: d.Options}); resp.Err != "" {
+			return fmt.Errorf("cannot create host volume %q: %s", d.Name, resp.Err)
+		}
+		path := v.pathForVolume(d.Name)
+		if mounted, err := isMounted(path); err != nil {
+			return err
+		} else if !mounted {
+			if resp := v.Mount(volume.MountRequest{Name: d.Name, ID: nomadMountID}); resp.Err != "" {
+				return fmt.Errorf("cannot mount host volume %q: %s", d.Name, resp.Err)
+			}
+			logctx.Infof("mounted host volume at %s", path)
+		}
+		v.m.Lock()
+		meta, err := v.meta.Get(d.Name)
+		v.m.Unlock()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&hcl, "  host_volume %s {\n    path      = %s\n    read_only = %t\n  }\n",
+			strconv.Quote(d.Name), strconv.Quote(path), meta.Options.ReadOnly)
+	}
+	hcl.WriteString("}\n")
+
+	tmp := configPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, hcl.Bytes(), 0644); err != nil {
+		return fmt.Errorf("cannot write nomad configuration: %v", err)
+	}
+	if err := os.Rename(tmp, configPath); err != nil {
+		return fmt.Errorf("cannot write nomad configuration: %v", err)
+	}
+	log.Infof("declared %d host volumes in %s", len(defs), configPath)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Container runtimes the driver can serve.
+const (
+	runtimeDocker = "docker"
+	runtimePodman = "podman"
+)
+
+const (
+	// defaultPodmanConfig is the containers.conf drop-in registering the
+	// plugin with Podman, which does not discover plugins by their socket.
+	defaultPodmanConfig = "/etc/containers/containers.conf.d/azurefile.conf"
+
+	// podmanSELinuxContext is the label of mounts when SELinux is enabled,
+	// as container processes cannot access files labeled otherwise and
+	// Podman cannot relabel CIFS and NFS mounts.
+	podmanSELinuxContext = "system_u:object_r:container_file_t:s0"
+)
+
+// registerPodmanPlugin writes the containers.conf drop-in at path declaring
+// the plugin listening on socket.
+func registerPodmanPlugin(path, name, socket string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("cannot create podman configuration directory: %v", err)
+	}
+	conf := fmt.Sprintf("# Generated by azurefile-dockervolumedriver, do not edit.\n[engine.volume_plugins]\n%s = %s\n", name, strconv.Quote(socket))
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		return fmt.Errorf("cannot write podman configuration: %v", err)
+	}
+	return nil
+}
+
+// selinuxEnabled returns true if SELinux is enabled on the host.
+func selinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// withSELinuxContext returns the mount options with the SELinux context
+// added, unless they set one already.
+func withSELinuxContext(opts VolumeOptions, context string) VolumeOptions {
+	for _, o := range opts.ExtraOpts {
+		if strings.HasPrefix(o, "context=") {
+			return opts
+		}
+	}
+	opts.ExtraOpts = append(append([]string(nil), opts.ExtraOpts...), "context="+context)
+	return opts
+}
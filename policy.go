@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+)
+
+// Operations that can be restricted by a policy rule.
+const (
+	opCreate = "create"
+	opRemove = "remove"
+	opMount  = "mount"
+)
+
+// policy is an ordered list of rules restricting volume operations. The first
+// rule matching an operation decides whether it is allowed; operations no
+// rule matches are allowed.
+type policy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// policyRule matches operations on volumes whose name matches any of the
+// name patterns (path.Match syntax) and which have all of the labels. Empty
+// fields match everything.
+type policyRule struct {
+	Operations []string          `json:"operations"`
+	Names      []string          `json:"names"`
+	Labels     map[string]string `json:"labels"`
+	Action     string            `json:"action"` // "allow" or "deny"
+}
+
+func loadPolicy(file string) (*policy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read policy: %v", err)
+	}
+	var p policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("cannot parse policy: %v", err)
+	}
+	for i, r := range p.Rules {
+		if r.Action != "allow" && r.Action != "deny" {
+			return nil, fmt.Errorf("policy rule #%d: action must be 'allow' or 'deny', got %q", i+1, r.Action)
+		}
+		for _, op := range r.Operations {
+			if op != opCreate && op != opRemove && op != opMount {
+				return nil, fmt.Errorf("policy rule #%d: unknown operation %q", i+1, op)
+			}
+		}
+		for _, n := range r.Names {
+			if _, err := path.Match(n, ""); err != nil {
+				return nil, fmt.Errorf("policy rule #%d: bad name pattern %q: %v", i+1, n, err)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// check returns an error if the operation on the volume is denied. A nil
+// policy allows everything.
+func (p *policy) check(op, name string, labels map[string]string) error {
+	if p == nil {
+		return nil
+	}
+	for i, r := range p.Rules {
+		if r.matches(op, name, labels) {
+			if r.Action == "deny" {
+				return newError(codePolicyDenied, "%s of volume %q denied by policy rule #%d", op, name, i+1)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r policyRule) matches(op, name string, labels map[string]string) bool {
+	if len(r.Operations) > 0 && !contains(r.Operations, op) {
+		return false
+	}
+	if len(r.Names) > 0 {
+		found := false
+		for _, n := range r.Names {
+			if ok, _ := path.Match(n, name); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range r.Labels {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// maxPressureLevel bounds the pressure level of an account, which is
+	// raised by throttled and slow requests and decays by one level every
+	// pressureDecay without any.
+	maxPressureLevel = 6
+	pressureDecay    = time.Minute
+
+	// Background jobs pause for backgroundPause between volumes on an
+	// account at pressure level 1, doubling with every level.
+	backgroundPause = time.Second
+
+	// latencyWeight is the weight of the latest request in the moving
+	// average of the request latency of a share.
+	latencyWeight = 0.2
+
+	// defaultSlowRequestThreshold is the default of --slow-request-threshold.
+	defaultSlowRequestThreshold = 2 * time.Second
+)
+
+// pressureTracker tracks throttled and slow requests to the storage
+// accounts. A nil tracker tracks nothing and never pauses.
+type pressureTracker struct {
+	slow time.Duration // requests taking longer count as slow
+
+	m        sync.Mutex
+	accounts map[string]*accountPressure
+	latency  map[string]float64 // moving average in seconds by account and share
+}
+
+type accountPressure struct {
+	level     int
+	lastEvent time.Time
+}
+
+func newPressureTracker(slow time.Duration) *pressureTracker {
+	return &pressureTracker{
+		slow:     slow,
+		accounts: make(map[string]*accountPressure),
+		latency:  make(map[string]float64),
+	}
+}
+
+// requestShare returns the share a request path is addressed to, or an
+// empty string for account-level requests.
+func requestShare(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+}
+
+// observe records the duration of a request to the share and whether the
+// account throttled it.
+func (p *pressureTracker) observe(account, share string, d time.Duration, throttled bool) {
+	if p == nil {
+		return
+	}
+	slow := d > p.slow
+	if share != "" {
+		p.m.Lock()
+		k := account + "/" + share
+		avg, ok := p.latency[k]
+		if !ok {
+			avg = d.Seconds()
+		} else {
+			avg = latencyWeight*d.Seconds() + (1-latencyWeight)*avg
+		}
+		p.latency[k] = avg
+		p.m.Unlock()
+		shareRequestLatency.set(avg, account, share)
+		if throttled {
+			shareThrottled.inc(account, share)
+		}
+		if slow {
+			shareSlowRequests.inc(account, share)
+		}
+	}
+	if throttled || slow {
+		p.raise(account)
+	}
+}
+
+// raise increases the pressure level of the account.
+func (p *pressureTracker) raise(account string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	a := p.decayed(account, time.Now())
+	if a.level < maxPressureLevel {
+		a.level++
+		if a.level == maxPressureLevel {
+			log.WithField("account", account).Warn("storage account is under heavy pressure, slowing down background jobs")
+		}
+	}
+	a.lastEvent = time.Now()
+	accountPressureLevel.set(float64(a.level), account)
+}
+
+// decayed returns the pressure of the account after decaying it until now.
+// Caller must hold p.m.
+func (p *pressureTracker) decayed(account string, now time.Time) *accountPressure {
+	a, ok := p.accounts[account]
+	if !ok {
+		a = &accountPressure{}
+		p.accounts[account] = a
+	}
+	if a.level > 0 {
+		steps := int(now.Sub(a.lastEvent) / pressureDecay)
+		if steps > 0 {
+			if a.level -= steps; a.level < 0 {
+				a.level = 0
+			}
+			a.lastEvent = a.lastEvent.Add(time.Duration(steps) * pressureDecay)
+		}
+	}
+	return a
+}
+
+// level returns the current pressure level of the account.
+func (p *pressureTracker) level(account string) int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	a := p.decayed(account, time.Now())
+	accountPressureLevel.set(float64(a.level), account)
+	return a.level
+}
+
+// pause blocks a background job between two volumes for as long as the
+// pressure level of the account calls for, none when it is not under
+// pressure.
+func (p *pressureTracker) pause(account string) {
+	if p == nil {
+		return
+	}
+	l := p.level(account)
+	if l == 0 {
+		return
+	}
+	d := backgroundPause << uint(l-1)
+	log.WithField("account", account).Debugf("storage account under pressure (level %d), pausing background job for %v", l, d)
+	time.Sleep(d)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// setProtection enables or disables the deletion protection of the volume,
+// which makes Remove fail while it is enabled.
+func (v *volumeDriver) setProtection(name string, protected bool) error {
+	logctx := log.WithFields(log.Fields{
+		"operation": "protect",
+		"name":      name,
+	})
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	meta, err := v.meta.Get(name)
+	if err != nil {
+		return err
+	}
+	if err := v.checkNamespace(meta); err != nil {
+		return err
+	}
+	if meta.Options.Protected == protected {
+		return nil
+	}
+	meta.Options.Protected = protected
+	if err := v.meta.Set(name, meta); err != nil {
+		return newError(codeInternal, "error saving metadata: %v", err)
+	}
+	if protected {
+		logctx.Info("deletion protection enabled")
+	} else {
+		logctx.Warn("deletion protection cleared")
+	}
+	return nil
+}
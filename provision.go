@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	// Volumes of --volumes that cannot be created at startup because the
+	// storage account is not reachable yet are retried with an exponential
+	// backoff between these bounds.
+	provisionRetryInitialBackoff = 5 * time.Second
+	provisionRetryMaxBackoff     = 5 * time.Minute
+)
+
+// loadVolumeDefinitions reads a JSON array of volume definitions, in the
+// format of the /volumes/batch admin endpoint.
+func loadVolumeDefinitions(path string) ([]volumeDefinition, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read volume definitions: %v", err)
+	}
+	var defs []volumeDefinition
+	if err := json.Unmarshal(b, &defs); err != nil {
+		return nil, fmt.Errorf("cannot parse volume definitions %s: %v", path, err)
+	}
+	for _, d := range defs {
+		if err := validateVolumeName(d.Name); err != nil {
+			return nil, fmt.Errorf("%v in %s", err, path)
+		}
+	}
+	return defs, nil
+}
+
+// provisionVolumes ensures that the defined volumes exist, creating them (and
+// their shares) if needed. Volumes failing with a retryable error are retried
+// until they are created, other failures are logged and not retried. It
+// returns once all volumes have been handled.
+func (v *volumeDriver) provisionVolumes(defs []volumeDefinition) {
+	pending, provisioned := defs, 0
+	backoff := provisionRetryInitialBackoff
+	for {
+		var retry []volumeDefinition
+		for _, d := range pending {
+			rq := v.newRequest("create", d.Name, nil)
+			err := v.create(rq, d.Name, d.Options)
+			var msg string
+			if err != nil {
+				msg = err.Error()
+			}
+			rq.finish(&msg)
+			switch {
+			case err == nil:
+				provisioned++
+				rq.log.Debug("volume provisioned")
+			case retryable(err):
+				retry = append(retry, d)
+			default:
+				rq.log.Errorf("cannot provision volume, giving up: %s", msg)
+			}
+		}
+		if len(retry) == 0 {
+			log.Infof("provisioned %d of %d volumes", provisioned, len(defs))
+			return
+		}
+		log.Warnf("%d volumes could not be provisioned, retrying in %v", len(retry), backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > provisionRetryMaxBackoff {
+			backoff = provisionRetryMaxBackoff
+		}
+		pending = retry
+	}
+}
+
+// volumesDirPollInterval is how often the --volumes-dir directory is checked
+// for added, changed and removed definition files.
+const volumesDirPollInterval = 30 * time.Second
+
+// watchVolumesDir keeps the volumes in line with the definition files
+// (*.json, in the format of --volumes) of dir until the process exits. See
+// syncVolumesDir for allowEmpty.
+func (v *volumeDriver) watchVolumesDir(dir string, allowEmpty bool) {
+	for {
+		v.syncVolumesDir(dir, allowEmpty)
+		time.Sleep(volumesDirPollInterval)
+	}
+}
+
+// syncVolumesDir creates the volumes defined by the files of dir, and removes
+// the volumes it created for files that were deleted or no longer define
+// them. Volumes that existed before being declared are never removed. Failed
+// creations and removals (e.g. of mounted volumes) are retried on the next
+// sync.
+//
+// Nothing is synced while dir cannot be read. Declared volumes are not removed
+// when dir holds no definitions at all, which is more likely an unmounted or
+// wiped directory than the intent to remove them all, unless allowEmpty is set.
+func (v *volumeDriver) syncVolumesDir(dir string, allowEmpty bool) {
+	// Glob ignores I/O errors and would report a missing or unreadable
+	// directory as an empty one
+	if _, err := ioutil.ReadDir(dir); err != nil {
+		log.Errorf("volumes dir: cannot read %s, skipping sync: %v", dir, err)
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		log.Errorf("volumes dir: %v", err)
+		return
+	}
+	defs := make(map[string]volumeDefinition)
+	sources := make(map[string]string)
+	broken := make(map[string]bool) // files whose volumes must be kept
+	for _, f := range files {
+		file := filepath.Base(f)
+		fdefs, err := loadVolumeDefinitions(f)
+		if err != nil {
+			log.Errorf("volumes dir: %v", err)
+			broken[file] = true
+			continue
+		}
+		for _, d := range fdefs {
+			if other, ok := sources[d.Name]; ok {
+				log.Errorf("volumes dir: volume %q is defined in both %s and %s, ignoring the latter", d.Name, other, file)
+				continue
+			}
+			defs[d.Name], sources[d.Name] = d, file
+		}
+	}
+
+	for name, d := range defs {
+		v.m.Lock()
+		meta, err := v.meta.Get(name)
+		v.m.Unlock()
+		existed := err == nil
+		// creating an existing volume only applies a changed quota or tier
+		rq := v.newRequest("create", name, nil)
+		err = v.create(rq, name, d.Options)
+		var msg string
+		if err != nil {
+			msg = err.Error()
+		}
+		rq.finish(&msg)
+		if err != nil {
+			rq.log.Errorf("cannot create volume declared in %s: %s", sources[name], msg)
+			continue
+		}
+		if existed && (meta.Declared == "" || meta.Declared == sources[name]) {
+			continue
+		}
+		v.m.Lock()
+		if meta, err = v.meta.Get(name); err == nil {
+			meta.Declared = sources[name]
+			err = v.meta.Set(name, meta)
+		}
+		v.m.Unlock()
+		if err != nil {
+			rq.log.Errorf("cannot record the declaration of the volume: %v", err)
+		} else if !existed {
+			rq.log.Infof("created volume declared in %s", sources[name])
+		}
+	}
+
+	v.m.Lock()
+	names, err := v.meta.List()
+	declared := make(map[string]string)
+	for _, n := range names {
+		if meta, err := v.meta.Get(n); err == nil && meta.Declared != "" {
+			declared[n] = meta.Declared
+		}
+	}
+	v.m.Unlock()
+	if err != nil {
+		log.Errorf("volumes dir: failed to list volumes: %v", err)
+		return
+	}
+	if len(defs) == 0 && len(declared) > 0 && !allowEmpty {
+		log.Warnf("volumes dir: %s defines no volumes, not removing the %d declared volume(s) (set --volumes-dir-allow-empty to remove them)", dir, len(declared))
+		return
+	}
+	for name, file := range declared {
+		if _, ok := defs[name]; ok || broken[file] {
+			continue
+		}
+		if resp := v.Remove(volume.Request{Name: name}); resp.Err != "" {
+			log.WithField("name", name).Errorf("cannot remove volume no longer declared in %s: %s", file, resp.Err)
+		} else {
+			log.WithField("name", name).Infof("removed volume no longer declared in %s", file)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// recoverResult is the outcome of recovering the volume of a share.
+type recoverResult struct {
+	Name    string `json:"name"`
+	Share   string `json:"share"`
+	Skipped string `json:"skipped,omitempty"` // why the share was left alone
+	Error   string `json:"error,omitempty"`
+}
+
+// parseShareTags parses the 'tag' query parameters (repeatable, "key" or
+// "key=value") selecting shares by their metadata. Metadata keys are case
+// insensitive, an empty value matches any value.
+func parseShareTags(q url.Values) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, t := range q["tag"] {
+		kv := strings.SplitN(t, "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag filter %q", t)
+		}
+		if len(kv) == 2 {
+			tags[strings.ToLower(kv[0])] = kv[1]
+		} else {
+			tags[strings.ToLower(kv[0])] = ""
+		}
+	}
+	return tags, nil
+}
+
+// matchTags returns true if the share metadata has all the tags.
+func matchTags(metadata, tags map[string]string) bool {
+	lower := make(map[string]string, len(metadata))
+	for k, val := range metadata {
+		lower[strings.ToLower(k)] = val
+	}
+	for k, want := range tags {
+		got, ok := lower[k]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// recoverVolumes regenerates the metadata of volumes from the shares of the
+// account in the namespace of the driver whose name (without the share
+// prefix) starts with prefix and whose metadata has the tags, e.g. after the
+// metadata root of the host was lost. Each share becomes a volume named
+// after it (without the share prefix) with the quota, protocol and access
+// tier of the share; mount options such as uid or filemode cannot be
+// recovered. Shares already backing a volume, and shares whose volume name is
+// taken, are skipped.
+func (v *volumeDriver) recoverVolumes(prefix string, tags map[string]string) ([]recoverResult, error) {
+	logctx := log.WithField("operation", "recover")
+
+	v.m.Lock()
+	accountName, files := v.accountName, v.files
+	v.m.Unlock()
+
+	shares, err := files.listShares(v.sharePrefix + prefix)
+	if err != nil {
+		return nil, wrapError(err, codeStorageAPI, "error listing azure file shares: %v", err)
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	results := []recoverResult{}
+	for _, s := range shares {
+		if !matchTags(s.Metadata, tags) {
+			continue
+		}
+		name := strings.TrimPrefix(s.Name, v.sharePrefix)
+		if name == "" {
+			continue
+		}
+		res := recoverResult{Name: name, Share: s.Name}
+		if vols := v.meta.VolumesOfShare(s.Name); len(vols) != 0 {
+			res.Name = vols[0]
+			res.Skipped = "share already backs a volume"
+			results = append(results, res)
+			continue
+		}
+		if _, err := v.meta.Get(name); classify(err, codeInternal) != codeVolumeNotFound {
+			res.Skipped = "volume name is taken"
+			results = append(results, res)
+			continue
+		}
+		meta := volumeMetadata{
+			CreatedAt: time.Now().UTC(),
+			Account:   accountName,
+			Options: VolumeOptions{
+				Share:      s.Name,
+				Protocol:   s.Protocol,
+				Squash:     s.Squash,
+				Quota:      s.QuotaGiB,
+				LargeShare: s.QuotaGiB > maxShareQuota,
+				AccessTier: s.Tier,
+			},
+		}
+		if err := v.meta.Set(name, meta); err != nil {
+			res.Error = newError(codeInternal, "error saving metadata: %v", err).Error()
+			logctx.WithField("name", name).Error(res.Error)
+		} else {
+			logctx.WithField("name", name).Infof("recovered volume of share %q", s.Name)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// redacted replaces the secrets masked in logs and errors.
+const redacted = "REDACTED"
+
+var (
+	// secretPatterns match credentials whatever their origin: SAS signatures,
+	// the account keys of connection strings and the passwords of mount.cifs
+	// credential files and environment, keeping the key of key=value pairs.
+	secretPatterns = []struct {
+		re   *regexp.Regexp
+		repl string
+	}{
+		{regexp.MustCompile(`(?i)\b((?:sig|accountkey|password|passwd|pass)=)[^&;,\s"'\\]+`), "${1}" + redacted},
+		// account keys are 64 random bytes, encoded as 88 base64 characters
+		{regexp.MustCompile(`[A-Za-z0-9+/]{86}==`), redacted},
+	}
+
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// registerSecret adds s, e.g. an account key, to the secrets masked by
+// redact.
+func registerSecret(s string) {
+	if s == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if !contains(secrets, s) {
+		secrets = append(secrets, s)
+	}
+}
+
+// redact masks the registered secrets and anything looking like a credential
+// in s.
+func redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	secretsMu.RUnlock()
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// redactingFormatter redacts the log lines formatted by the wrapped
+// formatter.
+type redactingFormatter struct {
+	log.Formatter
+}
+
+func (f redactingFormatter) Format(e *log.Entry) ([]byte, error) {
+	b, err := f.Formatter.Format(e)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(redact(string(b))), nil
+}
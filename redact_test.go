@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	key := strings.Repeat("k", 86) + "=="
+	registerSecret("hunter2-registered")
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"plain", "mount error(13): Permission denied", "mount error(13): Permission denied"},
+		{"registered secret", "password is hunter2-registered here", "password is REDACTED here"},
+		{"sas signature", "https://a.file.core.windows.net/s?sv=2019-02-02&sig=abc%2Fdef&se=x", "https://a.file.core.windows.net/s?sv=2019-02-02&sig=REDACTED&se=x"},
+		{"connection string key", "AccountName=a;AccountKey=abc+/def==;EndpointSuffix=x", "AccountName=a;AccountKey=REDACTED;EndpointSuffix=x"},
+		{"case insensitive", "PASSWORD=secret,vers=3.0", "PASSWORD=REDACTED,vers=3.0"},
+		{"credentials file", "username=a\npassword=secret\n", "username=a\npassword=REDACTED\n"},
+		{"quoted", `"pass=secret"`, `"pass=REDACTED"`},
+		{"account key", "key " + key + " end", "key REDACTED end"},
+		{"short base64", "c2hvcnQ=", "c2hvcnQ="},
+	} {
+		if got := redact(tc.in); got != tc.want {
+			t.Errorf("%s: redact(%q) = %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// imdsLocationURL returns the region of the VM from the Azure Instance
+// Metadata Service.
+const imdsLocationURL = "http://169.254.169.254/metadata/instance/compute/location?api-version=2021-02-01&format=text"
+
+// imdsClient queries the Instance Metadata Service, which is only reachable
+// directly from the VM, bypassing any proxy.
+var imdsClient = &http.Client{
+	Transport: &http.Transport{},
+	Timeout:   5 * time.Second,
+}
+
+// hostRegion returns the region of the Azure VM the driver runs on.
+func hostRegion() (string, error) {
+	req, err := http.NewRequest("GET", imdsLocationURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := imdsClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot query the instance metadata service (not an Azure VM?): %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the region of the VM: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("instance metadata service returned %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	region := normalizeRegion(string(b))
+	if region == "" {
+		return "", fmt.Errorf("instance metadata service returned no region")
+	}
+	return region, nil
+}
+
+// normalizeRegion returns the name of the region as used by the Azure APIs,
+// e.g. "westeurope" for "West Europe".
+func normalizeRegion(region string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(region), " ", "", -1))
+}
+
+// regionalAccount returns the name of the first (in name order) of the named
+// accounts that is in the region and allowed (all if allowed is empty), or
+// an empty string if none is.
+func regionalAccount(accounts map[string]*storageAccount, allowed []string, region string) string {
+	names := make([]string, 0, len(accounts))
+	for name, a := range accounts {
+		if a.region == region && (len(allowed) == 0 || contains(allowed, name)) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return names[0]
+}
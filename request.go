@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Defaults of --create-timeout, --mount-timeout (also bounding unmounts) and
+// --remove-timeout.
+const (
+	defaultCreateTimeout = 10 * time.Minute
+	defaultMountTimeout  = 2 * time.Minute
+	defaultRemoveTimeout = 2 * time.Minute
+)
+
+// request carries the state correlating the logs, trace and error of a
+// single plugin (or admin) request, and the context cancelled when the
+// request times out or finishes.
+type request struct {
+	id        string
+	operation string
+	name      string
+	start     time.Time
+	log       *log.Entry
+	span      *span
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// timeoutContext returns a context bounded by the timeout, if positive.
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// operationContext returns a context bounded by the timeout of the
+// operation, if any.
+func (v *volumeDriver) operationContext(operation string) (context.Context, context.CancelFunc) {
+	return timeoutContext(v.timeouts[operation])
+}
+
+// newRequest starts a request for the operation on the named volume (empty
+// for operations not bound to a volume) with a new request ID. Its span is a
+// child of parent, if not nil.
+func (v *volumeDriver) newRequest(operation, name string, parent *span) *request {
+	r := &request{id: randomHex(4), operation: operation, name: name, start: time.Now()}
+	r.ctx, r.cancel = v.operationContext(operation)
+	fields := log.Fields{"operation": operation, "request": r.id}
+	if name != "" {
+		fields["name"] = name
+		r.span = v.tracer.start(operation, parent, "volume.name", name, "request.id", r.id)
+	} else {
+		r.span = v.tracer.start(operation, parent, "request.id", r.id)
+	}
+	r.log = log.WithFields(fields)
+	return r
+}
+
+// withLabels adds the labels of the volume to the log fields of the request
+// (as "label.<key>") and returns its updated log entry.
+func (r *request) withLabels(labels map[string]string) *log.Entry {
+	if len(labels) != 0 {
+		fields := make(log.Fields, len(labels))
+		for k, val := range labels {
+			fields["label."+k] = val
+		}
+		r.log = r.log.WithFields(fields)
+	}
+	return r.log
+}
+
+// finish ends the request and records it as an event. A non-empty error
+// message is redacted and suffixed with the request ID so that errors
+// reported by Docker can be matched to the logs.
+func (r *request) finish(errMsg *string) {
+	r.cancel()
+	*errMsg = redact(*errMsg)
+	r.span.end(*errMsg)
+	events.add(event{
+		Time:      r.start,
+		Operation: r.operation,
+		Volume:    r.name,
+		Request:   r.id,
+		Duration:  time.Since(r.start).Seconds(),
+		Error:     *errMsg,
+	})
+	if *errMsg != "" {
+		*errMsg = fmt.Sprintf("%s (request %s)", *errMsg, r.id)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// resizeVolume sets the quota of the volume's share to quota GiB and records
+// it in the volume metadata.
+func (v *volumeDriver) resizeVolume(name string, quota int) error {
+	logctx := log.WithFields(log.Fields{
+		"operation": "resize",
+		"name":      name,
+		"quota":     quota,
+	})
+
+	v.m.Lock()
+	meta, err := v.meta.Get(name)
+	var a *storageAccount
+	if err == nil {
+		a, err = v.volumeAccount(name, meta)
+	}
+	v.m.Unlock()
+	if err != nil {
+		return err
+	}
+	files := a.files
+	if err := v.checkNamespace(meta); err != nil {
+		return err
+	}
+	if err := validateQuota(quota, meta.Options.LargeShare); err != nil {
+		return newError(codeInvalidOptions, "%v", err)
+	}
+
+	if err := files.setShareQuota(meta.Options.Share, quota); err != nil {
+		return wrapError(err, codeStorageAPI, "error setting quota of azure file share %q: %v", meta.Options.Share, err)
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	meta, err = v.meta.Get(name)
+	if err != nil {
+		return err
+	}
+	old := meta.Options.Quota
+	meta.Options.Quota = quota
+	if err := v.meta.Set(name, meta); err != nil {
+		return newError(codeInternal, "error saving metadata: %v", err)
+	}
+	logctx.Infof("quota changed from %d to %d GiB", old, quota)
+	return nil
+}
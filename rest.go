@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Transports SMB volumes can be mounted with.
+const (
+	transportSMB  = "smb"
+	transportREST = "rest"
+)
+
+// defaultRESTMountHelper is the default of --rest-mount-helper.
+const defaultRESTMountHelper = "rclone"
+
+// mountREST mounts the share at mountPath with helper, a FUSE file system
+// backed by the File service REST API (over HTTPS on port 443) supporting the
+// azurefiles backend of rclone. It is much slower than SMB, as every operation
+// is an HTTPS request and files are cached locally while written, but only
+// needs the port the driver itself uses to reach the storage account.
+func mountREST(ctx context.Context, helper, accountName, accountKey, storageBase, mountPath string, options VolumeOptions) error {
+	remote := ":azurefiles:" + options.Share
+	if len(options.RemotePath) != 0 {
+		remote += "/" + strings.TrimPrefix(options.RemotePath, "/")
+	}
+	args := []string{"mount", remote, mountPath,
+		"--daemon",
+		"--allow-other",
+		"--vfs-cache-mode", "writes",
+		"--azurefiles-account", accountName,
+		"--azurefiles-endpoint", fmt.Sprintf("https://%s.file.%s", accountName, storageBase),
+	}
+	if len(options.UID) != 0 {
+		args = append(args, "--uid", options.UID)
+	}
+	if len(options.GID) != 0 {
+		args = append(args, "--gid", options.GID)
+	}
+	if len(options.FileMode) != 0 {
+		args = append(args, "--file-perms", options.FileMode)
+	}
+	if len(options.DirMode) != 0 {
+		args = append(args, "--dir-perms", options.DirMode)
+	}
+	if options.ReadOnly {
+		args = append(args, "--read-only")
+	}
+	for _, o := range options.ExtraOpts {
+		// mount.cifs options do not apply, except the SELinux context which
+		// FUSE supports as well
+		if strings.HasPrefix(o, "context=") {
+			args = append(args, "--option", o)
+		} else {
+			log.Warnf("ignoring mount option %q with transport %q", o, transportREST)
+		}
+	}
+	cmd := exec.CommandContext(ctx, helper, args...)
+	// like mount.cifs, keep the account key out of the process arguments
+	cmd.Env = append(os.Environ(), "RCLONE_AZUREFILES_KEY="+accountKey)
+	return runMount(ctx, cmd)
+}
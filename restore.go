@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// parseSnapshotRef parses a snapshot reference given as "<volume>@<snapshot>".
+func parseSnapshotRef(s string) (string, string, error) {
+	p := strings.SplitN(s, "@", 2)
+	if len(p) != 2 || p[0] == "" || p[1] == "" {
+		return "", "", fmt.Errorf("malformed snapshot reference %q, expected <volume>@<snapshot>", s)
+	}
+	return p[0], p[1], nil
+}
+
+// snapshotSource returns the metadata of a volume whose snapshots are read
+// from, checking that they can be copied through the REST API. The caller
+// must hold the driver lock.
+func (v *volumeDriver) snapshotSource(name string) (volumeMetadata, error) {
+	meta, err := v.meta.Get(name)
+	if err != nil {
+		return meta, err
+	}
+	if meta.Account != v.accountName {
+		return meta, newError(codeAccountMismatch, "volume %q is hosted on a different account (%q)", name, meta.Account)
+	}
+	if err := v.checkNamespace(meta); err != nil {
+		return meta, err
+	}
+	if meta.Options.Protocol == protocolNFS {
+		return meta, newError(codeProtocolMismatch, "snapshots of NFS volume %q cannot be copied", name)
+	}
+	return meta, nil
+}
+
+// snapshotVolume takes a snapshot of the volume's share and returns its
+// identifier.
+func (v *volumeDriver) snapshotVolume(name string) (string, error) {
+	v.m.Lock()
+	meta, err := v.snapshotSource(name)
+	files := v.files
+	v.m.Unlock()
+	if err != nil {
+		return "", err
+	}
+	snapshot, err := files.createSnapshot(meta.Options.Share)
+	if err != nil {
+		return "", wrapError(err, codeStorageAPI, "error creating snapshot: %v", err)
+	}
+	v.snapshots.invalidate(meta.Options.Share)
+	log.WithFields(log.Fields{
+		"operation": "snapshot",
+		"name":      name,
+	}).Infof("created snapshot %s of share %q", snapshot, meta.Options.Share)
+	return snapshot, nil
+}
+
+// volumeSnapshots returns the snapshots of the volume's share, oldest first.
+func (v *volumeDriver) volumeSnapshots(name string) ([]shareSnapshot, error) {
+	v.m.Lock()
+	meta, err := v.snapshotSource(name)
+	files := v.files
+	v.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := files.listSnapshots(meta.Options.Share)
+	if err != nil {
+		return nil, wrapError(err, codeStorageAPI, "error listing snapshots: %v", err)
+	}
+	return snapshots, nil
+}
+
+// restoreVolume promotes the snapshot over the live share of the volume by
+// copying every file of the snapshot back into the share. Files created after
+// the snapshot was taken are left in place. The driver lock is not held while
+// the copy is in progress.
+func (v *volumeDriver) restoreVolume(name, snapshot string) (*treeCopy, error) {
+	logctx := log.WithFields(log.Fields{
+		"operation": "restore",
+		"name":      name,
+		"snapshot":  snapshot,
+	})
+
+	v.m.Lock()
+	meta, err := v.snapshotSource(name)
+	files := v.files
+	v.m.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	share := meta.Options.Share
+	logctx.Debug("restore started")
+	c := newTreeCopy(files, share, snapshot, files, share)
+	if err := c.run("", ""); err != nil {
+		return c, wrapError(err, codeStorageAPI, "error restoring snapshot: %v", err)
+	}
+	logctx.Infof("restored %d files, %d bytes", c.Files, c.Bytes)
+	return c, nil
+}
+
+// restoreInto materializes the snapshot referenced by ref into the share of a
+// volume being created.
+func (v *volumeDriver) restoreInto(files *fileClient, share, ref string, logctx *log.Entry) error {
+	name, snapshot, err := parseSnapshotRef(ref)
+	if err != nil {
+		return newError(codeInvalidOptions, "%v", err)
+	}
+	v.m.Lock()
+	src, err := v.snapshotSource(name)
+	v.m.Unlock()
+	if err != nil {
+		return wrapError(err, codeInvalidOptions, "cannot restore from %q: %v", ref, err)
+	}
+	c := newTreeCopy(files, src.Options.Share, snapshot, files, share)
+	if err := c.run("", ""); err != nil {
+		return wrapError(err, codeStorageAPI, "error restoring snapshot %q: %v", ref, err)
+	}
+	logctx.Infof("restored %d files, %d bytes from snapshot %q", c.Files, c.Bytes, ref)
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// seedFetchTimeout bounds how long downloading a seed archive may take.
+const seedFetchTimeout = 10 * time.Minute
+
+const (
+	// defaultSeedMaxSize is the total size in MiB of the files a seed archive
+	// may extract unless set otherwise (--seed-max-size).
+	defaultSeedMaxSize = 1024
+
+	// defaultSeedMaxFiles is the number of entries a seed archive may extract
+	// unless set otherwise (--seed-max-files).
+	defaultSeedMaxFiles = 100000
+)
+
+// seedPolicy restricts where seed archives are read from and how much they
+// may extract, set by the --seed-* flags.
+type seedPolicy struct {
+	dir      string   // directory of the host archives, see checkSeedPath
+	hosts    []string // hosts of the archive URLs, see checkSeedHost
+	maxBytes int64    // total size of the extracted files
+	maxFiles int      // number of extracted entries
+}
+
+// validateSeed returns an error if s is not an https URL or an absolute path
+// to a seed archive. Plain http URLs are only accepted along with the SHA-256
+// checksum of the archive (sum), which is verified before extracting it.
+func validateSeed(s, sum string) error {
+	if sum != "" && !seedSumRe.MatchString(sum) {
+		return fmt.Errorf("option 'seed-sha256' must be a hex-encoded SHA-256 checksum, got %q", sum)
+	}
+	switch {
+	case strings.HasPrefix(s, "https://"), filepath.IsAbs(s):
+		return nil
+	case strings.HasPrefix(s, "http://"):
+		if sum == "" {
+			return fmt.Errorf("seed URLs over plain http require option 'seed-sha256'")
+		}
+		return nil
+	}
+	return fmt.Errorf("seed must be an https URL or an absolute path, got %q", s)
+}
+
+var seedSumRe = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// checkSeedPath returns an error if the local seed archive at path is not in
+// seedDir (--seed-dir), so that volume options cannot read arbitrary host
+// files. Symbolic links are resolved first.
+func checkSeedPath(path, seedDir string) error {
+	if seedDir == "" {
+		return fmt.Errorf("seeding from host paths requires --seed-dir")
+	}
+	dir, err := filepath.EvalSymlinks(seedDir)
+	if err != nil {
+		return fmt.Errorf("cannot resolve --seed-dir: %v", err)
+	}
+	p, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("cannot resolve seed %q: %v", path, err)
+	}
+	if !strings.HasPrefix(p, dir+string(filepath.Separator)) {
+		return fmt.Errorf("seed %q is not in --seed-dir %s", path, seedDir)
+	}
+	return nil
+}
+
+// checkSeedHost returns an error if the host of the seed URL is not one of
+// hosts (--seed-hosts), so that volume options cannot make the driver fetch
+// URLs of the internal network, such as the instance metadata service. A
+// host starting with a dot allows its subdomains.
+func checkSeedHost(src string, hosts []string) error {
+	if len(hosts) == 0 {
+		return fmt.Errorf("seeding from URLs requires --seed-hosts")
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return fmt.Errorf("invalid seed URL: %v", err)
+	}
+	host := strings.ToLower(u.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasPrefix(h, ".") && strings.HasSuffix(host, h) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q of the seed URL is not in --seed-hosts", host)
+}
+
+// openSeed opens the seed archive at the URL or local path. If sum is set,
+// the archive is downloaded to a temporary file first and its checksum
+// verified.
+func openSeed(src, sum string, p seedPolicy) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	if filepath.IsAbs(src) {
+		if err := checkSeedPath(src, p.dir); err != nil {
+			return nil, err
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	} else {
+		if err := checkSeedHost(src, p.hosts); err != nil {
+			return nil, err
+		}
+		hc := &http.Client{
+			Timeout: seedFetchTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return fmt.Errorf("stopped after 10 redirects")
+				}
+				return checkSeedHost(req.URL.String(), p.hosts)
+			},
+		}
+		resp, err := hc.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s returned %s", src, resp.Status)
+		}
+		r = resp.Body
+	}
+	if sum == "" {
+		return r, nil
+	}
+	defer r.Close()
+	return verifiedSeed(r, sum, p.maxBytes)
+}
+
+// verifiedSeed copies r to a temporary file, removed once closed, and returns
+// it rewound if its SHA-256 checksum is sum. It fails if r is larger than
+// maxBytes.
+func verifiedSeed(r io.Reader, sum string, maxBytes int64) (io.ReadCloser, error) {
+	f, err := ioutil.TempFile("", "azurefile-seed-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if n > maxBytes {
+		f.Close()
+		return nil, fmt.Errorf("archive is larger than %d bytes (--seed-max-size)", maxBytes)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, sum) {
+		f.Close()
+		return nil, fmt.Errorf("checksum mismatch: got sha256 %s, expected %s", got, sum)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// seedVolume extracts the tar archive (optionally gzip-compressed) at src
+// into dir. Nothing is extracted if dir is not empty, so that existing
+// shares are never overwritten. Only regular files and directories are
+// extracted, up to the size and number of entries of the policy, and the
+// extracted files are removed if the archive turns out to be invalid or too
+// large, so that the next mount tries again. See openSeed for sum.
+func seedVolume(dir, src, sum string, p seedPolicy, logctx *log.Entry) (err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", dir, err)
+	}
+	if len(entries) > 0 {
+		logctx.Infof("share is not empty, not extracting seed %q", src)
+		return nil
+	}
+
+	f, err := openSeed(src, sum, p)
+	if err != nil {
+		return fmt.Errorf("cannot open seed %q: %v", src, err)
+	}
+	defer f.Close()
+	defer func() {
+		if err != nil {
+			if cerr := removeContents(dir); cerr != nil {
+				logctx.Errorf("cannot remove the files extracted from seed %q: %v", src, cerr)
+			}
+		}
+	}()
+	r := bufio.NewReader(f)
+	var in io.Reader = r
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("cannot decompress seed %q: %v", src, err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	var files, n int
+	var size int64
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("cannot read seed %q: %v", src, err)
+		}
+		if n++; n > p.maxFiles {
+			return fmt.Errorf("seed %q has more than %d entries (--seed-max-files)", src, p.maxFiles)
+		}
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("seed %q contains unsafe path %q", src, hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)&os.ModePerm|0700); err != nil {
+				return fmt.Errorf("cannot create %s: %v", target, err)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("cannot create %s: %v", filepath.Dir(target), err)
+			}
+			if size += hdr.Size; size > p.maxBytes {
+				return fmt.Errorf("seed %q extracts more than %d bytes (--seed-max-size)", src, p.maxBytes)
+			}
+			if err := writeSeedFile(target, os.FileMode(hdr.Mode)&os.ModePerm, tr); err != nil {
+				return err
+			}
+			files++
+		default:
+			logctx.Debugf("skipping seed entry %q of unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+	logctx.Infof("extracted %d files from seed %q", files, src)
+	return nil
+}
+
+// removeContents removes the files and directories in dir.
+func removeContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSeedFile(path string, mode os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("cannot create %s: %v", path, err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write %s: %v", path, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// writeSeedArchive writes a tar archive of the files, by name, to path.
+func writeSeedArchive(t *testing.T, path string, files map[string]string) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckSeedHost(t *testing.T) {
+	hosts := []string{"fixtures.example.com", ".blob.core.windows.net"}
+	for _, tc := range []struct {
+		url   string
+		hosts []string
+		ok    bool
+	}{
+		{"https://fixtures.example.com/seed.tar.gz", hosts, true},
+		{"https://FIXTURES.example.com:8443/seed.tar.gz", hosts, true},
+		{"https://acct.blob.core.windows.net/seeds/app.tar?sv=x", hosts, true},
+		{"https://example.com/seed.tar.gz", hosts, false},
+		{"https://fixtures.example.com.evil.net/seed.tar.gz", hosts, false},
+		{"https://evilblob.core.windows.net/seed.tar", hosts, false},
+		{"http://169.254.169.254/metadata/instance", hosts, false},
+		{"https://fixtures.example.com/seed.tar.gz", nil, false},
+	} {
+		if err := checkSeedHost(tc.url, tc.hosts); (err == nil) != tc.ok {
+			t.Errorf("checkSeedHost(%q, %v) = %v, want allowed %v", tc.url, tc.hosts, err, tc.ok)
+		}
+	}
+}
+
+func TestSeedVolumeLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seedDir, share := filepath.Join(dir, "seeds"), filepath.Join(dir, "share")
+	for _, d := range []string{seedDir, share} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := filepath.Join(seedDir, "app.tar")
+	writeSeedArchive(t, archive, map[string]string{"a": "12345", "b": "67890", "c/d": "x"})
+	logctx := log.WithField("name", "vol")
+
+	for _, tc := range []struct {
+		p      seedPolicy
+		errSub string
+	}{
+		{p: seedPolicy{dir: seedDir, maxBytes: 10, maxFiles: 3}, errSub: "more than 10 bytes"},
+		{p: seedPolicy{dir: seedDir, maxBytes: 100, maxFiles: 2}, errSub: "more than 2 entries"},
+		{p: seedPolicy{dir: seedDir, maxBytes: 11, maxFiles: 3}},
+	} {
+		err := seedVolume(share, archive, "", tc.p, logctx)
+		entries, rerr := ioutil.ReadDir(share)
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		if tc.errSub != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.errSub) {
+				t.Errorf("seeding with %+v = %v, want error containing %q", tc.p, err, tc.errSub)
+			}
+			if len(entries) != 0 {
+				t.Errorf("seeding with %+v failed but left %d entries in the share", tc.p, len(entries))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("seeding with %+v failed: %v", tc.p, err)
+		} else if len(entries) != 3 {
+			t.Errorf("seeding with %+v extracted %d entries, want 3", tc.p, len(entries))
+		}
+	}
+}
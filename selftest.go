@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// selftestFileSize is the size of the file written to and read back from the
+// temporary volume of the selftest command.
+const selftestFileSize = 4 << 20
+
+// selftestCommand validates a host end to end by going through the life of a
+// temporary volume, with the driver configuration given by the global flags.
+var selftestCommand = cli.Command{
+	Name:  "selftest",
+	Usage: "Create a temporary share, mount it, write and read back a file, unmount it and delete it",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "opt, o",
+			Usage: "Option (key=value) of the temporary volume, e.g. -o uid=1000 -o wsize=4194304",
+			Value: &cli.StringSlice{},
+		},
+	},
+	Action: func(c *cli.Context) {
+		opts, err := parseOptFlags(c.StringSlice("opt"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		v, cleanup, err := temporaryDriver(c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		ok := runSelftest(os.Stdout, v, opts)
+		cleanup()
+		if !ok {
+			os.Exit(1)
+		}
+	},
+}
+
+// temporaryDriver returns a driver for the account and mount settings given
+// by the global flags, keeping its metadata and mountpoints in temporary
+// directories removed by cleanup so that the volumes of the host are left
+// alone. It removes the shares of the volumes it removes.
+func temporaryDriver(c *cli.Context) (*volumeDriver, func(), error) {
+	a, err := accountFromFlags(c)
+	if err != nil {
+		return nil, nil, err
+	} else if a.key == "" {
+		return nil, nil, fmt.Errorf("azure storage account key must be provided")
+	}
+	dir, err := ioutil.TempDir("", "azurefile-selftest-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	clients := newClientCache()
+	clients.pressure = newPressureTracker(c.GlobalDuration("slow-request-threshold"))
+	clients.breakers = newBreakers(c.GlobalInt("storage-breaker-threshold"), c.GlobalDuration("storage-breaker-cooldown"))
+	v, err := newVolumeDriver(clients, a.name, a.key, a.storageBase, a.endpoint, filepath.Join(dir, "mnt"), filepath.Join(dir, "meta"), nil, c.GlobalString("share-prefix"), true)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	v.smbMinVers = c.GlobalString("smb-min-version")
+	v.smbPort = c.GlobalInt("smb-port")
+	v.domain = c.GlobalString("domain")
+	v.dnsRetries = c.GlobalInt("mount-dns-retries")
+	v.resolveIP = c.GlobalBool("mount-resolve-ip")
+	v.restFallback = c.GlobalBool("rest-fallback")
+	v.restHelper = c.GlobalString("rest-mount-helper")
+	if a.emulator {
+		v.localShares = c.GlobalString("emulator-shares")
+	}
+	if f := c.GlobalString("accounts"); f != "" {
+		if s := c.GlobalString("allowed-accounts"); s != "" {
+			v.allowAccounts = strings.Split(s, ",")
+		}
+		if v.accounts, err = loadAccounts(v.clients, f, a.storageBase, a.endpoint, v.allowAccounts); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	return v, cleanup, nil
+}
+
+// parseOptFlags parses the volume options given as key=value with -o.
+func parseOptFlags(flags []string) (map[string]string, error) {
+	opts := make(map[string]string)
+	for _, o := range flags {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid volume option %q, must be key=value", o)
+		}
+		opts[kv[0]] = kv[1]
+	}
+	return opts, nil
+}
+
+// runSelftest creates a volume with a new share and the options, mounts it,
+// writes a file and reads it back, then unmounts and removes the volume and
+// its share, printing the outcome and duration of each step to w. The volume
+// is cleaned up if a step fails. It returns true if all the steps succeeded.
+func runSelftest(w io.Writer, v *volumeDriver, opts map[string]string) bool {
+	log.SetOutput(ioutil.Discard) // the steps print the errors
+	name := "selftest-" + randomHex(4)
+	opts["share"] = name
+	fmt.Fprintf(w, "Testing with share %s%s\n", v.sharePrefix, name)
+
+	step := func(what string, f func() error) bool {
+		start := time.Now()
+		if err := f(); err != nil {
+			fmt.Fprintf(w, "%-10s FAILED (%v)\n", what+":", err)
+			return false
+		}
+		fmt.Fprintf(w, "%-10s ok (%v)\n", what+":", elapsed(start))
+		return true
+	}
+	var mountpoint string
+	created, mounted := false, false
+	defer func() {
+		if mounted {
+			step("unmount", func() error { return responseError(v.Unmount(volume.UnmountRequest{Name: name, ID: "selftest"})) })
+		}
+		if created {
+			step("remove", func() error { return responseError(v.Remove(volume.Request{Name: name})) })
+		}
+	}()
+
+	if created = step("create", func() error { return responseError(v.Create(volume.Request{Name: name, Options: opts})) }); !created {
+		return false
+	}
+	if mounted = step("mount", func() error {
+		resp := v.Mount(volume.MountRequest{Name: name, ID: "selftest"})
+		mountpoint = resp.Mountpoint
+		return responseError(resp)
+	}); !mounted {
+		return false
+	}
+	data := make([]byte, selftestFileSize)
+	if _, err := rand.Read(data); err != nil {
+		fmt.Fprintln(w, err)
+		return false
+	}
+	file := filepath.Join(mountpoint, "selftest.dat")
+	if !step("write", func() error { return writeFileSync(file, data) }) {
+		return false
+	}
+	if !step("read", func() error {
+		got, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		} else if !bytes.Equal(got, data) {
+			return fmt.Errorf("file read back differs from the file written")
+		}
+		return os.Remove(file)
+	}) {
+		return false
+	}
+	mounted = false
+	if !step("unmount", func() error { return responseError(v.Unmount(volume.UnmountRequest{Name: name, ID: "selftest"})) }) {
+		return false
+	}
+	created = false
+	return step("remove", func() error { return responseError(v.Remove(volume.Request{Name: name})) })
+}
+
+// responseError returns the error of a plugin API response, nil if the
+// request succeeded.
+func responseError(resp volume.Response) error {
+	if resp.Err != "" {
+		return errors.New(resp.Err)
+	}
+	return nil
+}
+
+// writeFileSync writes data to the file at path and flushes it to the
+// server.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// shareDeletedError returns the error reported for volumes whose share was
+// deleted outside of the driver.
+func shareDeletedError(meta volumeMetadata) error {
+	return newError(codeShareNotFound, "share %q was deleted (detected on %s)",
+		meta.Options.Share, meta.ShareMissingSince.Format(time.RFC3339))
+}
+
+// recordShareState marks the volume as errored if its share is missing, or
+// clears the mark if the share exists again, and returns the updated
+// metadata. Caller must hold the driver lock.
+func (v *volumeDriver) recordShareState(name string, meta volumeMetadata, exists bool) (volumeMetadata, error) {
+	logctx := log.WithFields(log.Fields{"name": name, "share": meta.Options.Share})
+	switch {
+	case !exists && meta.ShareMissingSince == nil:
+		now := time.Now().UTC()
+		meta.ShareMissingSince = &now
+		logctx.Warn("share was deleted outside of the driver, marking volume as errored")
+	case exists && meta.ShareMissingSince != nil:
+		meta.ShareMissingSince = nil
+		logctx.Info("share exists again, clearing error")
+	default:
+		return meta, nil
+	}
+	return meta, v.meta.Set(name, meta)
+}
+
+// checkShare verifies that the share of the volume exists and records the
+// result in the metadata. Caller must hold the driver lock.
+func (v *volumeDriver) checkShare(name string, meta volumeMetadata) (volumeMetadata, bool, error) {
+	a, err := v.account(meta.Options)
+	if err != nil {
+		return meta, false, err
+	}
+	exists, err := a.files.shareExists(meta.Options.Share)
+	if err != nil {
+		return meta, false, err
+	}
+	meta, err = v.recordShareState(name, meta, exists)
+	return meta, exists, err
+}
+
+// runShareChecks verifies every interval that the shares of all volumes on
+// the account still exist. The driver lock is not held while querying the
+// File service.
+func (v *volumeDriver) runShareChecks(interval time.Duration) {
+	for range time.Tick(interval) {
+		v.m.Lock()
+		names, err := v.meta.List()
+		files, account := v.files, v.accountName
+		v.m.Unlock()
+		if err != nil {
+			log.Errorf("share check: failed to list volumes: %v", err)
+			continue
+		}
+		for _, name := range names {
+			v.clients.pressure.pause(account)
+			v.m.Lock()
+			meta, err := v.meta.Get(name)
+			v.m.Unlock()
+			if err != nil || meta.Account != account {
+				continue
+			}
+			exists, err := files.shareExists(meta.Options.Share)
+			if err != nil {
+				log.WithField("name", name).Errorf("share check failed: %v", err)
+				continue
+			}
+			v.m.Lock()
+			if meta, err = v.meta.Get(name); err == nil {
+				_, err = v.recordShareState(name, meta, exists)
+			}
+			v.m.Unlock()
+			if err != nil {
+				log.WithField("name", name).Errorf("share check: %v", err)
+			}
+		}
+	}
+}
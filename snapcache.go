@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// snapshotCacheTTL is how long the snapshots of a share reported in the
+	// status of its volumes are reused before being listed again.
+	snapshotCacheTTL = time.Minute
+
+	// snapshotListTimeout bounds the listing of the snapshots of a share for
+	// the status of its volumes.
+	snapshotListTimeout = 15 * time.Second
+)
+
+// snapshotCache holds the snapshots of the shares reported by Get, which
+// Docker calls often: listing them is slow on large accounts and must not
+// hold up plugin requests, so they are listed in the background and Get
+// reports the last listing.
+type snapshotCache struct {
+	m       sync.Mutex
+	entries map[string]*snapshotEntry // by share
+}
+
+type snapshotEntry struct {
+	snapshots []shareSnapshot
+	listedAt  time.Time
+	listing   bool
+}
+
+func newSnapshotCache() *snapshotCache {
+	return &snapshotCache{entries: make(map[string]*snapshotEntry)}
+}
+
+// get returns the snapshots of the share last listed, if any, and lists them
+// again in the background with files if that was more than snapshotCacheTTL
+// ago. It never blocks on the File service.
+func (c *snapshotCache) get(share string, files *fileClient) []shareSnapshot {
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.entries[share]
+	if !ok {
+		e = &snapshotEntry{}
+		c.entries[share] = e
+	}
+	if !e.listing && time.Since(e.listedAt) > snapshotCacheTTL {
+		e.listing = true
+		go c.list(share, e, files)
+	}
+	return e.snapshots
+}
+
+func (c *snapshotCache) list(share string, e *snapshotEntry, files *fileClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotListTimeout)
+	defer cancel()
+	snapshots, err := files.withContext(ctx).listSnapshots(share)
+	if err != nil {
+		log.WithField("share", share).Debugf("cannot list snapshots: %v", err)
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	e.listing = false
+	if err == nil {
+		e.snapshots, e.listedAt = snapshots, time.Now()
+	}
+}
+
+// invalidate forgets the snapshots of the share, e.g. after one was taken.
+func (c *snapshotCache) invalidate(share string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.entries, share)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// volumeStats is a usage sample of a mounted volume.
+type volumeStats struct {
+	CollectedAt     time.Time `json:"collected_at"`
+	UsedBytes       uint64    `json:"used_bytes"`
+	CapacityBytes   uint64    `json:"capacity_bytes"`
+	Files           int64     `json:"files,omitempty"`
+	ShareUsageBytes int64     `json:"share_usage_bytes,omitempty"`
+}
+
+// statsCollector periodically samples usage of the mounted volumes.
+type statsCollector struct {
+	countFiles bool // walk the mounted volume to count files
+	useREST    bool // query share usage from the File service
+
+	m     sync.Mutex
+	stats map[string]volumeStats
+}
+
+// enableStats starts collecting usage statistics of mounted volumes every
+// interval.
+func (v *volumeDriver) enableStats(interval time.Duration, countFiles, useREST bool) {
+	v.stats = &statsCollector{
+		countFiles: countFiles,
+		useREST:    useREST,
+		stats:      make(map[string]volumeStats),
+	}
+	go func() {
+		for range time.Tick(interval) {
+			v.collectStats()
+		}
+	}()
+}
+
+// volumeStats returns the last usage sample of the volume, if any.
+func (v *volumeDriver) volumeStats(name string) (volumeStats, bool) {
+	if v.stats == nil {
+		return volumeStats{}, false
+	}
+	v.stats.m.Lock()
+	defer v.stats.m.Unlock()
+	st, ok := v.stats.stats[name]
+	return st, ok
+}
+
+// collectStats samples all mounted volumes. The driver lock is only held
+// while listing volumes so that slow samples do not block plugin requests.
+func (v *volumeDriver) collectStats() {
+	v.m.Lock()
+	names, err := v.meta.List()
+	metas := make(map[string]volumeMetadata)
+	files := make(map[string]*fileClient) // of the accounts of the volumes
+	for _, n := range names {
+		if meta, err := v.meta.Get(n); err == nil {
+			metas[n] = meta
+			if a, err := v.volumeAccount(n, meta); err == nil {
+				files[n] = a.files
+			}
+		}
+	}
+	v.m.Unlock()
+	if err != nil {
+		log.Errorf("stats: failed to list volumes: %v", err)
+		return
+	}
+
+	collected := make(map[string]volumeStats)
+	for name, meta := range metas {
+		logctx := log.WithFields(log.Fields{"operation": "stats", "name": name})
+		path := v.pathForVolume(name)
+		if ok, err := isMounted(path); err != nil || !ok {
+			continue
+		}
+		st := volumeStats{CollectedAt: time.Now().UTC()}
+
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(path, &fs); err != nil {
+			logctx.Errorf("statfs failed: %v", err)
+			continue
+		}
+		st.CapacityBytes = fs.Blocks * uint64(fs.Bsize)
+		st.UsedBytes = (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
+
+		if v.stats.countFiles {
+			filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					st.Files++
+				}
+				return nil
+			})
+		}
+		if files := files[name]; v.stats.useREST && files != nil {
+			v.clients.pressure.pause(meta.Account)
+			if u, err := files.shareUsage(meta.Options.Share); err != nil {
+				logctx.Errorf("cannot get share usage: %v", err)
+			} else {
+				st.ShareUsageBytes = u
+			}
+		}
+		collected[name] = st
+	}
+
+	v.stats.m.Lock()
+	defer v.stats.m.Unlock()
+	for name, meta := range metas {
+		lv := v.volumeLabelValues(name, meta)
+		st, ok := collected[name]
+		if _, err := v.meta.Get(name); err != nil {
+			ok = false // removed while sampling
+		}
+		if !ok {
+			volumeUsedBytes.delete(lv...)
+			volumeCapacityBytes.delete(lv...)
+			volumeFiles.delete(lv...)
+			shareUsageBytes.delete(lv...)
+			continue
+		}
+		volumeUsedBytes.set(float64(st.UsedBytes), lv...)
+		volumeCapacityBytes.set(float64(st.CapacityBytes), lv...)
+		if v.stats.countFiles {
+			volumeFiles.set(float64(st.Files), lv...)
+		}
+		if v.stats.useREST {
+			shareUsageBytes.set(float64(st.ShareUsageBytes), lv...)
+		}
+	}
+	v.stats.stats = collected
+}
+
+// forgetVolumeMetrics deletes the series of the removed volume from the
+// volume metrics, and its last usage sample, as the collectors only visit
+// the volumes that still exist.
+func (v *volumeDriver) forgetVolumeMetrics(name string, meta volumeMetadata) {
+	if v.stats != nil {
+		v.stats.m.Lock()
+		defer v.stats.m.Unlock()
+		delete(v.stats.stats, name)
+	}
+	if v.monitor != nil {
+		v.monitor.m.Lock()
+		defer v.monitor.m.Unlock()
+	}
+	lv := v.volumeLabelValues(name, meta)
+	for _, m := range volumeMetrics {
+		m.delete(lv...)
+	}
+}
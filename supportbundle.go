@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// supportBundleTimeout bounds the request fetching the recent events from
+// the running driver.
+const supportBundleTimeout = 10 * time.Second
+
+// secretFlags are the flags whose values are left out of support bundles.
+var secretFlags = []string{"connection-string", "account-key", "backup-account-key", "admin-token", "aad-client-secret"}
+
+// supportBundleCommand collects what is needed to investigate a problem of
+// the driver on the host in a tarball to attach to bug reports. Everything
+// is redacted.
+var supportBundleCommand = cli.Command{
+	Name:  "support-bundle",
+	Usage: "Package the configuration, volume metadata, recent events, mounts and host checks into a tarball for bug reports",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Path of the tarball (azurefile-support-<host>-<time>.tar.gz in the current directory if empty)",
+		},
+	},
+	Action: func(c *cli.Context) {
+		out := c.String("output")
+		if out == "" {
+			host, _ := os.Hostname()
+			out = fmt.Sprintf("azurefile-support-%s-%s.tar.gz", host, time.Now().UTC().Format("20060102T150405"))
+		}
+		if err := writeSupportBundle(c, out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(out)
+	},
+}
+
+// writeSupportBundle writes the support bundle to path. Parts that cannot be
+// collected are listed in errors.txt rather than failing the bundle.
+func writeSupportBundle(c *cli.Context, path string) error {
+	for _, name := range secretFlags {
+		registerSecret(c.GlobalString(name))
+	}
+	files := make(map[string][]byte)
+	var errs []string
+	fail := func(part string, err error) {
+		errs = append(errs, fmt.Sprintf("%s: %v", part, err))
+	}
+
+	files["version.txt"] = []byte(fmt.Sprintf("%s %s\n", c.App.Name, currentBuild()))
+	files["flags.txt"] = supportFlags(c)
+
+	var doctor bytes.Buffer
+	runDoctor(&doctor, doctorChecks(c))
+	files["doctor.txt"] = doctor.Bytes()
+
+	if b, err := supportMounts(c.GlobalString("mountpoint")); err != nil {
+		fail("mounts", err)
+	} else {
+		files["mounts.txt"] = b
+	}
+
+	root := c.GlobalString("metadata")
+	key, err := supportMetadataKey(c)
+	if err != nil {
+		fail("metadata key", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		fail("volume metadata", err)
+	} else if m, err := newMetadataDriver(root, key); err != nil {
+		fail("volume metadata", err)
+	} else if names, err := m.List(); err != nil {
+		fail("volume metadata", err)
+	} else {
+		for _, name := range names {
+			meta, err := m.Get(name)
+			if err != nil {
+				fail("volume "+name, err)
+				continue
+			}
+			b, _ := json.MarshalIndent(meta, "", "  ")
+			files["volumes/"+name+".json"] = b
+		}
+	}
+
+	if b, err := supportEvents(c.GlobalString("admin-addr"), c.GlobalString("admin-token")); err != nil {
+		fail("events", err)
+	} else {
+		files["events.json"] = b
+	}
+
+	if len(errs) != 0 {
+		files["errors.txt"] = []byte(strings.Join(errs, "\n") + "\n")
+	}
+	return writeTarball(path, strings.TrimSuffix(filepath.Base(path), ".tar.gz"), files)
+}
+
+// supportMetadataKey returns the key to decrypt the volume metadata with,
+// nil if the driver does not encrypt it.
+func supportMetadataKey(c *cli.Context) (cipher.AEAD, error) {
+	f := c.GlobalString("metadata-key-file")
+	if f == "" {
+		return nil, nil
+	}
+	aad, err := newAADCredential(c.GlobalString("aad-endpoint"), c.GlobalString("aad-tenant-id"), c.GlobalString("aad-client-id"), c.GlobalString("aad-client-secret"))
+	if err != nil {
+		return nil, err
+	}
+	return loadMetadataKey(f, c.GlobalString("metadata-key-vault-key"), aad)
+}
+
+// supportFlags lists the global flags and their values, without the secret
+// ones.
+func supportFlags(c *cli.Context) []byte {
+	var b bytes.Buffer
+	for _, name := range c.GlobalFlagNames() {
+		val := fmt.Sprint(c.GlobalGeneric(name))
+		if contains(secretFlags, name) && val != "" {
+			val = redacted
+		}
+		fmt.Fprintf(&b, "--%s=%s\n", name, val)
+	}
+	return b.Bytes()
+}
+
+// supportMounts returns the mount table entries of the shares and of the
+// volumes under mountpoint.
+func supportMounts(mountpoint string) ([]byte, error) {
+	b, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	for _, l := range strings.Split(string(b), "\n") {
+		f := strings.Fields(l)
+		if len(f) < 5 {
+			continue
+		}
+		fsType := ""
+		for i, s := range f {
+			if s == "-" && i+1 < len(f) {
+				fsType = f[i+1]
+				break
+			}
+		}
+		if fsType == "cifs" || fsType == "smb3" || strings.HasPrefix(fsType, "nfs") || strings.HasPrefix(fsType, "fuse") ||
+			strings.HasPrefix(f[4], strings.TrimSuffix(mountpoint, "/")+"/") {
+			out.WriteString(l + "\n")
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// supportEvents fetches the recent events from the admin endpoint of the
+// running driver at addr.
+func supportEvents(addr, token string) ([]byte, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("the admin endpoint is disabled (--admin-addr)")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	req, err := http.NewRequest("GET", "http://"+net.JoinHostPort(host, port)+"/events", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Timeout: supportBundleTimeout}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the driver: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// writeTarball writes the files, redacted, under dir in a gzipped tarball at
+// path.
+func writeTarball(path, dir string, files map[string][]byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create support bundle: %v", err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, name := range sortedFileNames(files) {
+		b := []byte(redact(string(files[name])))
+		hdr := &tar.Header{Name: dir + "/" + name, Mode: 0600, Size: int64(len(b)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return fmt.Errorf("cannot write support bundle: %v", err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			f.Close()
+			return fmt.Errorf("cannot write support bundle: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write support bundle: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write support bundle: %v", err)
+	}
+	return f.Close()
+}
+
+func sortedFileNames(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// accessTiers maps the accepted spellings of the share access tiers to the
+// values of the File service. Premium is the only tier of shares on premium
+// (FileStorage) accounts, which cannot be changed.
+var accessTiers = map[string]string{
+	"transactionoptimized":  "TransactionOptimized",
+	"transaction-optimized": "TransactionOptimized",
+	"hot":                   "Hot",
+	"cool":                  "Cool",
+	"premium":               "Premium",
+}
+
+// parseAccessTier returns the File service value of the access tier.
+func parseAccessTier(s string) (string, error) {
+	t, ok := accessTiers[strings.ToLower(s)]
+	if !ok {
+		return "", fmt.Errorf("access tier must be one of 'transactionoptimized', 'hot' or 'cool', got %q", s)
+	}
+	return t, nil
+}
+
+// setVolumeTier moves the volume's share to the access tier and records it
+// in the volume metadata. The change can take up to an hour to complete on
+// the service side, during which the share remains usable.
+func (v *volumeDriver) setVolumeTier(name, tier string) error {
+	logctx := log.WithFields(log.Fields{
+		"operation": "tier",
+		"name":      name,
+		"tier":      tier,
+	})
+
+	v.m.Lock()
+	meta, err := v.meta.Get(name)
+	var a *storageAccount
+	if err == nil {
+		a, err = v.volumeAccount(name, meta)
+	}
+	v.m.Unlock()
+	if err != nil {
+		return err
+	}
+	files := a.files
+	if err := v.checkNamespace(meta); err != nil {
+		return err
+	}
+
+	if err := files.setShareTier(meta.Options.Share, tier); err != nil {
+		return wrapError(err, codeStorageAPI, "error setting access tier of azure file share %q: %v", meta.Options.Share, err)
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	meta, err = v.meta.Get(name)
+	if err != nil {
+		return err
+	}
+	old := meta.Options.AccessTier
+	meta.Options.AccessTier = tier
+	if err := v.meta.Set(name, meta); err != nil {
+		return newError(codeInternal, "error saving metadata: %v", err)
+	}
+	if old == "" {
+		old = "the account default"
+	}
+	logctx.Infof("access tier changed from %s to %s", old, tier)
+	return nil
+}
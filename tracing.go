@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// traceServiceName is the service.name resource attribute of exported
+	// spans.
+	traceServiceName = "azurefile-dockervolumedriver"
+
+	// Spans are exported in batches of up to traceBatchSize spans, at least
+	// every traceFlushInterval.
+	traceBatchSize     = 100
+	traceFlushInterval = 5 * time.Second
+)
+
+// otlpTracer exports spans to an OpenTelemetry collector with the OTLP/HTTP
+// protocol in its JSON encoding. A nil tracer disables tracing.
+type otlpTracer struct {
+	url   string
+	hc    *http.Client
+	spans chan *span
+	attrs []otlpAttribute // resource attributes
+}
+
+// span is a timed operation of a trace.
+type span struct {
+	tracer   *otlpTracer // exporting the span
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	finish   time.Time
+	attrs    map[string]string
+}
+
+// newTracer returns a tracer exporting spans to the OTLP/HTTP endpoint of a
+// collector (e.g. http://localhost:4318).
+func newTracer(endpoint string) *otlpTracer {
+	host, _ := os.Hostname()
+	t := &otlpTracer{
+		url:   strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		hc:    &http.Client{Timeout: 10 * time.Second},
+		spans: make(chan *span, 10*traceBatchSize),
+		attrs: []otlpAttribute{
+			stringAttribute("service.name", traceServiceName),
+			stringAttribute("service.version", GitSummary),
+			stringAttribute("host.name", host),
+		},
+	}
+	go t.run()
+	return t
+}
+
+// start starts a span, as a child of parent if not nil. Attributes are given
+// as key/value pairs. It returns nil if tracing is disabled; the methods of
+// span are no-ops on nil spans.
+func (t *otlpTracer) start(name string, parent *span, kv ...string) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{
+		tracer: t,
+		spanID: randomHex(8),
+		name:   name,
+		start:  time.Now(),
+		attrs:  make(map[string]string),
+	}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.attrs[kv[i]] = kv[i+1]
+	}
+	return s
+}
+
+// startSpan starts a child span of parent with the tracer of parent, see
+// otlpTracer.start. It returns nil if parent is nil.
+func startSpan(name string, parent *span, kv ...string) *span {
+	if parent == nil {
+		return nil
+	}
+	return parent.tracer.start(name, parent, kv...)
+}
+
+// set sets an attribute of the span.
+func (s *span) set(key, val string) {
+	if s != nil {
+		s.attrs[key] = val
+	}
+}
+
+// end ends the span, marking it as failed with the message if errMsg is not
+// empty, and queues it for export.
+func (s *span) end(errMsg string) {
+	if s == nil {
+		return
+	}
+	s.finish = time.Now()
+	if errMsg != "" {
+		s.attrs["error.message"] = errMsg
+		if i := strings.IndexByte(errMsg, ' '); i > 0 && strings.HasPrefix(errMsg, "AZF") {
+			s.attrs["error.code"] = errMsg[:i]
+		}
+	}
+	select {
+	case s.tracer.spans <- s:
+	default:
+		log.Debug("tracing: export queue full, dropping span")
+	}
+}
+
+// endErr is like end for operations returning errors.
+func (s *span) endErr(err error) {
+	if err != nil {
+		s.end(err.Error())
+	} else {
+		s.end("")
+	}
+}
+
+func (t *otlpTracer) run() {
+	var batch []*span
+	tick := time.Tick(traceFlushInterval)
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-tick:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			log.Debugf("tracing: cannot export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// OTLP JSON messages, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func stringAttribute(key, val string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = val
+	return a
+}
+
+func (t *otlpTracer) export(batch []*span) error {
+	var spans []otlpSpan
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.finish.UnixNano(), 10),
+		}
+		if s.parentID == "" {
+			o.Kind = 2 // server, the plugin request
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, stringAttribute(k, v))
+		}
+		if msg, ok := s.attrs["error.message"]; ok {
+			o.Status.Code, o.Status.Message = 2, msg
+		}
+		spans = append(spans, o)
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": t.attrs},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": traceServiceName},
+				"spans": spans,
+			}},
+		}},
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := t.hc.Post(t.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
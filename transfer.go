@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Directions of transfers between a volume and remote storage.
+const (
+	transferExport = "export"
+	transferImport = "import"
+)
+
+// States of a transfer job.
+const (
+	transferRunning   = "running"
+	transferCompleted = "completed"
+	transferFailed    = "failed"
+)
+
+// transferSASValidity is how long the volume's share is accessible through
+// the SAS passed to azcopy for a transfer. Longer transfers fail once it
+// expires and are resumed with a new one, see resumeTransfer.
+const transferSASValidity = 2 * time.Hour
+
+// Authentication of azcopy to the volume's share (--azcopy-auth).
+const (
+	// azcopyAuthSAS passes a SAS of the share in its URL.
+	azcopyAuthSAS = "sas"
+	// azcopyAuthAAD has azcopy log in to Azure AD with the credentials of the
+	// driver (--aad-*), passed in its environment.
+	azcopyAuthAAD = "aad"
+)
+
+// transferJob is an azcopy transfer of a volume's contents to or from remote
+// storage (a blob container or another share) started through the admin API.
+type transferJob struct {
+	ID        string     `json:"id"`
+	Volume    string     `json:"volume"`
+	Direction string     `json:"direction"`
+	Remote    string     `json:"remote"` // without the SAS
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+
+	// Progress last reported by azcopy.
+	AzCopyJobID        string  `json:"azcopyJobId,omitempty"`
+	PercentComplete    float64 `json:"percentComplete"`
+	TotalTransfers     int     `json:"totalTransfers"`
+	TransfersCompleted int     `json:"transfersCompleted"`
+	TransfersFailed    int     `json:"transfersFailed"`
+	BytesTransferred   int64   `json:"bytesTransferred"`
+
+	remote *url.URL // including the SAS, for resuming
+	share  string
+}
+
+// transferManager runs azcopy and tracks the transfer jobs started since the
+// driver started. Jobs are not persisted.
+type transferManager struct {
+	m      sync.Mutex
+	azcopy string
+	env    []string // AZCOPY_* variables logging azcopy in, nil to use SAS
+	jobs   map[string]*transferJob
+}
+
+func newTransferManager(azcopy string) *transferManager {
+	return &transferManager{azcopy: azcopy, jobs: make(map[string]*transferJob)}
+}
+
+// useAAD has azcopy log in to Azure AD as the service principal with the
+// client secret or, without a secret, as the managed identity of the VM (the
+// user-assigned identity clientID if set), rather than passing it a SAS of
+// the volume's share on the command line, readable by any user of the host.
+func (t *transferManager) useAAD(tenantID, clientID, clientSecret string) {
+	if clientSecret != "" {
+		t.env = []string{
+			"AZCOPY_AUTO_LOGIN_TYPE=SPN",
+			"AZCOPY_TENANT_ID=" + tenantID,
+			"AZCOPY_SPA_APPLICATION_ID=" + clientID,
+			"AZCOPY_SPA_CLIENT_SECRET=" + clientSecret,
+		}
+		return
+	}
+	t.env = []string{"AZCOPY_AUTO_LOGIN_TYPE=MSI"}
+	if clientID != "" {
+		t.env = append(t.env, "AZCOPY_MSI_CLIENT_ID="+clientID)
+	}
+}
+
+// azcopyMessage is a line of the JSON output of azcopy.
+type azcopyMessage struct {
+	MessageType    string
+	MessageContent string
+}
+
+// azcopyProgress is the content of the progress and end of job messages.
+type azcopyProgress struct {
+	JobID                 string
+	JobStatus             string
+	ErrorMsg              string
+	PercentComplete       float64
+	TotalTransfers        int
+	TransfersCompleted    int
+	TransfersFailed       int
+	TotalBytesTransferred int64
+}
+
+// get returns a copy of the job with the ID.
+func (t *transferManager) get(id string) (transferJob, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	j, ok := t.jobs[id]
+	if !ok {
+		return transferJob{}, false
+	}
+	return *j, true
+}
+
+// list returns copies of all jobs, oldest first.
+func (t *transferManager) list() []transferJob {
+	t.m.Lock()
+	defer t.m.Unlock()
+	jobs := make([]transferJob, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Sort(byStartTime(jobs))
+	return jobs
+}
+
+type byStartTime []transferJob
+
+func (s byStartTime) Len() int           { return len(s) }
+func (s byStartTime) Less(i, j int) bool { return s[i].StartedAt.Before(s[j].StartedAt) }
+func (s byStartTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// startTransfer starts exporting the contents of the volume to the remote URL
+// or importing them from it. The remote URL must carry a SAS granting access
+// to it.
+func (v *volumeDriver) startTransfer(name, direction, remote string) (transferJob, error) {
+	if v.transfers == nil {
+		return transferJob{}, newError(codeInvalidOptions, "transfers are not enabled")
+	}
+	u, err := url.Parse(remote)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return transferJob{}, newError(codeInvalidOptions, "remote must be an https URL, got %q", redactURL(remote))
+	}
+	v.m.Lock()
+	meta, err := v.snapshotSource(name)
+	v.m.Unlock()
+	if err != nil {
+		return transferJob{}, err
+	}
+
+	id, err := newTransferID()
+	if err != nil {
+		return transferJob{}, newError(codeInternal, "cannot generate job ID: %v", err)
+	}
+	j := &transferJob{
+		ID:        id,
+		Volume:    name,
+		Direction: direction,
+		Remote:    redactURL(remote),
+		State:     transferRunning,
+		StartedAt: time.Now().UTC(),
+		remote:    u,
+		share:     meta.Options.Share,
+	}
+	src, dst := v.transferEndpoints(j)
+	v.transfers.m.Lock()
+	v.transfers.jobs[id] = j
+	v.transfers.m.Unlock()
+	go v.transfers.run(j, "copy", src, dst, "--recursive")
+	return *j, nil
+}
+
+// resumeTransfer resumes a failed transfer job from where it stopped.
+func (v *volumeDriver) resumeTransfer(id string) (transferJob, error) {
+	if v.transfers == nil {
+		return transferJob{}, newError(codeInvalidOptions, "transfers are not enabled")
+	}
+	t := v.transfers
+	t.m.Lock()
+	j, ok := t.jobs[id]
+	if !ok {
+		t.m.Unlock()
+		return transferJob{}, newError(codeVolumeNotFound, "transfer job %q does not exist", id)
+	}
+	if j.State != transferFailed || j.AzCopyJobID == "" {
+		t.m.Unlock()
+		return transferJob{}, newError(codeInvalidOptions, "only failed jobs started by azcopy can be resumed, job %q is %s", id, j.State)
+	}
+	j.State, j.Error, j.EndedAt = transferRunning, "", nil
+	azJob := j.AzCopyJobID
+	t.m.Unlock()
+
+	// SAS are not persisted by azcopy and must be passed again, which also
+	// renews the SAS of the share if it expired during the transfer.
+	src, dst := v.transferEndpoints(j)
+	args := []string{"jobs", "resume", azJob}
+	if srcURL, _ := url.Parse(src); srcURL.RawQuery != "" {
+		args = append(args, "--source-sas="+srcURL.RawQuery)
+	}
+	if dstURL, _ := url.Parse(dst); dstURL.RawQuery != "" {
+		args = append(args, "--destination-sas="+dstURL.RawQuery)
+	}
+	go t.run(j, args...)
+	return *j, nil
+}
+
+// transferEndpoints returns the azcopy source and destination of the job.
+// Unless azcopy logs in to Azure AD, the URL of the volume's share carries a
+// fresh SAS scoped to the share: read-only when exporting it, allowing to
+// create and write files when importing into it.
+func (v *volumeDriver) transferEndpoints(j *transferJob) (string, string) {
+	v.m.Lock()
+	files := v.files
+	v.m.Unlock()
+	shareURL := files.fileURL(j.share, nil).String()
+	if j.Direction == transferExport {
+		// copy the contents of the share rather than the share itself
+		shareURL += "/*"
+	}
+	if v.transfers.env == nil {
+		perms := sasRead
+		if j.Direction == transferImport {
+			perms = sasWrite
+		}
+		shareURL += "?" + files.shareSAS(j.share, perms, time.Now().Add(transferSASValidity))
+	}
+	if j.Direction == transferExport {
+		return shareURL, j.remote.String()
+	}
+	return j.remote.String(), shareURL
+}
+
+// run runs azcopy with the arguments and updates the job with the progress it
+// reports until it exits.
+func (t *transferManager) run(j *transferJob, args ...string) {
+	logctx := log.WithFields(log.Fields{
+		"operation": j.Direction,
+		"name":      j.Volume,
+		"job":       j.ID,
+	})
+	fail := func(err error) {
+		logctx.Errorf("transfer failed: %v", err)
+		t.m.Lock()
+		defer t.m.Unlock()
+		now := time.Now().UTC()
+		j.State, j.Error, j.EndedAt = transferFailed, err.Error(), &now
+	}
+
+	cmd := exec.Command(t.azcopy, append(args, "--output-type=json")...)
+	if t.env != nil {
+		cmd.Env = append(os.Environ(), t.env...)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		fail(fmt.Errorf("cannot start azcopy: %v", err))
+		return
+	}
+	logctx.Infof("transfer started with %s", j.Remote)
+
+	var last azcopyProgress
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		var msg azcopyMessage
+		if err := json.Unmarshal(s.Bytes(), &msg); err != nil {
+			continue
+		}
+		var p azcopyProgress
+		if err := json.Unmarshal([]byte(msg.MessageContent), &p); err != nil {
+			if msg.MessageType == "Error" {
+				last.ErrorMsg = msg.MessageContent
+			}
+			continue
+		}
+		t.m.Lock()
+		if p.JobID != "" {
+			j.AzCopyJobID = p.JobID
+		}
+		if msg.MessageType == "Progress" || msg.MessageType == "EndOfJob" {
+			j.PercentComplete = p.PercentComplete
+			j.TotalTransfers = p.TotalTransfers
+			j.TransfersCompleted = p.TransfersCompleted
+			j.TransfersFailed = p.TransfersFailed
+			j.BytesTransferred = p.TotalBytesTransferred
+			last = p
+		}
+		t.m.Unlock()
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if last.ErrorMsg != "" {
+			err = fmt.Errorf("%v: %s", err, last.ErrorMsg)
+		} else if last.JobStatus != "" {
+			err = fmt.Errorf("%v: job %s", err, last.JobStatus)
+		}
+		fail(fmt.Errorf("azcopy failed: %v", err))
+		return
+	}
+	t.m.Lock()
+	now := time.Now().UTC()
+	j.State, j.EndedAt = transferCompleted, &now
+	t.m.Unlock()
+	logctx.Infof("transfer completed: %d files, %d bytes", j.TransfersCompleted, j.BytesTransferred)
+}
+
+// redactURL returns the URL without its query string, which may carry a SAS.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	u.RawQuery = ""
+	return u.String()
+}
+
+func newTransferID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAzcopy writes a script printing the output lines in the JSON format of
+// azcopy and exiting with the status, and returns its path.
+func fakeAzcopy(t *testing.T, dir string, status int, lines ...string) string {
+	script := "#!/bin/sh\n"
+	for _, l := range lines {
+		script += "echo '" + l + "'\n"
+	}
+	script += fmt.Sprintf("exit %d\n", status)
+	p := filepath.Join(dir, "azcopy")
+	if err := ioutil.WriteFile(p, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTransferRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	progress := `{"MessageType":"Progress","MessageContent":"{\"JobID\":\"az-1\",\"PercentComplete\":50,\"TotalTransfers\":4,\"TransfersCompleted\":2,\"TotalBytesTransferred\":1024}"}`
+	for _, tc := range []struct {
+		name      string
+		status    int
+		lines     []string
+		state     string
+		errSubstr string
+		completed int
+		bytes     int64
+	}{
+		{
+			name:   "completed",
+			status: 0,
+			lines: []string{
+				"INFO: not JSON",
+				progress,
+				`{"MessageType":"EndOfJob","MessageContent":"{\"JobID\":\"az-1\",\"JobStatus\":\"Completed\",\"PercentComplete\":100,\"TotalTransfers\":4,\"TransfersCompleted\":4,\"TotalBytesTransferred\":2048}"}`,
+			},
+			state:     transferCompleted,
+			completed: 4,
+			bytes:     2048,
+		},
+		{
+			name:      "failed with message",
+			status:    1,
+			lines:     []string{progress, `{"MessageType":"Error","MessageContent":"authentication failed"}`},
+			state:     transferFailed,
+			errSubstr: "authentication failed",
+			completed: 2,
+			bytes:     1024,
+		},
+		{
+			name:   "failed job",
+			status: 1,
+			lines: []string{
+				`{"MessageType":"EndOfJob","MessageContent":"{\"JobID\":\"az-1\",\"JobStatus\":\"CompletedWithErrors\",\"TotalTransfers\":4,\"TransfersCompleted\":3,\"TransfersFailed\":1,\"TotalBytesTransferred\":1536}"}`,
+			},
+			state:     transferFailed,
+			errSubstr: "job CompletedWithErrors",
+			completed: 3,
+			bytes:     1536,
+		},
+	} {
+		m := newTransferManager(fakeAzcopy(t, dir, tc.status, tc.lines...))
+		j := &transferJob{ID: tc.name, Volume: "web-data", Direction: transferExport, State: transferRunning, StartedAt: time.Now()}
+		m.jobs[j.ID] = j
+		m.run(j, "copy", "src", "dst")
+
+		got, ok := m.get(j.ID)
+		if !ok {
+			t.Fatalf("%s: job not found", tc.name)
+		}
+		if got.State != tc.state || got.EndedAt == nil {
+			t.Errorf("%s: job is %s (ended at %v), want %s", tc.name, got.State, got.EndedAt, tc.state)
+		}
+		if tc.errSubstr == "" && got.Error != "" || !strings.Contains(got.Error, tc.errSubstr) {
+			t.Errorf("%s: job error %q, want it to contain %q", tc.name, got.Error, tc.errSubstr)
+		}
+		if got.AzCopyJobID != "az-1" || got.TransfersCompleted != tc.completed || got.BytesTransferred != tc.bytes {
+			t.Errorf("%s: job reports azcopy job %q, %d transfers and %d bytes completed, want az-1, %d and %d",
+				tc.name, got.AzCopyJobID, got.TransfersCompleted, got.BytesTransferred, tc.completed, tc.bytes)
+		}
+	}
+}
+
+func TestTransferList(t *testing.T) {
+	m := newTransferManager("azcopy")
+	now := time.Now()
+	for i, id := range []string{"b", "c", "a"} {
+		m.jobs[id] = &transferJob{ID: id, StartedAt: now.Add(time.Duration(i) * time.Minute)}
+	}
+	var ids []string
+	for _, j := range m.list() {
+		ids = append(ids, j.ID)
+	}
+	if got := strings.Join(ids, ","); got != "b,c,a" {
+		t.Errorf("list() returned jobs %s, want b,c,a", got)
+	}
+
+	j, _ := m.get("a")
+	j.State = transferFailed
+	if again, _ := m.get("a"); again.State != "" {
+		t.Errorf("get() returned the job itself rather than a copy")
+	}
+	if _, ok := m.get("d"); ok {
+		t.Errorf("get() found a job that does not exist")
+	}
+}
+
+func TestResumeTransfer(t *testing.T) {
+	v := &volumeDriver{transfers: newTransferManager("azcopy")}
+	v.transfers.jobs["running"] = &transferJob{ID: "running", State: transferRunning, AzCopyJobID: "az-1"}
+	v.transfers.jobs["unstarted"] = &transferJob{ID: "unstarted", State: transferFailed}
+	for _, tc := range []struct {
+		id   string
+		want errorCode
+	}{
+		{"missing", codeVolumeNotFound},
+		{"running", codeInvalidOptions},
+		{"unstarted", codeInvalidOptions},
+	} {
+		if _, err := v.resumeTransfer(tc.id); classify(err, codeInternal) != tc.want {
+			t.Errorf("resumeTransfer(%q) = %v, want error %s", tc.id, err, tc.want.name)
+		}
+	}
+	if j, _ := v.transfers.get("running"); j.State != transferRunning {
+		t.Errorf("job running is %s after a refused resume", j.State)
+	}
+
+	var v2 volumeDriver
+	if _, err := v2.startTransfer("web-data", transferExport, "https://acct.blob.core.windows.net/backup"); classify(err, codeInternal) != codeInvalidOptions {
+		t.Errorf("startTransfer without transfers enabled = %v, want error %s", err, codeInvalidOptions.name)
+	}
+}
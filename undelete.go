@@ -0,0 +1,86 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// undeleteResult is the outcome of undeleting the share of a volume.
+type undeleteResult struct {
+	Name    string `json:"name"`
+	Share   string `json:"share"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// undeleteVolume restores the soft-deleted share of a volume, either one
+// whose share was deleted outside of the driver or one removed along with its
+// share, whose metadata is restored as well. The most recently deleted
+// version of the share is restored unless version is given.
+func (v *volumeDriver) undeleteVolume(name, version string) (undeleteResult, error) {
+	logctx := log.WithFields(log.Fields{
+		"operation": "undelete",
+		"name":      name,
+	})
+	res := undeleteResult{Name: name}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	meta, err := v.meta.Get(name)
+	removed := false
+	if classify(err, codeInternal) == codeVolumeNotFound {
+		meta, err = v.meta.GetArchived(name)
+		removed = true
+	}
+	if err != nil {
+		return res, err
+	}
+	if meta.Account != v.accountName {
+		return res, newError(codeAccountMismatch, "volume %q is hosted on a different account (%q)", name, meta.Account)
+	}
+	if err := v.checkNamespace(meta); err != nil {
+		return res, err
+	}
+	share := meta.Options.Share
+	res.Share = share
+
+	if exists, err := v.files.shareExists(share); err != nil {
+		return res, wrapError(err, codeStorageAPI, "error checking azure file share: %v", err)
+	} else if exists {
+		return res, newError(codeShareExists, "azure file share %q exists, there is nothing to undelete", share)
+	}
+	deleted, err := v.files.listDeletedShares(share)
+	if err != nil {
+		return res, wrapError(err, codeStorageAPI, "error listing deleted shares: %v", err)
+	}
+	if len(deleted) == 0 {
+		return res, newError(codeShareNotFound, "no deleted version of share %q can be restored, soft delete may be disabled on the account or its retention period over", share)
+	}
+	if version == "" {
+		version = deleted[len(deleted)-1].Version
+	} else {
+		found := false
+		for _, d := range deleted {
+			found = found || d.Version == version
+		}
+		if !found {
+			return res, newError(codeShareNotFound, "share %q has no deleted version %q", share, version)
+		}
+	}
+	res.Version = version
+	if err := v.files.undeleteShare(share, version); err != nil {
+		return res, wrapError(err, codeStorageAPI, "error undeleting azure file share: %v", err)
+	}
+	logctx.Infof("undeleted version %s of share %q", version, share)
+
+	meta.ShareMissingSince = nil
+	if err := v.meta.Set(name, meta); err != nil {
+		return res, newError(codeInternal, "error saving metadata: %v", err)
+	}
+	if removed {
+		if err := v.meta.DeleteArchived(name); err != nil {
+			logctx.Errorf("%v", err)
+		}
+		logctx.Info("restored volume metadata")
+	}
+	return res, nil
+}
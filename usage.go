@@ -4,7 +4,7 @@ package main
 // - removed '[argument...]' at the end of USAGE line
 // - changed '[global options]' with '[options]'
 // - changed 'GLOBAL OPTIONS' with 'OPTIONS'
-// - removed 'COMMANDS' section entirely (was showing only 'help,h' anyway)
+// - moved 'COMMANDS' section after 'OPTIONS'
 // - removed '{{if .Commands}} command [command options]{{end}}' from the line after 'USAGE'
 const usageTemplate = `NAME:
    {{.Name}} - {{.Usage}}
@@ -20,6 +20,9 @@ AUTHOR(S):
    {{end}}{{if .Flags}}
 OPTIONS:
    {{range .Flags}}{{.}}
+   {{end}}{{end}}{{if .Commands}}
+COMMANDS:
+   {{range .Commands}}{{join .Names ", "}}{{ "\t" }}{{.Usage}}
    {{end}}{{end}}{{if .Copyright }}
 COPYRIGHT:
    {{.Copyright}}
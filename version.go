@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+// versionInfo identifies the build of the driver.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// driverVersion returns the version of the driver, "dev" for builds without
+// govvv.
+func driverVersion() string {
+	if GitSummary == "" {
+		return "dev"
+	}
+	return GitSummary
+}
+
+func currentBuild() versionInfo {
+	return versionInfo{
+		Version:   driverVersion(),
+		Commit:    GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+func (b versionInfo) String() string {
+	s := b.Version
+	if b.Commit != "" {
+		s += " (commit " + b.Commit
+		if b.BuildDate != "" {
+			s += ", built " + b.BuildDate
+		}
+		s += ")"
+	}
+	return fmt.Sprintf("%s, %s", s, b.GoVersion)
+}
+
+// handleVersion reports the build of the driver, so that fleet tooling can
+// check which build each host runs.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, currentBuild())
+}